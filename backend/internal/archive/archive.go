@@ -0,0 +1,106 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+// Record is a room as it stood when it was last archived: the folded doc at Seq
+// plus every op the room has seen, so a bill can be reopened (or audited) long
+// after its live keys expired.
+type Record struct {
+	RoomID      string            `json:"room_id"`
+	Seq         int64             `json:"seq"`
+	Doc         *crdt.RoomDoc     `json:"doc"`
+	Ops         []storage.OpEntry `json:"ops"`
+	ArchivedAt  int64             `json:"archived_at"`
+	FinalizedAt int64             `json:"finalized_at,omitempty"`
+}
+
+// Store persists room records outside the TTL-bound room store.
+type Store interface {
+	// Load returns the record for a room, or nil if it was never archived.
+	Load(ctx context.Context, roomID string) (*Record, error)
+	Save(ctx context.Context, record *Record) error
+}
+
+var roomIDPattern = regexp.MustCompile(`^[A-Z0-9]{1,32}$`)
+
+var ErrInvalidRoomID = errors.New("archive: invalid room id")
+
+// FileStore keeps one JSON file per room under Dir. Writes go through a temp
+// file and rename so a crash never leaves a half-written record behind.
+type FileStore struct {
+	Dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (s *FileStore) path(roomID string) (string, error) {
+	// Room ids come straight from URLs; only accept the code alphabet so they
+	// can't escape Dir.
+	if !roomIDPattern.MatchString(roomID) {
+		return "", ErrInvalidRoomID
+	}
+	return filepath.Join(s.Dir, roomID+".json"), nil
+}
+
+func (s *FileStore) Load(ctx context.Context, roomID string) (*Record, error) {
+	path, err := s.path(roomID)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record Record
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return nil, fmt.Errorf("archive: decode %s: %w", roomID, err)
+	}
+	return &record, nil
+}
+
+func (s *FileStore) Save(ctx context.Context, record *Record) error {
+	path, err := s.path(record.RoomID)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.Dir, record.RoomID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,65 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "archive"))
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if record, err := store.Load(ctx, "ABC123"); err != nil || record != nil {
+		t.Fatalf("expected missing record, got %#v err=%v", record, err)
+	}
+
+	doc := crdt.NewRoom("ABC123", "Dinner")
+	record := &Record{
+		RoomID: "ABC123",
+		Seq:    2,
+		Doc:    doc,
+		Ops: []storage.OpEntry{
+			{Seq: 1, Op: crdt.Op{ID: "op-1", Kind: "set_item"}},
+			{Seq: 2, Op: crdt.Op{ID: "op-2", Kind: "set_tax_tip"}},
+		},
+		ArchivedAt: 1000,
+	}
+	if err := store.Save(ctx, record); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	loaded, err := store.Load(ctx, "ABC123")
+	if err != nil || loaded == nil {
+		t.Fatalf("load: %#v err=%v", loaded, err)
+	}
+	if loaded.Seq != 2 || loaded.Doc.Name != "Dinner" || len(loaded.Ops) != 2 || loaded.Ops[1].Op.ID != "op-2" {
+		t.Fatalf("unexpected record %#v", loaded)
+	}
+
+	entries, _ := os.ReadDir(store.Dir)
+	if len(entries) != 1 || entries[0].Name() != "ABC123.json" {
+		t.Fatalf("expected only the record file, got %v", entries)
+	}
+}
+
+func TestFileStoreRejectsUnsafeRoomIDs(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	for _, roomID := range []string{"", "../ETC", "abc", "A/B"} {
+		if _, err := store.Load(context.Background(), roomID); !errors.Is(err, ErrInvalidRoomID) {
+			t.Fatalf("expected ErrInvalidRoomID for %q, got %v", roomID, err)
+		}
+		if err := store.Save(context.Background(), &Record{RoomID: roomID}); !errors.Is(err, ErrInvalidRoomID) {
+			t.Fatalf("expected ErrInvalidRoomID saving %q, got %v", roomID, err)
+		}
+	}
+}
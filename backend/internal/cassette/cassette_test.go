@@ -0,0 +1,75 @@
+package cassette
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordThenReplayWithoutNetwork(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 2 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+		io.WriteString(w, `{"call":`+string(rune('0'+calls))+`}`)
+	}))
+	defer upstream.Close()
+
+	recorder := &Recorder{}
+	client := &http.Client{Transport: recorder}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/v1/parse?key=secret", strings.NewReader("{}"))
+		req.Header.Set("x-goog-api-key", "secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("record: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := `{"call":` + string(rune('1'+i)) + `}`; string(body) != want {
+			t.Fatalf("recorder changed the body: got %s want %s", body, want)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	if err := recorder.Cassette().Save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	upstream.Close()
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, interaction := range loaded.Interactions {
+		if strings.Contains(interaction.URL, "secret") {
+			t.Fatalf("api key leaked into the cassette: %s", interaction.URL)
+		}
+	}
+	replayer := NewReplayer(loaded)
+	client = &http.Client{Transport: replayer}
+	for i, wantStatus := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/v1/parse?key=other", strings.NewReader("{}"))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("replay %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != wantStatus || string(body) != `{"call":`+string(rune('1'+i))+`}` {
+			t.Fatalf("replay %d: got %d %s", i, resp.StatusCode, body)
+		}
+	}
+	if replayer.Unused() != 0 {
+		t.Fatalf("expected every interaction replayed, %d left", replayer.Unused())
+	}
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/v1/parse", nil)
+	if _, err := client.Do(req); err == nil {
+		t.Fatalf("expected a request past the end of the cassette to fail")
+	}
+}
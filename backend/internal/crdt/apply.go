@@ -23,6 +23,19 @@ type AssignPayload struct {
 	On     bool   `json:"on"`
 }
 
+// AllocatePayload sets a weighted assignment. Shares <= 0 with no Cents removes the assignee.
+type AllocatePayload struct {
+	ItemID string `json:"item_id"`
+	UserID string `json:"user_id"`
+	Shares int    `json:"shares,omitempty"`
+	Cents  *int   `json:"cents,omitempty"`
+}
+
+type PayerPayload struct {
+	ParticipantID string `json:"participant_id"`
+	AmountCents   int    `json:"amount_cents"`
+}
+
 type TaxTipPayload struct {
 	TaxCents          *int `json:"tax_cents,omitempty"`
 	TipCents          *int `json:"tip_cents,omitempty"`
@@ -38,7 +51,7 @@ type RoomPayload struct {
 
 // ApplyOp is the single CRDT reducer. It is intentionally side-effect free:
 // given the current doc and one op, mutate the doc in-place to the new state.
-// Last-write-wins using UpdatedAt timestamps; tombstones prevent resurrecting deleted ids.
+// Last-write-wins on HLC stamps (see Op.Stamp); tombstones prevent resurrecting deleted ids.
 func ApplyOp(doc *RoomDoc, op Op) {
 	if doc == nil {
 		return
@@ -47,6 +60,11 @@ func ApplyOp(doc *RoomDoc, op Op) {
 	if op.Timestamp == 0 {
 		op.Timestamp = time.Now().UnixMilli()
 	}
+	stamp := op.Stamp()
+	if op.Clock != nil {
+		// Keep UpdatedAt fields in wall-clock ms even if the client's timestamp was off.
+		op.Timestamp = op.Clock.Wall
+	}
 
 	// Ensure maps are initialized (old snapshots may omit them).
 	if doc.Items == nil {
@@ -61,6 +79,15 @@ func ApplyOp(doc *RoomDoc, op Op) {
 	if doc.ParticipantTombstones == nil {
 		doc.ParticipantTombstones = map[string]int64{}
 	}
+	if doc.Payers == nil {
+		doc.Payers = map[string]*Payer{}
+	}
+	if doc.TombstoneClocks == nil {
+		doc.TombstoneClocks = map[string]HLC{}
+	}
+	if doc.ParticipantTombstoneClocks == nil {
+		doc.ParticipantTombstoneClocks = map[string]HLC{}
+	}
 
 	switch op.Kind {
 	case "set_item":
@@ -69,23 +96,60 @@ func ApplyOp(doc *RoomDoc, op Op) {
 			return
 		}
 		item := payload.Item
-		item.UpdatedAt = op.Timestamp
-		// Last-write-wins: drop stale updates if we already have a newer item.
 		if existing, ok := doc.Items[item.ID]; ok {
-			if existing.UpdatedAt > op.Timestamp {
+			// An update merges field by field, so it only overwrites what nobody
+			// has changed since; fields missing from the payload are left alone.
+			var raw struct {
+				Item map[string]json.RawMessage `json:"item"`
+			}
+			if json.Unmarshal(op.Payload, &raw) != nil {
 				return
 			}
-			if item.SortOrder == nil && existing.SortOrder != nil {
-				item.SortOrder = existing.SortOrder
+			existing.merge(raw.Item, stamp, op.Timestamp, true)
+			// Only users named in the payload change: one missing from it may
+			// have been assigned concurrently by someone else.
+			for userID, on := range item.Assigned {
+				if existing.Assigned[userID] != on {
+					existing.setAssigned(userID, on, stamp, op.Timestamp)
+				}
+			}
+			// Clients that predate weighted assignments send items without
+			// allocations; the weights of anyone still assigned are kept.
+			for userID, allocation := range item.Allocations {
+				if current, ok := existing.Allocations[userID]; ok && stampOr(current.Clock, current.UpdatedAt).After(stamp) {
+					continue
+				}
+				if !existing.Assigned[userID] {
+					continue
+				}
+				if existing.Allocations == nil {
+					existing.Allocations = map[string]Allocation{}
+				}
+				allocation.UpdatedAt = op.Timestamp
+				allocation.Clock = &stamp
+				existing.Allocations[userID] = allocation
+				existing.noteChange(op.Timestamp)
 			}
+			return
 		}
-		if doc.Tombstones[item.ID] > op.Timestamp {
+		if doc.itemTombstone(item.ID).After(stamp) {
 			return
 		}
+		item.UpdatedAt = op.Timestamp
+		item.Clock = &stamp
+		item.FieldClocks = nil
 		if item.Assigned == nil {
 			item.Assigned = map[string]bool{}
 		}
 		doc.Items[item.ID] = &item
+	case "patch_item":
+		var payload PatchPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return
+		}
+		if item, ok := doc.Items[payload.ID]; ok {
+			item.merge(payload.Fields, stamp, op.Timestamp, false)
+		}
 	case "remove_item":
 		var payload RemovePayload
 		if json.Unmarshal(op.Payload, &payload) != nil {
@@ -94,25 +158,62 @@ func ApplyOp(doc *RoomDoc, op Op) {
 		if payload.ID == "" {
 			return
 		}
-		doc.Tombstones[payload.ID] = op.Timestamp
+		if stamp.After(doc.itemTombstone(payload.ID)) {
+			doc.Tombstones[payload.ID] = op.Timestamp
+			doc.TombstoneClocks[payload.ID] = stamp
+		}
 		delete(doc.Items, payload.ID)
+	case "restore_item":
+		// Puts an item back exactly as given, e.g. to undo a removal. Unlike
+		// set_item it replaces the whole item and may follow a tombstone, as
+		// long as its stamp is newer than the removal.
+		var payload ItemPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return
+		}
+		item := payload.Item
+		if item.ID == "" || doc.itemTombstone(item.ID).After(stamp) {
+			return
+		}
+		item.UpdatedAt = op.Timestamp
+		item.Clock = &stamp
+		item.FieldClocks = nil
+		if item.Assigned == nil {
+			item.Assigned = map[string]bool{}
+		}
+		doc.Items[item.ID] = &item
 	case "set_participant":
 		var payload ParticipantPayload
 		if json.Unmarshal(op.Payload, &payload) != nil {
 			return
 		}
 		participant := payload.Participant
-		participant.UpdatedAt = op.Timestamp
 		// Tombstone check blocks resurrection after a delete.
-		if doc.ParticipantTombstones[participant.ID] > op.Timestamp {
+		if doc.participantTombstone(participant.ID).After(stamp) {
 			return
 		}
 		if existing, ok := doc.Participants[participant.ID]; ok {
-			if existing.UpdatedAt > op.Timestamp {
+			var raw struct {
+				Participant map[string]json.RawMessage `json:"participant"`
+			}
+			if json.Unmarshal(op.Payload, &raw) != nil {
 				return
 			}
+			existing.merge(raw.Participant, stamp, op.Timestamp, true)
+			return
 		}
+		participant.UpdatedAt = op.Timestamp
+		participant.Clock = &stamp
+		participant.FieldClocks = nil
 		doc.Participants[participant.ID] = &participant
+	case "patch_participant":
+		var payload PatchPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return
+		}
+		if participant, ok := doc.Participants[payload.ID]; ok {
+			participant.merge(payload.Fields, stamp, op.Timestamp, false)
+		}
 	case "remove_participant":
 		var payload RemovePayload
 		if json.Unmarshal(op.Payload, &payload) != nil {
@@ -121,8 +222,24 @@ func ApplyOp(doc *RoomDoc, op Op) {
 		if payload.ID == "" {
 			return
 		}
-		doc.ParticipantTombstones[payload.ID] = op.Timestamp
+		if stamp.After(doc.participantTombstone(payload.ID)) {
+			doc.ParticipantTombstones[payload.ID] = op.Timestamp
+			doc.ParticipantTombstoneClocks[payload.ID] = stamp
+		}
 		delete(doc.Participants, payload.ID)
+	case "restore_participant":
+		var payload ParticipantPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return
+		}
+		participant := payload.Participant
+		if participant.ID == "" || doc.participantTombstone(participant.ID).After(stamp) {
+			return
+		}
+		participant.UpdatedAt = op.Timestamp
+		participant.Clock = &stamp
+		participant.FieldClocks = nil
+		doc.Participants[participant.ID] = &participant
 	case "assign_item":
 		var payload AssignPayload
 		if json.Unmarshal(op.Payload, &payload) != nil {
@@ -132,11 +249,60 @@ func ApplyOp(doc *RoomDoc, op Op) {
 		if !ok {
 			return
 		}
-		if item.Assigned == nil {
-			item.Assigned = map[string]bool{}
+		item.setAssigned(payload.UserID, payload.On, stamp, op.Timestamp)
+	case "allocate_item":
+		var payload AllocatePayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return
+		}
+		item, ok := doc.Items[payload.ItemID]
+		if !ok || payload.UserID == "" {
+			return
+		}
+		if existing, ok := item.Allocations[payload.UserID]; ok && stampOr(existing.Clock, existing.UpdatedAt).After(stamp) {
+			return
+		}
+		if payload.Shares <= 0 && payload.Cents == nil {
+			item.setAssigned(payload.UserID, false, stamp, op.Timestamp)
+			break
+		}
+		if !item.setAssigned(payload.UserID, true, stamp, op.Timestamp) {
+			return
+		}
+		if item.Allocations == nil {
+			item.Allocations = map[string]Allocation{}
+		}
+		allocation := Allocation{Shares: payload.Shares, UpdatedAt: op.Timestamp, Clock: &stamp}
+		if payload.Cents != nil {
+			cents := *payload.Cents
+			if cents < 0 {
+				cents = 0
+			}
+			allocation.Shares = 0
+			allocation.Cents = &cents
+		}
+		item.Allocations[payload.UserID] = allocation
+	case "set_payer":
+		var payload PayerPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return
+		}
+		if payload.ParticipantID == "" {
+			return
+		}
+		if existing, ok := doc.Payers[payload.ParticipantID]; ok && stampOr(existing.Clock, existing.UpdatedAt).After(stamp) {
+			return
+		}
+		amount := payload.AmountCents
+		if amount < 0 {
+			amount = 0
+		}
+		doc.Payers[payload.ParticipantID] = &Payer{
+			ParticipantID: payload.ParticipantID,
+			AmountCents:   amount,
+			UpdatedAt:     op.Timestamp,
+			Clock:         &stamp,
 		}
-		item.Assigned[payload.UserID] = payload.On
-		item.UpdatedAt = op.Timestamp
 	case "set_tax_tip":
 		var payload TaxTipPayload
 		if json.Unmarshal(op.Payload, &payload) != nil {
@@ -174,3 +340,19 @@ func ApplyOp(doc *RoomDoc, op Op) {
 		}
 	}
 }
+
+func (item *Item) stamp() HLC { return stampOr(item.Clock, item.UpdatedAt) }
+
+func (doc *RoomDoc) itemTombstone(id string) HLC {
+	if clock, ok := doc.TombstoneClocks[id]; ok {
+		return clock
+	}
+	return HLC{Wall: doc.Tombstones[id]}
+}
+
+func (doc *RoomDoc) participantTombstone(id string) HLC {
+	if clock, ok := doc.ParticipantTombstoneClocks[id]; ok {
+		return clock
+	}
+	return HLC{Wall: doc.ParticipantTombstones[id]}
+}
@@ -138,3 +138,69 @@ func TestToggleFinishedOneUserDoesNotAffectAnother(t *testing.T) {
 		t.Fatal("user-2 should NOT be finished — toggling one user must not affect another")
 	}
 }
+
+func TestAllocateItemSetsWeightAndKeepsLegacyAssigned(t *testing.T) {
+	doc := NewRoom("room-1", "")
+	doc.Items["item-1"] = &Item{ID: "item-1", Name: "Tacos", Assigned: map[string]bool{"user-1": true}}
+
+	payload, _ := json.Marshal(AllocatePayload{ItemID: "item-1", UserID: "user-2", Shares: 2})
+	ApplyOp(doc, Op{Kind: "allocate_item", Timestamp: 100, Payload: payload})
+
+	item := doc.Items["item-1"]
+	if !item.Assigned["user-2"] {
+		t.Fatal("expected allocate_item to mark user-2 assigned")
+	}
+	if got := item.Allocations["user-2"]; got.Shares != 2 || got.Cents != nil {
+		t.Fatalf("expected 2 shares for user-2, got %#v", got)
+	}
+	if _, ok := item.Allocations["user-1"]; ok {
+		t.Fatal("legacy boolean assignee should not gain an allocation entry")
+	}
+
+	// Stale allocation is ignored.
+	stale, _ := json.Marshal(AllocatePayload{ItemID: "item-1", UserID: "user-2", Shares: 5})
+	ApplyOp(doc, Op{Kind: "allocate_item", Timestamp: 50, Payload: stale})
+	if got := item.Allocations["user-2"]; got.Shares != 2 {
+		t.Fatalf("expected stale allocation to be dropped, got %#v", got)
+	}
+
+	// Unassigning via assign_item also clears the weight.
+	off, _ := json.Marshal(AssignPayload{ItemID: "item-1", UserID: "user-2", On: false})
+	ApplyOp(doc, Op{Kind: "assign_item", Timestamp: 200, Payload: off})
+	if item.Assigned["user-2"] {
+		t.Fatal("expected user-2 to be unassigned")
+	}
+	if _, ok := item.Allocations["user-2"]; ok {
+		t.Fatal("expected allocation to be cleared on unassign")
+	}
+}
+
+func TestSetItemWithoutAllocationsPreservesExistingWeights(t *testing.T) {
+	cents := 700
+	doc := NewRoom("room-1", "")
+	doc.Items["item-1"] = &Item{
+		ID:          "item-1",
+		Name:        "Wine",
+		Assigned:    map[string]bool{"user-1": true, "user-2": true},
+		Allocations: map[string]Allocation{"user-1": {Cents: &cents, UpdatedAt: 10}, "user-2": {Shares: 3, UpdatedAt: 10}},
+		UpdatedAt:   10,
+	}
+
+	payload, _ := json.Marshal(ItemPayload{Item: Item{
+		ID:       "item-1",
+		Name:     "Red Wine",
+		Assigned: map[string]bool{"user-1": true, "user-2": false},
+	}})
+	ApplyOp(doc, Op{Kind: "set_item", Timestamp: 20, Payload: payload})
+
+	item := doc.Items["item-1"]
+	if item.Name != "Red Wine" {
+		t.Fatalf("expected rename to apply, got %q", item.Name)
+	}
+	if got := item.Allocations["user-1"]; got.Cents == nil || *got.Cents != 700 {
+		t.Fatalf("expected user-1 fixed allocation to survive, got %#v", got)
+	}
+	if _, ok := item.Allocations["user-2"]; ok {
+		t.Fatal("expected allocation of unassigned user-2 to be dropped")
+	}
+}
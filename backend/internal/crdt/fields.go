@@ -0,0 +1,163 @@
+package crdt
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// PatchPayload changes some fields of an item or participant, keyed by their
+// JSON names. Each field is last-write-wins on its own, so concurrent edits to
+// different fields of the same entity both survive.
+type PatchPayload struct {
+	ID     string                     `json:"id"`
+	Fields map[string]json.RawMessage `json:"fields"`
+}
+
+// fieldDecoder decodes one JSON field into its place on an entity. Values are
+// decoded into a fresh variable first so a bad value never half-applies and a
+// map or slice replaces, rather than merges into, the current one.
+type fieldDecoder[T any] func(target *T, raw json.RawMessage) error
+
+func field[T, V any](get func(*T) *V) fieldDecoder[T] {
+	return func(target *T, raw json.RawMessage) error {
+		var value V
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		*get(target) = value
+		return nil
+	}
+}
+
+// ItemFields are the item fields that patch_item may set. Assignments and
+// allocations have their own ops.
+var ItemFields = map[string]fieldDecoder[Item]{
+	"name":             field(func(it *Item) *string { return &it.Name }),
+	"quantity":         field(func(it *Item) *int { return &it.Quantity }),
+	"unit_price_cents": field(func(it *Item) *int { return &it.UnitPriceCents }),
+	"line_price_cents": field(func(it *Item) *int { return &it.LinePriceCents }),
+	"discount_cents":   field(func(it *Item) *int { return &it.DiscountCents }),
+	"discount_percent": field(func(it *Item) *float64 { return &it.DiscountPercent }),
+	"sort_order":       field(func(it *Item) **int64 { return &it.SortOrder }),
+	"raw_text":         field(func(it *Item) *string { return &it.RawText }),
+	"warnings":         field(func(it *Item) *[]string { return &it.Warnings }),
+	"meta":             field(func(it *Item) *map[string]any { return &it.Meta }),
+}
+
+// ParticipantFields are the participant fields that patch_participant may set.
+var ParticipantFields = map[string]fieldDecoder[Participant]{
+	"name":           field(func(p *Participant) *string { return &p.Name }),
+	"initials":       field(func(p *Participant) *string { return &p.Initials }),
+	"color_seed":     field(func(p *Participant) *string { return &p.ColorSeed }),
+	"venmo_username": field(func(p *Participant) *string { return &p.VenmoUsername }),
+	"present":        field(func(p *Participant) *bool { return &p.Present }),
+	"finished":       field(func(p *Participant) *bool { return &p.Finished }),
+}
+
+// assignedField is the field clock key for one user's assignment to an item.
+func assignedField(userID string) string { return "assigned/" + userID }
+
+// fieldStamp is the stamp of the last write to one field. Fields never written
+// on their own date from the entity's base clock (its creation, or its
+// millisecond UpdatedAt for state written before HLCs).
+func fieldStamp(fieldClocks map[string]HLC, base HLC, name string) HLC {
+	if clock, ok := fieldClocks[name]; ok {
+		return clock
+	}
+	return base
+}
+
+// mergeFields applies each known field whose last write is older than stamp.
+// skipNull leaves fields sent as null untouched, for whole-entity ops from
+// clients that send null for fields they don't track.
+func mergeFields[T any](target *T, decoders map[string]fieldDecoder[T], fields map[string]json.RawMessage, fieldClocks *map[string]HLC, base, stamp HLC, skipNull bool) bool {
+	changed := false
+	// Sorted so a doc folds identically everywhere, whatever the map order.
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		decode, ok := decoders[name]
+		raw := fields[name]
+		if !ok || (skipNull && string(raw) == "null") {
+			continue
+		}
+		if fieldStamp(*fieldClocks, base, name).After(stamp) {
+			continue
+		}
+		if decode(target, raw) != nil {
+			continue
+		}
+		setFieldClock(fieldClocks, name, stamp)
+		changed = true
+	}
+	return changed
+}
+
+func setFieldClock(fieldClocks *map[string]HLC, name string, stamp HLC) {
+	if *fieldClocks == nil {
+		*fieldClocks = map[string]HLC{}
+	}
+	(*fieldClocks)[name] = stamp
+}
+
+// noteChange records a field-level change in UpdatedAt. The first one on an
+// item from before HLCs pins its legacy timestamp as the base clock, since
+// UpdatedAt no longer dates the untouched fields once it moves.
+func (item *Item) noteChange(millis int64) {
+	if item.Clock == nil {
+		base := HLC{Wall: item.UpdatedAt}
+		item.Clock = &base
+	}
+	if millis > item.UpdatedAt {
+		item.UpdatedAt = millis
+	}
+}
+
+func (p *Participant) noteChange(millis int64) {
+	if p.Clock == nil {
+		base := HLC{Wall: p.UpdatedAt}
+		p.Clock = &base
+	}
+	if millis > p.UpdatedAt {
+		p.UpdatedAt = millis
+	}
+}
+
+func (item *Item) fieldStamp(name string) HLC {
+	return fieldStamp(item.FieldClocks, item.stamp(), name)
+}
+
+func (item *Item) merge(fields map[string]json.RawMessage, stamp HLC, millis int64, skipNull bool) {
+	base := item.stamp()
+	if mergeFields(item, ItemFields, fields, &item.FieldClocks, base, stamp, skipNull) {
+		item.noteChange(millis)
+	}
+}
+
+func (p *Participant) merge(fields map[string]json.RawMessage, stamp HLC, millis int64, skipNull bool) {
+	base := stampOr(p.Clock, p.UpdatedAt)
+	if mergeFields(p, ParticipantFields, fields, &p.FieldClocks, base, stamp, skipNull) {
+		p.noteChange(millis)
+	}
+}
+
+// setAssigned is LWW on one user's assignment. Unassigning drops their weight.
+func (item *Item) setAssigned(userID string, on bool, stamp HLC, millis int64) bool {
+	key := assignedField(userID)
+	if item.fieldStamp(key).After(stamp) {
+		return false
+	}
+	if item.Assigned == nil {
+		item.Assigned = map[string]bool{}
+	}
+	item.noteChange(millis)
+	item.Assigned[userID] = on
+	if !on {
+		delete(item.Allocations, userID)
+	}
+	setFieldClock(&item.FieldClocks, key, stamp)
+	return true
+}
@@ -0,0 +1,107 @@
+package crdt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func patchOp(kind, actor string, stamp HLC, id string, fields map[string]any) Op {
+	raw := map[string]json.RawMessage{}
+	for name, value := range fields {
+		raw[name], _ = json.Marshal(value)
+	}
+	payload, _ := json.Marshal(PatchPayload{ID: id, Fields: raw})
+	return Op{Kind: kind, ActorID: actor, Clock: &stamp, Payload: payload}
+}
+
+func TestConcurrentPatchesToDifferentFieldsBothSurvive(t *testing.T) {
+	clock := fixedClock(time.UnixMilli(10_000))
+	doc := NewRoom("ROOM", "")
+	created := clock.Receive(HLC{}, "alice")
+	itemPayload, _ := json.Marshal(ItemPayload{Item: Item{ID: "fries", Name: "Fries", Quantity: 1, LinePriceCents: 500}})
+	ApplyOp(doc, Op{Kind: "set_item", ActorID: "alice", Clock: &created, Payload: itemPayload})
+
+	rename := patchOp("patch_item", "alice", clock.Receive(HLC{}, "alice"), "fries", map[string]any{"name": "Curly fries"})
+	reprice := patchOp("patch_item", "bob", clock.Receive(HLC{}, "bob"), "fries", map[string]any{"line_price_cents": 650})
+	// Delivered in either order, the fold is the same.
+	for _, order := range [][]Op{{rename, reprice}, {reprice, rename}} {
+		replica := NewRoom("ROOM", "")
+		ApplyOp(replica, Op{Kind: "set_item", ActorID: "alice", Clock: &created, Payload: itemPayload})
+		for _, op := range order {
+			ApplyOp(replica, op)
+		}
+		got := replica.Items["fries"]
+		if got.Name != "Curly fries" || got.LinePriceCents != 650 || got.Quantity != 1 {
+			t.Fatalf("expected both edits to survive, got %+v", got)
+		}
+	}
+}
+
+func TestStaleFieldWriteLosesToNewerOne(t *testing.T) {
+	clock := fixedClock(time.UnixMilli(10_000))
+	doc := NewRoom("ROOM", "")
+	created := clock.Receive(HLC{}, "alice")
+	itemPayload, _ := json.Marshal(ItemPayload{Item: Item{ID: "fries", Name: "Fries"}})
+	ApplyOp(doc, Op{Kind: "set_item", ActorID: "alice", Clock: &created, Payload: itemPayload})
+
+	older := clock.Receive(HLC{}, "bob")
+	newer := clock.Receive(HLC{}, "alice")
+	ApplyOp(doc, patchOp("patch_item", "alice", newer, "fries", map[string]any{"name": "Chips"}))
+	ApplyOp(doc, patchOp("patch_item", "bob", older, "fries", map[string]any{"name": "Frites", "quantity": 2}))
+	got := doc.Items["fries"]
+	if got.Name != "Chips" || got.Quantity != 2 {
+		t.Fatalf("expected newer name and untouched-field quantity, got %+v", got)
+	}
+}
+
+func TestAssignmentSurvivesConcurrentWholeItemEdit(t *testing.T) {
+	clock := fixedClock(time.UnixMilli(10_000))
+	doc := NewRoom("ROOM", "")
+	created := clock.Receive(HLC{}, "alice")
+	itemPayload, _ := json.Marshal(ItemPayload{Item: Item{ID: "fries", Name: "Fries", Assigned: map[string]bool{}}})
+	ApplyOp(doc, Op{Kind: "set_item", ActorID: "alice", Clock: &created, Payload: itemPayload})
+
+	// Bob assigns himself while Alice, who never saw that, renames the item
+	// with a whole-item set_item carrying her stale assignments.
+	assignStamp := clock.Receive(HLC{}, "bob")
+	assign, _ := json.Marshal(AssignPayload{ItemID: "fries", UserID: "bob", On: true})
+	ApplyOp(doc, Op{Kind: "assign_item", ActorID: "bob", Clock: &assignStamp, Payload: assign})
+	renameStamp := clock.Receive(HLC{}, "alice")
+	rename, _ := json.Marshal(ItemPayload{Item: Item{ID: "fries", Name: "Curly fries", Assigned: map[string]bool{}}})
+	ApplyOp(doc, Op{Kind: "set_item", ActorID: "alice", Clock: &renameStamp, Payload: rename})
+
+	got := doc.Items["fries"]
+	if got.Name != "Curly fries" || !got.Assigned["bob"] {
+		t.Fatalf("expected rename and assignment to both survive, got %+v", got)
+	}
+}
+
+func TestPresencePatchKeepsConcurrentRename(t *testing.T) {
+	clock := fixedClock(time.UnixMilli(10_000))
+	doc := NewRoom("ROOM", "")
+	joined := clock.Receive(HLC{}, "alice")
+	join, _ := json.Marshal(ParticipantPayload{Participant: Participant{ID: "alice", Name: "Alice", Present: true}})
+	ApplyOp(doc, Op{Kind: "set_participant", ActorID: "alice", Clock: &joined, Payload: join})
+
+	ApplyOp(doc, patchOp("patch_participant", "alice", clock.Receive(HLC{}, "alice"), "alice", map[string]any{"name": "Ali"}))
+	ApplyOp(doc, patchOp("patch_participant", "alice", clock.Receive(HLC{}, "alice"), "alice", map[string]any{"present": false}))
+
+	got := doc.Participants["alice"]
+	if got.Name != "Ali" || got.Present {
+		t.Fatalf("expected rename kept and presence cleared, got %+v", got)
+	}
+}
+
+func TestPatchIgnoresMissingEntityAndUnknownFields(t *testing.T) {
+	doc := NewRoom("ROOM", "")
+	ApplyOp(doc, patchOp("patch_item", "alice", HLC{Wall: 1}, "ghost", map[string]any{"name": "Ghost"}))
+	if _, ok := doc.Items["ghost"]; ok {
+		t.Fatal("patch must not create an item")
+	}
+	doc.Items["fries"] = &Item{ID: "fries", Name: "Fries", UpdatedAt: 1}
+	ApplyOp(doc, patchOp("patch_item", "alice", HLC{Wall: 2}, "fries", map[string]any{"assigned": map[string]bool{"alice": true}}))
+	if got := doc.Items["fries"]; len(got.Assigned) != 0 || got.UpdatedAt != 1 {
+		t.Fatalf("expected unknown field to be ignored, got %+v", got)
+	}
+}
@@ -0,0 +1,108 @@
+package crdt
+
+import (
+	"sync"
+	"time"
+)
+
+// HLC is a hybrid logical clock timestamp: wall-clock milliseconds, a counter
+// that orders events within the same millisecond (or while the wall clock lags
+// behind one already seen), and the actor as a final tie-break so two stamps
+// only compare equal when they come from the same event.
+type HLC struct {
+	Wall    int64  `json:"wall"`
+	Counter int    `json:"counter,omitempty"`
+	Actor   string `json:"actor,omitempty"`
+}
+
+// Compare returns -1, 0 or 1 as h is before, equal to or after other.
+func (h HLC) Compare(other HLC) int {
+	switch {
+	case h.Wall != other.Wall:
+		return compareInt64(h.Wall, other.Wall)
+	case h.Counter != other.Counter:
+		return compareInt64(int64(h.Counter), int64(other.Counter))
+	case h.Actor < other.Actor:
+		return -1
+	case h.Actor > other.Actor:
+		return 1
+	}
+	return 0
+}
+
+func (h HLC) After(other HLC) bool { return h.Compare(other) > 0 }
+
+func (h HLC) IsZero() bool { return h == HLC{} }
+
+func compareInt64(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// stampOr returns clock, or for state written before HLCs a stamp carrying
+// just the legacy millisecond timestamp, which sorts before any real HLC from
+// the same millisecond.
+func stampOr(clock *HLC, legacyMillis int64) HLC {
+	if clock != nil {
+		return *clock
+	}
+	return HLC{Wall: legacyMillis}
+}
+
+// Stamp is the op's position in LWW order.
+func (op Op) Stamp() HLC {
+	if op.Clock != nil {
+		return *op.Clock
+	}
+	return HLC{Wall: op.Timestamp, Actor: op.ActorID}
+}
+
+// Clock issues HLC stamps. Remote stamps more than MaxDrift ahead of the local
+// wall clock are not trusted, so a phone set to next year can't win every
+// conflict from then on.
+type Clock struct {
+	// Now is the physical clock; tests may replace it.
+	Now      func() time.Time
+	MaxDrift time.Duration
+
+	mu   sync.Mutex
+	last HLC
+}
+
+func NewClock(maxDrift time.Duration) *Clock {
+	return &Clock{Now: time.Now, MaxDrift: maxDrift}
+}
+
+// Receive merges a stamp seen from elsewhere (zero for a local event) and
+// returns a new stamp for actor that is after both it and every stamp this
+// clock has issued.
+func (c *Clock) Receive(remote HLC, actor string) HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	physical := c.Now().UnixMilli()
+	if remote.Wall > physical+c.MaxDrift.Milliseconds() {
+		remote = HLC{}
+	}
+	wall := max(c.last.Wall, remote.Wall, physical)
+	counter := 0
+	switch {
+	case wall == c.last.Wall && wall == remote.Wall:
+		counter = max(c.last.Counter, remote.Counter) + 1
+	case wall == c.last.Wall:
+		counter = c.last.Counter + 1
+	case wall == remote.Wall:
+		counter = remote.Counter + 1
+	}
+	c.last = HLC{Wall: wall, Counter: counter}
+	return HLC{Wall: wall, Counter: counter, Actor: actor}
+}
+
+// Observe advances the clock past a stamp issued elsewhere, e.g. by another node.
+func (c *Clock) Observe(remote HLC) {
+	c.Receive(remote, "")
+}
@@ -0,0 +1,101 @@
+package crdt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func fixedClock(now time.Time) *Clock {
+	clock := NewClock(time.Minute)
+	clock.Now = func() time.Time { return now }
+	return clock
+}
+
+func TestHLCCompareOrdersByWallCounterThenActor(t *testing.T) {
+	ordered := []HLC{
+		{Wall: 100},
+		{Wall: 100, Actor: "a"},
+		{Wall: 100, Counter: 1},
+		{Wall: 100, Counter: 1, Actor: "b"},
+		{Wall: 101},
+	}
+	for i := 1; i < len(ordered); i++ {
+		if !ordered[i].After(ordered[i-1]) || ordered[i-1].After(ordered[i]) {
+			t.Fatalf("expected %+v after %+v", ordered[i], ordered[i-1])
+		}
+	}
+	if (HLC{Wall: 5, Actor: "a"}).Compare(HLC{Wall: 5, Actor: "a"}) != 0 {
+		t.Fatal("identical stamps should compare equal")
+	}
+}
+
+func TestClockIsMonotonicWhenWallClockStalls(t *testing.T) {
+	clock := fixedClock(time.UnixMilli(1_000))
+	first := clock.Receive(HLC{}, "a")
+	second := clock.Receive(HLC{}, "b")
+	if first.Wall != 1_000 || !second.After(first) || second.Counter != first.Counter+1 {
+		t.Fatalf("expected counter to advance within a millisecond: %+v then %+v", first, second)
+	}
+	// A slightly-ahead remote within the drift window pulls the clock forward.
+	ahead := clock.Receive(HLC{Wall: 5_000, Counter: 3}, "c")
+	if ahead.Wall != 5_000 || ahead.Counter != 4 {
+		t.Fatalf("expected to adopt remote wall, got %+v", ahead)
+	}
+	if next := clock.Receive(HLC{}, "a"); !next.After(ahead) {
+		t.Fatalf("expected %+v after %+v", next, ahead)
+	}
+}
+
+func TestClockIgnoresRemoteStampsPastMaxDrift(t *testing.T) {
+	now := time.UnixMilli(1_000_000)
+	clock := fixedClock(now)
+	skewed := clock.Receive(HLC{Wall: now.Add(365 * 24 * time.Hour).UnixMilli()}, "phone")
+	if skewed.Wall != now.UnixMilli() {
+		t.Fatalf("expected a far-future stamp to be clamped to now, got %+v", skewed)
+	}
+}
+
+func TestHLCRemoveBeatsItemFromSkewedLegacyClock(t *testing.T) {
+	// An item written before HLCs by a phone a year ahead.
+	doc := NewRoom("ROOM", "")
+	future := time.Now().Add(365 * 24 * time.Hour).UnixMilli()
+	doc.Items["fries"] = &Item{ID: "fries", UpdatedAt: future, Assigned: map[string]bool{}}
+
+	clock := NewClock(time.Minute)
+	removeStamp := clock.Receive(HLC{}, "alice")
+	payload, _ := json.Marshal(RemovePayload{ID: "fries"})
+	ApplyOp(doc, Op{Kind: "remove_item", ActorID: "alice", Clock: &removeStamp, Payload: payload})
+	if _, ok := doc.Items["fries"]; ok {
+		t.Fatal("expected remove to delete the item")
+	}
+
+	// A stale re-add stamped before the removal stays deleted; a newer one comes back.
+	stale := HLC{Wall: removeStamp.Wall - 1, Actor: "bob"}
+	itemPayload, _ := json.Marshal(ItemPayload{Item: Item{ID: "fries", Name: "Fries"}})
+	ApplyOp(doc, Op{Kind: "set_item", ActorID: "bob", Clock: &stale, Payload: itemPayload})
+	if _, ok := doc.Items["fries"]; ok {
+		t.Fatal("expected stale set_item to stay tombstoned")
+	}
+	fresh := clock.Receive(HLC{}, "bob")
+	ApplyOp(doc, Op{Kind: "set_item", ActorID: "bob", Clock: &fresh, Payload: itemPayload})
+	if got := doc.Items["fries"]; got == nil || got.Clock == nil || *got.Clock != fresh || got.UpdatedAt != fresh.Wall {
+		t.Fatalf("expected newer set_item to win with its stamp, got %#v", got)
+	}
+}
+
+func TestHLCBreaksSameMillisecondTiesByCounter(t *testing.T) {
+	doc := NewRoom("ROOM", "")
+	clock := fixedClock(time.UnixMilli(2_000))
+	first := clock.Receive(HLC{}, "zed")
+	second := clock.Receive(HLC{}, "amy")
+	older, _ := json.Marshal(ItemPayload{Item: Item{ID: "soup", Name: "Old"}})
+	newer, _ := json.Marshal(ItemPayload{Item: Item{ID: "soup", Name: "New"}})
+	// Delivered out of order: the later stamp must still win even though its
+	// actor sorts first.
+	ApplyOp(doc, Op{Kind: "set_item", ActorID: "amy", Clock: &second, Payload: newer})
+	ApplyOp(doc, Op{Kind: "set_item", ActorID: "zed", Clock: &first, Payload: older})
+	if doc.Items["soup"].Name != "New" {
+		t.Fatalf("expected the later stamp to win, got %q", doc.Items["soup"].Name)
+	}
+}
@@ -0,0 +1,228 @@
+package crdt
+
+import "encoding/json"
+
+// Inverse returns the ops that put back what op changes, computed against doc
+// as it stands before op is applied. The ops carry only a kind and payload;
+// the caller gives them ids and fresh stamps, which is also what lets a
+// restore win over the tombstone left by the removal it undoes. Ops that
+// change nothing have no inverse.
+func Inverse(doc *RoomDoc, op Op) []Op {
+	if doc == nil {
+		return nil
+	}
+	switch op.Kind {
+	case "set_item":
+		var payload ItemPayload
+		var raw struct {
+			Item map[string]json.RawMessage `json:"item"`
+		}
+		if json.Unmarshal(op.Payload, &payload) != nil || json.Unmarshal(op.Payload, &raw) != nil {
+			return nil
+		}
+		existing, ok := doc.Items[payload.Item.ID]
+		if !ok {
+			return []Op{inverseOp("remove_item", RemovePayload{ID: payload.Item.ID})}
+		}
+		var ops []Op
+		if fields := priorFields(existing, ItemFields, raw.Item, true); len(fields) > 0 {
+			ops = append(ops, inverseOp("patch_item", PatchPayload{ID: existing.ID, Fields: fields}))
+		}
+		changed := map[string]bool{}
+		for userID, on := range payload.Item.Assigned {
+			if existing.Assigned[userID] != on {
+				changed[userID] = true
+				ops = append(ops, restoreAssignment(existing, userID, false))
+			}
+		}
+		for userID := range payload.Item.Allocations {
+			if !changed[userID] && existing.Assigned[userID] {
+				ops = append(ops, restoreAssignment(existing, userID, true))
+			}
+		}
+		return ops
+	case "patch_item":
+		var payload PatchPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		existing, ok := doc.Items[payload.ID]
+		if !ok {
+			return nil
+		}
+		if fields := priorFields(existing, ItemFields, payload.Fields, false); len(fields) > 0 {
+			return []Op{inverseOp("patch_item", PatchPayload{ID: existing.ID, Fields: fields})}
+		}
+	case "remove_item":
+		var payload RemovePayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		if existing, ok := doc.Items[payload.ID]; ok {
+			return []Op{inverseOp("restore_item", ItemPayload{Item: *existing})}
+		}
+	case "restore_item":
+		var payload ItemPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		if existing, ok := doc.Items[payload.Item.ID]; ok {
+			return []Op{inverseOp("restore_item", ItemPayload{Item: *existing})}
+		}
+		return []Op{inverseOp("remove_item", RemovePayload{ID: payload.Item.ID})}
+	case "set_participant":
+		var payload ParticipantPayload
+		var raw struct {
+			Participant map[string]json.RawMessage `json:"participant"`
+		}
+		if json.Unmarshal(op.Payload, &payload) != nil || json.Unmarshal(op.Payload, &raw) != nil {
+			return nil
+		}
+		existing, ok := doc.Participants[payload.Participant.ID]
+		if !ok {
+			return []Op{inverseOp("remove_participant", RemovePayload{ID: payload.Participant.ID})}
+		}
+		if fields := priorFields(existing, ParticipantFields, raw.Participant, true); len(fields) > 0 {
+			return []Op{inverseOp("patch_participant", PatchPayload{ID: existing.ID, Fields: fields})}
+		}
+	case "patch_participant":
+		var payload PatchPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		existing, ok := doc.Participants[payload.ID]
+		if !ok {
+			return nil
+		}
+		if fields := priorFields(existing, ParticipantFields, payload.Fields, false); len(fields) > 0 {
+			return []Op{inverseOp("patch_participant", PatchPayload{ID: existing.ID, Fields: fields})}
+		}
+	case "remove_participant":
+		var payload RemovePayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		if existing, ok := doc.Participants[payload.ID]; ok {
+			return []Op{inverseOp("restore_participant", ParticipantPayload{Participant: *existing})}
+		}
+	case "restore_participant":
+		var payload ParticipantPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		if existing, ok := doc.Participants[payload.Participant.ID]; ok {
+			return []Op{inverseOp("restore_participant", ParticipantPayload{Participant: *existing})}
+		}
+		return []Op{inverseOp("remove_participant", RemovePayload{ID: payload.Participant.ID})}
+	case "assign_item":
+		var payload AssignPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		if item, ok := doc.Items[payload.ItemID]; ok {
+			return []Op{restoreAssignment(item, payload.UserID, false)}
+		}
+	case "allocate_item":
+		var payload AllocatePayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		if item, ok := doc.Items[payload.ItemID]; ok {
+			return []Op{restoreAssignment(item, payload.UserID, true)}
+		}
+	case "set_payer":
+		var payload PayerPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		prior := PayerPayload{ParticipantID: payload.ParticipantID}
+		if existing, ok := doc.Payers[payload.ParticipantID]; ok {
+			prior.AmountCents = existing.AmountCents
+		}
+		return []Op{inverseOp("set_payer", prior)}
+	case "set_tax_tip":
+		var payload TaxTipPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		var prior TaxTipPayload
+		if payload.TaxCents != nil {
+			prior.TaxCents = &doc.TaxCents
+		}
+		if payload.TipCents != nil {
+			prior.TipCents = &doc.TipCents
+		}
+		if payload.BillDiscountCents != nil {
+			prior.BillDiscountCents = &doc.BillDiscountCents
+		}
+		if payload.BillChargesCents != nil {
+			prior.BillChargesCents = &doc.BillChargesCents
+		}
+		return []Op{inverseOp("set_tax_tip", prior)}
+	case "set_room_name":
+		var payload RoomPayload
+		if json.Unmarshal(op.Payload, &payload) != nil {
+			return nil
+		}
+		var prior RoomPayload
+		if payload.Name != "" {
+			prior.Name = doc.Name
+		}
+		if payload.Currency != "" {
+			prior.Currency = doc.Currency
+		}
+		if payload.TargetCurrency != "" {
+			prior.TargetCurrency = doc.TargetCurrency
+		}
+		if prior != (RoomPayload{}) {
+			return []Op{inverseOp("set_room_name", prior)}
+		}
+	}
+	return nil
+}
+
+func inverseOp(kind string, payload any) Op {
+	raw, _ := json.Marshal(payload)
+	return Op{Kind: kind, Payload: raw}
+}
+
+// priorFields picks the current values of the patchable fields named in sent.
+// skipNull matches how whole-entity ops merge, ignoring fields sent as null.
+func priorFields[T any](entity *T, decoders map[string]fieldDecoder[T], sent map[string]json.RawMessage, skipNull bool) map[string]json.RawMessage {
+	encoded, err := json.Marshal(entity)
+	if err != nil {
+		return nil
+	}
+	var current map[string]json.RawMessage
+	if json.Unmarshal(encoded, &current) != nil {
+		return nil
+	}
+	fields := map[string]json.RawMessage{}
+	for name, raw := range sent {
+		if _, ok := decoders[name]; !ok || (skipNull && string(raw) == "null") {
+			continue
+		}
+		value, ok := current[name]
+		if !ok {
+			// Omitted when empty, e.g. a nil sort_order.
+			value = json.RawMessage("null")
+		}
+		fields[name] = value
+	}
+	return fields
+}
+
+// restoreAssignment puts one user's assignment to item back as it is now,
+// weight included. weighted is set when the op being undone may have given
+// them an allocation, which has to be overwritten even if they had none.
+func restoreAssignment(item *Item, userID string, weighted bool) Op {
+	allocation, ok := item.Allocations[userID]
+	if item.Assigned[userID] && (ok || weighted) {
+		if !ok {
+			// An assignee without an entry counts as one share.
+			allocation = Allocation{Shares: 1}
+		}
+		return inverseOp("allocate_item", AllocatePayload{ItemID: item.ID, UserID: userID, Shares: allocation.Shares, Cents: allocation.Cents})
+	}
+	return inverseOp("assign_item", AssignPayload{ItemID: item.ID, UserID: userID, On: item.Assigned[userID]})
+}
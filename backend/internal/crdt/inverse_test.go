@@ -0,0 +1,130 @@
+package crdt
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// billView is what a user sees of a doc, without the bookkeeping stamps that
+// undo necessarily moves forward.
+func billView(doc *RoomDoc) map[string]any {
+	items := map[string]any{}
+	for id, item := range doc.Items {
+		allocations := map[string]any{}
+		for userID, allocation := range item.Allocations {
+			allocations[userID] = []any{allocation.Shares, allocation.Cents}
+		}
+		assigned := map[string]bool{}
+		for userID, on := range item.Assigned {
+			if on {
+				assigned[userID] = true
+			}
+		}
+		items[id] = []any{item.Name, item.Quantity, item.LinePriceCents, item.SortOrder, assigned, allocations}
+	}
+	participants := map[string]any{}
+	for id, p := range doc.Participants {
+		participants[id] = []any{p.Name, p.Present, p.Finished}
+	}
+	payers := map[string]int{}
+	for id, payer := range doc.Payers {
+		if payer.AmountCents != 0 {
+			payers[id] = payer.AmountCents
+		}
+	}
+	return map[string]any{
+		"name": doc.Name, "items": items, "participants": participants, "payers": payers,
+		"tax": doc.TaxCents, "tip": doc.TipCents,
+	}
+}
+
+func inverseTestDoc(clock *Clock) *RoomDoc {
+	doc := NewRoom("ROOM", "Dinner")
+	for _, op := range []Op{
+		testStampedOp(clock, "set_participant", ParticipantPayload{Participant: Participant{ID: "alice", Name: "Alice", Present: true}}),
+		testStampedOp(clock, "set_participant", ParticipantPayload{Participant: Participant{ID: "bob", Name: "Bob"}}),
+		testStampedOp(clock, "set_item", ItemPayload{Item: Item{ID: "fries", Name: "Fries", Quantity: 1, LinePriceCents: 500, Assigned: map[string]bool{"alice": true}}}),
+		testStampedOp(clock, "allocate_item", AllocatePayload{ItemID: "fries", UserID: "alice", Shares: 2}),
+		testStampedOp(clock, "set_payer", PayerPayload{ParticipantID: "alice", AmountCents: 900}),
+	} {
+		ApplyOp(doc, op)
+	}
+	return doc
+}
+
+func testStampedOp(clock *Clock, kind string, payload any) Op {
+	raw, _ := json.Marshal(payload)
+	stamp := clock.Receive(HLC{}, "alice")
+	return Op{Kind: kind, ActorID: "alice", Clock: &stamp, Payload: raw}
+}
+
+func TestInverseUndoesEachOpKind(t *testing.T) {
+	tax := 120
+	cases := []struct {
+		kind    string
+		payload any
+	}{
+		{"set_item", ItemPayload{Item: Item{ID: "soup", Name: "Soup", Quantity: 1}}},
+		{"set_item", ItemPayload{Item: Item{ID: "fries", Name: "Chips", Assigned: map[string]bool{"alice": false, "bob": true}}}},
+		{"set_item", ItemPayload{Item: Item{ID: "fries", Name: "Fries", Allocations: map[string]Allocation{"alice": {Shares: 5}}}}},
+		{"patch_item", PatchPayload{ID: "fries", Fields: map[string]json.RawMessage{"line_price_cents": json.RawMessage(`650`), "sort_order": json.RawMessage(`3`)}}},
+		{"remove_item", RemovePayload{ID: "fries"}},
+		{"assign_item", AssignPayload{ItemID: "fries", UserID: "alice", On: false}},
+		{"assign_item", AssignPayload{ItemID: "fries", UserID: "bob", On: true}},
+		{"allocate_item", AllocatePayload{ItemID: "fries", UserID: "bob", Shares: 3}},
+		{"allocate_item", AllocatePayload{ItemID: "fries", UserID: "alice"}},
+		{"set_participant", ParticipantPayload{Participant: Participant{ID: "carol", Name: "Carol"}}},
+		{"set_participant", ParticipantPayload{Participant: Participant{ID: "bob", Name: "Robert", Finished: true}}},
+		{"patch_participant", PatchPayload{ID: "alice", Fields: map[string]json.RawMessage{"present": json.RawMessage(`false`)}}},
+		{"remove_participant", RemovePayload{ID: "bob"}},
+		{"set_payer", PayerPayload{ParticipantID: "alice", AmountCents: 100}},
+		{"set_payer", PayerPayload{ParticipantID: "bob", AmountCents: 100}},
+		{"set_tax_tip", TaxTipPayload{TaxCents: &tax}},
+		{"set_room_name", RoomPayload{Name: "Lunch"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.kind, func(t *testing.T) {
+			clock := fixedClock(time.UnixMilli(50_000))
+			doc := inverseTestDoc(clock)
+			before := billView(doc)
+
+			op := testStampedOp(clock, tc.kind, tc.payload)
+			inverse := Inverse(doc, op)
+			ApplyOp(doc, op)
+			if reflect.DeepEqual(billView(doc), before) {
+				t.Fatal("op changed nothing; the case tests nothing")
+			}
+			for _, undo := range inverse {
+				stamp := clock.Receive(HLC{}, "alice")
+				undo.Clock = &stamp
+				ApplyOp(doc, undo)
+			}
+			if got := billView(doc); !reflect.DeepEqual(got, before) {
+				t.Fatalf("undo did not restore the bill:\n got %v\nwant %v", got, before)
+			}
+		})
+	}
+}
+
+func TestRestoreResurrectsOnlyPastOlderTombstones(t *testing.T) {
+	clock := fixedClock(time.UnixMilli(50_000))
+	doc := inverseTestDoc(clock)
+	remove := testStampedOp(clock, "remove_item", RemovePayload{ID: "fries"})
+	restore := Inverse(doc, remove)[0]
+	ApplyOp(doc, remove)
+
+	stale := HLC{Wall: remove.Clock.Wall - 1}
+	restore.Clock = &stale
+	ApplyOp(doc, restore)
+	if _, ok := doc.Items["fries"]; ok {
+		t.Fatal("a restore older than the removal must not resurrect the item")
+	}
+	fresh := clock.Receive(HLC{}, "alice")
+	restore.Clock = &fresh
+	ApplyOp(doc, restore)
+	if got := doc.Items["fries"]; got == nil || got.Name != "Fries" || got.Allocations["alice"].Shares != 2 {
+		t.Fatalf("expected the item back as it was, got %+v", got)
+	}
+}
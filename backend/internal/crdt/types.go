@@ -20,22 +20,46 @@ type RoomDoc struct {
 	UpdatedAt             int64                   `json:"updated_at"`
 	Tombstones            map[string]int64        `json:"tombstones"`
 	ParticipantTombstones map[string]int64        `json:"participant_tombstones,omitempty"`
+	Payers                map[string]*Payer       `json:"payers,omitempty"`
+	// TombstoneClocks and ParticipantTombstoneClocks hold the HLC of each
+	// removal; the millisecond maps above stay for older readers and for
+	// tombstones written before HLCs.
+	TombstoneClocks            map[string]HLC `json:"tombstone_clocks,omitempty"`
+	ParticipantTombstoneClocks map[string]HLC `json:"participant_tombstone_clocks,omitempty"`
+	// CreatedAt tells a room from a later one that reuses its code after it
+	// expires. Rooms created before it was recorded have 0.
+	CreatedAt int64 `json:"created_at,omitempty"`
 }
 
 type Item struct {
-	ID              string          `json:"id"`
-	Name            string          `json:"name"`
-	Quantity        int             `json:"quantity"`
-	UnitPriceCents  int             `json:"unit_price_cents"`
-	LinePriceCents  int             `json:"line_price_cents"`
-	DiscountCents   int             `json:"discount_cents"`
-	DiscountPercent float64         `json:"discount_percent"`
-	Assigned        map[string]bool `json:"assigned"`
-	SortOrder       *int64          `json:"sort_order,omitempty"`
-	UpdatedAt       int64           `json:"updated_at"`
-	RawText         string          `json:"raw_text"`
-	Warnings        []string        `json:"warnings"`
-	Meta            map[string]any  `json:"meta"`
+	ID              string                `json:"id"`
+	Name            string                `json:"name"`
+	Quantity        int                   `json:"quantity"`
+	UnitPriceCents  int                   `json:"unit_price_cents"`
+	LinePriceCents  int                   `json:"line_price_cents"`
+	DiscountCents   int                   `json:"discount_cents"`
+	DiscountPercent float64               `json:"discount_percent"`
+	Assigned        map[string]bool       `json:"assigned"`
+	Allocations     map[string]Allocation `json:"allocations,omitempty"`
+	SortOrder       *int64                `json:"sort_order,omitempty"`
+	UpdatedAt       int64                 `json:"updated_at"`
+	Clock           *HLC                  `json:"clock,omitempty"`
+	RawText         string                `json:"raw_text"`
+	Warnings        []string              `json:"warnings"`
+	Meta            map[string]any        `json:"meta"`
+	// FieldClocks stamps fields written since the item was created (see
+	// ItemFields), plus "assigned/{userID}" for each assignment.
+	FieldClocks map[string]HLC `json:"field_clocks,omitempty"`
+}
+
+// Allocation weights one assignee's portion of an item: either a number of shares
+// (2 of 3 tacos, 70/30) or a fixed amount of the line in cents. Assignees without
+// an entry in Item.Allocations (including every legacy boolean snapshot) count as one share.
+type Allocation struct {
+	Shares    int   `json:"shares,omitempty"`
+	Cents     *int  `json:"cents,omitempty"`
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+	Clock     *HLC  `json:"clock,omitempty"`
 }
 
 type Participant struct {
@@ -47,12 +71,28 @@ type Participant struct {
 	Present       bool   `json:"present"`
 	Finished      bool   `json:"finished"`
 	UpdatedAt     int64  `json:"updated_at"`
+	Clock         *HLC   `json:"clock,omitempty"`
+	// FieldClocks stamps fields written since the participant was created.
+	FieldClocks map[string]HLC `json:"field_clocks,omitempty"`
+}
+
+// Payer records how much a participant fronted toward the bill. A zero amount is
+// kept (rather than deleted) so LWW still orders later updates.
+type Payer struct {
+	ParticipantID string `json:"participant_id"`
+	AmountCents   int    `json:"amount_cents"`
+	UpdatedAt     int64  `json:"updated_at"`
+	Clock         *HLC   `json:"clock,omitempty"`
 }
 
+// Op is one change to a room. Timestamp is wall-clock milliseconds; Clock is
+// the HLC stamp the server assigns on receipt and is what LWW compares. Ops
+// logged before HLCs have no Clock and order by Timestamp.
 type Op struct {
 	ID        string          `json:"id"`
 	ActorID   string          `json:"actor_id"`
 	Timestamp int64           `json:"timestamp"`
+	Clock     *HLC            `json:"clock,omitempty"`
 	Kind      string          `json:"kind"`
 	Payload   json.RawMessage `json:"payload"`
 }
@@ -67,6 +107,7 @@ func NewRoom(roomID, name string) *RoomDoc {
 		TargetCurrency:        "USD",
 		Tombstones:            map[string]int64{},
 		ParticipantTombstones: map[string]int64{},
+		Payers:                map[string]*Payer{},
 		UpdatedAt:             time.Now().UnixMilli(),
 	}
 }
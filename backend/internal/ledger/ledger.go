@@ -0,0 +1,347 @@
+package ledger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/settlement"
+)
+
+// Ledger groups several rooms (bills) shared by the same people, e.g. a trip.
+// Each bill keeps the last doc seen for its room so balances survive the room's TTL.
+type Ledger struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Currency string  `json:"currency"`
+	Bills    []*Bill `json:"bills"`
+	// Links joins a bill's participant (by ParticipantKey) to the member they
+	// were confirmed to be in another bill; see Link.
+	Links     map[string]string `json:"links,omitempty"`
+	CreatedAt int64             `json:"created_at"`
+	UpdatedAt int64             `json:"updated_at"`
+}
+
+type Bill struct {
+	RoomCode string        `json:"room_code"`
+	AddedAt  int64         `json:"added_at"`
+	Seq      int64         `json:"seq"`
+	Doc      *crdt.RoomDoc `json:"doc,omitempty"`
+}
+
+// Converter converts an amount in minor units of one currency into another.
+type Converter func(amountCents int64, from, to string) (int64, error)
+
+type BillTotal struct {
+	RoomCode            string `json:"room_code"`
+	Name                string `json:"name"`
+	Currency            string `json:"currency"`
+	TotalCents          int64  `json:"total_cents"`
+	PaidCents           int64  `json:"paid_cents"`
+	ConvertedTotalCents int64  `json:"converted_total_cents"`
+}
+
+type MemberBalance struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	OwedCents int64  `json:"owed_cents"`
+	PaidCents int64  `json:"paid_cents"`
+	NetCents  int64  `json:"net_cents"`
+}
+
+// LinkSuggestion is a member of one bill who goes by the same name as a
+// member of another. They stay apart until someone links them.
+type LinkSuggestion struct {
+	RoomCode      string `json:"room_code"`
+	ParticipantID string `json:"participant_id"`
+	Name          string `json:"name"`
+	MemberID      string `json:"member_id"`
+	MemberName    string `json:"member_name"`
+}
+
+// Settlement is the combined plan across every bill, in the ledger currency.
+// Transfer ids are member ids (see MemberID).
+type Settlement struct {
+	LedgerID       string                `json:"ledger_id"`
+	Name           string                `json:"name"`
+	Currency       string                `json:"currency"`
+	Bills          []BillTotal           `json:"bills"`
+	Balances       []MemberBalance       `json:"balances"`
+	Transfers      []settlement.Transfer `json:"transfers"`
+	UnsettledCents int64                 `json:"unsettled_cents"`
+	Suggestions    []LinkSuggestion      `json:"suggestions"`
+}
+
+func New(id, name, currency string, now int64) *Ledger {
+	return &Ledger{
+		ID:        id,
+		Name:      name,
+		Currency:  currency,
+		Bills:     []*Bill{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// Bill returns the bill for a room code, or nil.
+func (l *Ledger) Bill(roomCode string) *Bill {
+	for _, bill := range l.Bills {
+		if bill.RoomCode == roomCode {
+			return bill
+		}
+	}
+	return nil
+}
+
+// AddBill adds (or refreshes, see Refresh) a room. It reports whether the
+// bill was new.
+func (l *Ledger) AddBill(roomCode string, doc *crdt.RoomDoc, seq, now int64) bool {
+	if bill := l.Bill(roomCode); bill != nil {
+		if bill.Refresh(doc, seq) {
+			l.UpdatedAt = now
+		}
+		return false
+	}
+	l.Bills = append(l.Bills, &Bill{RoomCode: roomCode, AddedAt: now, Seq: seq, Doc: doc})
+	l.UpdatedAt = now
+	return true
+}
+
+// Refresh replaces the bill's doc with a later one of its room. It reports
+// false, and keeps the doc it has, when doc belongs to a different room that
+// took over the code after the bill's room expired.
+func (b *Bill) Refresh(doc *crdt.RoomDoc, seq int64) bool {
+	if b.Doc != nil && b.Doc.CreatedAt != doc.CreatedAt {
+		return false
+	}
+	b.Doc = doc
+	b.Seq = seq
+	return true
+}
+
+// RemoveBill drops a room from the ledger, along with its participants'
+// links. It reports whether anything was removed.
+func (l *Ledger) RemoveBill(roomCode string, now int64) bool {
+	for idx, bill := range l.Bills {
+		if bill.RoomCode == roomCode {
+			l.Bills = append(l.Bills[:idx], l.Bills[idx+1:]...)
+			prefix := ParticipantKey(roomCode, "")
+			for key, member := range l.Links {
+				if strings.HasPrefix(key, prefix) || strings.HasPrefix(member, prefix) {
+					delete(l.Links, key)
+				}
+			}
+			l.UpdatedAt = now
+			return true
+		}
+	}
+	return false
+}
+
+// ParticipantKey names one participant of one bill. Every room mints its own
+// participant ids, so the id alone doesn't say who someone is across bills.
+func ParticipantKey(roomCode, participantID string) string {
+	return roomCode + "/" + participantID
+}
+
+// MemberID identifies a bill's participant across the ledger: the member they
+// were linked to, or otherwise a member of their own.
+func (l *Ledger) MemberID(roomCode, participantID string) string {
+	key := ParticipantKey(roomCode, participantID)
+	if member, ok := l.Links[key]; ok {
+		return member
+	}
+	return key
+}
+
+// Link records that a bill's participant is the same person as memberID, a
+// member of another bill. People are never matched by name alone: two bills'
+// "Sam" may be different people. An empty memberID undoes the link.
+func (l *Ledger) Link(roomCode, participantID, memberID string, now int64) {
+	key := ParticipantKey(roomCode, participantID)
+	if memberID == "" || memberID == key {
+		delete(l.Links, key)
+		l.UpdatedAt = now
+		return
+	}
+	if linked, ok := l.Links[memberID]; ok {
+		memberID = linked
+	}
+	if l.Links == nil {
+		l.Links = map[string]string{}
+	}
+	// Anyone already linked to this participant moves with them.
+	for other, member := range l.Links {
+		if member == key {
+			l.Links[other] = memberID
+		}
+	}
+	l.Links[key] = memberID
+	l.UpdatedAt = now
+}
+
+// HasParticipant reports whether a bill's last doc has the participant.
+func (l *Ledger) HasParticipant(roomCode, participantID string) bool {
+	bill := l.Bill(roomCode)
+	if bill == nil || bill.Doc == nil {
+		return false
+	}
+	_, ok := bill.Doc.Participants[participantID]
+	return ok
+}
+
+func normalizedName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Combine nets every bill's balances into one settlement in the ledger currency.
+// Each bill's paid and owed totals are converted once and then spread back over
+// people proportionally, so a balanced bill stays exactly balanced after FX.
+func Combine(l *Ledger, convert Converter) (*Settlement, error) {
+	out := &Settlement{
+		LedgerID:    l.ID,
+		Name:        l.Name,
+		Currency:    l.Currency,
+		Bills:       []BillTotal{},
+		Balances:    []MemberBalance{},
+		Transfers:   []settlement.Transfer{},
+		Suggestions: []LinkSuggestion{},
+	}
+	members := map[string]*MemberBalance{}
+	member := func(roomCode, participantID, name string) *MemberBalance {
+		id := l.MemberID(roomCode, participantID)
+		entry := members[id]
+		if entry == nil {
+			entry = &MemberBalance{ID: id, Name: name}
+			if entry.Name == "" {
+				entry.Name = participantID
+			}
+			members[id] = entry
+		}
+		return entry
+	}
+
+	for _, bill := range l.Bills {
+		if bill == nil || bill.Doc == nil {
+			continue
+		}
+		plan := settlement.PlanRoom(bill.Doc)
+		currency := bill.Doc.Currency
+		if currency == "" {
+			currency = l.Currency
+		}
+		paid := map[string]int64{}
+		owed := map[string]int64{}
+		names := map[string]string{}
+		for _, balance := range plan.Balances {
+			paid[balance.ID] = balance.PaidCents
+			owed[balance.ID] = balance.OwedCents
+			names[balance.ID] = balance.Name
+		}
+		paidTotal := sumValues(paid)
+		owedTotal := sumValues(owed)
+
+		paidConverted, err := convert(paidTotal, currency, l.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("bill %s: %w", bill.RoomCode, err)
+		}
+		owedConverted := paidConverted
+		if owedTotal != paidTotal {
+			if owedConverted, err = convert(owedTotal, currency, l.Currency); err != nil {
+				return nil, fmt.Errorf("bill %s: %w", bill.RoomCode, err)
+			}
+		}
+		totalConverted := paidConverted
+		if plan.TotalCents != paidTotal {
+			if totalConverted, err = convert(plan.TotalCents, currency, l.Currency); err != nil {
+				return nil, fmt.Errorf("bill %s: %w", bill.RoomCode, err)
+			}
+		}
+		for id, cents := range settlement.SplitProportional(paidConverted, paid) {
+			member(bill.RoomCode, id, names[id]).PaidCents += cents
+		}
+		for id, cents := range settlement.SplitProportional(owedConverted, owed) {
+			member(bill.RoomCode, id, names[id]).OwedCents += cents
+		}
+		out.Bills = append(out.Bills, BillTotal{
+			RoomCode:            bill.RoomCode,
+			Name:                bill.Doc.Name,
+			Currency:            currency,
+			TotalCents:          plan.TotalCents,
+			PaidCents:           paidTotal,
+			ConvertedTotalCents: totalConverted,
+		})
+	}
+
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	nets := map[string]int64{}
+	for _, id := range ids {
+		entry := members[id]
+		entry.NetCents = entry.PaidCents - entry.OwedCents
+		nets[id] = entry.NetCents
+		out.Balances = append(out.Balances, *entry)
+	}
+	transfers, unsettled := settlement.MinimizeTransfers(nets)
+	for _, transfer := range transfers {
+		transfer.FromName = members[transfer.FromID].Name
+		transfer.ToName = members[transfer.ToID].Name
+		out.Transfers = append(out.Transfers, transfer)
+	}
+	out.UnsettledCents = unsettled
+	out.Suggestions = suggestLinks(l, members, ids)
+	return out, nil
+}
+
+// suggestLinks offers to link each unlinked participant to the first member,
+// from another bill, who goes by the same name. Only the later of two
+// participants is offered, so a pair is suggested once.
+func suggestLinks(l *Ledger, members map[string]*MemberBalance, ids []string) []LinkSuggestion {
+	suggestions := []LinkSuggestion{}
+	for _, bill := range l.Bills {
+		if bill == nil || bill.Doc == nil {
+			continue
+		}
+		participantIDs := make([]string, 0, len(bill.Doc.Participants))
+		for id := range bill.Doc.Participants {
+			participantIDs = append(participantIDs, id)
+		}
+		sort.Strings(participantIDs)
+		for _, participantID := range participantIDs {
+			participant := bill.Doc.Participants[participantID]
+			key := ParticipantKey(bill.RoomCode, participantID)
+			if _, linked := l.Links[key]; linked || participant == nil || members[key] == nil || normalizedName(participant.Name) == "" {
+				continue
+			}
+			name := participant.Name
+			for _, id := range ids {
+				if id >= key {
+					break
+				}
+				if !strings.HasPrefix(id, ParticipantKey(bill.RoomCode, "")) && normalizedName(members[id].Name) == normalizedName(name) {
+					suggestions = append(suggestions, LinkSuggestion{
+						RoomCode:      bill.RoomCode,
+						ParticipantID: participantID,
+						Name:          name,
+						MemberID:      id,
+						MemberName:    members[id].Name,
+					})
+					break
+				}
+			}
+		}
+	}
+	return suggestions
+}
+
+func sumValues(values map[string]int64) int64 {
+	total := int64(0)
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
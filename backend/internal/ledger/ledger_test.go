@@ -0,0 +1,136 @@
+package ledger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+func billDoc(roomID, currency string, lineCents int, payerName string, names ...string) *crdt.RoomDoc {
+	doc := crdt.NewRoom(roomID, "Bill "+roomID)
+	doc.Currency = currency
+	assigned := map[string]bool{}
+	for _, name := range names {
+		// Every room mints its own participant ids.
+		id := roomID + "-" + name
+		doc.Participants[id] = &crdt.Participant{ID: id, Name: name}
+		assigned[id] = true
+		if name == payerName {
+			doc.Payers[id] = &crdt.Payer{ParticipantID: id, AmountCents: lineCents}
+		}
+	}
+	doc.Items["item"] = &crdt.Item{ID: "item", Name: "Dinner", Quantity: 1, LinePriceCents: lineCents, Assigned: assigned}
+	return doc
+}
+
+func identity(amount int64, from, to string) (int64, error) {
+	if from != to {
+		return 0, fmt.Errorf("unexpected conversion %s->%s", from, to)
+	}
+	return amount, nil
+}
+
+func TestCombineNetsBalancesAcrossLinkedBills(t *testing.T) {
+	l := New("TRIP", "Trip", "USD", 1)
+	l.AddBill("R1", billDoc("R1", "USD", 3000, "Alice", "Alice", "Bob", "Cara"), 1, 2)
+	l.AddBill("R2", billDoc("R2", "USD", 3000, "bob ", "Alice", "bob ", "Cara"), 1, 3)
+
+	// Nobody is merged on their name alone; matching names are only offered.
+	combined, err := Combine(l, identity)
+	if err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	if len(combined.Balances) != 6 || len(combined.Suggestions) != 3 {
+		t.Fatalf("expected 6 separate members and 3 suggested links, got %#v %#v", combined.Balances, combined.Suggestions)
+	}
+	for _, suggestion := range combined.Suggestions {
+		if suggestion.RoomCode != "R2" || suggestion.MemberID != ParticipantKey("R1", "R1-"+suggestion.MemberName) {
+			t.Fatalf("unexpected suggestion %#v", suggestion)
+		}
+		l.Link(suggestion.RoomCode, suggestion.ParticipantID, suggestion.MemberID, 4)
+	}
+
+	combined, err = Combine(l, identity)
+	if err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	if len(combined.Balances) != 3 || len(combined.Suggestions) != 0 {
+		t.Fatalf("expected linked members merged, got %#v %#v", combined.Balances, combined.Suggestions)
+	}
+	for _, balance := range combined.Balances {
+		want := map[string]int64{"Alice": 1000, "Bob": 1000, "Cara": -2000}[balance.Name]
+		if balance.NetCents != want {
+			t.Fatalf("expected %s net %d, got %d", balance.Name, want, balance.NetCents)
+		}
+	}
+	if len(combined.Transfers) != 2 || combined.UnsettledCents != 0 {
+		t.Fatalf("expected Cara to pay twice, got %#v (unsettled %d)", combined.Transfers, combined.UnsettledCents)
+	}
+	for _, transfer := range combined.Transfers {
+		if transfer.FromName != "Cara" || transfer.AmountCents != 1000 {
+			t.Fatalf("unexpected transfer %#v", transfer)
+		}
+	}
+
+	// Unlinking splits them again, and removing a bill drops its links.
+	l.Link("R2", "R2-Cara", "", 5)
+	if combined, _ = Combine(l, identity); len(combined.Balances) != 4 {
+		t.Fatalf("expected Cara unlinked, got %#v", combined.Balances)
+	}
+	l.RemoveBill("R2", 6)
+	if len(l.Links) != 0 {
+		t.Fatalf("expected the removed bill's links dropped, got %v", l.Links)
+	}
+}
+
+func TestCombineConvertsBillCurrencies(t *testing.T) {
+	l := New("TRIP", "Trip", "USD", 1)
+	l.AddBill("R1", billDoc("R1", "USD", 1000, "Alice", "Alice", "Bob"), 1, 2)
+	// 3333 JPY at 1 JPY = 0.7 US cents -> 2333 cents, which can't split evenly.
+	l.AddBill("R2", billDoc("R2", "JPY", 3333, "Bob", "Alice", "Bob", "Cara"), 1, 3)
+
+	convert := func(amount int64, from, to string) (int64, error) {
+		if from == to {
+			return amount, nil
+		}
+		return (amount * 7) / 10, nil
+	}
+	combined, err := Combine(l, convert)
+	if err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	total := int64(0)
+	for _, balance := range combined.Balances {
+		total += balance.NetCents
+	}
+	if total != 0 || combined.UnsettledCents != 0 {
+		t.Fatalf("expected converted balances to stay zero-sum, got total=%d unsettled=%d", total, combined.UnsettledCents)
+	}
+	if combined.Bills[1].Currency != "JPY" || combined.Bills[1].ConvertedTotalCents != 2333 {
+		t.Fatalf("unexpected converted bill %#v", combined.Bills[1])
+	}
+}
+
+func TestAddAndRemoveBill(t *testing.T) {
+	l := New("TRIP", "Trip", "USD", 1)
+	if !l.AddBill("R1", crdt.NewRoom("R1", ""), 1, 2) {
+		t.Fatal("expected first add to report new bill")
+	}
+	if l.AddBill("R1", crdt.NewRoom("R1", "renamed"), 2, 3) {
+		t.Fatal("expected re-add to refresh existing bill")
+	}
+	if len(l.Bills) != 1 || l.Bills[0].Seq != 2 || l.Bills[0].Doc.Name != "renamed" {
+		t.Fatalf("unexpected bills %#v", l.Bills)
+	}
+	// A new room that took over the code after R1 expired is not R1.
+	successor := crdt.NewRoom("R1", "someone else's")
+	successor.CreatedAt = 99
+	l.AddBill("R1", successor, 1, 4)
+	if l.Bills[0].Seq != 2 || l.Bills[0].Doc.Name != "renamed" || l.UpdatedAt != 3 {
+		t.Fatalf("expected the re-add from another room ignored, got %#v", l.Bills[0])
+	}
+	if !l.RemoveBill("R1", 4) || l.RemoveBill("R1", 5) {
+		t.Fatal("expected remove to succeed exactly once")
+	}
+}
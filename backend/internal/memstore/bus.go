@@ -0,0 +1,117 @@
+package memstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+// Bus is an in-process message bus. Each Node is one subscriber, so several
+// hubs sharing a Bus behave like backend nodes sharing Redis.
+type Bus struct {
+	// Now is the clock used for presence expiry; tests may replace it.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	nodes    map[*BusNode]bool
+	presence map[string]map[string]presenceEntry
+}
+
+type presenceEntry struct {
+	actors    []string
+	expiresAt time.Time
+}
+
+// BusNode is one node's view of a Bus.
+type BusNode struct {
+	bus      *Bus
+	rooms    map[string]bool
+	messages chan storage.BusMessage
+}
+
+var _ storage.Bus = (*BusNode)(nil)
+
+func NewBus() *Bus {
+	return &Bus{
+		Now:      time.Now,
+		nodes:    map[*BusNode]bool{},
+		presence: map[string]map[string]presenceEntry{},
+	}
+}
+
+// Node attaches a new subscriber to the bus.
+func (b *Bus) Node() *BusNode {
+	node := &BusNode{bus: b, rooms: map[string]bool{}, messages: make(chan storage.BusMessage, 256)}
+	b.mu.Lock()
+	b.nodes[node] = true
+	b.mu.Unlock()
+	return node
+}
+
+func (n *BusNode) Publish(ctx context.Context, roomID string, payload []byte) error {
+	n.bus.mu.Lock()
+	defer n.bus.mu.Unlock()
+	for node := range n.bus.nodes {
+		if !node.rooms[roomID] {
+			continue
+		}
+		select {
+		case node.messages <- storage.BusMessage{RoomID: roomID, Payload: payload}:
+		default:
+			// Like Redis pub/sub, a subscriber that can't keep up loses messages.
+		}
+	}
+	return nil
+}
+
+func (n *BusNode) Subscribe(ctx context.Context, roomID string) error {
+	n.bus.mu.Lock()
+	defer n.bus.mu.Unlock()
+	n.rooms[roomID] = true
+	return nil
+}
+
+func (n *BusNode) Unsubscribe(ctx context.Context, roomID string) error {
+	n.bus.mu.Lock()
+	defer n.bus.mu.Unlock()
+	delete(n.rooms, roomID)
+	return nil
+}
+
+func (n *BusNode) Messages() <-chan storage.BusMessage {
+	return n.messages
+}
+
+func (n *BusNode) SetPresence(ctx context.Context, roomID, nodeID string, actorIDs []string, ttl time.Duration) error {
+	n.bus.mu.Lock()
+	defer n.bus.mu.Unlock()
+	if len(actorIDs) == 0 {
+		delete(n.bus.presence[roomID], nodeID)
+		return nil
+	}
+	if n.bus.presence[roomID] == nil {
+		n.bus.presence[roomID] = map[string]presenceEntry{}
+	}
+	n.bus.presence[roomID][nodeID] = presenceEntry{
+		actors:    append([]string(nil), actorIDs...),
+		expiresAt: n.bus.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (n *BusNode) RoomPresence(ctx context.Context, roomID string) (map[string][]string, error) {
+	n.bus.mu.Lock()
+	defer n.bus.mu.Unlock()
+	now := n.bus.Now()
+	out := map[string][]string{}
+	for nodeID, entry := range n.bus.presence[roomID] {
+		if !now.Before(entry.expiresAt) {
+			delete(n.bus.presence[roomID], nodeID)
+			continue
+		}
+		out[nodeID] = append([]string(nil), entry.actors...)
+	}
+	return out, nil
+}
@@ -0,0 +1,275 @@
+package memstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/ledger"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+var _ storage.Store = (*Store)(nil)
+
+// Store is an in-process storage.Store with the same key/TTL semantics as
+// redisstore. Values are kept JSON-encoded so callers never share pointers
+// with stored state, just like a round-trip through Redis.
+type Store struct {
+	TTL time.Duration
+	// Now is the clock used for expiry; tests may replace it.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]entry
+	ops     map[string][]storage.OpEntry
+}
+
+type entry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func New(ttl time.Duration) *Store {
+	return &Store{
+		TTL:     ttl,
+		Now:     time.Now,
+		entries: map[string]entry{},
+		ops:     map[string][]storage.OpEntry{},
+	}
+}
+
+func snapshotKey(roomID string) string    { return "room:" + roomID + ":snapshot" }
+func snapshotSeqKey(roomID string) string { return "room:" + roomID + ":snapshot_seq" }
+func seqKey(roomID string) string         { return "room:" + roomID + ":seq" }
+func opsKey(roomID string) string         { return "room:" + roomID + ":ops" }
+func ledgerKey(ledgerID string) string    { return "ledger:" + ledgerID }
+
+// get returns a live entry, dropping it if it has expired. Callers hold s.mu.
+func (s *Store) get(key string) (entry, bool) {
+	e, ok := s.entries[key]
+	if !ok {
+		return entry{}, false
+	}
+	if !e.expiresAt.IsZero() && !s.Now().Before(e.expiresAt) {
+		delete(s.entries, key)
+		delete(s.ops, key)
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (s *Store) set(key string, value []byte, ttl time.Duration) {
+	e := entry{value: value}
+	if ttl > 0 {
+		e.expiresAt = s.Now().Add(ttl)
+	}
+	s.entries[key] = e
+}
+
+func (s *Store) expire(key string, ttl time.Duration) {
+	e, ok := s.get(key)
+	if !ok {
+		return
+	}
+	if ttl > 0 {
+		e.expiresAt = s.Now().Add(ttl)
+	}
+	s.entries[key] = e
+}
+
+// opsLive reports whether the op list for a room exists; the list's TTL is
+// tracked through a marker entry under the same key.
+func (s *Store) opsLive(roomID string) bool {
+	_, ok := s.get(opsKey(roomID))
+	return ok
+}
+
+func (s *Store) intValue(key string) (int64, bool) {
+	e, ok := s.get(key)
+	if !ok {
+		return 0, false
+	}
+	var value int64
+	_ = json.Unmarshal(e.value, &value)
+	return value, true
+}
+
+func (s *Store) seqValue(roomID string) int64 {
+	seq, _ := s.intValue(seqKey(roomID))
+	return seq
+}
+
+func (s *Store) LoadSnapshot(ctx context.Context, roomID string) (*crdt.RoomDoc, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(snapshotKey(roomID))
+	if !ok {
+		return nil, 0, nil
+	}
+	var doc crdt.RoomDoc
+	if err := json.Unmarshal(e.value, &doc); err != nil {
+		return nil, 0, err
+	}
+	seq, _ := s.intValue(snapshotSeqKey(roomID))
+	return &doc, seq, nil
+}
+
+func (s *Store) SaveSnapshot(ctx context.Context, roomID string, doc *crdt.RoomDoc, seq int64) error {
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.get(snapshotKey(roomID)); ok {
+		if stored, _ := s.intValue(snapshotSeqKey(roomID)); stored > seq {
+			return nil
+		}
+	}
+	seqPayload, _ := json.Marshal(seq)
+	s.set(snapshotKey(roomID), payload, s.TTL)
+	s.set(snapshotSeqKey(roomID), seqPayload, s.TTL)
+	// Like the Redis script, never lower the seq counter.
+	if current := s.seqValue(roomID); current < seq {
+		s.set(seqKey(roomID), seqPayload, s.TTL)
+	} else {
+		s.expire(seqKey(roomID), s.TTL)
+	}
+	s.expire(opsKey(roomID), s.TTL)
+	return nil
+}
+
+func (s *Store) AppendOp(ctx context.Context, roomID string, op crdt.Op) (int64, error) {
+	return s.AppendOps(ctx, roomID, []crdt.Op{op})
+}
+
+func (s *Store) AppendOps(ctx context.Context, roomID string, ops []crdt.Op) (int64, error) {
+	if len(ops) == 0 {
+		return 0, errors.New("append ops: no ops")
+	}
+	// Round-trip the ops so later mutation of their payloads by the caller can't leak in.
+	stored := make([]crdt.Op, len(ops))
+	for i, op := range ops {
+		payload, err := json.Marshal(op)
+		if err != nil {
+			return 0, err
+		}
+		if err := json.Unmarshal(payload, &stored[i]); err != nil {
+			return 0, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.seqValue(roomID)
+	if !s.opsLive(roomID) {
+		s.ops[opsKey(roomID)] = nil
+	}
+	for _, op := range stored {
+		seq++
+		s.ops[opsKey(roomID)] = append(s.ops[opsKey(roomID)], storage.OpEntry{Seq: seq, Op: op})
+	}
+	seqPayload, _ := json.Marshal(seq)
+	s.set(seqKey(roomID), seqPayload, s.TTL)
+	s.set(opsKey(roomID), nil, s.TTL)
+	s.expire(snapshotKey(roomID), s.TTL)
+	s.expire(snapshotSeqKey(roomID), s.TTL)
+	return seq, nil
+}
+
+func (s *Store) CurrentSeq(ctx context.Context, roomID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seqValue(roomID), nil
+}
+
+func (s *Store) LoadOps(ctx context.Context, roomID string, fromSeq int64) ([]storage.OpEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.opsLive(roomID) {
+		return nil, nil
+	}
+	entries := s.ops[opsKey(roomID)]
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].Seq > fromSeq })
+	return append([]storage.OpEntry{}, entries[start:]...), nil
+}
+
+func (s *Store) TrimOps(ctx context.Context, roomID string, throughSeq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.opsLive(roomID) {
+		return nil
+	}
+	entries := s.ops[opsKey(roomID)]
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].Seq > throughSeq })
+	s.ops[opsKey(roomID)] = append([]storage.OpEntry(nil), entries[start:]...)
+	return nil
+}
+
+func (s *Store) TouchRoom(ctx context.Context, roomID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(snapshotKey(roomID), s.TTL)
+	s.expire(snapshotSeqKey(roomID), s.TTL)
+	s.expire(seqKey(roomID), s.TTL)
+	s.expire(opsKey(roomID), s.TTL)
+}
+
+func (s *Store) SnapshotTTL(ctx context.Context, roomID string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(snapshotKey(roomID))
+	if !ok {
+		return 0, nil
+	}
+	if e.expiresAt.IsZero() {
+		// Mirrors Redis TTL returning -1 for keys without expiry.
+		return -1, nil
+	}
+	return e.expiresAt.Sub(s.Now()), nil
+}
+
+func (s *Store) LoadLedger(ctx context.Context, ledgerID string) (*ledger.Ledger, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(ledgerKey(ledgerID))
+	if !ok {
+		return nil, nil
+	}
+	var l ledger.Ledger
+	if err := json.Unmarshal(e.value, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (s *Store) SaveLedger(ctx context.Context, l *ledger.Ledger, ttl time.Duration) error {
+	payload, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(ledgerKey(l.ID), payload, ttl)
+	return nil
+}
+
+func (s *Store) GetCached(ctx context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if !ok {
+		return "", false, nil
+	}
+	return string(e.value), true, nil
+}
+
+func (s *Store) SetCached(ctx context.Context, key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, []byte(value), ttl)
+	return nil
+}
@@ -0,0 +1,182 @@
+package memstore
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+func TestAppendAndLoadOpsInSeqOrder(t *testing.T) {
+	ctx := context.Background()
+	store := New(time.Hour)
+	for i := 0; i < 3; i++ {
+		seq, err := store.AppendOp(ctx, "ROOM", crdt.Op{ID: string(rune('a' + i)), Kind: "set_item"})
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		if seq != int64(i+1) {
+			t.Fatalf("expected seq %d, got %d", i+1, seq)
+		}
+	}
+	ops, err := store.LoadOps(ctx, "ROOM", 1)
+	if err != nil {
+		t.Fatalf("load ops: %v", err)
+	}
+	if len(ops) != 2 || ops[0].Op.ID != "b" || ops[1].Op.ID != "c" || ops[1].Seq != 3 {
+		t.Fatalf("expected ops after seq 1, got %#v", ops)
+	}
+	if seq, _ := store.CurrentSeq(ctx, "ROOM"); seq != 3 {
+		t.Fatalf("expected current seq 3, got %d", seq)
+	}
+}
+
+func TestAppendOpsTakesOneSeqRange(t *testing.T) {
+	ctx := context.Background()
+	store := New(time.Hour)
+	store.AppendOp(ctx, "ROOM", crdt.Op{ID: "a", Kind: "set_item"})
+	last, err := store.AppendOps(ctx, "ROOM", []crdt.Op{{ID: "b", Kind: "set_item"}, {ID: "c", Kind: "set_item"}})
+	if err != nil {
+		t.Fatalf("append ops: %v", err)
+	}
+	if last != 3 {
+		t.Fatalf("expected last seq 3, got %d", last)
+	}
+	ops, _ := store.LoadOps(ctx, "ROOM", 0)
+	if len(ops) != 3 || ops[1].Seq != 2 || ops[1].Op.ID != "b" || ops[2].Seq != 3 {
+		t.Fatalf("expected the batch at seqs 2 and 3, got %#v", ops)
+	}
+	if _, err := store.AppendOps(ctx, "ROOM", nil); err == nil {
+		t.Fatal("expected an empty batch to fail")
+	}
+}
+
+func TestSnapshotIsCopiedAndExpires(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	store := New(time.Minute)
+	store.Now = func() time.Time { return now }
+
+	doc := crdt.NewRoom("ROOM", "Dinner")
+	if err := store.SaveSnapshot(ctx, "ROOM", doc, 4); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	doc.Name = "mutated after save"
+
+	loaded, seq, err := store.LoadSnapshot(ctx, "ROOM")
+	if err != nil || loaded == nil {
+		t.Fatalf("load: %v %#v", err, loaded)
+	}
+	if loaded.Name != "Dinner" || seq != 4 {
+		t.Fatalf("expected isolated copy at seq 4, got %q seq %d", loaded.Name, seq)
+	}
+	if ttl, _ := store.SnapshotTTL(ctx, "ROOM"); ttl != time.Minute {
+		t.Fatalf("expected full TTL, got %v", ttl)
+	}
+
+	now = now.Add(45 * time.Second)
+	store.TouchRoom(ctx, "ROOM")
+	now = now.Add(45 * time.Second)
+	if loaded, _, _ := store.LoadSnapshot(ctx, "ROOM"); loaded == nil {
+		t.Fatal("expected TouchRoom to extend the TTL")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if loaded, _, _ := store.LoadSnapshot(ctx, "ROOM"); loaded != nil {
+		t.Fatal("expected snapshot to expire")
+	}
+	if ops, _ := store.LoadOps(ctx, "ROOM", 0); len(ops) != 0 {
+		t.Fatalf("expected no ops after expiry, got %#v", ops)
+	}
+}
+
+func TestCachedValues(t *testing.T) {
+	ctx := context.Background()
+	store := New(time.Hour)
+	if _, ok, _ := store.GetCached(ctx, "fx"); ok {
+		t.Fatal("expected cache miss")
+	}
+	payload, _ := json.Marshal(map[string]float64{"USD": 1})
+	if err := store.SetCached(ctx, "fx", string(payload), time.Hour); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	got, ok, err := store.GetCached(ctx, "fx")
+	if err != nil || !ok || got != string(payload) {
+		t.Fatalf("expected cached payload, got %q ok=%v err=%v", got, ok, err)
+	}
+}
+
+func TestConcurrentAppendsStayOrdered(t *testing.T) {
+	ctx := context.Background()
+	store := New(time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.AppendOp(ctx, "ROOM", crdt.Op{Kind: "set_item"}); err != nil {
+				t.Errorf("append: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	entries := store.ops[opsKey("ROOM")]
+	if len(entries) != 50 {
+		t.Fatalf("expected 50 ops, got %d", len(entries))
+	}
+	for idx, entry := range entries {
+		if entry.Seq != int64(idx+1) {
+			t.Fatalf("expected seq %d at index %d, got %d", idx+1, idx, entry.Seq)
+		}
+	}
+	if ops, _ := store.LoadOps(ctx, "ROOM", 45); len(ops) != 5 {
+		t.Fatalf("expected ranged read of 5 ops, got %d", len(ops))
+	}
+}
+
+func TestSaveSnapshotNeverLowersSeq(t *testing.T) {
+	ctx := context.Background()
+	store := New(time.Hour)
+	for i := 0; i < 3; i++ {
+		store.AppendOp(ctx, "ROOM", crdt.Op{Kind: "set_item"})
+	}
+	if err := store.SaveSnapshot(ctx, "ROOM", crdt.NewRoom("ROOM", ""), 1); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	seq, err := store.AppendOp(ctx, "ROOM", crdt.Op{Kind: "set_item"})
+	if err != nil || seq != 4 {
+		t.Fatalf("expected next seq 4 after stale snapshot, got %d err=%v", seq, err)
+	}
+}
+
+func TestSaveSnapshotIgnoresOlderSeq(t *testing.T) {
+	ctx := context.Background()
+	store := New(time.Hour)
+	store.SaveSnapshot(ctx, "ROOM", crdt.NewRoom("ROOM", "newer"), 5)
+	store.SaveSnapshot(ctx, "ROOM", crdt.NewRoom("ROOM", "older"), 3)
+	snapshot, seq, _ := store.LoadSnapshot(ctx, "ROOM")
+	if snapshot.Name != "newer" || seq != 5 {
+		t.Fatalf("expected newer snapshot to win, got %q at %d", snapshot.Name, seq)
+	}
+}
+
+func TestTrimOps(t *testing.T) {
+	ctx := context.Background()
+	store := New(time.Hour)
+	for i := 0; i < 5; i++ {
+		store.AppendOp(ctx, "ROOM", crdt.Op{Kind: "set_item"})
+	}
+	if err := store.TrimOps(ctx, "ROOM", 3); err != nil {
+		t.Fatalf("trim: %v", err)
+	}
+	entries, _ := store.LoadOps(ctx, "ROOM", 0)
+	if len(entries) != 2 || entries[0].Seq != 4 {
+		t.Fatalf("expected ops 4..5 after trim, got %#v", entries)
+	}
+	if seq, _ := store.AppendOp(ctx, "ROOM", crdt.Op{Kind: "set_item"}); seq != 6 {
+		t.Fatalf("expected trim to leave seq counter alone, got %d", seq)
+	}
+}
@@ -0,0 +1,356 @@
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// PDF object types. Numbers are float64, booleans bool and null nil.
+type (
+	Name    string
+	String  string
+	Array   []any
+	Dict    map[Name]any
+	keyword string
+)
+
+// Ref is an indirect reference ("12 0 R").
+type Ref struct {
+	Num, Gen int
+}
+
+// Stream is a stream object with its data still encoded.
+type Stream struct {
+	Dict Dict
+	Data []byte
+}
+
+var errSyntax = errors.New("pdf: syntax error")
+
+// maxNesting bounds how deeply arrays and dictionaries nest, so a crafted
+// file can't recurse the parser off the stack.
+const maxNesting = 64
+
+// lexer reads PDF tokens and objects from data, in files and content streams
+// alike.
+type lexer struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isDelim(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+// skip moves past whitespace and comments.
+func (l *lexer) skip() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if isSpace(c) {
+			l.pos++
+			continue
+		}
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		return
+	}
+}
+
+func (l *lexer) eof() bool {
+	l.skip()
+	return l.pos >= len(l.data)
+}
+
+func (l *lexer) hasPrefix(prefix string) bool {
+	return bytes.HasPrefix(l.data[l.pos:], []byte(prefix))
+}
+
+// token reads one token: a Name, String, number, or keyword (which includes
+// the delimiters "[", "]", "<<" and ">>").
+func (l *lexer) token() (any, error) {
+	l.skip()
+	if l.pos >= len(l.data) {
+		return nil, errSyntax
+	}
+	c := l.data[l.pos]
+	switch {
+	case c == '/':
+		l.pos++
+		return l.name(), nil
+	case c == '(':
+		l.pos++
+		return l.literalString(), nil
+	case c == '<':
+		if l.hasPrefix("<<") {
+			l.pos += 2
+			return keyword("<<"), nil
+		}
+		l.pos++
+		return l.hexString(), nil
+	case c == '>':
+		if l.hasPrefix(">>") {
+			l.pos += 2
+			return keyword(">>"), nil
+		}
+		l.pos++
+		return nil, errSyntax
+	case c == '[' || c == ']' || c == '{' || c == '}':
+		l.pos++
+		return keyword(string(c)), nil
+	case c == ')':
+		l.pos++
+		return nil, errSyntax
+	}
+	start := l.pos
+	for l.pos < len(l.data) && !isSpace(l.data[l.pos]) && !isDelim(l.data[l.pos]) {
+		l.pos++
+	}
+	word := string(l.data[start:l.pos])
+	if c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9') {
+		if value, err := strconv.ParseFloat(word, 64); err == nil {
+			return value, nil
+		}
+	}
+	return keyword(word), nil
+}
+
+func (l *lexer) name() Name {
+	var b []byte
+	for l.pos < len(l.data) && !isSpace(l.data[l.pos]) && !isDelim(l.data[l.pos]) {
+		c := l.data[l.pos]
+		if c == '#' && l.pos+2 < len(l.data) {
+			if value, err := strconv.ParseUint(string(l.data[l.pos+1:l.pos+3]), 16, 8); err == nil {
+				b = append(b, byte(value))
+				l.pos += 3
+				continue
+			}
+		}
+		b = append(b, c)
+		l.pos++
+	}
+	return Name(b)
+}
+
+func (l *lexer) literalString() String {
+	var b []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return String(b)
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return String(b)
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					value := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						value = value*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(value)
+				} else {
+					c = e
+				}
+			}
+		}
+		b = append(b, c)
+	}
+	return String(b)
+}
+
+func (l *lexer) hexString() String {
+	var b []byte
+	var digits []byte
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		if c == '>' {
+			break
+		}
+		if isSpace(c) {
+			continue
+		}
+		digits = append(digits, c)
+		if len(digits) == 2 {
+			if value, err := strconv.ParseUint(string(digits), 16, 8); err == nil {
+				b = append(b, byte(value))
+			}
+			digits = digits[:0]
+		}
+	}
+	if len(digits) == 1 {
+		if value, err := strconv.ParseUint(string(digits)+"0", 16, 8); err == nil {
+			b = append(b, byte(value))
+		}
+	}
+	return String(b)
+}
+
+// object reads a whole object: composites are built, "N G R" becomes a Ref,
+// and true, false and null their Go values. Other keywords (content stream
+// operators) come back as keyword.
+func (l *lexer) object() (any, error) {
+	tok, err := l.token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case keyword:
+		if tok == "[" || tok == "<<" {
+			if l.depth >= maxNesting {
+				return nil, errSyntax
+			}
+			l.depth++
+			defer func() { l.depth-- }()
+		}
+		switch tok {
+		case "[":
+			var array Array
+			for {
+				l.skip()
+				if l.pos >= len(l.data) {
+					return nil, errSyntax
+				}
+				if l.data[l.pos] == ']' {
+					l.pos++
+					return array, nil
+				}
+				item, err := l.object()
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, item)
+			}
+		case "<<":
+			dict := Dict{}
+			for {
+				l.skip()
+				if l.hasPrefix(">>") {
+					l.pos += 2
+					return dict, nil
+				}
+				key, err := l.token()
+				if err != nil {
+					return nil, err
+				}
+				name, ok := key.(Name)
+				if !ok {
+					return nil, fmt.Errorf("%w: dictionary key %v", errSyntax, key)
+				}
+				value, err := l.object()
+				if err != nil {
+					return nil, err
+				}
+				dict[name] = value
+			}
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return tok, nil
+	case float64:
+		// "N G R" is a reference; anything else leaves the lexer where it was.
+		save := l.pos
+		if gen, err := l.token(); err == nil {
+			if genNum, ok := gen.(float64); ok {
+				if r, err := l.token(); err == nil && r == keyword("R") {
+					return Ref{Num: int(tok), Gen: int(genNum)}, nil
+				}
+			}
+		}
+		l.pos = save
+		return tok, nil
+	}
+	return tok, nil
+}
+
+// stream reads the data after a stream dictionary; the lexer sits at the
+// "stream" keyword.
+func (l *lexer) stream(dict Dict) (*Stream, error) {
+	l.pos += len("stream")
+	if l.hasPrefix("\r\n") {
+		l.pos += 2
+	} else if l.hasPrefix("\n") || l.hasPrefix("\r") {
+		l.pos++
+	}
+	start := l.pos
+	if length, ok := dict["Length"].(float64); ok && length >= 0 && start+int(length) <= len(l.data) {
+		end := start + int(length)
+		after := lexer{data: l.data, pos: end}
+		after.skip()
+		if after.hasPrefix("endstream") {
+			l.pos = after.pos + len("endstream")
+			return &Stream{Dict: dict, Data: l.data[start:end]}, nil
+		}
+	}
+	// The length is indirect or wrong: the data runs to "endstream".
+	idx := bytes.Index(l.data[start:], []byte("endstream"))
+	if idx < 0 {
+		return nil, errSyntax
+	}
+	end := start + idx
+	if end > start && l.data[end-1] == '\n' {
+		end--
+	}
+	if end > start && l.data[end-1] == '\r' {
+		end--
+	}
+	l.pos = start + idx + len("endstream")
+	return &Stream{Dict: dict, Data: l.data[start:end]}, nil
+}
+
+func number(v any) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
@@ -0,0 +1,539 @@
+// Package pdf reads what receipt ingestion needs from a PDF: each page's text
+// layer as lines, and the image a scanned page is made of. It is not a
+// renderer. Objects are found by scanning the file rather than trusting the
+// xref table, which emailed and re-saved PDFs often get wrong; encrypted files
+// are refused.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/ascii85"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrNotPDF    = errors.New("pdf: not a PDF file")
+	ErrEncrypted = errors.New("pdf: encrypted documents are not supported")
+	// errUnsupportedFilter is a stream encoding this package can't decode.
+	errUnsupportedFilter = errors.New("pdf: unsupported stream filter")
+)
+
+// maxStreamSize bounds one decoded stream, so a crafted file can't inflate
+// without limit.
+const maxStreamSize = 64 << 20
+
+// Document is a parsed PDF.
+type Document struct {
+	objects map[int]entry
+	pages   []*Page
+	fonts   map[Ref]*font
+}
+
+type entry struct {
+	value  any
+	offset int
+}
+
+// Page is one page of a Document.
+type Page struct {
+	doc       *Document
+	dict      Dict
+	resources Dict
+}
+
+var objectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// IsPDF reports whether data starts like a PDF file.
+func IsPDF(data []byte) bool {
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	return bytes.Contains(head, []byte("%PDF-"))
+}
+
+// Open parses data as a PDF.
+func Open(data []byte) (*Document, error) {
+	if !IsPDF(data) {
+		return nil, ErrNotPDF
+	}
+	d := &Document{objects: map[int]entry{}, fonts: map[Ref]*font{}}
+	var trailers []entry
+	for cursor := 0; cursor < len(data); {
+		loc := objectHeader.FindSubmatchIndex(data[cursor:])
+		if loc == nil {
+			break
+		}
+		start := cursor + loc[0]
+		num, _ := strconv.Atoi(string(data[cursor+loc[2] : cursor+loc[3]]))
+		l := &lexer{data: data, pos: cursor + loc[1]}
+		value, err := l.object()
+		if err != nil {
+			cursor += loc[1]
+			continue
+		}
+		if dict, ok := value.(Dict); ok {
+			l.skip()
+			if l.hasPrefix("stream") {
+				stream, err := l.stream(dict)
+				if err != nil {
+					cursor += loc[1]
+					continue
+				}
+				value = stream
+				if dict["Type"] == Name("XRef") {
+					trailers = append(trailers, entry{value: dict, offset: start})
+				}
+			}
+		}
+		d.objects[num] = entry{value: value, offset: start}
+		cursor = l.pos
+	}
+	for idx := 0; ; {
+		next := bytes.Index(data[idx:], []byte("trailer"))
+		if next < 0 {
+			break
+		}
+		idx += next + len("trailer")
+		l := &lexer{data: data, pos: idx}
+		if dict, err := l.object(); err == nil {
+			if dict, ok := dict.(Dict); ok {
+				trailers = append(trailers, entry{value: dict, offset: idx})
+			}
+		}
+	}
+	d.loadObjectStreams()
+
+	sort.SliceStable(trailers, func(i, j int) bool { return trailers[i].offset < trailers[j].offset })
+	var root Dict
+	for _, trailer := range trailers {
+		dict := trailer.value.(Dict)
+		if _, ok := dict["Encrypt"]; ok {
+			return nil, ErrEncrypted
+		}
+		if r, ok := d.resolve(dict["Root"]).(Dict); ok {
+			root = r
+		}
+	}
+	if root != nil {
+		d.walkPages(root["Pages"], nil, map[Ref]bool{}, 0)
+	}
+	if len(d.pages) == 0 {
+		d.scanPages()
+	}
+	return d, nil
+}
+
+// loadObjectStreams unpacks objects stored inside /ObjStm streams. An object
+// defined again later in the file, by an incremental update, keeps the later
+// definition.
+func (d *Document) loadObjectStreams() {
+	streams := make([]entry, 0)
+	for _, e := range d.objects {
+		if s, ok := e.value.(*Stream); ok && s.Dict["Type"] == Name("ObjStm") {
+			streams = append(streams, e)
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].offset < streams[j].offset })
+	for _, e := range streams {
+		s := e.value.(*Stream)
+		data, err := d.decode(s)
+		if err != nil {
+			continue
+		}
+		count, _ := number(s.Dict["N"])
+		first, _ := number(s.Dict["First"])
+		header := &lexer{data: data}
+		for i := 0; i < int(count); i++ {
+			numTok, err1 := header.token()
+			offTok, err2 := header.token()
+			num, ok1 := numTok.(float64)
+			off, ok2 := offTok.(float64)
+			if err1 != nil || err2 != nil || !ok1 || !ok2 {
+				break
+			}
+			if existing, ok := d.objects[int(num)]; ok && existing.offset > e.offset {
+				continue
+			}
+			if first < 0 || off < 0 {
+				continue
+			}
+			l := &lexer{data: data, pos: int(first) + int(off)}
+			if l.pos < 0 || l.pos >= len(data) {
+				continue
+			}
+			value, err := l.object()
+			if err != nil {
+				continue
+			}
+			d.objects[int(num)] = entry{value: value, offset: e.offset}
+		}
+	}
+}
+
+func (d *Document) walkPages(node any, inherited Dict, seen map[Ref]bool, depth int) {
+	if ref, ok := node.(Ref); ok {
+		if seen[ref] {
+			return
+		}
+		seen[ref] = true
+	}
+	dict, ok := d.resolve(node).(Dict)
+	if !ok || depth > 32 {
+		return
+	}
+	resources := inherited
+	if r, ok := d.resolve(dict["Resources"]).(Dict); ok {
+		resources = r
+	}
+	if dict["Type"] == Name("Page") {
+		d.pages = append(d.pages, &Page{doc: d, dict: dict, resources: resources})
+		return
+	}
+	kids, _ := d.resolve(dict["Kids"]).(Array)
+	for _, kid := range kids {
+		d.walkPages(kid, resources, seen, depth+1)
+	}
+}
+
+// scanPages falls back to every /Page object in object-number order when the
+// page tree can't be followed.
+func (d *Document) scanPages() {
+	nums := make([]int, 0)
+	for num, e := range d.objects {
+		if dict, ok := e.value.(Dict); ok && dict["Type"] == Name("Page") {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		dict := d.objects[num].value.(Dict)
+		resources, _ := d.resolve(dict["Resources"]).(Dict)
+		d.pages = append(d.pages, &Page{doc: d, dict: dict, resources: resources})
+	}
+}
+
+// resolve follows indirect references.
+func (d *Document) resolve(v any) any {
+	for i := 0; i < 16; i++ {
+		ref, ok := v.(Ref)
+		if !ok {
+			return v
+		}
+		v = d.objects[ref.Num].value
+	}
+	return nil
+}
+
+// Pages returns the pages in reading order.
+func (d *Document) Pages() []*Page {
+	return d.pages
+}
+
+// content returns the page's decoded content streams, joined.
+func (p *Page) content() []byte {
+	var out []byte
+	contents := p.doc.resolve(p.dict["Contents"])
+	streams, ok := contents.(Array)
+	if !ok {
+		streams = Array{contents}
+	}
+	for _, item := range streams {
+		s, ok := p.doc.resolve(item).(*Stream)
+		if !ok {
+			continue
+		}
+		data, err := p.doc.decode(s)
+		if err != nil {
+			continue
+		}
+		out = append(out, data...)
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// decode applies the stream's filters. It stops with errUnsupportedFilter at
+// image codecs such as DCTDecode, returning the data decoded so far.
+func (d *Document) decode(s *Stream) ([]byte, error) {
+	filters, params := d.filters(s.Dict)
+	data := s.Data
+	for i, filter := range filters {
+		var err error
+		switch filter {
+		case "FlateDecode", "Fl":
+			data, err = inflate(data, params[i])
+		case "ASCIIHexDecode", "AHx":
+			data, err = hex.DecodeString(string(bytes.Map(func(r rune) rune {
+				if r == '>' || isSpace(byte(r)) {
+					return -1
+				}
+				return r
+			}, data)))
+		case "ASCII85Decode", "A85":
+			data, err = decodeASCII85(data)
+		default:
+			return data, fmt.Errorf("%w %s", errUnsupportedFilter, filter)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (d *Document) filters(dict Dict) ([]Name, []Dict) {
+	var filters []Name
+	switch f := d.resolve(dict["Filter"]).(type) {
+	case Name:
+		filters = []Name{f}
+	case Array:
+		for _, item := range f {
+			if name, ok := d.resolve(item).(Name); ok {
+				filters = append(filters, name)
+			}
+		}
+	}
+	params := make([]Dict, len(filters))
+	switch p := d.resolve(dict["DecodeParms"]).(type) {
+	case Dict:
+		if len(params) > 0 {
+			params[0] = p
+		}
+	case Array:
+		for i, item := range p {
+			if i < len(params) {
+				params[i], _ = d.resolve(item).(Dict)
+			}
+		}
+	}
+	return filters, params
+}
+
+func inflate(data []byte, params Dict) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxStreamSize))
+	// Truncated streams are common; keep what inflated.
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if predictor, _ := number(params["Predictor"]); predictor >= 10 {
+		return unpredictPNG(out, params)
+	}
+	return out, nil
+}
+
+// unpredictPNG reverses the PNG row filters that FlateDecode's Predictor
+// parameter applies.
+func unpredictPNG(data []byte, params Dict) ([]byte, error) {
+	columns, colors, bits := 1.0, 1.0, 8.0
+	if v, ok := number(params["Columns"]); ok {
+		columns = v
+	}
+	if v, ok := number(params["Colors"]); ok {
+		colors = v
+	}
+	if v, ok := number(params["BitsPerComponent"]); ok {
+		bits = v
+	}
+	rowLen := (int(colors*bits*columns) + 7) / 8
+	bpp := int(colors*bits) / 8
+	if bpp < 1 {
+		bpp = 1
+	}
+	if rowLen <= 0 {
+		return nil, errSyntax
+	}
+	out := make([]byte, 0, len(data))
+	prev := make([]byte, rowLen)
+	for pos := 0; pos+1+rowLen <= len(data); pos += 1 + rowLen {
+		kind := data[pos]
+		row := append([]byte(nil), data[pos+1:pos+1+rowLen]...)
+		for i := range row {
+			var left, up, upLeft byte
+			if i >= bpp {
+				left = row[i-bpp]
+				upLeft = prev[i-bpp]
+			}
+			up = prev[i]
+			switch kind {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func decodeASCII85(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	data = bytes.TrimPrefix(data, []byte("<~"))
+	if idx := bytes.Index(data, []byte("~>")); idx >= 0 {
+		data = data[:idx]
+	}
+	out := make([]byte, 4*len(data)/5+4)
+	n, _, err := ascii85.Decode(out, data, true)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// Image is an image pulled out of a page, ready to decode.
+type Image struct {
+	Data        []byte
+	ContentType string
+}
+
+// minScanSide is the smallest width and height an image needs to count as a
+// scanned page rather than a logo or a QR code.
+const minScanSide = 200
+
+// ScanImage returns the largest image drawn on the page, as a JPEG (passed
+// through untouched) or PNG, when it is big enough to be a scan of the page.
+// Images in encodings other than DCT or 8-bit Flate gray/RGB are skipped.
+func (p *Page) ScanImage() (Image, bool) {
+	var best *Stream
+	bestArea := 0
+	var visit func(resources Dict, depth int)
+	visit = func(resources Dict, depth int) {
+		xobjects, _ := p.doc.resolve(resources["XObject"]).(Dict)
+		for _, v := range xobjects {
+			s, ok := p.doc.resolve(v).(*Stream)
+			if !ok {
+				continue
+			}
+			switch s.Dict["Subtype"] {
+			case Name("Image"):
+				w, _ := number(p.doc.resolve(s.Dict["Width"]))
+				h, _ := number(p.doc.resolve(s.Dict["Height"]))
+				if w < minScanSide || h < minScanSide || int(w*h) <= bestArea {
+					continue
+				}
+				best, bestArea = s, int(w*h)
+			case Name("Form"):
+				if depth < 3 {
+					if inner, ok := p.doc.resolve(s.Dict["Resources"]).(Dict); ok {
+						visit(inner, depth+1)
+					}
+				}
+			}
+		}
+	}
+	visit(p.resources, 0)
+	if best == nil {
+		return Image{}, false
+	}
+	return p.doc.imageData(best)
+}
+
+func (d *Document) imageData(s *Stream) (Image, bool) {
+	filters, _ := d.filters(s.Dict)
+	data, err := d.decode(s)
+	if err != nil {
+		if errors.Is(err, errUnsupportedFilter) && len(filters) > 0 && (filters[len(filters)-1] == "DCTDecode" || filters[len(filters)-1] == "DCT") {
+			// decode stopped at the DCT filter, so data is the JPEG itself.
+			return Image{Data: data, ContentType: "image/jpeg"}, true
+		}
+		return Image{}, false
+	}
+	w, _ := number(d.resolve(s.Dict["Width"]))
+	h, _ := number(d.resolve(s.Dict["Height"]))
+	bits, _ := number(d.resolve(s.Dict["BitsPerComponent"]))
+	width, height := int(w), int(h)
+	if bits != 8 {
+		return Image{}, false
+	}
+	var img image.Image
+	switch d.colorComponents(s.Dict["ColorSpace"]) {
+	case 1:
+		if len(data) < width*height {
+			return Image{}, false
+		}
+		gray := image.NewGray(image.Rect(0, 0, width, height))
+		copy(gray.Pix, data[:width*height])
+		img = gray
+	case 3:
+		if len(data) < width*height*3 {
+			return Image{}, false
+		}
+		rgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+		for i := 0; i < width*height; i++ {
+			rgba.Pix[i*4], rgba.Pix[i*4+1], rgba.Pix[i*4+2], rgba.Pix[i*4+3] = data[i*3], data[i*3+1], data[i*3+2], 255
+		}
+		img = rgba
+	default:
+		return Image{}, false
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return Image{}, false
+	}
+	return Image{Data: buf.Bytes(), ContentType: "image/png"}, true
+}
+
+// colorComponents returns how many components a color space has, or 0 for
+// ones this package doesn't turn into pixels.
+func (d *Document) colorComponents(v any) int {
+	switch cs := d.resolve(v).(type) {
+	case Name:
+		switch cs {
+		case "DeviceGray", "CalGray", "G":
+			return 1
+		case "DeviceRGB", "CalRGB", "RGB":
+			return 3
+		}
+	case Array:
+		if len(cs) == 2 && cs[0] == Name("ICCBased") {
+			if s, ok := d.resolve(cs[1]).(*Stream); ok {
+				if n, ok := number(d.resolve(s.Dict["N"])); ok && (n == 1 || n == 3) {
+					return int(n)
+				}
+			}
+		}
+		if len(cs) == 2 && (cs[0] == Name("CalRGB") || cs[0] == Name("CalGray")) {
+			return d.colorComponents(cs[0])
+		}
+	}
+	return 0
+}
@@ -0,0 +1,197 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+// buildPDF lays out objects 1..n (object 1 the catalog) with an xref table
+// and trailer. A string is written as the object itself, a stream with its
+// dictionary entries and a computed /Length.
+func buildPDF(t *testing.T, trailerExtra string, objects ...any) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n", i+1)
+		switch object := object.(type) {
+		case string:
+			b.WriteString(object)
+		case stream:
+			fmt.Fprintf(&b, "<< %s /Length %d >>\nstream\n", object.dict, len(object.data))
+			b.Write(object.data)
+			b.WriteString("\nendstream")
+		}
+		b.WriteString("\nendobj\n")
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R %s >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, trailerExtra, xref)
+	return b.Bytes()
+}
+
+type stream struct {
+	dict string
+	data []byte
+}
+
+func deflate(data string) []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(data))
+	w.Close()
+	return b.Bytes()
+}
+
+func TestTextLinesFromSimpleAndCIDFonts(t *testing.T) {
+	// Font F1 is a plain WinAnsi Helvetica. F2 is a two-byte Type0 font whose
+	// glyph ids only mean something through its ToUnicode map, the way
+	// subsetted fonts in emailed receipts are written.
+	content := strings.Join([]string{
+		"BT /F1 12 Tf 72 720 Td (Harbor Street Diner) Tj ET",
+		"BT /F1 10 Tf 72 690 Td (Fish Tacos) Tj 200 0 Td (16.00) Tj ET",
+		"BT /F1 10 Tf 1 0 0 1 72 675 Tm [(Key) -250 (Lime) -250 (Pie)] TJ ET",
+		"BT /F1 10 Tf 272 675.5 Td (7.00) Tj ET",
+		"q 1 0 0 1 0 -30 cm BT /F2 10 Tf 72 675 Td <000100020003> Tj ET Q",
+		"BI /W 2 /H 1 /BPC 8 /CS /G ID \x00EI\xff EI",
+		"BT /F1 10 Tf 12 TL 72 600 Td (Subtotal 23.00) Tj T* (Total \\044 23.00) Tj ET",
+	}, "\n")
+	cmap := `/CIDInit /ProcSet findresource begin
+begincmap
+1 begincodespacerange <0000> <FFFF> endcodespacerange
+1 beginbfchar <0001> <0054> endbfchar
+1 beginbfrange <0002> <0003> <0061> endbfrange
+endcmap`
+	data := buildPDF(t, "",
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 /Resources << /Font << /F1 5 0 R /F2 6 0 R >> >> >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R >>",
+		stream{dict: "/Filter /FlateDecode", data: deflate(content)},
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type0 /BaseFont /ABCDEF+Receipt /Encoding /Identity-H /DescendantFonts [8 0 R] /ToUnicode 7 0 R >>",
+		stream{data: []byte(cmap)},
+		"<< /Type /Font /Subtype /CIDFontType2 /DW 600 /W [1 [500 500] 3 3 400] >>",
+	)
+
+	doc, err := Open(data)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if len(doc.Pages()) != 1 {
+		t.Fatalf("expected 1 page, got %d", len(doc.Pages()))
+	}
+	got := strings.Join(doc.Pages()[0].TextLines(), "\n")
+	want := strings.Join([]string{
+		"Harbor Street Diner",
+		"Fish Tacos 16.00",
+		"Key Lime Pie 7.00",
+		"Tab",
+		"Subtotal 23.00",
+		"Total $ 23.00",
+	}, "\n")
+	if got != want {
+		t.Fatalf("unexpected text lines:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestScanImageReturnsThePageJPEG(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 240, 320))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 251)
+	}
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, nil); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	logo := bytes.Repeat([]byte{0x80}, 32*32)
+	data := buildPDF(t, "",
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /XObject << /Logo 6 0 R /Fm1 7 0 R >> >> /Contents 4 0 R >>",
+		stream{data: []byte("q 612 0 0 792 0 0 cm /Fm1 Do Q")},
+		stream{dict: "/Type /XObject /Subtype /Image /Width 240 /Height 320 /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /DCTDecode", data: jpg.Bytes()},
+		stream{dict: "/Type /XObject /Subtype /Image /Width 32 /Height 32 /ColorSpace /DeviceGray /BitsPerComponent 8", data: logo},
+		stream{dict: "/Type /XObject /Subtype /Form /BBox [0 0 1 1] /Resources << /XObject << /Im1 5 0 R >> >>", data: []byte("/Im1 Do")},
+	)
+	doc, err := Open(data)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	page := doc.Pages()[0]
+	scan, ok := page.ScanImage()
+	if !ok || scan.ContentType != "image/jpeg" || !bytes.Equal(scan.Data, jpg.Bytes()) {
+		t.Fatalf("expected the scanned JPEG back untouched, got %v %q (%d bytes)", ok, scan.ContentType, len(scan.Data))
+	}
+	if lines := page.TextLines(); len(lines) != 0 {
+		t.Fatalf("expected no text layer, got %q", lines)
+	}
+}
+
+func TestOpenRefusesEncryptedAndNonPDF(t *testing.T) {
+	data := buildPDF(t, "/Encrypt 3 0 R",
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		"<< /Filter /Standard /V 2 /R 3 >>",
+	)
+	if _, err := Open(data); !errors.Is(err, ErrEncrypted) {
+		t.Fatalf("expected ErrEncrypted, got %v", err)
+	}
+	if _, err := Open([]byte("\xff\xd8\xff\xe0 a jpeg")); !errors.Is(err, ErrNotPDF) {
+		t.Fatalf("expected ErrNotPDF, got %v", err)
+	}
+}
+
+func TestOpenRejectsDeepNesting(t *testing.T) {
+	deep := "[" + strings.Repeat("[", 100000)
+	data := buildPDF(t, "",
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		deep,
+	)
+	// The nested object is skipped as unreadable rather than overflowing the
+	// stack.
+	if _, err := Open(data); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	l := &lexer{data: []byte(deep)}
+	if _, err := l.object(); !errors.Is(err, errSyntax) {
+		t.Fatalf("expected a syntax error, got %v", err)
+	}
+}
+
+func TestOpenSkipsObjectStreamOffsetsOutOfRange(t *testing.T) {
+	for _, data := range []string{
+		"%PDF-1.4\n1 0 obj\n<</Type/ObjStm/N 1/First -5/Length 4>>\nstream\n1 0 \nendstream\nendobj\n",
+		"%PDF-1.4\n1 0 obj\n<</Type/ObjStm/N 1/First 2/Length 5>>\nstream\n1 -9 \nendstream\nendobj\n",
+	} {
+		// The stream's objects are unreadable, not a panic.
+		Open([]byte(data))
+	}
+}
+
+// FuzzOpen checks that no input makes Open, or reading its pages, panic.
+func FuzzOpen(f *testing.F) {
+	f.Add([]byte("%PDF-1.4\n1 0 obj\n<</Type/ObjStm/N 1/First -5/Length 4>>\nstream\n1 0 \nendstream\nendobj\n"))
+	f.Add([]byte("%PDF-1.7\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n3 0 obj\n<< /Type /Page /Contents 4 0 R >>\nendobj\n4 0 obj\n<< /Length 20 >>\nstream\nBT (Total 8.10) Tj ET\nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		doc, err := Open(data)
+		if err != nil {
+			return
+		}
+		for _, page := range doc.Pages() {
+			page.TextLines()
+			page.ScanImage()
+		}
+	})
+}
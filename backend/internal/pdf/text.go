@@ -0,0 +1,573 @@
+package pdf
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+// mul returns m × n: m applied first, then n.
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func translate(x, y float64) matrix {
+	return matrix{1, 0, 0, 1, x, y}
+}
+
+// run is a string drawn on the page, placed in page space.
+type run struct {
+	x, y, endX, size float64
+	text             string
+}
+
+type graphicsState struct {
+	ctm       matrix
+	font      *font
+	size      float64
+	leading   float64
+	charSpace float64
+	wordSpace float64
+	hscale    float64
+	rise      float64
+}
+
+// TextLines returns the page's text layer as lines, top to bottom, with the
+// pieces of each line left to right and a space wherever there is a visible
+// gap between them.
+func (p *Page) TextLines() []string {
+	var runs []run
+	state := graphicsState{ctm: identity, hscale: 1}
+	p.doc.interpret(p.content(), p.resources, state, &runs, 0)
+	return groupLines(runs)
+}
+
+// interpret runs a content stream, collecting the text it draws. Only the
+// operators that place or show text, change the transformation, or draw form
+// XObjects (which can hold text) matter here.
+func (d *Document) interpret(content []byte, resources Dict, state graphicsState, runs *[]run, depth int) {
+	l := &lexer{data: content}
+	var stack []graphicsState
+	var tm, tlm matrix
+	var operands []any
+	fonts, _ := d.resolve(resources["Font"]).(Dict)
+	xobjects, _ := d.resolve(resources["XObject"]).(Dict)
+
+	show := func(s String) {
+		if state.font == nil {
+			return
+		}
+		text, advances := state.font.decode(s)
+		trm := matrix{state.size * state.hscale, 0, 0, state.size, 0, state.rise}.mul(tm).mul(state.ctm)
+		width := 0.0
+		for _, a := range advances {
+			width += (a.width*state.size + state.charSpace) * state.hscale
+			if a.space {
+				width += state.wordSpace * state.hscale
+			}
+		}
+		end := translate(width, 0).mul(tm).mul(state.ctm)
+		size := state.size * math.Hypot(tm.mul(state.ctm)[2], tm.mul(state.ctm)[3])
+		if text != "" {
+			*runs = append(*runs, run{x: trm[4], y: trm[5], endX: end[4], size: size, text: text})
+		}
+		tm = translate(width, 0).mul(tm)
+	}
+	nextLine := func(tx, ty float64) {
+		tlm = translate(tx, ty).mul(tlm)
+		tm = tlm
+	}
+
+	for !l.eof() {
+		value, err := l.object()
+		if err != nil {
+			return
+		}
+		op, ok := value.(keyword)
+		if !ok {
+			operands = append(operands, value)
+			continue
+		}
+		nums := make([]float64, 0, len(operands))
+		for _, operand := range operands {
+			if n, ok := operand.(float64); ok {
+				nums = append(nums, n)
+			}
+		}
+		switch op {
+		case "q":
+			stack = append(stack, state)
+		case "Q":
+			if len(stack) > 0 {
+				state = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "cm":
+			if len(nums) == 6 {
+				state.ctm = matrix{nums[0], nums[1], nums[2], nums[3], nums[4], nums[5]}.mul(state.ctm)
+			}
+		case "BT":
+			tm, tlm = identity, identity
+		case "Tf":
+			if len(operands) == 2 {
+				if name, ok := operands[0].(Name); ok {
+					state.font = d.loadFont(fonts[name])
+				}
+				state.size, _ = number(operands[1])
+			}
+		case "Tc":
+			if len(nums) == 1 {
+				state.charSpace = nums[0]
+			}
+		case "Tw":
+			if len(nums) == 1 {
+				state.wordSpace = nums[0]
+			}
+		case "Tz":
+			if len(nums) == 1 {
+				state.hscale = nums[0] / 100
+			}
+		case "TL":
+			if len(nums) == 1 {
+				state.leading = nums[0]
+			}
+		case "Ts":
+			if len(nums) == 1 {
+				state.rise = nums[0]
+			}
+		case "Td":
+			if len(nums) == 2 {
+				nextLine(nums[0], nums[1])
+			}
+		case "TD":
+			if len(nums) == 2 {
+				state.leading = -nums[1]
+				nextLine(nums[0], nums[1])
+			}
+		case "Tm":
+			if len(nums) == 6 {
+				tlm = matrix{nums[0], nums[1], nums[2], nums[3], nums[4], nums[5]}
+				tm = tlm
+			}
+		case "T*":
+			nextLine(0, -state.leading)
+		case "Tj":
+			if len(operands) == 1 {
+				if s, ok := operands[0].(String); ok {
+					show(s)
+				}
+			}
+		case "'":
+			nextLine(0, -state.leading)
+			if len(operands) == 1 {
+				if s, ok := operands[0].(String); ok {
+					show(s)
+				}
+			}
+		case "\"":
+			nextLine(0, -state.leading)
+			if len(operands) == 3 {
+				state.wordSpace, _ = number(operands[0])
+				state.charSpace, _ = number(operands[1])
+				if s, ok := operands[2].(String); ok {
+					show(s)
+				}
+			}
+		case "TJ":
+			if len(operands) == 1 {
+				items, _ := operands[0].(Array)
+				for _, item := range items {
+					switch item := item.(type) {
+					case String:
+						show(item)
+					case float64:
+						tm = translate(-item/1000*state.size*state.hscale, 0).mul(tm)
+					}
+				}
+			}
+		case "Do":
+			if len(operands) == 1 && depth < 5 {
+				name, _ := operands[0].(Name)
+				form, ok := d.resolve(xobjects[name]).(*Stream)
+				if !ok || form.Dict["Subtype"] != Name("Form") {
+					break
+				}
+				data, err := d.decode(form)
+				if err != nil {
+					break
+				}
+				inner := state
+				if m, ok := d.resolve(form.Dict["Matrix"]).(Array); ok && len(m) == 6 {
+					var fm matrix
+					for i := range fm {
+						fm[i], _ = number(m[i])
+					}
+					inner.ctm = fm.mul(state.ctm)
+				}
+				formResources, ok := d.resolve(form.Dict["Resources"]).(Dict)
+				if !ok {
+					formResources = resources
+				}
+				d.interpret(data, formResources, inner, runs, depth+1)
+			}
+		case "BI":
+			// Inline image data is binary; skip to the whitespace-delimited EI.
+			for !l.eof() {
+				value, err := l.token()
+				if err != nil {
+					return
+				}
+				if value == keyword("ID") {
+					break
+				}
+			}
+			end := strings.Index(string(l.data[l.pos:]), "EI")
+			for end >= 0 {
+				at := l.pos + end
+				before := at == 0 || isSpace(l.data[at-1])
+				after := at+2 >= len(l.data) || isSpace(l.data[at+2])
+				if before && after {
+					break
+				}
+				next := strings.Index(string(l.data[at+2:]), "EI")
+				if next < 0 {
+					end = -1
+					break
+				}
+				end += 2 + next
+			}
+			if end < 0 {
+				return
+			}
+			l.pos += end + 2
+		}
+		operands = operands[:0]
+	}
+}
+
+// groupLines puts runs whose baselines are within about half a glyph of each
+// other on one line.
+func groupLines(runs []run) []string {
+	sort.SliceStable(runs, func(i, j int) bool {
+		if runs[i].y != runs[j].y {
+			return runs[i].y > runs[j].y
+		}
+		return runs[i].x < runs[j].x
+	})
+	var lines []string
+	for start := 0; start < len(runs); {
+		end := start + 1
+		for end < len(runs) {
+			tolerance := math.Max(math.Max(runs[start].size, runs[end].size)*0.4, 1)
+			if runs[start].y-runs[end].y > tolerance {
+				break
+			}
+			end++
+		}
+		line := append([]run(nil), runs[start:end]...)
+		sort.SliceStable(line, func(i, j int) bool { return line[i].x < line[j].x })
+		var b strings.Builder
+		for i, r := range line {
+			if i > 0 && r.x-line[i-1].endX > math.Max(r.size, 1)*0.2 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(r.text)
+		}
+		if text := strings.Join(strings.Fields(b.String()), " "); text != "" {
+			lines = append(lines, text)
+		}
+		start = end
+	}
+	return lines
+}
+
+// font is what text extraction needs from a font: how to split a string into
+// character codes, what text each code stands for, and how far it advances.
+type font struct {
+	twoByte      bool
+	toUnicode    map[uint32]string
+	encoding     *[256]rune
+	widths       map[uint32]float64
+	defaultWidth float64
+}
+
+// advance is one character code's width in text space (glyph units / 1000)
+// and whether it is the single-byte space, which word spacing applies to.
+type advance struct {
+	width float64
+	space bool
+}
+
+func (d *Document) loadFont(v any) *font {
+	ref, isRef := v.(Ref)
+	if isRef {
+		if f, ok := d.fonts[ref]; ok {
+			return f
+		}
+	}
+	dict, _ := d.resolve(v).(Dict)
+	f := &font{widths: map[uint32]float64{}, defaultWidth: 0.5}
+	if dict != nil {
+		f.load(d, dict)
+	}
+	if isRef {
+		d.fonts[ref] = f
+	}
+	return f
+}
+
+func (f *font) load(d *Document, dict Dict) {
+	if s, ok := d.resolve(dict["ToUnicode"]).(*Stream); ok {
+		if data, err := d.decode(s); err == nil {
+			f.toUnicode = parseCMap(data)
+		}
+	}
+	if dict["Subtype"] == Name("Type0") {
+		f.twoByte = true
+		f.defaultWidth = 1
+		descendants, _ := d.resolve(dict["DescendantFonts"]).(Array)
+		if len(descendants) == 0 {
+			return
+		}
+		cid, _ := d.resolve(descendants[0]).(Dict)
+		if dw, ok := number(d.resolve(cid["DW"])); ok {
+			f.defaultWidth = dw / 1000
+		}
+		w, _ := d.resolve(cid["W"]).(Array)
+		for i := 0; i < len(w); {
+			first, ok := number(d.resolve(w[i]))
+			if !ok || i+1 >= len(w) {
+				break
+			}
+			if list, ok := d.resolve(w[i+1]).(Array); ok {
+				for j, item := range list {
+					if width, ok := number(d.resolve(item)); ok {
+						f.widths[uint32(first)+uint32(j)] = width / 1000
+					}
+				}
+				i += 2
+				continue
+			}
+			last, ok1 := number(d.resolve(w[i+1]))
+			if i+2 >= len(w) || !ok1 {
+				break
+			}
+			width, _ := number(d.resolve(w[i+2]))
+			for code := uint32(first); code <= uint32(last) && code-uint32(first) < 65536; code++ {
+				f.widths[code] = width / 1000
+			}
+			i += 3
+		}
+		return
+	}
+
+	firstChar, _ := number(d.resolve(dict["FirstChar"]))
+	widths, _ := d.resolve(dict["Widths"]).(Array)
+	for i, item := range widths {
+		if width, ok := number(d.resolve(item)); ok {
+			f.widths[uint32(firstChar)+uint32(i)] = width / 1000
+		}
+	}
+	if descriptor, ok := d.resolve(dict["FontDescriptor"]).(Dict); ok {
+		if missing, ok := number(d.resolve(descriptor["MissingWidth"])); ok && missing > 0 {
+			f.defaultWidth = missing / 1000
+		}
+	}
+	encoding := winAnsiEncoding
+	switch enc := d.resolve(dict["Encoding"]).(type) {
+	case Name:
+		if enc == "MacRomanEncoding" {
+			encoding = macRomanEncoding()
+		}
+	case Dict:
+		if enc["BaseEncoding"] == Name("MacRomanEncoding") {
+			encoding = macRomanEncoding()
+		}
+		if differences, ok := d.resolve(enc["Differences"]).(Array); ok {
+			code := 0
+			for _, item := range differences {
+				switch item := d.resolve(item).(type) {
+				case float64:
+					code = int(item)
+				case Name:
+					if code >= 0 && code < 256 {
+						if r, ok := glyphRune(string(item)); ok {
+							encoding[code] = r
+						}
+					}
+					code++
+				}
+			}
+		}
+	}
+	f.encoding = &encoding
+}
+
+func (f *font) decode(s String) (string, []advance) {
+	var b strings.Builder
+	var advances []advance
+	step := 1
+	if f.twoByte {
+		step = 2
+	}
+	for i := 0; i+step <= len(s); i += step {
+		code := uint32(s[i])
+		if f.twoByte {
+			code = code<<8 | uint32(s[i+1])
+		}
+		if text, ok := f.toUnicode[code]; ok {
+			b.WriteString(text)
+		} else if f.encoding != nil {
+			if r := f.encoding[code]; r != 0 {
+				b.WriteRune(r)
+			}
+		}
+		width, ok := f.widths[code]
+		if !ok {
+			width = f.defaultWidth
+		}
+		advances = append(advances, advance{width: width, space: !f.twoByte && code == ' '})
+	}
+	return b.String(), advances
+}
+
+// parseCMap reads the bfchar and bfrange mappings of a ToUnicode CMap.
+func parseCMap(data []byte) map[uint32]string {
+	out := map[uint32]string{}
+	l := &lexer{data: data}
+	var operands []any
+	mode := ""
+	for !l.eof() {
+		value, err := l.object()
+		if err != nil {
+			break
+		}
+		op, ok := value.(keyword)
+		if !ok {
+			operands = append(operands, value)
+			if mode == "bfchar" && len(operands) == 2 {
+				src, _ := operands[0].(String)
+				dst, _ := operands[1].(String)
+				out[codeOf(src)] = utf16Text(dst)
+				operands = operands[:0]
+			}
+			if mode == "bfrange" && len(operands) == 3 {
+				loString, _ := operands[0].(String)
+				hiString, _ := operands[1].(String)
+				lo, hi := codeOf(loString), codeOf(hiString)
+				switch dst := operands[2].(type) {
+				case String:
+					base := []rune(utf16Text(dst))
+					for code := lo; code <= hi && code-lo < 65536 && len(base) > 0; code++ {
+						last := base[len(base)-1] + rune(code-lo)
+						out[code] = string(append(append([]rune(nil), base[:len(base)-1]...), last))
+					}
+				case Array:
+					for i, item := range dst {
+						if s, ok := item.(String); ok && lo+uint32(i) <= hi {
+							out[lo+uint32(i)] = utf16Text(s)
+						}
+					}
+				}
+				operands = operands[:0]
+			}
+			continue
+		}
+		switch op {
+		case "beginbfchar":
+			mode = "bfchar"
+		case "beginbfrange":
+			mode = "bfrange"
+		case "endbfchar", "endbfrange":
+			mode = ""
+		}
+		operands = operands[:0]
+	}
+	return out
+}
+
+func codeOf(s String) uint32 {
+	var code uint32
+	for i := 0; i < len(s); i++ {
+		code = code<<8 | uint32(s[i])
+	}
+	return code
+}
+
+func utf16Text(s String) string {
+	if len(s)%2 != 0 {
+		return string(s)
+	}
+	units := make([]uint16, len(s)/2)
+	for i := range units {
+		units[i] = uint16(s[2*i])<<8 | uint16(s[2*i+1])
+	}
+	return string(utf16.Decode(units))
+}
+
+// winAnsiEncoding is Windows-1252, the usual encoding of simple fonts.
+var winAnsiEncoding = func() [256]rune {
+	var enc [256]rune
+	for i := 32; i < 256; i++ {
+		enc[i] = rune(i)
+	}
+	enc[127] = 0
+	high := []rune{
+		'€', 0, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0, 'Ž', 0,
+		0, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0, 'ž', 'Ÿ',
+	}
+	copy(enc[128:160], high)
+	return enc
+}()
+
+// macRomanEncoding covers ASCII; the high half is rare on receipts and left
+// out.
+func macRomanEncoding() [256]rune {
+	var enc [256]rune
+	for i := 32; i < 127; i++ {
+		enc[i] = rune(i)
+	}
+	return enc
+}
+
+var glyphNames = map[string]rune{
+	"space": ' ', "exclam": '!', "quotedbl": '"', "numbersign": '#', "dollar": '$', "percent": '%',
+	"ampersand": '&', "quotesingle": '\'', "quoteright": '’', "quoteleft": '‘', "parenleft": '(',
+	"parenright": ')', "asterisk": '*', "plus": '+', "comma": ',', "hyphen": '-', "minus": '−',
+	"period": '.', "slash": '/', "zero": '0', "one": '1', "two": '2', "three": '3', "four": '4',
+	"five": '5', "six": '6', "seven": '7', "eight": '8', "nine": '9', "colon": ':', "semicolon": ';',
+	"less": '<', "equal": '=', "greater": '>', "question": '?', "at": '@', "bracketleft": '[',
+	"backslash": '\\', "bracketright": ']', "asciicircum": '^', "underscore": '_', "grave": '`',
+	"braceleft": '{', "bar": '|', "braceright": '}', "asciitilde": '~', "endash": '–', "emdash": '—',
+	"bullet": '•', "Euro": '€', "sterling": '£', "yen": '¥', "cent": '¢', "degree": '°',
+	"multiply": '×', "ellipsis": '…', "quotedblleft": '“', "quotedblright": '”',
+}
+
+func glyphRune(name string) (rune, bool) {
+	if r, ok := glyphNames[name]; ok {
+		return r, true
+	}
+	if len(name) == 1 {
+		return rune(name[0]), true
+	}
+	if strings.HasPrefix(name, "uni") && len(name) == 7 {
+		if value, err := strconv.ParseUint(name[3:], 16, 32); err == nil {
+			return rune(value), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,114 @@
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+var _ storage.Bus = (*Bus)(nil)
+
+// Bus fans room messages out over Redis pub/sub (one channel per room) and
+// keeps each node's connected actors in a per-room hash.
+type Bus struct {
+	Client   *redis.Client
+	pubsub   *redis.PubSub
+	messages chan storage.BusMessage
+}
+
+func NewBus(ctx context.Context, client *redis.Client) *Bus {
+	b := &Bus{
+		Client:   client,
+		pubsub:   client.Subscribe(ctx),
+		messages: make(chan storage.BusMessage, 256),
+	}
+	go b.forward()
+	return b
+}
+
+func eventsChannel(roomID string) string {
+	return fmt.Sprintf("room:%s:events", roomID)
+}
+
+func presenceKey(roomID string) string {
+	return fmt.Sprintf("room:%s:presence", roomID)
+}
+
+func (b *Bus) forward() {
+	defer close(b.messages)
+	for msg := range b.pubsub.Channel() {
+		roomID := strings.TrimSuffix(strings.TrimPrefix(msg.Channel, "room:"), ":events")
+		b.messages <- storage.BusMessage{RoomID: roomID, Payload: []byte(msg.Payload)}
+	}
+}
+
+func (b *Bus) Publish(ctx context.Context, roomID string, payload []byte) error {
+	return b.Client.Publish(ctx, eventsChannel(roomID), payload).Err()
+}
+
+func (b *Bus) Subscribe(ctx context.Context, roomID string) error {
+	return b.pubsub.Subscribe(ctx, eventsChannel(roomID))
+}
+
+func (b *Bus) Unsubscribe(ctx context.Context, roomID string) error {
+	return b.pubsub.Unsubscribe(ctx, eventsChannel(roomID))
+}
+
+func (b *Bus) Messages() <-chan storage.BusMessage {
+	return b.messages
+}
+
+func (b *Bus) Close() error {
+	return b.pubsub.Close()
+}
+
+type presenceEntry struct {
+	Actors    []string `json:"actors"`
+	ExpiresAt int64    `json:"expires_at"`
+}
+
+func (b *Bus) SetPresence(ctx context.Context, roomID, nodeID string, actorIDs []string, ttl time.Duration) error {
+	key := presenceKey(roomID)
+	if len(actorIDs) == 0 {
+		return b.Client.HDel(ctx, key, nodeID).Err()
+	}
+	payload, err := json.Marshal(presenceEntry{Actors: actorIDs, ExpiresAt: time.Now().Add(ttl).UnixMilli()})
+	if err != nil {
+		return err
+	}
+	pipe := b.Client.TxPipeline()
+	pipe.HSet(ctx, key, nodeID, payload)
+	pipe.PExpire(ctx, key, ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (b *Bus) RoomPresence(ctx context.Context, roomID string) (map[string][]string, error) {
+	key := presenceKey(roomID)
+	values, err := b.Client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	out := map[string][]string{}
+	expired := []string{}
+	for nodeID, value := range values {
+		var entry presenceEntry
+		// Entries from a node that died without clearing them age out here.
+		if err := json.Unmarshal([]byte(value), &entry); err != nil || entry.ExpiresAt <= now {
+			expired = append(expired, nodeID)
+			continue
+		}
+		out[nodeID] = entry.Actors
+	}
+	if len(expired) > 0 {
+		b.Client.HDel(ctx, key, expired...)
+	}
+	return out, nil
+}
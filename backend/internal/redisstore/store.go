@@ -4,13 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 
 	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/ledger"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
 )
 
+var _ storage.Store = (*Store)(nil)
+
 type Store struct {
 	Client *redis.Client
 	TTL    time.Duration
@@ -28,6 +34,12 @@ func (s *Store) snapshotKey(roomID string) string {
 	return fmt.Sprintf("room:%s:snapshot", roomID)
 }
 
+// snapshotSeqKey holds the seq the snapshot was folded through. Snapshots saved
+// before it existed were always current, so its absence means "the seq key".
+func (s *Store) snapshotSeqKey(roomID string) string {
+	return fmt.Sprintf("room:%s:snapshot_seq", roomID)
+}
+
 func (s *Store) seqKey(roomID string) string {
 	return fmt.Sprintf("room:%s:seq", roomID)
 }
@@ -36,53 +48,166 @@ func (s *Store) opsKey(roomID string) string {
 	return fmt.Sprintf("room:%s:ops", roomID)
 }
 
+func (s *Store) ledgerKey(ledgerID string) string {
+	return fmt.Sprintf("ledger:%s", ledgerID)
+}
+
 func (s *Store) LoadSnapshot(ctx context.Context, roomID string) (*crdt.RoomDoc, int64, error) {
-	payload, err := s.Client.Get(ctx, s.snapshotKey(roomID)).Result()
-	if err == redis.Nil {
-		return nil, 0, nil
-	}
+	// One MGET so the doc and its seq are read from the same write.
+	values, err := s.Client.MGet(ctx, s.snapshotKey(roomID), s.snapshotSeqKey(roomID), s.seqKey(roomID)).Result()
 	if err != nil {
 		return nil, 0, err
 	}
+	payload, ok := values[0].(string)
+	if !ok {
+		return nil, 0, nil
+	}
 	var doc crdt.RoomDoc
 	if err := json.Unmarshal([]byte(payload), &doc); err != nil {
 		return nil, 0, err
 	}
-	seq, _ := s.Client.Get(ctx, s.seqKey(roomID)).Int64()
+	seqValue, ok := values[1].(string)
+	if !ok {
+		seqValue, _ = values[2].(string)
+	}
+	seq, _ := strconv.ParseInt(seqValue, 10, 64)
 	return &doc, seq, nil
 }
 
+// saveSnapshotScript writes the snapshot unless a newer one is already stored,
+// and raises the seq counter to the snapshot's seq without ever lowering it: a
+// stale seq would make INCR hand out numbers that are already in the op log.
+//
+// KEYS: snapshot, snapshot_seq, seq, ops. ARGV: snapshot JSON, seq, ttl seconds.
+var saveSnapshotScript = redis.NewScript(`
+local ttl = tonumber(ARGV[3])
+local seq = tonumber(ARGV[2])
+local stored = redis.call('GET', KEYS[2])
+if stored and redis.call('EXISTS', KEYS[1]) == 1 and tonumber(stored) > seq then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ttl)
+redis.call('SET', KEYS[2], seq, 'EX', ttl)
+local current = tonumber(redis.call('GET', KEYS[3]) or '0')
+if seq > current then
+  redis.call('SET', KEYS[3], seq, 'EX', ttl)
+else
+  redis.call('EXPIRE', KEYS[3], ttl)
+end
+redis.call('EXPIRE', KEYS[4], ttl)
+return 1
+`)
+
+// appendOpScript assigns the next seq and pushes the op in one step, so the
+// ops list is always in strict seq order with no gaps. The op JSON is spliced
+// in verbatim rather than round-tripped through cjson, which would mangle
+// payloads (empty arrays, large integers).
+//
+// KEYS: seq, ops, snapshot, snapshot_seq. ARGV: op JSON, ttl seconds.
+var appendOpScript = redis.NewScript(`
+local ttl = tonumber(ARGV[2])
+local seq = redis.call('INCR', KEYS[1])
+redis.call('RPUSH', KEYS[2], '{"seq":' .. seq .. ',"op":' .. ARGV[1] .. '}')
+for i = 1, #KEYS do
+  redis.call('EXPIRE', KEYS[i], ttl)
+end
+return seq
+`)
+
+// appendOpsScript is appendOpScript for several ops, which get consecutive
+// seqs. It returns the last one.
+//
+// KEYS: seq, ops, snapshot, snapshot_seq. ARGV: ttl seconds, op JSON...
+var appendOpsScript = redis.NewScript(`
+local ttl = tonumber(ARGV[1])
+local count = #ARGV - 1
+local last = redis.call('INCRBY', KEYS[1], count)
+for i = 2, #ARGV do
+  redis.call('RPUSH', KEYS[2], '{"seq":' .. (last - count + i - 1) .. ',"op":' .. ARGV[i] .. '}')
+end
+for i = 1, #KEYS do
+  redis.call('EXPIRE', KEYS[i], ttl)
+end
+return last
+`)
+
+// loadOpsScript returns the tail of the ops list after fromSeq. Seqs are
+// contiguous and the list ends at the current seq, so the entries after
+// fromSeq are at most the last (seq - fromSeq) elements (fewer once trimmed).
+//
+// KEYS: seq, ops. ARGV: fromSeq.
+var loadOpsScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local count = current - tonumber(ARGV[1])
+if count <= 0 then
+  return {}
+end
+return redis.call('LRANGE', KEYS[2], -count, -1)
+`)
+
+// trimOpsScript keeps only the entries after throughSeq, using the same
+// tail arithmetic as loadOpsScript.
+//
+// KEYS: seq, ops. ARGV: throughSeq.
+var trimOpsScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local keep = current - tonumber(ARGV[1])
+if keep <= 0 then
+  redis.call('DEL', KEYS[2])
+else
+  redis.call('LTRIM', KEYS[2], -keep, -1)
+end
+return 1
+`)
+
+func (s *Store) ttlSeconds() int64 {
+	seconds := int64(s.TTL / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
 func (s *Store) SaveSnapshot(ctx context.Context, roomID string, doc *crdt.RoomDoc, seq int64) error {
 	payload, err := json.Marshal(doc)
 	if err != nil {
 		return err
 	}
-	pipe := s.Client.TxPipeline()
-	pipe.Set(ctx, s.snapshotKey(roomID), payload, s.TTL)
-	pipe.Set(ctx, s.seqKey(roomID), seq, s.TTL)
-	pipe.Expire(ctx, s.opsKey(roomID), s.TTL)
-	_, err = pipe.Exec(ctx)
-	return err
+	keys := []string{s.snapshotKey(roomID), s.snapshotSeqKey(roomID), s.seqKey(roomID), s.opsKey(roomID)}
+	return saveSnapshotScript.Run(ctx, s.Client, keys, payload, seq, s.ttlSeconds()).Err()
 }
 
 func (s *Store) AppendOp(ctx context.Context, roomID string, op crdt.Op) (int64, error) {
-	seq, err := s.Client.Incr(ctx, s.seqKey(roomID)).Result()
+	payload, err := json.Marshal(op)
 	if err != nil {
 		return 0, err
 	}
-	wrapper := map[string]any{
-		"seq": seq,
-		"op":  op,
+	keys := []string{s.seqKey(roomID), s.opsKey(roomID), s.snapshotKey(roomID), s.snapshotSeqKey(roomID)}
+	seq, err := appendOpScript.Run(ctx, s.Client, keys, payload, s.ttlSeconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("append op room=%s: %w", roomID, err)
 	}
-	payload, err := json.Marshal(wrapper)
+	return seq, nil
+}
+
+func (s *Store) AppendOps(ctx context.Context, roomID string, ops []crdt.Op) (int64, error) {
+	if len(ops) == 0 {
+		return 0, fmt.Errorf("append ops room=%s: no ops", roomID)
+	}
+	args := make([]any, 0, len(ops)+1)
+	args = append(args, s.ttlSeconds())
+	for _, op := range ops {
+		payload, err := json.Marshal(op)
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, payload)
+	}
+	keys := []string{s.seqKey(roomID), s.opsKey(roomID), s.snapshotKey(roomID), s.snapshotSeqKey(roomID)}
+	seq, err := appendOpsScript.Run(ctx, s.Client, keys, args...).Int64()
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("append ops room=%s: %w", roomID, err)
 	}
-	pipe := s.Client.TxPipeline()
-	pipe.RPush(ctx, s.opsKey(roomID), payload)
-	pipe.Expire(ctx, s.opsKey(roomID), s.TTL)
-	pipe.Expire(ctx, s.seqKey(roomID), s.TTL)
-	pipe.Exec(ctx)
 	return seq, nil
 }
 
@@ -95,33 +220,40 @@ func (s *Store) CurrentSeq(ctx context.Context, roomID string) (int64, error) {
 	return val, err
 }
 
-func (s *Store) LoadOps(ctx context.Context, roomID string, fromSeq int64) ([]crdt.Op, error) {
-	values, err := s.Client.LRange(ctx, s.opsKey(roomID), 0, -1).Result()
+func (s *Store) LoadOps(ctx context.Context, roomID string, fromSeq int64) ([]storage.OpEntry, error) {
+	keys := []string{s.seqKey(roomID), s.opsKey(roomID)}
+	values, err := loadOpsScript.Run(ctx, s.Client, keys, fromSeq).StringSlice()
 	if err == redis.Nil {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	ops := []crdt.Op{}
+	entries := make([]storage.OpEntry, 0, len(values))
 	for _, value := range values {
-		var wrapper struct {
-			Seq int64   `json:"seq"`
-			Op  crdt.Op `json:"op"`
-		}
-		if err := json.Unmarshal([]byte(value), &wrapper); err != nil {
+		var entry storage.OpEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
 			continue
 		}
-		if wrapper.Seq > fromSeq {
-			ops = append(ops, wrapper.Op)
+		// Lists written before appends were atomic can have gaps, so the tail
+		// may reach back past fromSeq.
+		if entry.Seq > fromSeq {
+			entries = append(entries, entry)
 		}
 	}
-	return ops, nil
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries, nil
+}
+
+func (s *Store) TrimOps(ctx context.Context, roomID string, throughSeq int64) error {
+	keys := []string{s.seqKey(roomID), s.opsKey(roomID)}
+	return trimOpsScript.Run(ctx, s.Client, keys, throughSeq).Err()
 }
 
 func (s *Store) TouchRoom(ctx context.Context, roomID string) {
 	pipe := s.Client.TxPipeline()
 	pipe.Expire(ctx, s.snapshotKey(roomID), s.TTL)
+	pipe.Expire(ctx, s.snapshotSeqKey(roomID), s.TTL)
 	pipe.Expire(ctx, s.seqKey(roomID), s.TTL)
 	pipe.Expire(ctx, s.opsKey(roomID), s.TTL)
 	pipe.Exec(ctx)
@@ -136,3 +268,43 @@ func (s *Store) SnapshotTTL(ctx context.Context, roomID string) (time.Duration,
 	}
 	return ttl, nil
 }
+
+// LoadLedger returns the stored ledger, or nil if it does not exist.
+func (s *Store) LoadLedger(ctx context.Context, ledgerID string) (*ledger.Ledger, error) {
+	payload, err := s.Client.Get(ctx, s.ledgerKey(ledgerID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var l ledger.Ledger
+	if err := json.Unmarshal([]byte(payload), &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// SaveLedger writes a ledger with its own TTL; ledgers outlive the rooms they group.
+func (s *Store) SaveLedger(ctx context.Context, l *ledger.Ledger, ttl time.Duration) error {
+	payload, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return s.Client.Set(ctx, s.ledgerKey(l.ID), payload, ttl).Err()
+}
+
+func (s *Store) GetCached(ctx context.Context, key string) (string, bool, error) {
+	value, err := s.Client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (s *Store) SetCached(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.Client.Set(ctx, key, value, ttl).Err()
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/archive"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+var errArchiveDisabled = errors.New("room archive is not configured")
+
+type RoomArchiveResponse struct {
+	RoomCode    string `json:"room_code"`
+	Seq         int64  `json:"seq"`
+	ArchivedAt  int64  `json:"archived_at"`
+	FinalizedAt int64  `json:"finalized_at,omitempty"`
+}
+
+// handleFinalizeRoom archives a room immediately and marks it finalized, for
+// when the group is done rather than waiting for everyone to disconnect.
+func (s *Server) handleFinalizeRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	roomCode := strings.ToUpper(strings.TrimSpace(r.PathValue("code")))
+	if roomCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	if !s.hub.restoreRoom(ctx, roomCode) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	record, err := s.hub.archiveRoom(ctx, roomCode, true)
+	if errors.Is(err, errArchiveDisabled) {
+		w.WriteHeader(http.StatusNotImplemented)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil || record == nil {
+		log.Printf("room finalize failed room=%s err=%v", roomCode, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, RoomArchiveResponse{
+		RoomCode:    roomCode,
+		Seq:         record.Seq,
+		ArchivedAt:  record.ArchivedAt,
+		FinalizedAt: record.FinalizedAt,
+	})
+}
+
+// restoreRoom makes sure a room is live in the store, reloading its archived
+// snapshot if the live keys have expired. It reports whether the room exists.
+func (h *Hub) restoreRoom(ctx context.Context, roomID string) bool {
+	snapshot, _, err := h.store.LoadSnapshot(ctx, roomID)
+	if err != nil {
+		return false
+	}
+	if snapshot != nil {
+		return true
+	}
+	if h.archive == nil {
+		return false
+	}
+	record, err := h.archive.Load(ctx, roomID)
+	if err != nil {
+		if !errors.Is(err, archive.ErrInvalidRoomID) {
+			log.Printf("room archive load failed room=%s err=%v", roomID, err)
+		}
+		return false
+	}
+	if record == nil || record.Doc == nil {
+		return false
+	}
+	// Restoring at the archived seq keeps seq numbering continuous with the
+	// archived op log, so later archives simply append to it.
+	if err := h.store.SaveSnapshot(ctx, roomID, record.Doc, record.Seq); err != nil {
+		log.Printf("room restore failed room=%s err=%v", roomID, err)
+		return false
+	}
+	log.Printf("room restored from archive room=%s seq=%d archived_at=%d", roomID, record.Seq, record.ArchivedAt)
+	return true
+}
+
+// archiveRoom writes the room's current doc and any ops not yet archived to
+// the archive. It returns a nil record when the room has neither live state nor
+// an existing archive entry.
+func (h *Hub) archiveRoom(ctx context.Context, roomID string, finalize bool) (*archive.Record, error) {
+	if h.archive == nil {
+		return nil, errArchiveDisabled
+	}
+	h.archiveMu.Lock()
+	defer h.archiveMu.Unlock()
+
+	previous, err := h.archive.Load(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, _, err := h.store.LoadSnapshot(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	if snapshot == nil {
+		if previous != nil && finalize && previous.FinalizedAt == 0 {
+			previous.FinalizedAt = now
+			return previous, h.archive.Save(ctx, previous)
+		}
+		return previous, nil
+	}
+
+	doc, seq := h.loadDoc(ctx, roomID)
+	record := &archive.Record{RoomID: roomID, Seq: seq, Doc: doc, Ops: []storage.OpEntry{}, ArchivedAt: now}
+	archivedSeq := int64(0)
+	if previous != nil {
+		record.Ops = previous.Ops
+		record.FinalizedAt = previous.FinalizedAt
+		archivedSeq = previous.Seq
+	}
+	if seq > archivedSeq {
+		entries, err := h.store.LoadOps(ctx, roomID, archivedSeq)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 && entries[0].Seq > archivedSeq+1 {
+			log.Printf("room archive gap room=%s archived_seq=%d first_retained=%d", roomID, archivedSeq, entries[0].Seq)
+		}
+		for _, entry := range entries {
+			// Ops past seq were appended after the doc was folded and belong to the next archive.
+			if entry.Seq > seq {
+				break
+			}
+			record.Ops = append(record.Ops, entry)
+		}
+	}
+	if finalize && record.FinalizedAt == 0 {
+		record.FinalizedAt = now
+	}
+	if err := h.archive.Save(ctx, record); err != nil {
+		return nil, err
+	}
+	log.Printf("room archived room=%s seq=%d ops=%d finalized=%v", roomID, record.Seq, len(record.Ops), record.FinalizedAt != 0)
+	return record, nil
+}
+
+// roomCodeTaken reports whether a code is in use live or in the archive, so a
+// new room never inherits an old bill's history.
+func (h *Hub) roomCodeTaken(ctx context.Context, roomID string) bool {
+	if snapshot, _, err := h.store.LoadSnapshot(ctx, roomID); err != nil || snapshot != nil {
+		return true
+	}
+	if h.archive == nil {
+		return false
+	}
+	record, err := h.archive.Load(ctx, roomID)
+	return err != nil || record != nil
+}
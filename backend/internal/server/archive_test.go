@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/archive"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+func TestRoomIsArchivedWhenIdleAndRestoredAfterExpiry(t *testing.T) {
+	now := time.Now()
+	store := memstore.New(time.Hour)
+	store.Now = func() time.Time { return now }
+	archiveStore, err := archive.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour}, store, HubOptions{Archive: archiveStore})
+	ts := httptest.NewServer(srv.Routes())
+	defer ts.Close()
+
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, conn, "snapshot")
+	tax := 250
+	payload, _ := json.Marshal(crdt.TaxTipPayload{TaxCents: &tax})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{ActorID: created.UserID, Kind: "set_tax_tip", Payload: payload}})
+	readUntil(t, conn, "ack")
+	conn.Close()
+
+	var record *archive.Record
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		// The idle archive is the one written after the creator was marked absent.
+		record, _ = archiveStore.Load(context.Background(), created.RoomCode)
+		if record != nil && record.Doc.TaxCents == 250 && !record.Doc.Participants[created.UserID].Present {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if record == nil || record.Doc.TaxCents != 250 || record.Doc.Participants[created.UserID].Present {
+		t.Fatalf("expected idle room to be archived, got %#v", record)
+	}
+	if len(record.Ops) < 2 {
+		t.Fatalf("expected archived op log, got %d ops", len(record.Ops))
+	}
+
+	// Let the live keys expire, then rejoin.
+	now = now.Add(2 * time.Hour)
+	if snapshot, _, _ := store.LoadSnapshot(context.Background(), created.RoomCode); snapshot != nil {
+		t.Fatal("expected live room to expire")
+	}
+	body, _ := json.Marshal(JoinRoomRequest{RoomCode: created.RoomCode, Name: "Bob"})
+	resp, err := http.Post(ts.URL+"/api/join-room", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected join to restore the archived room, got %d", resp.StatusCode)
+	}
+	doc, seq := srv.hub.loadDoc(context.Background(), created.RoomCode)
+	if doc.TaxCents != 250 || len(doc.Participants) != 2 {
+		t.Fatalf("expected restored doc plus new participant, got tax=%d participants=%d", doc.TaxCents, len(doc.Participants))
+	}
+	if seq != record.Seq+1 {
+		t.Fatalf("expected seq to continue from archive %d, got %d", record.Seq, seq)
+	}
+}
+
+func TestFinalizeRoom(t *testing.T) {
+	archiveStore, err := archive.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour}, memstore.New(time.Hour), HubOptions{Archive: archiveStore})
+	ts := httptest.NewServer(srv.Routes())
+	defer ts.Close()
+
+	created := createTestRoom(t, ts, "Alice")
+	resp, err := http.Post(ts.URL+"/api/rooms/"+created.RoomCode+"/finalize", "application/json", nil)
+	if err != nil {
+		t.Fatalf("finalize: %v", err)
+	}
+	defer resp.Body.Close()
+	var out RoomArchiveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	// Creating a room logs its settings and its creator.
+	if out.FinalizedAt == 0 || out.Seq != 2 {
+		t.Fatalf("expected finalized archive at seq 2, got %#v", out)
+	}
+
+	resp, err = http.Post(ts.URL+"/api/rooms/NOPE42/finalize", "application/json", nil)
+	if err != nil {
+		t.Fatalf("finalize missing: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown room, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+func newSignedTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	config := Config{
+		RoomTTL:            time.Hour,
+		JoinTokenKey:       "test-key",
+		CorsAllowedOrigins: []string{"https://split.example"},
+	}
+	srv := NewServerWithStore(config, memstore.New(time.Hour), HubOptions{})
+	ts := httptest.NewServer(srv.Routes())
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+func TestWSRejectsBadJoinToken(t *testing.T) {
+	_, ts := newSignedTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+
+	_, resp, err := websocket.DefaultDialer.Dial(testWSURL(ts, created.RoomCode, created.UserID, "forged"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a forged token, got resp=%v err=%v", resp, err)
+	}
+	// A token is only good for the room it was issued for.
+	other := createTestRoom(t, ts, "Bob")
+	_, resp, err = websocket.DefaultDialer.Dial(testWSURL(ts, other.RoomCode, created.UserID, created.JoinToken), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for another room's token, got resp=%v err=%v", resp, err)
+	}
+}
+
+func TestWSHelloAuthenticatesSocket(t *testing.T) {
+	_, ts := newSignedTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/" + created.RoomCode
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteJSON(wsHello{Type: "hello", UserID: created.UserID, JoinToken: created.JoinToken})
+	if msg := readUntil(t, conn, "snapshot"); msg.Doc == nil {
+		t.Fatalf("expected snapshot after hello, got %s", msg.Raw)
+	}
+
+	intruder, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer intruder.Close()
+	intruder.SetReadDeadline(time.Now().Add(5 * time.Second))
+	intruder.WriteJSON(wsHello{Type: "hello", UserID: created.UserID, JoinToken: "forged"})
+	_, _, err = intruder.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected policy violation close, got %v", err)
+	}
+}
+
+func TestWSRejectsOpsForOtherParticipants(t *testing.T) {
+	srv, ts := newSignedTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, conn, "snapshot")
+	before, _ := srv.store.CurrentSeq(context.Background(), created.RoomCode)
+
+	tax := 100
+	payload, _ := json.Marshal(crdt.TaxTipPayload{TaxCents: &tax})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{ID: "spoofed", ActorID: "someone-else", Kind: "set_tax_tip", Payload: payload}})
+	rejected := readUntil(t, conn, "reject")
+	if !strings.Contains(string(rejected.Raw), `"op_id":"spoofed"`) {
+		t.Fatalf("expected reject for the spoofed op, got %s", rejected.Raw)
+	}
+	if after, _ := srv.store.CurrentSeq(context.Background(), created.RoomCode); after != before {
+		t.Fatalf("spoofed op was appended: seq %d -> %d", before, after)
+	}
+
+	// Ops without an actor are attributed to the connected participant.
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "set_tax_tip", Payload: payload}})
+	if op := readUntil(t, conn, "op"); op.Op == nil || op.Op.ActorID != created.UserID {
+		t.Fatalf("expected op attributed to %s, got %s", created.UserID, op.Raw)
+	}
+}
+
+func TestWSEnforcesOriginAllowlist(t *testing.T) {
+	_, ts := newSignedTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	url := testWSURL(ts, created.RoomCode, created.UserID, created.JoinToken)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for an unlisted origin, got resp=%v err=%v", resp, err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://split.example"}})
+	if err != nil {
+		t.Fatalf("allowlisted origin: %v", err)
+	}
+	conn.Close()
+}
+
+func TestJoinRoomRequiresTokenToRejoinAsParticipant(t *testing.T) {
+	_, ts := newSignedTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	join := func(req JoinRoomRequest) (int, JoinRoomResponse) {
+		t.Helper()
+		req.RoomCode = created.RoomCode
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(ts.URL+"/api/join-room", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatalf("join room: %v", err)
+		}
+		defer resp.Body.Close()
+		var joined JoinRoomResponse
+		json.NewDecoder(resp.Body).Decode(&joined)
+		return resp.StatusCode, joined
+	}
+
+	if status, _ := join(JoinRoomRequest{Name: "Mallory", UserID: created.UserID}); status != http.StatusUnauthorized {
+		t.Fatalf("expected a token-less rejoin as Alice refused, got %d", status)
+	}
+	if status, _ := join(JoinRoomRequest{Name: "Mallory", UserID: created.UserID, Token: "forged"}); status != http.StatusUnauthorized {
+		t.Fatalf("expected a forged rejoin refused, got %d", status)
+	}
+	// The same name no longer picks up Alice's identity.
+	if status, joined := join(JoinRoomRequest{Name: "Alice"}); status != http.StatusOK || joined.UserID == created.UserID {
+		t.Fatalf("expected a new participant for a matching name, got %d %s", status, joined.UserID)
+	}
+	if status, joined := join(JoinRoomRequest{Name: "Alice", UserID: created.UserID, Token: created.JoinToken}); status != http.StatusOK || joined.UserID != created.UserID {
+		t.Fatalf("expected Alice to rejoin with her token, got %d %s", status, joined.UserID)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/settlement"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+// maxBatchOps caps one batch message; a long receipt is a few dozen items.
+const maxBatchOps = 500
+
+// handleBatch applies a client's ops atomically (see applyBatch) and acks or
+// rejects the whole batch.
+func (h *Hub) handleBatch(ctx context.Context, c *client, roomID, actorID, batchID string, ops []crdt.Op) {
+	start := time.Now()
+	seq, err := h.applyBatch(ctx, roomID, actorID, ops)
+	var rejection *batchRejection
+	if errors.As(err, &rejection) {
+		rejectBatch(c, roomID, actorID, batchID, rejection.opID, rejection.reason)
+		return
+	}
+	if err != nil {
+		log.Printf("ws batch append failed room=%s actor=%s ops=%d err=%v", roomID, actorID, len(ops), err)
+		return
+	}
+	c.sendJSON(map[string]any{"type": "ack", "seq": seq, "batch_id": batchID})
+	log.Printf("ws batch room=%s seq=%d actor=%s ops=%d total_ms=%d", roomID, seq, actorID, len(ops), time.Since(start).Milliseconds())
+}
+
+// batchRejection is a batch that failed validation; nothing was appended.
+type batchRejection struct {
+	opID   string
+	reason string
+}
+
+func (r *batchRejection) Error() string { return r.reason }
+
+// applyBatch applies ops as one edit by actorID: each is checked against the
+// doc with the ones before it applied, and if any fails none are appended
+// (the error is a *batchRejection). The batch lands as one seq range with one
+// snapshot and one broadcast, and is undone as a single edit. It returns the
+// last seq.
+func (h *Hub) applyBatch(ctx context.Context, roomID, actorID string, ops []crdt.Op) (int64, error) {
+	if len(ops) == 0 || len(ops) > maxBatchOps {
+		return 0, &batchRejection{reason: fmt.Sprintf("a batch must carry between 1 and %d ops", maxBatchOps)}
+	}
+	doc, docSeq := h.loadDoc(ctx, roomID)
+	var inverse []crdt.Op
+	for i := range ops {
+		op := &ops[i]
+		if op.ActorID == "" {
+			op.ActorID = actorID
+		}
+		if op.ActorID != actorID {
+			return 0, &batchRejection{opID: op.ID, reason: "op actor_id does not match the connected participant"}
+		}
+		if op.ID == "" {
+			op.ID = uuid.NewString()
+		}
+		if op.Timestamp == 0 {
+			op.Timestamp = time.Now().UnixMilli()
+		}
+		if err := validateOp(doc, *op); err != nil {
+			return 0, &batchRejection{opID: op.ID, reason: err.Error()}
+		}
+		h.stampOp(op)
+		inverse = append(crdt.Inverse(doc, *op), inverse...)
+		crdt.ApplyOp(doc, *op)
+	}
+	seq, err := h.commitOps(ctx, roomID, doc, docSeq, ops)
+	if err != nil {
+		return 0, err
+	}
+	h.recordEdit(roomID, actorID, inverse)
+	return seq, nil
+}
+
+func rejectBatch(c *client, roomID, actorID, batchID, opID, reason string) {
+	log.Printf("ws batch rejected room=%s actor=%s batch_id=%s op_id=%s reason=%q", roomID, actorID, batchID, opID, reason)
+	c.sendJSON(map[string]any{"type": "reject", "batch_id": batchID, "op_id": opID, "reason": reason})
+}
+
+// commitOps appends ops, already stamped and applied to doc (loaded at
+// docSeq), as one seq range, then snapshots and broadcasts once: a single op
+// goes out as "op", several as one "ops" message. It returns the last seq.
+func (h *Hub) commitOps(ctx context.Context, roomID string, doc *crdt.RoomDoc, docSeq int64, ops []crdt.Op) (int64, error) {
+	last, err := h.store.AppendOps(ctx, roomID, ops)
+	if err != nil {
+		return 0, err
+	}
+	first := last - int64(len(ops)) + 1
+	// doc is only the state through last if nobody else appended in between.
+	if first == docSeq+1 {
+		h.afterAppend(ctx, roomID, doc, last)
+	} else {
+		h.afterAppend(ctx, roomID, nil, last)
+	}
+	if len(ops) == 1 {
+		h.broadcast(roomID, map[string]any{"type": "op", "seq": last, "op": ops[0]})
+	} else {
+		entries := make([]storage.OpEntry, len(ops))
+		for i, op := range ops {
+			entries[i] = storage.OpEntry{Seq: first + int64(i), Op: op}
+		}
+		h.broadcast(roomID, map[string]any{"type": "ops", "from_seq": first - 1, "seq": last, "ops": entries})
+	}
+	if len(doc.Payers) > 0 {
+		h.broadcast(roomID, map[string]any{"type": "settlement", "seq": last, "settlement": settlement.PlanRoom(doc)})
+	}
+	return last, nil
+}
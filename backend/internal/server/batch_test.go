@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+func itemOp(t *testing.T, item crdt.Item) crdt.Op {
+	t.Helper()
+	payload, err := json.Marshal(crdt.ItemPayload{Item: item})
+	if err != nil {
+		t.Fatalf("marshal item: %v", err)
+	}
+	return crdt.Op{Kind: "set_item", Payload: payload}
+}
+
+func TestBatchLandsAsOneSeqRangeAndOneBroadcast(t *testing.T) {
+	_, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	bob := joinTestRoom(t, ts, created.RoomCode, "Bob")
+	alice := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	start := readUntil(t, alice, "snapshot").Seq
+	bobConn := dialTestRoom(t, ts, created.RoomCode, bob.UserID, bob.JoinToken)
+	readUntil(t, bobConn, "snapshot")
+
+	alice.WriteJSON(map[string]any{"type": "batch", "id": "receipt", "ops": []crdt.Op{
+		itemOp(t, crdt.Item{ID: "pho", Name: "Pho", Quantity: 1, LinePriceCents: 1500}),
+		itemOp(t, crdt.Item{ID: "tea", Name: "Thai tea", Quantity: 2, LinePriceCents: 900}),
+		itemOp(t, crdt.Item{ID: "rolls", Name: "Spring rolls", Quantity: 1, LinePriceCents: 800}),
+	}})
+
+	var broadcast struct {
+		FromSeq int64             `json:"from_seq"`
+		Seq     int64             `json:"seq"`
+		Ops     []storage.OpEntry `json:"ops"`
+	}
+	json.Unmarshal(readUntil(t, bobConn, "ops").Raw, &broadcast)
+	if len(broadcast.Ops) != 3 || broadcast.Seq != broadcast.FromSeq+3 {
+		t.Fatalf("expected three ops in one contiguous range, got %+v", broadcast)
+	}
+	for i, entry := range broadcast.Ops {
+		if entry.Seq != broadcast.FromSeq+int64(i)+1 || entry.Op.ActorID != created.UserID || entry.Op.Clock == nil {
+			t.Fatalf("unexpected entry %d: %+v", i, entry)
+		}
+	}
+	ack := readUntil(t, alice, "ack")
+	if ack.Seq != broadcast.Seq || !strings.Contains(string(ack.Raw), `"batch_id":"receipt"`) {
+		t.Fatalf("expected an ack for the batch at seq %d, got %s", broadcast.Seq, ack.Raw)
+	}
+	if broadcast.FromSeq < start {
+		t.Fatalf("batch started at %d, before the snapshot at %d", broadcast.FromSeq, start)
+	}
+	if items := resyncItems(t, alice); len(items) != 3 {
+		t.Fatalf("expected all three items, got %+v", items)
+	}
+
+	// One batch is one edit to undo.
+	alice.WriteJSON(map[string]any{"type": "undo"})
+	readUntil(t, alice, "ack")
+	if items := resyncItems(t, alice); len(items) != 0 {
+		t.Fatalf("expected undo to remove the whole batch, got %+v", items)
+	}
+}
+
+func TestBatchIsRejectedWholeWhenOneOpFails(t *testing.T) {
+	_, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	before := readUntil(t, conn, "snapshot").Seq
+
+	bad := itemOp(t, crdt.Item{ID: "tea", Name: "Thai tea", Quantity: 1})
+	bad.ID = "bad-op"
+	bad.Payload = json.RawMessage(`{"item":{"id":"tea","quantity":-1}}`)
+	conn.WriteJSON(map[string]any{"type": "batch", "id": "receipt", "ops": []crdt.Op{
+		itemOp(t, crdt.Item{ID: "pho", Name: "Pho", Quantity: 1}),
+		bad,
+	}})
+	reject := readUntil(t, conn, "reject")
+	if !strings.Contains(string(reject.Raw), `"batch_id":"receipt"`) || !strings.Contains(string(reject.Raw), `"op_id":"bad-op"`) {
+		t.Fatalf("expected the batch rejected at the bad op, got %s", reject.Raw)
+	}
+
+	conn.WriteJSON(map[string]any{"type": "resync", "last_seq": 0})
+	snapshot := readUntil(t, conn, "snapshot")
+	if snapshot.Seq != before || len(snapshot.Doc.Items) != 0 {
+		t.Fatalf("expected nothing appended, got seq %d items %+v", snapshot.Seq, snapshot.Doc.Items)
+	}
+}
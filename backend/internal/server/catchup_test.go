@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+type catchUpMessage struct {
+	Type    string            `json:"type"`
+	FromSeq int64             `json:"from_seq"`
+	Seq     int64             `json:"seq"`
+	Ops     []storage.OpEntry `json:"ops"`
+	Doc     *crdt.RoomDoc     `json:"doc"`
+}
+
+func sendTestTax(t *testing.T, conn *websocket.Conn, actorID string, cents int) int64 {
+	t.Helper()
+	payload, _ := json.Marshal(crdt.TaxTipPayload{TaxCents: &cents})
+	if err := conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{ActorID: actorID, Kind: "set_tax_tip", Payload: payload}}); err != nil {
+		t.Fatalf("write op: %v", err)
+	}
+	return readUntil(t, conn, "ack").Seq
+}
+
+func readCatchUp(t *testing.T, conn *websocket.Conn) catchUpMessage {
+	t.Helper()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var msg catchUpMessage
+		json.Unmarshal(data, &msg)
+		if msg.Type == "ops" || msg.Type == "snapshot" {
+			return msg
+		}
+	}
+}
+
+func TestReconnectWithLastSeqGetsOnlyMissedOps(t *testing.T) {
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour, Compaction: CompactionPolicy{SnapshotEveryOps: 2, RetainOps: 3}}, memstore.New(time.Hour), HubOptions{})
+	ts := httptest.NewServer(srv.Routes())
+	defer ts.Close()
+	created := createTestRoom(t, ts, "Alice")
+
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	if first := readCatchUp(t, conn); first.Type != "snapshot" {
+		t.Fatalf("expected snapshot on first connect, got %s", first.Type)
+	}
+	lastSeen := sendTestTax(t, conn, created.UserID, 100)
+	sendTestTax(t, conn, created.UserID, 200)
+	latest := sendTestTax(t, conn, created.UserID, 300)
+
+	url := testWSURL(ts, created.RoomCode, created.UserID, created.JoinToken) + "&last_seq=" + strconv.FormatInt(lastSeen, 10)
+	other, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer other.Close()
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	delta := readCatchUp(t, other)
+	if delta.Type != "ops" || delta.FromSeq != lastSeen || delta.Seq != latest || len(delta.Ops) != int(latest-lastSeen) {
+		t.Fatalf("expected ops %d..%d, got %#v", lastSeen+1, latest, delta)
+	}
+	if delta.Ops[0].Seq != lastSeen+1 {
+		t.Fatalf("expected first op at %d, got %d", lastSeen+1, delta.Ops[0].Seq)
+	}
+
+	// Up to date: an empty delta.
+	other.WriteJSON(map[string]any{"type": "resync", "last_seq": latest})
+	if current := readCatchUp(t, other); current.Type != "ops" || len(current.Ops) != 0 || current.Seq != latest {
+		t.Fatalf("expected empty delta, got %#v", current)
+	}
+
+	// Push the early ops out of the retained tail; catching up from seq 1 needs a snapshot.
+	for i := 0; i < 6; i++ {
+		sendTestTax(t, conn, created.UserID, 400+i)
+	}
+	other.WriteJSON(map[string]any{"type": "resync", "last_seq": 1})
+	if fallback := readCatchUp(t, other); fallback.Type != "snapshot" || fallback.Doc == nil || fallback.Doc.TaxCents != 405 {
+		t.Fatalf("expected snapshot fallback, got %#v", fallback)
+	}
+
+	// A seq from the future (e.g. a recreated room) also gets a snapshot.
+	other.WriteJSON(map[string]any{"type": "resync", "last_seq": 999})
+	if ahead := readCatchUp(t, other); ahead.Type != "snapshot" {
+		t.Fatalf("expected snapshot for unknown seq, got %s", ahead.Type)
+	}
+}
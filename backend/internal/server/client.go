@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsSendBuffer is how many outbound messages a socket may have queued before
+// it is treated as a slow consumer and disconnected.
+const wsSendBuffer = 256
+
+// client is one websocket connection. Gorilla allows a single concurrent
+// writer, so every outbound message goes through send and is written by
+// writePump; nothing else writes to conn.
+type client struct {
+	conn *websocket.Conn
+	send chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newClient(conn *websocket.Conn, buffer int) *client {
+	return &client{
+		conn: conn,
+		send: make(chan []byte, buffer),
+		done: make(chan struct{}),
+	}
+}
+
+// enqueue queues a message without blocking. A full queue means the peer
+// isn't keeping up; the connection is closed rather than letting it stall
+// the room, and enqueue reports false.
+func (c *client) enqueue(message []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- message:
+		return true
+	default:
+		c.close()
+		return false
+	}
+}
+
+// sendJSON queues a reply to this socket only.
+func (c *client) sendJSON(payload any) bool {
+	message, err := json.Marshal(payload)
+	if err != nil {
+		return false
+	}
+	return c.enqueue(message)
+}
+
+// close shuts the connection down. Closing conn also fails the pending read in
+// HandleWS, which unregisters the client.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// writePump writes queued messages and keep-alive pings until the client is
+// closed or a write fails.
+func (c *client) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	defer c.close()
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
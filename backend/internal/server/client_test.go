@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+// testSocketPair returns the server and client ends of one websocket.
+func testSocketPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(ts.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn := <-serverConns
+	t.Cleanup(func() { conn.Close() })
+	return conn, peer
+}
+
+func TestSlowConsumerIsDisconnectedWithoutStallingRoom(t *testing.T) {
+	hub := NewHub(memstore.New(time.Hour), HubOptions{})
+	t.Cleanup(func() { close(hub.stopCh) })
+
+	stalledConn, stalledPeer := testSocketPair(t)
+	liveConn, livePeer := testSocketPair(t)
+	// The stalled client has no writer draining its one-slot queue.
+	stalled := newClient(stalledConn, 1)
+	live := newClient(liveConn, wsSendBuffer)
+	go live.writePump()
+	t.Cleanup(live.close)
+	hub.register("ROOM", stalled)
+	hub.register("ROOM", live)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			hub.deliver("ROOM", []byte(`{"type":"pong"}`))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("deliver blocked on a stalled client")
+	}
+
+	if !stalled.closed() {
+		t.Fatal("expected the stalled client to be disconnected")
+	}
+	if _, _, err := stalledPeer.ReadMessage(); err == nil {
+		t.Fatal("expected the stalled peer's connection to be closed")
+	}
+	for i := 0; i < 3; i++ {
+		if _, data, err := livePeer.ReadMessage(); err != nil || string(data) != `{"type":"pong"}` {
+			t.Fatalf("live peer message %d = %q, %v", i, data, err)
+		}
+	}
+	if live.closed() {
+		t.Fatal("live client should stay connected")
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+// CompactionPolicy controls how often room snapshots are written and how much
+// of the op log is kept behind them for client catch-up.
+type CompactionPolicy struct {
+	// SnapshotEveryOps snapshots once this many ops have landed since the last one.
+	SnapshotEveryOps int
+	// SnapshotInterval snapshots pending ops once the last snapshot is this old.
+	SnapshotInterval time.Duration
+	// RetainOps is how many ops are kept behind the snapshot; older ones are trimmed.
+	RetainOps int
+}
+
+// compactionState is this node's view of a room's snapshot. Another node may
+// snapshot the same room; the store ignores whichever save is older.
+type compactionState struct {
+	snapshotSeq int64
+	snapshotAt  time.Time
+	latestSeq   int64
+	trimmedSeq  int64
+}
+
+// noteSnapshot seeds the state for a room from a loaded snapshot.
+func (h *Hub) noteSnapshot(roomID string, seq int64) {
+	h.compactionMu.Lock()
+	defer h.compactionMu.Unlock()
+	if h.compaction[roomID] == nil {
+		h.compaction[roomID] = &compactionState{snapshotSeq: seq, snapshotAt: time.Now(), latestSeq: seq}
+	}
+}
+
+// noteOp records an appended op and reports whether a snapshot is due.
+func (h *Hub) noteOp(roomID string, seq int64) bool {
+	h.compactionMu.Lock()
+	defer h.compactionMu.Unlock()
+	state := h.compaction[roomID]
+	if state == nil {
+		state = &compactionState{snapshotAt: time.Now()}
+		h.compaction[roomID] = state
+	}
+	if seq > state.latestSeq {
+		state.latestSeq = seq
+	}
+	return h.snapshotDue(state, time.Now())
+}
+
+// snapshotDue reports whether state has pending ops past either cadence. Callers hold compactionMu.
+func (h *Hub) snapshotDue(state *compactionState, now time.Time) bool {
+	pending := state.latestSeq - state.snapshotSeq
+	if pending <= 0 {
+		return false
+	}
+	if h.policy.SnapshotEveryOps <= 1 || pending >= int64(h.policy.SnapshotEveryOps) {
+		return true
+	}
+	return h.policy.SnapshotInterval > 0 && now.Sub(state.snapshotAt) >= h.policy.SnapshotInterval
+}
+
+// afterAppend snapshots the room if the cadence says so. doc, when non-nil, must
+// be the room state through exactly seq; otherwise the doc is rebuilt.
+func (h *Hub) afterAppend(ctx context.Context, roomID string, doc *crdt.RoomDoc, seq int64) {
+	if !h.noteOp(roomID, seq) {
+		return
+	}
+	if doc == nil {
+		doc, seq = h.loadDoc(ctx, roomID)
+	}
+	h.snapshotRoom(ctx, roomID, doc, seq)
+}
+
+// snapshotRoom saves doc as the snapshot through seq and trims the op log behind
+// it once the trimmable backlog reaches RetainOps, so trims are amortized.
+func (h *Hub) snapshotRoom(ctx context.Context, roomID string, doc *crdt.RoomDoc, seq int64) {
+	if err := h.store.SaveSnapshot(ctx, roomID, doc, seq); err != nil {
+		log.Printf("room snapshot failed room=%s seq=%d err=%v", roomID, seq, err)
+		return
+	}
+	retain := int64(h.policy.RetainOps)
+	if retain < 0 {
+		retain = 0
+	}
+	throughSeq := seq - retain
+	h.compactionMu.Lock()
+	state := h.compaction[roomID]
+	if state == nil {
+		state = &compactionState{}
+		h.compaction[roomID] = state
+	}
+	if seq > state.snapshotSeq {
+		state.snapshotSeq = seq
+		state.snapshotAt = time.Now()
+	}
+	if seq > state.latestSeq {
+		state.latestSeq = seq
+	}
+	trim := throughSeq > state.trimmedSeq && (retain == 0 || throughSeq-state.trimmedSeq >= retain)
+	h.compactionMu.Unlock()
+	if !trim {
+		return
+	}
+
+	if h.archive != nil {
+		// Trimmed ops only survive in the archive, so bring it up to date first.
+		if _, err := h.archiveRoom(ctx, roomID, false); err != nil {
+			log.Printf("room archive before trim failed room=%s err=%v", roomID, err)
+			return
+		}
+	}
+	if err := h.store.TrimOps(ctx, roomID, throughSeq); err != nil {
+		log.Printf("room op trim failed room=%s through=%d err=%v", roomID, throughSeq, err)
+		return
+	}
+	h.compactionMu.Lock()
+	if throughSeq > state.trimmedSeq {
+		state.trimmedSeq = throughSeq
+	}
+	h.compactionMu.Unlock()
+}
+
+// flushSnapshots snapshots rooms whose pending ops have waited out the interval
+// and forgets rooms with no sockets once they are fully snapshotted.
+func (h *Hub) flushSnapshots(ctx context.Context) {
+	now := time.Now()
+	h.clientsMu.Lock()
+	active := map[string]bool{}
+	for roomID, conns := range h.clients {
+		if len(conns) > 0 {
+			active[roomID] = true
+		}
+	}
+	h.clientsMu.Unlock()
+
+	due := []string{}
+	h.compactionMu.Lock()
+	for roomID, state := range h.compaction {
+		if h.snapshotDue(state, now) || (!active[roomID] && state.latestSeq > state.snapshotSeq) {
+			due = append(due, roomID)
+		} else if !active[roomID] {
+			delete(h.compaction, roomID)
+		}
+	}
+	h.compactionMu.Unlock()
+
+	for _, roomID := range due {
+		h.flushSnapshot(ctx, roomID)
+	}
+}
+
+// flushSnapshot writes a snapshot if any ops are pending for the room.
+func (h *Hub) flushSnapshot(ctx context.Context, roomID string) {
+	h.compactionMu.Lock()
+	state := h.compaction[roomID]
+	pending := state != nil && state.latestSeq > state.snapshotSeq
+	h.compactionMu.Unlock()
+	if !pending {
+		return
+	}
+	doc, seq := h.loadDoc(ctx, roomID)
+	h.snapshotRoom(ctx, roomID, doc, seq)
+}
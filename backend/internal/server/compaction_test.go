@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+func appendTestItem(t *testing.T, h *Hub, roomID string, n int) int64 {
+	t.Helper()
+	payload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{
+		ID:             fmt.Sprintf("item-%d", n),
+		Name:           "Item",
+		Quantity:       1,
+		LinePriceCents: 100,
+		UpdatedAt:      int64(n),
+	}})
+	seq, err := h.store.AppendOp(context.Background(), roomID, crdt.Op{ID: fmt.Sprintf("op-%d", n), Kind: "set_item", Payload: payload})
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	h.afterAppend(context.Background(), roomID, nil, seq)
+	return seq
+}
+
+func TestCompactionSnapshotsEveryNOpsAndTrimsBehindRetainedTail(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New(time.Hour)
+	h := NewHub(store, HubOptions{Compaction: CompactionPolicy{SnapshotEveryOps: 3, SnapshotInterval: time.Hour, RetainOps: 2}})
+	store.SaveSnapshot(ctx, "ROOM", crdt.NewRoom("ROOM", "Dinner"), 0)
+
+	for i := 1; i <= 2; i++ {
+		appendTestItem(t, h, "ROOM", i)
+	}
+	if _, seq, _ := store.LoadSnapshot(ctx, "ROOM"); seq != 0 {
+		t.Fatalf("expected no snapshot before 3 ops, got seq %d", seq)
+	}
+	for i := 3; i <= 7; i++ {
+		appendTestItem(t, h, "ROOM", i)
+	}
+	snapshot, seq, _ := store.LoadSnapshot(ctx, "ROOM")
+	if seq != 6 || len(snapshot.Items) != 6 {
+		t.Fatalf("expected snapshot through seq 6 with 6 items, got seq %d items %d", seq, len(snapshot.Items))
+	}
+	entries, _ := store.LoadOps(ctx, "ROOM", 0)
+	if len(entries) != 3 || entries[0].Seq != 5 {
+		t.Fatalf("expected retained tail 5..7, got %#v", entries)
+	}
+
+	doc, docSeq := h.loadDoc(ctx, "ROOM")
+	if docSeq != 7 || len(doc.Items) != 7 {
+		t.Fatalf("expected doc through seq 7 with 7 items, got seq %d items %d", docSeq, len(doc.Items))
+	}
+}
+
+func TestCompactionFlushesPendingOpsAfterInterval(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New(time.Hour)
+	h := NewHub(store, HubOptions{Compaction: CompactionPolicy{SnapshotEveryOps: 100, SnapshotInterval: 20 * time.Millisecond, RetainOps: 100}})
+	store.SaveSnapshot(ctx, "ROOM", crdt.NewRoom("ROOM", "Dinner"), 0)
+	h.loadDoc(ctx, "ROOM")
+
+	appendTestItem(t, h, "ROOM", 1)
+	h.flushSnapshots(ctx)
+	// The room has no sockets, so pending ops are flushed right away.
+	if _, seq, _ := store.LoadSnapshot(ctx, "ROOM"); seq != 1 {
+		t.Fatalf("expected idle room to be flushed, got seq %d", seq)
+	}
+
+	h.register("ROOM", nil)
+	appendTestItem(t, h, "ROOM", 2)
+	h.flushSnapshots(ctx)
+	if _, seq, _ := store.LoadSnapshot(ctx, "ROOM"); seq != 1 {
+		t.Fatalf("expected active room to wait for the interval, got seq %d", seq)
+	}
+	time.Sleep(25 * time.Millisecond)
+	h.flushSnapshots(ctx)
+	if _, seq, _ := store.LoadSnapshot(ctx, "ROOM"); seq != 2 {
+		t.Fatalf("expected snapshot after interval, got seq %d", seq)
+	}
+}
+
+func TestJoinAndStatusReadOpsPastTheSnapshot(t *testing.T) {
+	ctx := context.Background()
+	config := Config{RoomTTL: time.Hour, Compaction: CompactionPolicy{SnapshotEveryOps: 100, SnapshotInterval: time.Hour}}
+	srv := NewServerWithStore(config, memstore.New(time.Hour), HubOptions{})
+	ts := httptest.NewServer(srv.Routes())
+	t.Cleanup(ts.Close)
+	created := createTestRoom(t, ts, "Alice")
+
+	// Alice adds her Venmo and an item lands; neither is in the snapshot yet.
+	appendTestItem(t, srv.hub, created.RoomCode, 1)
+	payload, _ := json.Marshal(crdt.ParticipantPayload{Participant: crdt.Participant{
+		ID: created.UserID, Name: "Alice", VenmoUsername: "alice-v", Present: true, UpdatedAt: time.Now().UnixMilli(),
+	}})
+	seq, _ := srv.store.AppendOp(ctx, created.RoomCode, crdt.Op{ID: "venmo", ActorID: created.UserID, Kind: "set_participant", Payload: payload})
+	srv.hub.afterAppend(ctx, created.RoomCode, nil, seq)
+	if snapshot, _, _ := srv.store.LoadSnapshot(ctx, created.RoomCode); len(snapshot.Items) != 0 {
+		t.Fatal("expected the snapshot to trail the log")
+	}
+
+	resp, err := http.Get(ts.URL + "/api/room-status?room_code=" + created.RoomCode)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var status RoomStatusResponse
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.TotalCents != 100 {
+		t.Fatalf("expected the status total to include the logged item, got %d", status.TotalCents)
+	}
+
+	body, _ := json.Marshal(JoinRoomRequest{RoomCode: created.RoomCode, Name: "Alice", UserID: created.UserID, Token: created.JoinToken})
+	resp, err = http.Post(ts.URL+"/api/join-room", "application/json", bytes.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("rejoin: %v %v", err, resp)
+	}
+	resp.Body.Close()
+	doc, _ := srv.hub.loadDoc(ctx, created.RoomCode)
+	if venmo := doc.Participants[created.UserID].VenmoUsername; venmo != "alice-v" {
+		t.Fatalf("expected the rejoin to keep Alice's newer Venmo, got %q", venmo)
+	}
+}
@@ -10,32 +10,56 @@ import (
 type Config struct {
 	Port               string
 	RedisURL           string
+	StoreBackend       string
+	ArchiveDir         string
 	SessionSecret      string
 	JoinTokenKey       string
 	CorsAllowedOrigins []string
 	RoomTTL            time.Duration
+	LedgerTTL          time.Duration
 	CookieSecure       bool
 	CookieDomain       string
 	OpenAIKey          string
 	GeminiKey          string
-	PublicBaseURL      string
-	ECBRatesURL        string
+	// ReceiptProviders and ReceiptRetryProviders are the receipt parser chains
+	// for standard and try-again parses, as "vendor[:model][@timeout]" specs.
+	ReceiptProviders      []string
+	ReceiptRetryProviders []string
+	PublicBaseURL         string
+	ECBRatesURL           string
+	Compaction            CompactionPolicy
+	ReceiptJobWorkers     int
+	// ReceiptCacheTTL is how long parse results are reused for the same image;
+	// zero turns the cache off.
+	ReceiptCacheTTL time.Duration
 }
 
 func LoadConfig() Config {
 	return Config{
-		Port:               getenv("BACKEND_PORT", "8080"),
-		RedisURL:           getenv("REDIS_URL", "redis://redis:6379/0"),
-		SessionSecret:      os.Getenv("SESSION_SECRET"),
-		JoinTokenKey:       os.Getenv("JOIN_TOKEN_SIGNING_KEY"),
-		CorsAllowedOrigins: splitCSV(os.Getenv("CORS_ALLOWED_ORIGINS")),
-		RoomTTL:            time.Duration(getenvInt("ROOM_TTL_SECONDS", 86400)) * time.Second, // default 24 hours
-		CookieSecure:       getenvBool("COOKIE_SECURE", true),
-		CookieDomain:       os.Getenv("COOKIE_DOMAIN"),
-		OpenAIKey:          os.Getenv("OPENAI_API_KEY"),
-		GeminiKey:          os.Getenv("GEMINI_API_KEY"),
-		PublicBaseURL:      getenv("PUBLIC_BASE_URL", "https://localhost"),
-		ECBRatesURL:        getenv("ECB_RATES_URL", "https://api.exchangerate.host/latest"),
+		Port:                  getenv("BACKEND_PORT", "8080"),
+		RedisURL:              getenv("REDIS_URL", "redis://redis:6379/0"),
+		StoreBackend:          getenv("STORE_BACKEND", "redis"),
+		ArchiveDir:            os.Getenv("ARCHIVE_DIR"),
+		SessionSecret:         os.Getenv("SESSION_SECRET"),
+		JoinTokenKey:          os.Getenv("JOIN_TOKEN_SIGNING_KEY"),
+		CorsAllowedOrigins:    splitCSV(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		RoomTTL:               time.Duration(getenvInt("ROOM_TTL_SECONDS", 86400)) * time.Second,     // default 24 hours
+		LedgerTTL:             time.Duration(getenvInt("LEDGER_TTL_SECONDS", 7776000)) * time.Second, // default 90 days
+		CookieSecure:          getenvBool("COOKIE_SECURE", true),
+		CookieDomain:          os.Getenv("COOKIE_DOMAIN"),
+		OpenAIKey:             os.Getenv("OPENAI_API_KEY"),
+		GeminiKey:             os.Getenv("GEMINI_API_KEY"),
+		ReceiptProviders:      splitCSV(os.Getenv("RECEIPT_PROVIDERS")),
+		ReceiptRetryProviders: splitCSV(os.Getenv("RECEIPT_RETRY_PROVIDERS")),
+		PublicBaseURL:         getenv("PUBLIC_BASE_URL", "https://localhost"),
+		ECBRatesURL:           getenv("ECB_RATES_URL", "https://api.exchangerate.host/latest"),
+		Compaction: CompactionPolicy{
+			SnapshotEveryOps: getenvInt("SNAPSHOT_EVERY_OPS", 50),
+			SnapshotInterval: time.Duration(getenvInt("SNAPSHOT_INTERVAL_MS", 2000)) * time.Millisecond,
+			RetainOps:        getenvInt("OP_LOG_RETAIN", 500),
+		},
+		ReceiptJobWorkers: getenvInt("RECEIPT_JOB_WORKERS", defaultReceiptJobWorkers),
+		ReceiptCacheTTL:   time.Duration(getenvInt("RECEIPT_CACHE_TTL_SECONDS", int(defaultReceiptCacheTTL/time.Second))) * time.Second,
 	}
 }
 
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+const (
+	presenceInterval = 5 * time.Second
+	// presenceTTL outlives a few missed heartbeats before another node's
+	// actors are treated as gone.
+	presenceTTL = 3 * presenceInterval
+)
+
+// busEnvelope tags a broadcast with the node that sent it, so the sender (which
+// already delivered to its own sockets) can skip its copy.
+type busEnvelope struct {
+	Node    string          `json:"node"`
+	Message json.RawMessage `json:"message"`
+}
+
+func (h *Hub) publish(roomID string, message []byte) {
+	if h.bus == nil {
+		return
+	}
+	payload, _ := json.Marshal(busEnvelope{Node: h.nodeID, Message: message})
+	if err := h.bus.Publish(h.baseCtx, roomID, payload); err != nil {
+		log.Printf("bus publish failed room=%s err=%v", roomID, err)
+	}
+}
+
+// consumeBus delivers messages published by other nodes to local sockets.
+func (h *Hub) consumeBus() {
+	for msg := range h.bus.Messages() {
+		var envelope busEnvelope
+		if err := json.Unmarshal(msg.Payload, &envelope); err != nil || envelope.Node == h.nodeID {
+			continue
+		}
+		h.observeClock(envelope.Message)
+		h.deliver(msg.RoomID, envelope.Message)
+	}
+}
+
+// observeClock keeps this node's HLC ahead of ops stamped on other nodes, so
+// an op handled here right after one handled there still wins LWW. Ops arrive
+// one at a time ("op") or as a batch ("ops").
+func (h *Hub) observeClock(message json.RawMessage) {
+	type stamped struct {
+		Clock *crdt.HLC `json:"clock"`
+	}
+	var peek struct {
+		Op  *stamped `json:"op"`
+		Ops []struct {
+			Op stamped `json:"op"`
+		} `json:"ops"`
+	}
+	if json.Unmarshal(message, &peek) != nil {
+		return
+	}
+	if peek.Op != nil && peek.Op.Clock != nil {
+		h.clock.Observe(*peek.Op.Clock)
+	}
+	for _, entry := range peek.Ops {
+		if entry.Op.Clock != nil {
+			h.clock.Observe(*entry.Op.Clock)
+		}
+	}
+}
+
+// syncSubscription subscribes to a room's bus channel while this node has
+// sockets in it. subsMu serializes the check with the (un)subscribe so a
+// connect racing a disconnect can't leave a busy room unsubscribed.
+func (h *Hub) syncSubscription(roomID string) {
+	if h.bus == nil {
+		return
+	}
+	h.subsMu.Lock()
+	defer h.subsMu.Unlock()
+	h.clientsMu.Lock()
+	want := len(h.clients[roomID]) > 0
+	h.clientsMu.Unlock()
+	if want == h.subscribed[roomID] {
+		return
+	}
+	var err error
+	if want {
+		err = h.bus.Subscribe(h.baseCtx, roomID)
+	} else {
+		err = h.bus.Unsubscribe(h.baseCtx, roomID)
+	}
+	if err != nil {
+		log.Printf("bus subscription failed room=%s subscribe=%v err=%v", roomID, want, err)
+		return
+	}
+	if want {
+		h.subscribed[roomID] = true
+	} else {
+		delete(h.subscribed, roomID)
+	}
+}
+
+// advertisePresence publishes the actors this node holds per room and clears
+// rooms it no longer has anyone in.
+func (h *Hub) advertisePresence(ctx context.Context, presence map[string]map[string]bool) {
+	if h.bus == nil {
+		return
+	}
+	h.subsMu.Lock()
+	stale := []string{}
+	for roomID := range h.advertised {
+		if len(presence[roomID]) == 0 {
+			stale = append(stale, roomID)
+		}
+	}
+	h.subsMu.Unlock()
+	for roomID, actors := range presence {
+		h.advertiseRoom(ctx, roomID, actors)
+	}
+	for _, roomID := range stale {
+		h.advertiseRoom(ctx, roomID, nil)
+	}
+}
+
+// advertiseLocal publishes the actors this node holds in a room right away,
+// rather than at the next presence tick, as sockets come and go.
+func (h *Hub) advertiseLocal(roomID string) {
+	if h.bus == nil {
+		return
+	}
+	h.advertiseRoom(h.baseCtx, roomID, h.localActors(roomID))
+}
+
+func (h *Hub) advertiseRoom(ctx context.Context, roomID string, actors map[string]bool) {
+	ids := make([]string, 0, len(actors))
+	for id := range actors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if err := h.bus.SetPresence(ctx, roomID, h.nodeID, ids, presenceTTL); err != nil {
+		log.Printf("bus presence failed room=%s err=%v", roomID, err)
+		return
+	}
+	h.subsMu.Lock()
+	if len(ids) > 0 {
+		h.advertised[roomID] = true
+	} else {
+		delete(h.advertised, roomID)
+	}
+	h.subsMu.Unlock()
+}
+
+// remoteActors returns the actors other nodes report as connected to a room.
+func (h *Hub) remoteActors(ctx context.Context, roomID string) (map[string]bool, error) {
+	out := map[string]bool{}
+	if h.bus == nil {
+		return out, nil
+	}
+	nodes, err := h.bus.RoomPresence(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	for nodeID, actors := range nodes {
+		if nodeID == h.nodeID {
+			continue
+		}
+		for _, actor := range actors {
+			out[actor] = true
+		}
+	}
+	return out, nil
+}
+
+// localActors returns the actors with a socket in the room on this node.
+func (h *Hub) localActors(roomID string) map[string]bool {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+	actors := map[string]bool{}
+	for c := range h.clients[roomID] {
+		if actor := h.connActor[c]; actor != "" {
+			actors[actor] = true
+		}
+	}
+	return actors
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+// newTestCluster starts two servers sharing one store and bus, standing in for
+// two backend nodes behind a load balancer.
+func newTestCluster(t *testing.T) (*Server, *httptest.Server, *Server, *httptest.Server) {
+	t.Helper()
+	store := memstore.New(time.Hour)
+	bus := memstore.NewBus()
+	config := Config{RoomTTL: time.Hour}
+	srv1 := NewServerWithStore(config, store, HubOptions{Bus: bus.Node()})
+	srv2 := NewServerWithStore(config, store, HubOptions{Bus: bus.Node()})
+	ts1 := httptest.NewServer(srv1.Routes())
+	ts2 := httptest.NewServer(srv2.Routes())
+	t.Cleanup(ts1.Close)
+	t.Cleanup(ts2.Close)
+	return srv1, ts1, srv2, ts2
+}
+
+func TestBroadcastReachesSocketsOnOtherNodes(t *testing.T) {
+	_, ts1, _, ts2 := newTestCluster(t)
+	created := createTestRoom(t, ts1, "Alice")
+
+	alice := dialTestRoom(t, ts1, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, alice, "snapshot")
+	bob := dialTestRoom(t, ts2, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, bob, "snapshot")
+
+	seq := sendTestTax(t, alice, created.UserID, 500)
+	got := readUntil(t, bob, "op")
+	if got.Seq != seq || got.Op == nil || got.Op.Kind != "set_tax_tip" {
+		t.Fatalf("expected op %d on the other node, got %s", seq, got.Raw)
+	}
+}
+
+func TestPresenceCountsSocketsOnOtherNodes(t *testing.T) {
+	_, ts1, srv2, ts2 := newTestCluster(t)
+	created := createTestRoom(t, ts1, "Alice")
+
+	// Alice has a tab open on each node.
+	tab1 := dialTestRoom(t, ts1, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, tab1, "snapshot")
+	sendTestTax(t, tab1, created.UserID, 100)
+	tab2 := dialTestRoom(t, ts2, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, tab2, "snapshot")
+	sendTestTax(t, tab2, created.UserID, 200)
+	// No presence tick has run: each node advertised Alice when her socket
+	// registered.
+
+	present := func() bool {
+		doc, _ := srv2.hub.loadDoc(context.Background(), created.RoomCode)
+		return doc.Participants[created.UserID].Present
+	}
+
+	tab1.Close()
+	time.Sleep(100 * time.Millisecond)
+	if !present() {
+		t.Fatal("expected Alice to stay present while connected through the other node")
+	}
+
+	tab2.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for present() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if present() {
+		t.Fatal("expected Alice to be marked absent once every node lost her")
+	}
+}
+
+func TestObserveClockReadsOpBatches(t *testing.T) {
+	srv, _ := newTestServer(t)
+	remote := crdt.HLC{Wall: time.Now().Add(time.Second).UnixMilli(), Counter: 7, Actor: "other-node"}
+	message, _ := json.Marshal(map[string]any{
+		"type": "ops",
+		"ops":  []storage.OpEntry{{Seq: 1, Op: crdt.Op{ID: "a"}}, {Seq: 2, Op: crdt.Op{ID: "b", Clock: &remote}}},
+	})
+	srv.hub.observeClock(message)
+	if local := srv.hub.clock.Receive(crdt.HLC{}, "here"); !local.After(remote) {
+		t.Fatalf("expected the local clock past the batch's %+v, got %+v", remote, local)
+	}
+}
@@ -59,7 +59,7 @@ func (s *Server) getRate(ctx context.Context, base, target string) (float64, tim
 
 func (s *Server) getECBRates(ctx context.Context) (map[string]float64, time.Time, error) {
 	cacheKey := "fx:ecb:latest"
-	if cached, err := s.store.Client.Get(ctx, cacheKey).Result(); err == nil && cached != "" {
+	if cached, ok, err := s.store.GetCached(ctx, cacheKey); err == nil && ok && cached != "" {
 		var payload struct {
 			Rates map[string]float64 `json:"rates"`
 			AsOf  int64              `json:"as_of"`
@@ -81,7 +81,7 @@ func (s *Server) getECBRates(ctx context.Context) (map[string]float64, time.Time
 	asOf := time.Now()
 	payload := map[string]any{"rates": rates, "as_of": asOf.Unix(), "base": base}
 	if encoded, err := json.Marshal(payload); err == nil {
-		_ = s.store.Client.Set(ctx, cacheKey, encoded, 24*time.Hour).Err()
+		_ = s.store.SetCached(ctx, cacheKey, string(encoded), 24*time.Hour)
 	}
 	return rates, asOf, nil
 }
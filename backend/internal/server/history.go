@@ -0,0 +1,505 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/archive"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// HistoryEntry describes one op in a room's audit trail.
+type HistoryEntry struct {
+	Seq        int64           `json:"seq"`
+	OpID       string          `json:"op_id"`
+	Kind       string          `json:"kind"`
+	ActorID    string          `json:"actor_id"`
+	ActorName  string          `json:"actor_name,omitempty"`
+	Timestamp  int64           `json:"timestamp"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id,omitempty"`
+	TargetName string          `json:"target_name,omitempty"`
+	Summary    string          `json:"summary"`
+	Changes    []HistoryChange `json:"changes"`
+}
+
+// HistoryChange is one field of the target before and after the op, by dotted
+// path (e.g. "assigned.<user_id>"). A missing value is null.
+type HistoryChange struct {
+	Field  string `json:"field"`
+	Before any    `json:"before"`
+	After  any    `json:"after"`
+}
+
+type RoomHistoryResponse struct {
+	RoomCode string `json:"room_code"`
+	Seq      int64  `json:"seq"`
+	// Complete is false when older ops have been trimmed without an archive,
+	// so early entries are missing and before values may be too.
+	Complete bool           `json:"complete"`
+	Entries  []HistoryEntry `json:"entries"`
+	// NextBefore is the before cursor for the next (older) page, or 0 at the end.
+	NextBefore int64 `json:"next_before,omitempty"`
+}
+
+type RoomAtResponse struct {
+	RoomCode string        `json:"room_code"`
+	Seq      int64         `json:"seq"`
+	Doc      *crdt.RoomDoc `json:"doc"`
+}
+
+// handleRoomHistory returns the room's audit trail newest first. before (an
+// exclusive seq) pages back through it; target narrows it to one item,
+// participant or payer id.
+func (s *Server) handleRoomHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	roomCode := strings.ToUpper(strings.TrimSpace(r.PathValue("code")))
+	if roomCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultHistoryLimit)
+	if err != nil || limit <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxHistoryLimit)
+	before, err := queryInt(query.Get("before"), 0)
+	if err != nil || before < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	target := query.Get("target")
+
+	ctx := r.Context()
+	_, seq, ok := s.loadExistingRoom(ctx, roomCode)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	entries, err := s.hub.fullLog(ctx, roomCode)
+	if err != nil {
+		log.Printf("room history load failed room=%s err=%v", roomCode, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	trail := buildHistory(roomCode, entries)
+	response := RoomHistoryResponse{RoomCode: roomCode, Seq: seq, Complete: logComplete(entries, seq), Entries: []HistoryEntry{}}
+	for i := len(trail) - 1; i >= 0; i-- {
+		entry := trail[i]
+		if before > 0 && entry.Seq >= int64(before) {
+			continue
+		}
+		if target != "" && entry.TargetID != target {
+			continue
+		}
+		if len(response.Entries) == limit {
+			response.NextBefore = response.Entries[limit-1].Seq
+			break
+		}
+		response.Entries = append(response.Entries, entry)
+	}
+	writeJSON(w, response)
+}
+
+// handleRoomAt rebuilds the room as it stood right after op seq by folding the
+// op log from the start.
+func (s *Server) handleRoomAt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	roomCode := strings.ToUpper(strings.TrimSpace(r.PathValue("code")))
+	if roomCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	at, err := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil || at < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	_, seq, ok := s.loadExistingRoom(ctx, roomCode)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if at > seq {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": fmt.Sprintf("seq %d is past the end of the log (%d)", at, seq)})
+		return
+	}
+	entries, err := s.hub.fullLog(ctx, roomCode)
+	if err != nil {
+		log.Printf("room history load failed room=%s err=%v", roomCode, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !logComplete(entries, seq) {
+		w.WriteHeader(http.StatusGone)
+		writeJSON(w, map[string]string{"error": "older ops have been trimmed; this room's history is incomplete"})
+		return
+	}
+	doc := crdt.NewRoom(roomCode, "")
+	for _, entry := range entries {
+		if entry.Seq > at {
+			break
+		}
+		foldOp(doc, entry.Op)
+	}
+	writeJSON(w, RoomAtResponse{RoomCode: roomCode, Seq: at, Doc: doc})
+}
+
+func queryInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// fullLog returns every op the room still has: the archived log followed by
+// the live ops past it.
+func (h *Hub) fullLog(ctx context.Context, roomID string) ([]storage.OpEntry, error) {
+	var entries []storage.OpEntry
+	if h.archive != nil {
+		record, err := h.archive.Load(ctx, roomID)
+		if err != nil && !errors.Is(err, archive.ErrInvalidRoomID) {
+			return nil, err
+		}
+		if record != nil {
+			entries = append(entries, record.Ops...)
+		}
+	}
+	archivedSeq := int64(0)
+	if len(entries) > 0 {
+		archivedSeq = entries[len(entries)-1].Seq
+	}
+	live, err := h.store.LoadOps(ctx, roomID, archivedSeq)
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, live...), nil
+}
+
+// logComplete reports whether entries run from seq 1 through seq with no gaps.
+// The log is read after seq was, so ops appended in between may follow; they
+// don't make it incomplete.
+func logComplete(entries []storage.OpEntry, seq int64) bool {
+	if int64(len(entries)) < seq {
+		return false
+	}
+	for i, entry := range entries[:seq] {
+		if entry.Seq != int64(i+1) {
+			return false
+		}
+	}
+	return true
+}
+
+// foldOp applies op the way loadDoc does.
+func foldOp(doc *crdt.RoomDoc, op crdt.Op) {
+	crdt.ApplyOp(doc, op)
+	if op.Timestamp > doc.UpdatedAt {
+		doc.UpdatedAt = op.Timestamp
+	}
+}
+
+// buildHistory folds entries from an empty room, recording what each op changed.
+func buildHistory(roomID string, entries []storage.OpEntry) []HistoryEntry {
+	doc := crdt.NewRoom(roomID, "")
+	trail := make([]HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		op := entry.Op
+		targetType, targetID := opTarget(op)
+		beforeName := targetName(doc, targetType, targetID)
+		existed := targetExists(doc, targetType, targetID)
+		before := auditValues(targetView(doc, targetType, targetID))
+		foldOp(doc, op)
+		after := auditValues(targetView(doc, targetType, targetID))
+
+		name := targetName(doc, targetType, targetID)
+		if name == "" {
+			name = beforeName
+		}
+		actorName := participantName(doc, op.ActorID)
+		trail = append(trail, HistoryEntry{
+			Seq:        entry.Seq,
+			OpID:       op.ID,
+			Kind:       op.Kind,
+			ActorID:    op.ActorID,
+			ActorName:  actorName,
+			Timestamp:  op.Timestamp,
+			TargetType: targetType,
+			TargetID:   targetID,
+			TargetName: name,
+			Summary:    describeOp(doc, op, actorName, targetID, name, existed),
+			Changes:    diffAuditValues(before, after),
+		})
+	}
+	return trail
+}
+
+// opTarget names what an op changes: an item, participant or payer by id, or
+// the room itself.
+func opTarget(op crdt.Op) (string, string) {
+	var payload struct {
+		ID            string            `json:"id"`
+		ItemID        string            `json:"item_id"`
+		ParticipantID string            `json:"participant_id"`
+		Item          *crdt.Item        `json:"item"`
+		Participant   *crdt.Participant `json:"participant"`
+	}
+	json.Unmarshal(op.Payload, &payload)
+	switch op.Kind {
+	case "set_item", "restore_item":
+		if payload.Item != nil {
+			return "item", payload.Item.ID
+		}
+		return "item", ""
+	case "patch_item", "remove_item":
+		return "item", payload.ID
+	case "assign_item", "allocate_item":
+		return "item", payload.ItemID
+	case "set_participant", "restore_participant":
+		if payload.Participant != nil {
+			return "participant", payload.Participant.ID
+		}
+		return "participant", ""
+	case "patch_participant", "remove_participant":
+		return "participant", payload.ID
+	case "set_payer":
+		return "payer", payload.ParticipantID
+	}
+	return "room", ""
+}
+
+// roomSettings is the room-level state shown in history.
+type roomSettings struct {
+	Name              string `json:"name"`
+	Currency          string `json:"currency"`
+	TargetCurrency    string `json:"target_currency"`
+	TaxCents          int    `json:"tax_cents"`
+	TipCents          int    `json:"tip_cents"`
+	BillDiscountCents int    `json:"bill_discount_cents"`
+	BillChargesCents  int    `json:"bill_charges_cents"`
+}
+
+func targetView(doc *crdt.RoomDoc, targetType, id string) any {
+	switch targetType {
+	case "item":
+		if item, ok := doc.Items[id]; ok {
+			return item
+		}
+	case "participant":
+		if participant, ok := doc.Participants[id]; ok {
+			return participant
+		}
+	case "payer":
+		if payer, ok := doc.Payers[id]; ok {
+			return payer
+		}
+	case "room":
+		return roomSettings{
+			Name:              doc.Name,
+			Currency:          doc.Currency,
+			TargetCurrency:    doc.TargetCurrency,
+			TaxCents:          doc.TaxCents,
+			TipCents:          doc.TipCents,
+			BillDiscountCents: doc.BillDiscountCents,
+			BillChargesCents:  doc.BillChargesCents,
+		}
+	}
+	return nil
+}
+
+func targetExists(doc *crdt.RoomDoc, targetType, id string) bool {
+	return targetView(doc, targetType, id) != nil
+}
+
+func targetName(doc *crdt.RoomDoc, targetType, id string) string {
+	switch targetType {
+	case "item":
+		if item, ok := doc.Items[id]; ok {
+			return item.Name
+		}
+	case "participant", "payer":
+		return participantName(doc, id)
+	}
+	return ""
+}
+
+func participantName(doc *crdt.RoomDoc, id string) string {
+	if participant, ok := doc.Participants[id]; ok {
+		return participant.Name
+	}
+	return ""
+}
+
+// auditSkip are bookkeeping fields left out of before/after values.
+var auditSkip = map[string]bool{"updated_at": true, "clock": true, "field_clocks": true}
+
+// auditValues flattens a target into dotted paths and leaf values.
+func auditValues(view any) map[string]any {
+	values := map[string]any{}
+	if view == nil {
+		return values
+	}
+	encoded, err := json.Marshal(view)
+	if err != nil {
+		return values
+	}
+	var decoded any
+	if json.Unmarshal(encoded, &decoded) != nil {
+		return values
+	}
+	flattenAudit("", decoded, values)
+	return values
+}
+
+func flattenAudit(prefix string, value any, out map[string]any) {
+	fields, ok := value.(map[string]any)
+	if !ok {
+		if prefix != "" {
+			out[prefix] = value
+		}
+		return
+	}
+	for key, child := range fields {
+		if auditSkip[key] {
+			continue
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		flattenAudit(key, child, out)
+	}
+}
+
+func diffAuditValues(before, after map[string]any) []HistoryChange {
+	fields := map[string]bool{}
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+	changes := []HistoryChange{}
+	for field := range fields {
+		was, is := before[field], after[field]
+		// Unset and zero read the same on a bill (e.g. an unassigned user).
+		if reflect.DeepEqual(was, is) || (auditZero(was) && auditZero(is)) {
+			continue
+		}
+		changes = append(changes, HistoryChange{Field: field, Before: was, After: is})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func auditZero(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case float64:
+		return v == 0
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// describeOp is the one-line, human-readable account of an op, e.g.
+// `Alice removed "Fries"`. doc is the state after it.
+func describeOp(doc *crdt.RoomDoc, op crdt.Op, actorName, targetID, targetName string, existed bool) string {
+	if actorName == "" {
+		actorName = "Someone"
+	}
+	item := strconv.Quote(targetName)
+	var action string
+	switch op.Kind {
+	case "set_item":
+		action = "edited " + item
+		if !existed {
+			action = "added " + item
+		}
+	case "patch_item":
+		action = "edited " + item
+	case "remove_item":
+		action = "removed " + item
+	case "restore_item":
+		action = "restored " + item
+	case "assign_item", "allocate_item":
+		var payload struct {
+			ItemID string `json:"item_id"`
+			UserID string `json:"user_id"`
+		}
+		json.Unmarshal(op.Payload, &payload)
+		user := participantName(doc, payload.UserID)
+		if user == "" {
+			user = payload.UserID
+		}
+		switch current := doc.Items[payload.ItemID]; {
+		case current == nil || !current.Assigned[payload.UserID]:
+			action = fmt.Sprintf("unassigned %s from %s", user, item)
+		case op.Kind == "allocate_item":
+			action = fmt.Sprintf("changed %s's share of %s", user, item)
+		default:
+			action = fmt.Sprintf("assigned %s to %s", item, user)
+		}
+	case "set_participant":
+		action = "updated " + targetName
+		if !existed {
+			action = "added " + targetName
+			if op.ActorID == targetID {
+				action = "joined"
+			}
+		}
+	case "patch_participant":
+		action = "updated " + targetName
+		var payload crdt.PatchPayload
+		json.Unmarshal(op.Payload, &payload)
+		if present, ok := payload.Fields["present"]; ok && len(payload.Fields) == 1 {
+			// The server's presence updates.
+			action = "went offline"
+			if string(present) == "true" {
+				action = "came online"
+			}
+		}
+	case "remove_participant":
+		action = "removed " + targetName
+	case "restore_participant":
+		action = "restored " + targetName
+	case "set_payer":
+		action = "recorded what " + targetName + " paid"
+	case "set_tax_tip":
+		action = "changed tax, tip and charges"
+	case "set_room_name":
+		action = "changed the bill settings"
+	default:
+		action = "applied " + op.Kind
+	}
+	return actorName + " " + action
+}
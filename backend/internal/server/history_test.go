@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/archive"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
+)
+
+// newHistoryTestServer trims the live op log aggressively, so history has to
+// come from the archive as well as the store.
+func newHistoryTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	archiveStore, err := archive.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	config := Config{RoomTTL: time.Hour, Compaction: CompactionPolicy{SnapshotEveryOps: 1, RetainOps: 1}}
+	srv := NewServerWithStore(config, memstore.New(time.Hour), HubOptions{Archive: archiveStore})
+	ts := httptest.NewServer(srv.Routes())
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+func getHistory(t *testing.T, ts *httptest.Server, path string) RoomHistoryResponse {
+	t.Helper()
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("history %s: status %d", path, resp.StatusCode)
+	}
+	var out RoomHistoryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode history: %v", err)
+	}
+	return out
+}
+
+func TestRoomHistoryShowsWhoRemovedAnItem(t *testing.T) {
+	_, ts := newHistoryTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	bob := joinTestRoom(t, ts, created.RoomCode, "Bob")
+	alice := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, alice, "snapshot")
+	bobConn := dialTestRoom(t, ts, created.RoomCode, bob.UserID, bob.JoinToken)
+	readUntil(t, bobConn, "snapshot")
+
+	itemPayload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{ID: "app", Name: "Calamari", Quantity: 1, LinePriceCents: 1400, Assigned: map[string]bool{created.UserID: true}}})
+	alice.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "set_item", Payload: itemPayload}})
+	readUntil(t, alice, "ack")
+	removePayload, _ := json.Marshal(crdt.RemovePayload{ID: "app"})
+	bobConn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "remove_item", Payload: removePayload}})
+	readUntil(t, bobConn, "ack")
+
+	page := getHistory(t, ts, "/api/rooms/"+created.RoomCode+"/history?target=app&limit=1")
+	if !page.Complete || len(page.Entries) != 1 || page.NextBefore == 0 {
+		t.Fatalf("expected one complete entry with a cursor, got %+v", page)
+	}
+	removed := page.Entries[0]
+	if removed.ActorID != bob.UserID || removed.Summary != `Bob removed "Calamari"` {
+		t.Fatalf("unexpected removal entry %+v", removed)
+	}
+	changes := map[string]HistoryChange{}
+	for _, change := range removed.Changes {
+		changes[change.Field] = change
+	}
+	if price := changes["line_price_cents"]; price.Before != float64(1400) || price.After != nil {
+		t.Fatalf("expected the price before and after the removal, got %+v", removed.Changes)
+	}
+
+	older := getHistory(t, ts, fmt.Sprintf("/api/rooms/%s/history?target=app&before=%d", created.RoomCode, page.NextBefore))
+	if len(older.Entries) != 1 || older.Entries[0].Summary != `Alice added "Calamari"` || older.NextBefore != 0 {
+		t.Fatalf("expected the add on the last page, got %+v", older)
+	}
+}
+
+func TestRoomAtFoldsToPastSeq(t *testing.T) {
+	_, ts := newHistoryTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, conn, "snapshot")
+
+	itemPayload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{ID: "fries", Name: "Fries", Quantity: 1}})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "set_item", Payload: itemPayload}})
+	added := readUntil(t, conn, "ack").Seq
+	removePayload, _ := json.Marshal(crdt.RemovePayload{ID: "fries"})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "remove_item", Payload: removePayload}})
+	removed := readUntil(t, conn, "ack").Seq
+
+	at := func(seq int64) (int, RoomAtResponse) {
+		resp, err := http.Get(fmt.Sprintf("%s/api/rooms/%s/at?seq=%d", ts.URL, created.RoomCode, seq))
+		if err != nil {
+			t.Fatalf("at: %v", err)
+		}
+		defer resp.Body.Close()
+		var out RoomAtResponse
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+	if status, out := at(added); status != http.StatusOK || out.Doc.Items["fries"] == nil || out.Doc.Name != "Dinner" || out.Doc.Participants[created.UserID] == nil {
+		t.Fatalf("expected fries and the creator at seq %d, got %d %+v", added, status, out.Doc)
+	}
+	if status, out := at(removed); status != http.StatusOK || out.Doc.Items["fries"] != nil {
+		t.Fatalf("expected fries gone at seq %d, got %d %+v", removed, status, out.Doc)
+	}
+	if status, _ := at(removed + 1); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 past the end of the log, got %d", status)
+	}
+}
+
+func TestRoomAtNeedsTheWholeLog(t *testing.T) {
+	// Without an archive, ops trimmed behind the snapshot are gone.
+	srv, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	srv.store.TrimOps(context.Background(), created.RoomCode, 1)
+
+	resp, err := http.Get(ts.URL + "/api/rooms/" + created.RoomCode + "/at?seq=1")
+	if err != nil {
+		t.Fatalf("at: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("expected 410 for a trimmed log, got %d", resp.StatusCode)
+	}
+	if page := getHistory(t, ts, "/api/rooms/"+created.RoomCode+"/history"); page.Complete {
+		t.Fatal("expected history to report it is incomplete")
+	}
+}
+
+func TestLogCompleteIgnoresOpsPastSeq(t *testing.T) {
+	entries := []storage.OpEntry{{Seq: 1}, {Seq: 2}, {Seq: 3}}
+	// An op appended between reading seq and reading the log.
+	if !logComplete(entries, 2) {
+		t.Fatal("expected ops past seq to be ignored")
+	}
+	if logComplete(entries[1:], 2) || logComplete(entries[:1], 2) {
+		t.Fatal("expected a log missing ops up to seq to be incomplete")
+	}
+	if logComplete([]storage.OpEntry{{Seq: 1}, {Seq: 3}, {Seq: 4}}, 2) {
+		t.Fatal("expected a gap before seq to be incomplete")
+	}
+}
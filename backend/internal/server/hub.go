@@ -12,45 +12,95 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/archive"
 	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
-	"github.com/aschi2/MultiplayerBillSplit/backend/internal/redisstore"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/settlement"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
 )
 
+// HubOptions configures the optional parts of a Hub.
+type HubOptions struct {
+	// Archive keeps rooms past the store TTL; nil disables archival.
+	Archive archive.Store
+	// Bus fans broadcasts and presence out to other nodes; nil runs single-node.
+	Bus        storage.Bus
+	Compaction CompactionPolicy
+	// VerifyToken authenticates sockets; nil rejects every connection.
+	VerifyToken TokenVerifier
+	// AllowedOrigins are the browser origins, besides our own host, that may open sockets.
+	AllowedOrigins []string
+}
+
 type Hub struct {
-	store     *redisstore.Store
+	store     storage.Store
+	clock     *crdt.Clock
+	archive   archive.Store
+	archiveMu sync.Mutex
+	policy    CompactionPolicy
 	upgrader  websocket.Upgrader
-	clients   map[string]map[*websocket.Conn]bool
-	connActor map[*websocket.Conn]string
+	verify    TokenVerifier
+	clients   map[string]map[*client]bool
+	connActor map[*client]string
 	clientsMu sync.Mutex
 	baseCtx   context.Context
 	stopCh    chan struct{}
+
+	compaction   map[string]*compactionState
+	compactionMu sync.Mutex
+
+	undo   map[string]map[string]*undoStacks
+	undoMu sync.Mutex
+
+	bus        storage.Bus
+	nodeID     string
+	subscribed map[string]bool
+	advertised map[string]bool
+	subsMu     sync.Mutex
 }
 
 const (
 	wsPongWait   = 90 * time.Second
 	wsPingPeriod = 30 * time.Second
 	wsWriteWait  = 10 * time.Second
+	// hlcMaxDrift is how far ahead of the server a client clock may be before
+	// its timestamps are ignored.
+	hlcMaxDrift = time.Minute
 )
 
-func NewHub(store *redisstore.Store) *Hub {
+func NewHub(store storage.Store, opts HubOptions) *Hub {
 	h := &Hub{
-		store:     store,
-		upgrader:  websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
-		clients:   map[string]map[*websocket.Conn]bool{},
-		connActor: map[*websocket.Conn]string{},
-		baseCtx:   context.Background(),
+		store:      store,
+		clock:      crdt.NewClock(hlcMaxDrift),
+		archive:    opts.Archive,
+		policy:     opts.Compaction,
+		upgrader:   websocket.Upgrader{CheckOrigin: checkOrigin(opts.AllowedOrigins)},
+		verify:     opts.VerifyToken,
+		clients:    map[string]map[*client]bool{},
+		connActor:  map[*client]string{},
+		baseCtx:    context.Background(),
+		compaction: map[string]*compactionState{},
+		undo:       map[string]map[string]*undoStacks{},
+		bus:        opts.Bus,
+		nodeID:     uuid.NewString(),
+		subscribed: map[string]bool{},
+		advertised: map[string]bool{},
+	}
+	if h.bus != nil {
+		go h.consumeBus()
 	}
 	h.startPresenceLoop()
 	return h
 }
 
-// loadDoc returns the latest room doc and current seq by applying ops after the stored snapshot
-// and peeking at the seq key to reflect the true latest sequence.
+// loadDoc returns the latest room doc and the seq it reflects by applying the ops
+// after the stored snapshot.
 func (h *Hub) loadDoc(ctx context.Context, roomID string) (*crdt.RoomDoc, int64) {
 	room, seq, _ := h.store.LoadSnapshot(ctx, roomID)
 	if room == nil {
 		room = crdt.NewRoom(roomID, "")
 		seq = 0
+	} else {
+		h.noteSnapshot(roomID, seq)
 	}
 	if room.ParticipantTombstones == nil {
 		room.ParticipantTombstones = map[string]int64{}
@@ -58,18 +108,16 @@ func (h *Hub) loadDoc(ctx context.Context, roomID string) (*crdt.RoomDoc, int64)
 	if room.Tombstones == nil {
 		room.Tombstones = map[string]int64{}
 	}
-	if ops, err := h.store.LoadOps(ctx, roomID, seq); err == nil {
-		for _, op := range ops {
+	if entries, err := h.store.LoadOps(ctx, roomID, seq); err == nil {
+		for _, entry := range entries {
 			// Rehydrate doc by folding every op after the snapshot.
-			crdt.ApplyOp(room, op)
-			if op.Timestamp > room.UpdatedAt {
-				room.UpdatedAt = op.Timestamp
+			crdt.ApplyOp(room, entry.Op)
+			if entry.Op.Timestamp > room.UpdatedAt {
+				room.UpdatedAt = entry.Op.Timestamp
 			}
+			seq = entry.Seq
 		}
 	}
-	if current, err := h.store.CurrentSeq(ctx, roomID); err == nil && current > seq {
-		seq = current
-	}
 	if ensureItemSortOrder(room) {
 		_ = h.store.SaveSnapshot(ctx, roomID, room, seq)
 	}
@@ -131,8 +179,8 @@ func ensureItemSortOrder(room *crdt.RoomDoc) bool {
 }
 
 func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request, roomID string) {
-	conn, err := h.upgrader.Upgrade(w, r, nil)
-	if err != nil {
+	conn, actorID, lastSeq, ok := h.authenticateWS(w, r, roomID)
+	if !ok {
 		return
 	}
 	// Keep-alive and idle timeout: any missed pong > wsPongWait will close the conn.
@@ -142,46 +190,30 @@ func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request, roomID string) {
 		return nil
 	})
 
-	defer conn.Close()
-
-	h.register(roomID, conn)
-	actorID := ""
-	defer h.handleDisconnect(roomID, conn, &actorID)
+	c := newClient(conn, wsSendBuffer)
+	defer c.close()
+	go c.writePump()
 
-	// ping loop
-	done := make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(wsPingPeriod)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
-				_ = conn.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(wsWriteWait))
-			case <-done:
-				return
-			}
-		}
-	}()
-	defer close(done)
+	// The socket is bound to the participant its token was issued for; the
+	// actor is tracked first so registering advertises them.
+	h.trackActor(roomID, c, actorID)
+	h.register(roomID, c)
+	defer h.handleDisconnect(roomID, c, &actorID)
 
 	ctx := h.baseCtx
-	room, seq := h.loadDoc(ctx, roomID)
-	snapshot := map[string]any{
-		"type": "snapshot",
-		"seq":  seq,
-		"doc":  room,
-	}
-	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
-	conn.WriteJSON(snapshot)
+	h.restoreRoom(ctx, roomID)
+	// Reconnecting clients pass the last seq they applied and get just the ops they missed.
+	c.sendJSON(h.catchUp(ctx, roomID, lastSeq))
 
 	for {
 		var message struct {
-			Type      string  `json:"type"`
-			Op        crdt.Op `json:"op"`
-			LastSeq   int64   `json:"last_seq"`
-			ClientID  string  `json:"client_id"`
-			Timestamp int64   `json:"timestamp"`
+			Type      string    `json:"type"`
+			ID        string    `json:"id"`
+			Op        crdt.Op   `json:"op"`
+			Ops       []crdt.Op `json:"ops"`
+			LastSeq   int64     `json:"last_seq"`
+			ClientID  string    `json:"client_id"`
+			Timestamp int64     `json:"timestamp"`
 		}
 		if err := conn.ReadJSON(&message); err != nil {
 			return
@@ -189,9 +221,12 @@ func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request, roomID string) {
 		switch message.Type {
 		case "op":
 			opStart := time.Now()
-			if message.Op.ActorID != "" {
-				actorID = message.Op.ActorID
-				h.trackActor(roomID, conn, actorID)
+			if message.Op.ActorID == "" {
+				message.Op.ActorID = actorID
+			}
+			if message.Op.ActorID != actorID {
+				rejectOp(c, roomID, actorID, message.Op, "op actor_id does not match the connected participant")
+				continue
 			}
 			if message.Op.ID == "" {
 				message.Op.ID = uuid.NewString()
@@ -201,8 +236,14 @@ func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request, roomID string) {
 			}
 			// refresh doc to latest snapshot + pending ops
 			docStart := time.Now()
-			doc, _ := h.loadDoc(ctx, roomID)
+			doc, docSeq := h.loadDoc(ctx, roomID)
 			docLoadMs := time.Since(docStart).Milliseconds()
+			if err := validateOp(doc, message.Op); err != nil {
+				rejectOp(c, roomID, actorID, message.Op, err.Error())
+				continue
+			}
+			h.stampOp(&message.Op)
+			inverse := crdt.Inverse(doc, message.Op)
 
 			appendStart := time.Now()
 			seq, err := h.store.AppendOp(ctx, roomID, message.Op)
@@ -211,11 +252,17 @@ func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request, roomID string) {
 				continue
 			}
 			appendMs := time.Since(appendStart).Milliseconds()
+			h.recordEdit(roomID, actorID, inverse)
 
 			applyStart := time.Now()
-			// Apply to local copy so we can re-snapshot and broadcast the exact new state.
+			// Apply to local copy so we can broadcast the exact new state. It is only
+			// the state through seq if nobody else appended in between.
 			crdt.ApplyOp(doc, message.Op)
-			h.store.SaveSnapshot(ctx, roomID, doc, seq)
+			if seq == docSeq+1 {
+				h.afterAppend(ctx, roomID, doc, seq)
+			} else {
+				h.afterAppend(ctx, roomID, nil, seq)
+			}
 			applyMs := time.Since(applyStart).Milliseconds()
 
 			broadcastStart := time.Now()
@@ -224,11 +271,18 @@ func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request, roomID string) {
 				"seq":  seq,
 				"op":   message.Op,
 			})
+			if len(doc.Payers) > 0 {
+				// Money changed (or may have); push the refreshed plan so clients don't poll.
+				h.broadcast(roomID, map[string]any{
+					"type":       "settlement",
+					"seq":        seq,
+					"settlement": settlement.PlanRoom(doc),
+				})
+			}
 			broadcastMs := time.Since(broadcastStart).Milliseconds()
 
 			ackStart := time.Now()
-			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
-			conn.WriteJSON(map[string]any{"type": "ack", "seq": seq})
+			c.sendJSON(map[string]any{"type": "ack", "seq": seq})
 			ackMs := time.Since(ackStart).Milliseconds()
 
 			totalMs := time.Since(opStart).Milliseconds()
@@ -236,38 +290,107 @@ func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request, roomID string) {
 				"ws op room=%s seq=%d actor=%s kind=%s load_ms=%d append_ms=%d apply_ms=%d broadcast_ms=%d ack_ms=%d total_ms=%d",
 				roomID, seq, message.Op.ActorID, message.Op.Kind, docLoadMs, appendMs, applyMs, broadcastMs, ackMs, totalMs,
 			)
+		case "batch":
+			h.handleBatch(ctx, c, roomID, actorID, message.ID, message.Ops)
+		case "undo", "redo":
+			h.handleUndo(ctx, c, roomID, actorID, message.Type == "redo")
 		case "resync":
 			resyncStart := time.Now()
-			doc, currentSeq := h.loadDoc(ctx, roomID)
+			reply := h.catchUp(ctx, roomID, message.LastSeq)
 			loadMs := time.Since(resyncStart).Milliseconds()
-			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
 			writeStart := time.Now()
-			conn.WriteJSON(map[string]any{"type": "snapshot", "seq": currentSeq, "doc": doc})
+			c.sendJSON(reply)
 			writeMs := time.Since(writeStart).Milliseconds()
 			totalMs := time.Since(resyncStart).Milliseconds()
-			log.Printf("ws resync room=%s actor=%s seq=%d load_ms=%d write_ms=%d total_ms=%d", roomID, actorID, currentSeq, loadMs, writeMs, totalMs)
+			log.Printf("ws resync room=%s actor=%s mode=%s last_seq=%d seq=%d load_ms=%d write_ms=%d total_ms=%d", roomID, actorID, reply["type"], message.LastSeq, reply["seq"], loadMs, writeMs, totalMs)
+		case "summary":
+			doc, currentSeq := h.loadDoc(ctx, roomID)
+			c.sendJSON(map[string]any{"type": "summary", "seq": currentSeq, "summary": settlement.Compute(doc)})
+		case "settlement":
+			doc, currentSeq := h.loadDoc(ctx, roomID)
+			c.sendJSON(map[string]any{"type": "settlement", "seq": currentSeq, "settlement": settlement.PlanRoom(doc)})
 		case "ping":
-			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
-			conn.WriteJSON(map[string]any{"type": "pong", "ts": time.Now().UnixMilli()})
+			c.sendJSON(map[string]any{"type": "pong", "ts": time.Now().UnixMilli()})
 		}
 	}
 }
 
-func (h *Hub) register(roomID string, conn *websocket.Conn) {
+// stampOp assigns op the hub's next HLC stamp, merged with the client's own
+// clock (or its millisecond timestamp), and sets Timestamp to the stamp's wall
+// time so a skewed client can't date ops into the past or far future.
+func (h *Hub) stampOp(op *crdt.Op) {
+	remote := op.Stamp()
+	stamp := h.clock.Receive(remote, op.ActorID)
+	if remote.Wall > stamp.Wall {
+		log.Printf("ws op clock clamped actor=%s kind=%s client_wall=%d server_wall=%d", op.ActorID, op.Kind, remote.Wall, stamp.Wall)
+	}
+	op.Clock = &stamp
+	op.Timestamp = stamp.Wall
+}
+
+// rejectOp tells the sender an op was dropped and why, so it can roll back its
+// optimistic copy.
+func rejectOp(c *client, roomID, actorID string, op crdt.Op, reason string) {
+	log.Printf("ws op rejected room=%s actor=%s op_actor=%s kind=%s op_id=%s reason=%q", roomID, actorID, op.ActorID, op.Kind, op.ID, reason)
+	c.sendJSON(map[string]any{"type": "reject", "op_id": op.ID, "reason": reason})
+}
+
+// catchUp brings a client at lastSeq up to date: an "ops" message with just the
+// missed ops when they are all still in the retained log, otherwise a full
+// "snapshot". A lastSeq of 0 always gets a snapshot.
+func (h *Hub) catchUp(ctx context.Context, roomID string, lastSeq int64) map[string]any {
+	if lastSeq > 0 {
+		if entries, ok := h.opsSince(ctx, roomID, lastSeq); ok {
+			seq := lastSeq
+			if len(entries) > 0 {
+				seq = entries[len(entries)-1].Seq
+			}
+			return map[string]any{"type": "ops", "from_seq": lastSeq, "seq": seq, "ops": entries}
+		}
+	}
+	doc, seq := h.loadDoc(ctx, roomID)
+	return map[string]any{"type": "snapshot", "seq": seq, "doc": doc}
+}
+
+// opsSince returns every op after lastSeq, reporting false if any of them have
+// been trimmed or the client claims a seq the room never reached.
+func (h *Hub) opsSince(ctx context.Context, roomID string, lastSeq int64) ([]storage.OpEntry, bool) {
+	if snapshot, _, err := h.store.LoadSnapshot(ctx, roomID); err != nil || snapshot == nil {
+		return nil, false
+	}
+	current, err := h.store.CurrentSeq(ctx, roomID)
+	if err != nil || lastSeq > current {
+		return nil, false
+	}
+	entries, err := h.store.LoadOps(ctx, roomID, lastSeq)
+	if err != nil {
+		return nil, false
+	}
+	if len(entries) == 0 {
+		return []storage.OpEntry{}, lastSeq == current
+	}
+	return entries, entries[0].Seq == lastSeq+1
+}
+
+func (h *Hub) register(roomID string, c *client) {
 	h.clientsMu.Lock()
-	defer h.clientsMu.Unlock()
 	if h.clients[roomID] == nil {
-		h.clients[roomID] = map[*websocket.Conn]bool{}
+		h.clients[roomID] = map[*client]bool{}
 	}
-	h.clients[roomID][conn] = true
+	h.clients[roomID][c] = true
+	h.clientsMu.Unlock()
+	h.syncSubscription(roomID)
+	h.advertiseLocal(roomID)
 }
 
-func (h *Hub) unregister(roomID string, conn *websocket.Conn) {
+func (h *Hub) unregister(roomID string, c *client) {
 	h.clientsMu.Lock()
-	defer h.clientsMu.Unlock()
 	if h.clients[roomID] != nil {
-		delete(h.clients[roomID], conn)
+		delete(h.clients[roomID], c)
 	}
+	h.clientsMu.Unlock()
+	h.syncSubscription(roomID)
+	h.advertiseLocal(roomID)
 }
 
 func (h *Hub) snapshotPresence() map[string]map[string]bool {
@@ -275,8 +398,8 @@ func (h *Hub) snapshotPresence() map[string]map[string]bool {
 	defer h.clientsMu.Unlock()
 	presence := make(map[string]map[string]bool)
 	for roomID, conns := range h.clients {
-		for conn := range conns {
-			actor := h.connActor[conn]
+		for c := range conns {
+			actor := h.connActor[c]
 			if actor == "" {
 				continue
 			}
@@ -291,12 +414,13 @@ func (h *Hub) snapshotPresence() map[string]map[string]bool {
 
 func (h *Hub) startPresenceLoop() {
 	h.stopCh = make(chan struct{})
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(presenceInterval)
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
 				h.reconcilePresence()
+				h.flushSnapshots(h.baseCtx)
 			case <-h.stopCh:
 				ticker.Stop()
 				return
@@ -308,105 +432,114 @@ func (h *Hub) startPresenceLoop() {
 func (h *Hub) reconcilePresence() {
 	presence := h.snapshotPresence()
 	now := time.Now().UnixMilli()
+	h.advertisePresence(h.baseCtx, presence)
 
 	for roomID, presentMap := range presence {
 		ctx := h.baseCtx
-		room, seq, err := h.store.LoadSnapshot(ctx, roomID)
-		if err != nil || room == nil {
+		if snapshot, _, err := h.store.LoadSnapshot(ctx, roomID); err != nil || snapshot == nil {
 			continue
 		}
-		// Pull any ops after the snapshot so we update presence against the latest state.
-		if ops, err := h.store.LoadOps(ctx, roomID, seq); err == nil {
-			for _, op := range ops {
-				crdt.ApplyOp(room, op)
-			}
+		// Actors connected through other nodes count as present too.
+		remote, err := h.remoteActors(ctx, roomID)
+		if err != nil {
+			continue
+		}
+		for id := range remote {
+			presentMap[id] = true
 		}
-		changed := false
-		lastSeq := seq
+		// Update presence against the latest state (snapshot + pending ops).
+		room, _ := h.loadDoc(ctx, roomID)
+		lastSeq := int64(0)
 		for id, participant := range room.Participants {
 			desired := presentMap[id]
 			if participant.Present == desired {
 				continue
 			}
-			updated := *participant
-			updated.Present = desired
-			updated.UpdatedAt = now
-			room.Participants[id] = &updated
-
-			op := crdt.Op{
-				ID:        uuid.NewString(),
-				ActorID:   id,
-				Kind:      "set_participant",
-				Timestamp: now,
-			}
-			payload, _ := json.Marshal(crdt.ParticipantPayload{Participant: updated})
-			op.Payload = payload
+			op := presenceOp(id, desired, now)
+			h.stampOp(&op)
 			if seqVal, err := h.store.AppendOp(ctx, roomID, op); err == nil {
 				lastSeq = seqVal
 				h.broadcast(roomID, map[string]any{"type": "op", "seq": seqVal, "op": op})
 			}
-			changed = true
 		}
-		if changed && lastSeq != 0 {
-			h.store.SaveSnapshot(ctx, roomID, room, lastSeq)
+		if lastSeq != 0 {
+			h.afterAppend(ctx, roomID, nil, lastSeq)
 		}
 	}
 }
 
-func (h *Hub) trackActor(roomID string, conn *websocket.Conn, actorID string) {
+func (h *Hub) trackActor(roomID string, c *client, actorID string) {
 	if actorID == "" {
 		return
 	}
 	h.clientsMu.Lock()
 	defer h.clientsMu.Unlock()
-	h.connActor[conn] = actorID
+	h.connActor[c] = actorID
 	// ensure room map exists to allow presence checks later
 	if h.clients[roomID] == nil {
-		h.clients[roomID] = map[*websocket.Conn]bool{}
+		h.clients[roomID] = map[*client]bool{}
 	}
 }
 
-func (h *Hub) handleDisconnect(roomID string, conn *websocket.Conn, actorPtr *string) {
+func (h *Hub) handleDisconnect(roomID string, c *client, actorPtr *string) {
 	h.clientsMu.Lock()
 	actorID := ""
 	if actorPtr != nil {
 		actorID = *actorPtr
 	}
 	if actorID == "" {
-		actorID = h.connActor[conn]
+		actorID = h.connActor[c]
 	}
-	delete(h.connActor, conn)
+	delete(h.connActor, c)
 	if h.clients[roomID] != nil {
-		delete(h.clients[roomID], conn)
+		delete(h.clients[roomID], c)
 	}
+	if len(h.clients[roomID]) == 0 {
+		delete(h.clients, roomID)
+	}
+	roomIdle := len(h.clients[roomID]) == 0
 	stillPresent := false
 	if actorID != "" && h.clients[roomID] != nil {
-		for c := range h.clients[roomID] {
-			if h.connActor[c] == actorID {
+		for other := range h.clients[roomID] {
+			if h.connActor[other] == actorID {
 				stillPresent = true
 				break
 			}
 		}
 	}
 	h.clientsMu.Unlock()
+	h.syncSubscription(roomID)
+	// Withdraw this node's claim before checking the others, so two nodes
+	// dropping the same actor at once can't each see the other's stale entry
+	// and both skip.
+	h.advertiseLocal(roomID)
 
 	if actorID != "" && !stillPresent {
 		h.markParticipantAbsent(roomID, actorID)
 	}
+	if roomIdle {
+		// Last socket left: fold pending ops into the snapshot, and persist the
+		// bill so it outlives the store TTL.
+		h.flushSnapshot(h.baseCtx, roomID)
+		h.dropUndo(roomID)
+		if h.archive != nil {
+			if _, err := h.archiveRoom(h.baseCtx, roomID, false); err != nil {
+				log.Printf("room archive failed room=%s err=%v", roomID, err)
+			}
+		}
+	}
 }
 
 func (h *Hub) markParticipantAbsent(roomID, actorID string) {
 	ctx := h.baseCtx
-	room, seq, err := h.store.LoadSnapshot(ctx, roomID)
-	if err != nil || room == nil {
+	if snapshot, _, err := h.store.LoadSnapshot(ctx, roomID); err != nil || snapshot == nil {
 		return
 	}
-	// Rebuild current doc (snapshot + tail ops) before writing absence.
-	if ops, err := h.store.LoadOps(ctx, roomID, seq); err == nil {
-		for _, op := range ops {
-			crdt.ApplyOp(room, op)
-		}
+	if remote, err := h.remoteActors(ctx, roomID); err != nil || remote[actorID] {
+		return
 	}
+	// Rebuild current doc (snapshot + tail ops) before writing absence.
+	room, _ := h.loadDoc(ctx, roomID)
 	participant, ok := room.Participants[actorID]
 	if !ok {
 		return
@@ -414,34 +547,57 @@ func (h *Hub) markParticipantAbsent(roomID, actorID string) {
 	if !participant.Present {
 		return
 	}
-	updated := *participant
-	updated.Present = false
-	updated.UpdatedAt = time.Now().UnixMilli()
-	room.Participants[actorID] = &updated
+	op := presenceOp(actorID, false, time.Now().UnixMilli())
+	h.stampOp(&op)
+	if seqVal, err := h.store.AppendOp(ctx, roomID, op); err == nil {
+		h.broadcast(roomID, map[string]any{"type": "op", "seq": seqVal, "op": op})
+		h.afterAppend(ctx, roomID, nil, seqVal)
+	}
+}
 
-	op := crdt.Op{
+// presenceOp patches only the present flag, so it can't undo a rename or
+// finish made concurrently by the participant.
+func presenceOp(actorID string, present bool, now int64) crdt.Op {
+	value, _ := json.Marshal(present)
+	payload, _ := json.Marshal(crdt.PatchPayload{ID: actorID, Fields: map[string]json.RawMessage{"present": value}})
+	return crdt.Op{
 		ID:        uuid.NewString(),
 		ActorID:   actorID,
-		Kind:      "set_participant",
-		Timestamp: updated.UpdatedAt,
-	}
-	payload, _ := json.Marshal(crdt.ParticipantPayload{Participant: updated})
-	op.Payload = payload
-	if seqVal, err := h.store.AppendOp(ctx, roomID, op); err == nil {
-		seq = seqVal
-		h.store.SaveSnapshot(ctx, roomID, room, seqVal)
-		h.broadcast(roomID, map[string]any{"type": "op", "seq": seqVal, "op": op})
+		Kind:      "patch_participant",
+		Timestamp: now,
+		Payload:   payload,
 	}
 }
 
+// broadcast sends payload to every socket in the room, on this node directly and
+// on other nodes through the bus.
 func (h *Hub) broadcast(roomID string, payload any) {
 	message, _ := json.Marshal(payload)
+	h.deliver(roomID, message)
+	h.publish(roomID, message)
+}
+
+// deliver queues message for every socket in the room on this node. It never
+// writes under clientsMu; sockets whose queue is full are disconnected.
+func (h *Hub) deliver(roomID string, message []byte) {
 	h.clientsMu.Lock()
-	defer h.clientsMu.Unlock()
-	for conn := range h.clients[roomID] {
-		if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			// ignore write errors; connection checker will clean up
+	targets := make([]*client, 0, len(h.clients[roomID]))
+	for c := range h.clients[roomID] {
+		targets = append(targets, c)
+	}
+	h.clientsMu.Unlock()
+	for _, c := range targets {
+		if c.closed() {
 			continue
 		}
+		if !c.enqueue(message) {
+			log.Printf("ws slow consumer disconnected room=%s actor=%s queued=%d", roomID, h.actorFor(c), len(c.send))
+		}
 	}
 }
+
+func (h *Hub) actorFor(c *client) string {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+	return h.connActor[c]
+}
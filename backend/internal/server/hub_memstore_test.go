@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour, LedgerTTL: time.Hour}, memstore.New(time.Hour), HubOptions{})
+	ts := httptest.NewServer(srv.Routes())
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+func createTestRoom(t *testing.T, ts *httptest.Server, name string) CreateRoomResponse {
+	t.Helper()
+	body, _ := json.Marshal(CreateRoomRequest{Name: name, BillName: "Dinner"})
+	resp, err := http.Post(ts.URL+"/api/create-room", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	defer resp.Body.Close()
+	var created CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create room: %v", err)
+	}
+	return created
+}
+
+func joinTestRoom(t *testing.T, ts *httptest.Server, roomCode, name string) JoinRoomResponse {
+	t.Helper()
+	body, _ := json.Marshal(JoinRoomRequest{RoomCode: roomCode, Name: name})
+	resp, err := http.Post(ts.URL+"/api/join-room", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("join room: %v", err)
+	}
+	defer resp.Body.Close()
+	var joined JoinRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&joined); err != nil {
+		t.Fatalf("decode join room: %v", err)
+	}
+	return joined
+}
+
+// dialTestRoom connects as the participant a create/join response was issued for.
+func dialTestRoom(t *testing.T, ts *httptest.Server, roomCode, userID, joinToken string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(testWSURL(ts, roomCode, userID, joinToken), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func testWSURL(ts *httptest.Server, roomCode, userID, joinToken string) string {
+	query := url.Values{"user_id": {userID}, "join_token": {joinToken}}
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/" + roomCode + "?" + query.Encode()
+}
+
+type testMessage struct {
+	Type string          `json:"type"`
+	Seq  int64           `json:"seq"`
+	Doc  *crdt.RoomDoc   `json:"doc"`
+	Op   *crdt.Op        `json:"op"`
+	Raw  json.RawMessage `json:"-"`
+}
+
+func readUntil(t *testing.T, conn *websocket.Conn, msgType string) testMessage {
+	t.Helper()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read waiting for %s: %v", msgType, err)
+		}
+		var msg testMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("decode message: %v", err)
+		}
+		msg.Raw = data
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestHubRoundTripWithMemoryStore(t *testing.T) {
+	_, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+
+	snapshot := readUntil(t, conn, "snapshot")
+	if snapshot.Doc == nil || snapshot.Doc.Participants[created.UserID] == nil {
+		t.Fatalf("expected snapshot with creator, got %#v", snapshot.Doc)
+	}
+
+	payload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{
+		ID:             "item-1",
+		Name:           "Tacos",
+		Quantity:       1,
+		LinePriceCents: 1200,
+		Assigned:       map[string]bool{created.UserID: true},
+	}})
+	if err := conn.WriteJSON(map[string]any{
+		"type": "op",
+		"op":   crdt.Op{ActorID: created.UserID, Kind: "set_item", Payload: payload},
+	}); err != nil {
+		t.Fatalf("write op: %v", err)
+	}
+	broadcast := readUntil(t, conn, "op")
+	if broadcast.Op == nil || broadcast.Op.Kind != "set_item" || broadcast.Seq == 0 {
+		t.Fatalf("expected set_item broadcast, got %s", broadcast.Raw)
+	}
+	ack := readUntil(t, conn, "ack")
+	if ack.Seq != broadcast.Seq {
+		t.Fatalf("expected ack seq %d, got %d", broadcast.Seq, ack.Seq)
+	}
+
+	resp, err := http.Get(ts.URL + "/api/rooms/" + created.RoomCode + "/summary")
+	if err != nil {
+		t.Fatalf("summary: %v", err)
+	}
+	defer resp.Body.Close()
+	var summary RoomSummaryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatalf("decode summary: %v", err)
+	}
+	if summary.Summary == nil || summary.Summary.TotalCents != 1200 || len(summary.Summary.People) != 1 {
+		t.Fatalf("expected summary to reflect the op, got %#v", summary.Summary)
+	}
+}
+
+func TestRoomSummaryMissingRoom(t *testing.T) {
+	_, ts := newTestServer(t)
+	resp, err := http.Get(ts.URL + "/api/rooms/NOPE42/summary")
+	if err != nil {
+		t.Fatalf("summary: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHubStampsOpsAndClampsSkewedClients(t *testing.T) {
+	_, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, conn, "snapshot")
+
+	// A phone a year ahead creates an item, then the same item is deleted from
+	// a correctly set clock; the delete has to stick.
+	future := time.Now().Add(365 * 24 * time.Hour).UnixMilli()
+	itemPayload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{ID: "fries", Name: "Fries", Quantity: 1}})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "set_item", Timestamp: future, Payload: itemPayload}})
+	itemOp := readUntil(t, conn, "op")
+	if itemOp.Op.Clock == nil || itemOp.Op.Timestamp >= future || itemOp.Op.Timestamp != itemOp.Op.Clock.Wall {
+		t.Fatalf("expected a server stamp near now, got %s", itemOp.Raw)
+	}
+
+	removePayload, _ := json.Marshal(crdt.RemovePayload{ID: "fries"})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "remove_item", Payload: removePayload}})
+	removed := readUntil(t, conn, "op")
+	if !removed.Op.Clock.After(*itemOp.Op.Clock) {
+		t.Fatalf("expected remove stamp %+v after %+v", removed.Op.Clock, itemOp.Op.Clock)
+	}
+	conn.WriteJSON(map[string]any{"type": "resync", "last_seq": 0})
+	if snapshot := readUntil(t, conn, "snapshot"); snapshot.Doc.Items["fries"] != nil {
+		t.Fatal("expected the item to stay deleted")
+	}
+
+	// An edit made before the removal and sent late would be restamped past
+	// it; it is refused, and only restore_item brings the item back.
+	stale := *itemOp.Op.Clock
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "set_item", Timestamp: stale.Wall, Clock: &stale, Payload: itemPayload}})
+	if reject := readUntil(t, conn, "reject"); !strings.Contains(string(reject.Raw), "was removed") {
+		t.Fatalf("expected the stale set_item refused, got %s", reject.Raw)
+	}
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "restore_item", Payload: itemPayload}})
+	readUntil(t, conn, "op")
+	conn.WriteJSON(map[string]any{"type": "resync", "last_seq": 0})
+	if snapshot := readUntil(t, conn, "snapshot"); snapshot.Doc.Items["fries"] == nil {
+		t.Fatal("expected restore_item to bring the item back")
+	}
+}
+
+func TestPatchItemOnlyTouchesSentFields(t *testing.T) {
+	_, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, conn, "snapshot")
+
+	itemPayload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{ID: "fries", Name: "Fries", Quantity: 1, LinePriceCents: 500}})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "set_item", Payload: itemPayload}})
+	readUntil(t, conn, "op")
+	for _, fields := range []map[string]json.RawMessage{
+		{"name": json.RawMessage(`"Curly fries"`)},
+		{"line_price_cents": json.RawMessage(`650`)},
+	} {
+		payload, _ := json.Marshal(crdt.PatchPayload{ID: "fries", Fields: fields})
+		conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "patch_item", Payload: payload}})
+		readUntil(t, conn, "op")
+	}
+
+	conn.WriteJSON(map[string]any{"type": "resync", "last_seq": 0})
+	item := readUntil(t, conn, "snapshot").Doc.Items["fries"]
+	if item == nil || item.Name != "Curly fries" || item.LinePriceCents != 650 || item.Quantity != 1 {
+		t.Fatalf("expected both patches applied and quantity untouched, got %+v", item)
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/ledger"
+)
+
+type CreateLedgerRequest struct {
+	Name     string `json:"name"`
+	Currency string `json:"currency"`
+}
+
+type AddLedgerBillRequest struct {
+	RoomCode string `json:"room_code"`
+}
+
+// LinkLedgerMemberRequest confirms that a bill's participant is member_id
+// (a member id from the settlement). An empty member_id unlinks them.
+type LinkLedgerMemberRequest struct {
+	RoomCode      string `json:"room_code"`
+	ParticipantID string `json:"participant_id"`
+	MemberID      string `json:"member_id"`
+}
+
+type LedgerResponse struct {
+	ID         string             `json:"id"`
+	Name       string             `json:"name"`
+	Currency   string             `json:"currency"`
+	CreatedAt  int64              `json:"created_at"`
+	UpdatedAt  int64              `json:"updated_at"`
+	Settlement *ledger.Settlement `json:"settlement"`
+}
+
+func (s *Server) handleCreateLedger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req CreateLedgerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	currency := normalizeCurrencyCode(req.Currency)
+	if currency == "" {
+		currency = "USD"
+	}
+	l := ledger.New(randomCode(8), strings.TrimSpace(req.Name), currency, time.Now().UnixMilli())
+	if err := s.store.SaveLedger(r.Context(), l, s.config.LedgerTTL); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeLedger(r.Context(), w, l)
+}
+
+func (s *Server) handleLedger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	l, ok := s.loadLedger(w, r)
+	if !ok {
+		return
+	}
+	s.refreshLedgerBills(r.Context(), l)
+	s.writeLedger(r.Context(), w, l)
+}
+
+func (s *Server) handleLedgerSettlement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	l, ok := s.loadLedger(w, r)
+	if !ok {
+		return
+	}
+	s.refreshLedgerBills(r.Context(), l)
+	combined, err := ledger.Combine(l, s.ledgerConverter(r.Context()))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, combined)
+}
+
+func (s *Server) handleAddLedgerBill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req AddLedgerBillRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	roomCode := strings.ToUpper(strings.TrimSpace(req.RoomCode))
+	if roomCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	l, ok := s.loadLedger(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	room, seq, exists := s.loadExistingRoom(ctx, roomCode)
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]string{"error": "room not found"})
+		return
+	}
+	l.AddBill(roomCode, room, seq, time.Now().UnixMilli())
+	if err := s.store.SaveLedger(ctx, l, s.config.LedgerTTL); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeLedger(ctx, w, l)
+}
+
+func (s *Server) handleRemoveLedgerBill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	l, ok := s.loadLedger(w, r)
+	if !ok {
+		return
+	}
+	roomCode := strings.ToUpper(strings.TrimSpace(r.PathValue("code")))
+	if !l.RemoveBill(roomCode, time.Now().UnixMilli()) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := s.store.SaveLedger(r.Context(), l, s.config.LedgerTTL); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeLedger(r.Context(), w, l)
+}
+
+func (s *Server) handleLinkLedgerMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req LinkLedgerMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	l, ok := s.loadLedger(w, r)
+	if !ok {
+		return
+	}
+	roomCode := strings.ToUpper(strings.TrimSpace(req.RoomCode))
+	if !l.HasParticipant(roomCode, req.ParticipantID) {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]string{"error": "participant not found in this ledger"})
+		return
+	}
+	if req.MemberID != "" {
+		memberRoom, memberParticipant, _ := strings.Cut(req.MemberID, "/")
+		if memberRoom == roomCode || !l.HasParticipant(memberRoom, memberParticipant) {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "member_id must be a member of another bill"})
+			return
+		}
+	}
+	l.Link(roomCode, req.ParticipantID, req.MemberID, time.Now().UnixMilli())
+	if err := s.store.SaveLedger(r.Context(), l, s.config.LedgerTTL); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeLedger(r.Context(), w, l)
+}
+
+func (s *Server) loadLedger(w http.ResponseWriter, r *http.Request) (*ledger.Ledger, bool) {
+	ledgerID := strings.ToUpper(strings.TrimSpace(r.PathValue("id")))
+	if ledgerID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	l, err := s.store.LoadLedger(r.Context(), ledgerID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	if l == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	return l, true
+}
+
+// refreshLedgerBills pulls the live doc for every bill whose room still exists so
+// the ledger keeps the latest state once the room itself expires. A room that
+// reused an expired bill's code is left alone.
+func (s *Server) refreshLedgerBills(ctx context.Context, l *ledger.Ledger) {
+	changed := false
+	for _, bill := range l.Bills {
+		room, seq, ok := s.loadExistingRoom(ctx, bill.RoomCode)
+		if !ok || (bill.Doc != nil && seq == bill.Seq) {
+			continue
+		}
+		if bill.Refresh(room, seq) {
+			changed = true
+		}
+	}
+	if changed {
+		l.UpdatedAt = time.Now().UnixMilli()
+		_ = s.store.SaveLedger(ctx, l, s.config.LedgerTTL)
+	}
+}
+
+func (s *Server) writeLedger(ctx context.Context, w http.ResponseWriter, l *ledger.Ledger) {
+	combined, err := ledger.Combine(l, s.ledgerConverter(ctx))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, LedgerResponse{
+		ID:         l.ID,
+		Name:       l.Name,
+		Currency:   l.Currency,
+		CreatedAt:  l.CreatedAt,
+		UpdatedAt:  l.UpdatedAt,
+		Settlement: combined,
+	})
+}
+
+// ledgerConverter converts minor units between currencies using the cached FX
+// rates, accounting for differing exponents (e.g. JPY has no minor unit).
+func (s *Server) ledgerConverter(ctx context.Context) ledger.Converter {
+	return func(amountCents int64, from, to string) (int64, error) {
+		if amountCents == 0 || strings.EqualFold(from, to) {
+			return amountCents, nil
+		}
+		rate, _, err := s.getRate(ctx, from, to)
+		if err != nil {
+			return 0, err
+		}
+		scale := math.Pow10(currencyExponent(to) - currencyExponent(from))
+		return int64(math.Round(float64(amountCents) * rate * scale)), nil
+	}
+}
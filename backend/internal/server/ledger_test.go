@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+func postTestLedger(t *testing.T, ts *httptest.Server, path string, body any) LedgerResponse {
+	t.Helper()
+	encoded, _ := json.Marshal(body)
+	resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("post %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("post %s: status %d", path, resp.StatusCode)
+	}
+	var out LedgerResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+	return out
+}
+
+func TestLedgerIgnoresARoomThatReusedTheCode(t *testing.T) {
+	srv, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	l := postTestLedger(t, ts, "/api/ledgers", CreateLedgerRequest{Name: "Trip"})
+	postTestLedger(t, ts, "/api/ledgers/"+l.ID+"/bills", AddLedgerBillRequest{RoomCode: created.RoomCode})
+
+	// The bill's room expires and a new room is given the same code.
+	ctx := context.Background()
+	seq, _ := srv.store.CurrentSeq(ctx, created.RoomCode)
+	imposter := crdt.NewRoom(created.RoomCode, "Someone else's lunch")
+	imposter.CreatedAt = 1
+	if err := srv.store.SaveSnapshot(ctx, created.RoomCode, imposter, seq); err != nil {
+		t.Fatalf("save snapshot: %v", err)
+	}
+	payload, _ := json.Marshal(crdt.RoomPayload{Name: "Someone else's lunch, again"})
+	if _, err := srv.store.AppendOp(ctx, created.RoomCode, crdt.Op{ID: "rename", Kind: "set_room_name", Payload: payload}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	resp, err := http.Get(ts.URL + "/api/ledgers/" + l.ID)
+	if err != nil {
+		t.Fatalf("get ledger: %v", err)
+	}
+	defer resp.Body.Close()
+	var got LedgerResponse
+	json.NewDecoder(resp.Body).Decode(&got)
+	if len(got.Settlement.Bills) != 1 || got.Settlement.Bills[0].Name != "Dinner" {
+		t.Fatalf("expected the bill to keep its own room's doc, got %+v", got.Settlement.Bills)
+	}
+}
+
+func TestLedgerLinksMembersOnlyWhenAsked(t *testing.T) {
+	srv, ts := newTestServer(t)
+	first := createTestRoom(t, ts, "Alice")
+	second := createTestRoom(t, ts, "Alice")
+	for _, room := range []CreateRoomResponse{first, second} {
+		payload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{ID: "pho", Name: "Pho", Quantity: 1, LinePriceCents: 1200, Assigned: map[string]bool{room.UserID: true}}})
+		if _, err := srv.store.AppendOp(context.Background(), room.RoomCode, crdt.Op{ID: "pho", Kind: "set_item", Payload: payload}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	l := postTestLedger(t, ts, "/api/ledgers", CreateLedgerRequest{Name: "Trip"})
+	postTestLedger(t, ts, "/api/ledgers/"+l.ID+"/bills", AddLedgerBillRequest{RoomCode: first.RoomCode})
+	l = postTestLedger(t, ts, "/api/ledgers/"+l.ID+"/bills", AddLedgerBillRequest{RoomCode: second.RoomCode})
+	if len(l.Settlement.Balances) != 2 {
+		t.Fatalf("expected the two Alices kept apart, got %+v", l.Settlement.Balances)
+	}
+
+	link := func(req LinkLedgerMemberRequest) int {
+		encoded, _ := json.Marshal(req)
+		resp, err := http.Post(ts.URL+"/api/ledgers/"+l.ID+"/links", "application/json", bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("link: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	member := first.RoomCode + "/" + first.UserID
+	if status := link(LinkLedgerMemberRequest{RoomCode: second.RoomCode, ParticipantID: "someone", MemberID: member}); status != http.StatusNotFound {
+		t.Fatalf("expected an unknown participant refused, got %d", status)
+	}
+	if status := link(LinkLedgerMemberRequest{RoomCode: first.RoomCode, ParticipantID: first.UserID, MemberID: first.RoomCode + "/other"}); status != http.StatusBadRequest {
+		t.Fatalf("expected a link within one bill refused, got %d", status)
+	}
+	l = postTestLedger(t, ts, "/api/ledgers/"+l.ID+"/links", LinkLedgerMemberRequest{RoomCode: second.RoomCode, ParticipantID: second.UserID, MemberID: member})
+	if len(l.Settlement.Balances) != 1 || l.Settlement.Balances[0].ID != member {
+		t.Fatalf("expected the linked Alices merged, got %+v", l.Settlement.Balances)
+	}
+}
@@ -32,6 +32,14 @@ const (
 	geminiReceiptTemperatureRetry        = 0.0
 )
 
+// geminiModifierTaggingTimeout bounds a tagging call on top of the caller's
+// deadline; tagging is an optional pass and shouldn't hold up a parse.
+const geminiModifierTaggingTimeout = 90 * time.Second
+
+// modelHTTPClient sends every receipt model call. Tests swap its transport for
+// a cassette (see internal/cassette) to replay recorded responses.
+var modelHTTPClient = &http.Client{}
+
 type ReceiptParseResult struct {
 	Merchant          string        `json:"merchant,omitempty"`
 	Items             []ReceiptItem `json:"items"`
@@ -46,6 +54,9 @@ type ReceiptParseResult struct {
 	Warnings          []string      `json:"warnings"`
 	Confidence        float64       `json:"confidence"`
 	UnparsedLines     []string      `json:"unparsed_lines,omitempty"`
+	// Cached is set when the result was served from the parse cache rather
+	// than a model call (see receiptCacheLookup).
+	Cached bool `json:"cached,omitempty"`
 }
 
 type ReceiptItem struct {
@@ -81,8 +92,8 @@ type ReceiptModifierTag struct {
 	Confidence  float64 `json:"confidence"`
 }
 
-func callOpenAIReceiptParse(ctx context.Context, apiKey string, image []byte, contentType string) (*ReceiptParseResult, error) {
-	payload, err := buildOpenAIRequest(image, contentType)
+func callOpenAIReceiptParse(ctx context.Context, apiKey, model string, image []byte, contentType string) (*ReceiptParseResult, error) {
+	payload, err := buildOpenAIRequest(image, contentType, model)
 	if err != nil {
 		return nil, err
 	}
@@ -94,8 +105,8 @@ func callOpenAIReceiptParse(ctx context.Context, apiKey string, image []byte, co
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	client := &http.Client{Timeout: 45 * time.Second}
-	resp, err := client.Do(req)
+	// The caller's context carries the timeout (see openAIReceiptParser).
+	resp, err := modelHTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -127,13 +138,12 @@ func callOpenAIReceiptParse(ctx context.Context, apiKey string, image []byte, co
 	if len(response.Choices) == 0 {
 		return nil, errors.New("no response from OpenAI")
 	}
-	content := response.Choices[0].Message.Content
-	var result ReceiptParseResult
-	if err := json.Unmarshal([]byte(content), &result); err != nil {
+	result, err := decodeReceiptParseResult(cleanModelJSON(response.Choices[0].Message.Content))
+	if err != nil {
 		return nil, err
 	}
 	result.Currency = normalizeCurrencyCode(result.Currency)
-	return &result, nil
+	return result, nil
 }
 
 func callGeminiReceiptParseWithModel(ctx context.Context, apiKey string, image []byte, contentType, model string, temperature float64) (*ReceiptParseResult, error) {
@@ -150,9 +160,9 @@ func callGeminiReceiptParseWithModel(ctx context.Context, apiKey string, image [
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("x-goog-api-key", apiKey)
 
-	// Dense receipt OCR can legitimately take longer for higher-cap parses.
-	client := &http.Client{Timeout: 180 * time.Second}
-	resp, err := client.Do(req)
+	// The caller's context carries the timeout: dense receipt OCR can
+	// legitimately take minutes for higher-cap parses (see geminiReceiptParser).
+	resp, err := modelHTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -261,6 +271,8 @@ func callGeminiModifierTaggingWithModel(ctx context.Context, apiKey, model strin
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := context.WithTimeout(ctx, geminiModifierTaggingTimeout)
+	defer cancel()
 
 	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent", model)
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(payload))
@@ -270,8 +282,7 @@ func callGeminiModifierTaggingWithModel(ctx context.Context, apiKey, model strin
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("x-goog-api-key", apiKey)
 
-	client := &http.Client{Timeout: 90 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := modelHTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -419,7 +430,7 @@ func buildGeminiModifierTaggingRequest(result *ReceiptParseResult) ([]byte, erro
 	return json.Marshal(body)
 }
 
-func buildOpenAIRequest(image []byte, contentType string) ([]byte, error) {
+func buildOpenAIRequest(image []byte, contentType, model string) ([]byte, error) {
 	encoded := base64.StdEncoding.EncodeToString(image)
 	schema := `{
   "merchant": "string or null",
@@ -496,7 +507,7 @@ func buildOpenAIRequest(image []byte, contentType string) ([]byte, error) {
 		"Do not let app-only modifier rows suppress nearby standalone beverage rows with explicit prices.",
 	}, " ")
 	body := map[string]any{
-		"model": "gpt-4o",
+		"model": model,
 		"messages": []map[string]any{
 			{
 				"role":    "system",
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReceiptCacheTTL = 24 * time.Hour
+	// receiptPHashIndexSize caps how many recent uploads per mode and chain are
+	// compared perceptually; older ones can still hit by exact hash.
+	receiptPHashIndexSize = 256
+	// receiptPHashMaxDistance is how many of the 256 hash bits may differ for
+	// two photos to count as the same receipt: enough for a re-encode, resize
+	// or slight exposure change, not for a retake of the page.
+	receiptPHashMaxDistance = 10
+	// receiptPHashMaxAspectDiff guards against two receipts from the same
+	// place, whose downscaled hashes look alike, matching at different lengths.
+	receiptPHashMaxAspectDiff = 0.05
+)
+
+// receiptImageHash is a 256-bit difference hash: one bit per horizontally
+// adjacent pair of cells in a 17x16 grayscale thumbnail.
+type receiptImageHash [4]uint64
+
+// receiptCacheLookup finds and stores the parse result for one preprocessed
+// image. Results are kept in the store's cache under the image's SHA-256, the
+// parse mode and the chain's parsers; a perceptual hash index per mode and
+// chain lets near-identical photos (the same picture re-sent, or re-encoded
+// by another phone) hit too.
+type receiptCacheLookup struct {
+	key      string
+	indexKey string
+	data     []byte
+	phash    receiptImageHash
+	aspect   float64
+	// hashed is false until the image decodes and gets a perceptual hash.
+	hashed bool
+}
+
+type receiptPHashEntry struct {
+	Hash   string  `json:"hash"`
+	Aspect float64 `json:"aspect"`
+	Key    string  `json:"key"`
+}
+
+// newReceiptCacheLookup returns nil when caching is off.
+func (s *Server) newReceiptCacheLookup(data []byte, preferHighAccuracy bool, chain []ReceiptParser) *receiptCacheLookup {
+	if s.config.ReceiptCacheTTL <= 0 || len(chain) == 0 {
+		return nil
+	}
+	mode := "standard"
+	if preferHighAccuracy {
+		mode = "accurate"
+	}
+	names := make([]string, len(chain))
+	for i, parser := range chain {
+		names[i] = parser.Name()
+	}
+	scope := mode + ":" + strings.Join(names, ",")
+	sum := sha256.Sum256(data)
+	return &receiptCacheLookup{
+		key:      "receipt_parse:" + scope + ":" + hex.EncodeToString(sum[:]),
+		indexKey: "receipt_parse_phash:" + scope,
+		data:     data,
+	}
+}
+
+// cachedReceiptResult returns a cached result for the image, marked Cached,
+// trying the exact hash first and then the perceptual index.
+func (s *Server) cachedReceiptResult(ctx context.Context, lookup *receiptCacheLookup) (*ReceiptParseResult, bool) {
+	if lookup == nil {
+		return nil, false
+	}
+	if result, ok := s.loadCachedReceipt(ctx, lookup.key); ok {
+		return result, true
+	}
+	lookup.phash, lookup.aspect, lookup.hashed = perceptualReceiptHash(lookup.data)
+	if !lookup.hashed {
+		return nil, false
+	}
+	for _, entry := range s.loadReceiptPHashIndex(ctx, lookup.indexKey) {
+		hash, ok := parseReceiptImageHash(entry.Hash)
+		if !ok || entry.Key == lookup.key {
+			continue
+		}
+		if math.Abs(entry.Aspect-lookup.aspect) > receiptPHashMaxAspectDiff*lookup.aspect {
+			continue
+		}
+		if hash.distance(lookup.phash) > receiptPHashMaxDistance {
+			continue
+		}
+		if result, ok := s.loadCachedReceipt(ctx, entry.Key); ok {
+			return result, true
+		}
+	}
+	return nil, false
+}
+
+// cacheReceiptResult stores a fresh result and, when the image has a
+// perceptual hash, puts it at the front of the index. The index is rewritten
+// without a lock, so two nodes storing at once can drop an entry; that only
+// costs a later near-match.
+func (s *Server) cacheReceiptResult(ctx context.Context, lookup *receiptCacheLookup, result *ReceiptParseResult) {
+	if lookup == nil || result == nil {
+		return
+	}
+	ttl := s.config.ReceiptCacheTTL
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("receipt cache encode failed err=%v", err)
+		return
+	}
+	if err := s.store.SetCached(ctx, lookup.key, string(encoded), ttl); err != nil {
+		log.Printf("receipt cache save failed err=%v", err)
+		return
+	}
+	if !lookup.hashed {
+		// A retry skips the lookup, which is where the hash is usually taken.
+		lookup.phash, lookup.aspect, lookup.hashed = perceptualReceiptHash(lookup.data)
+		if !lookup.hashed {
+			return
+		}
+	}
+	index := []receiptPHashEntry{{Hash: lookup.phash.String(), Aspect: lookup.aspect, Key: lookup.key}}
+	for _, entry := range s.loadReceiptPHashIndex(ctx, lookup.indexKey) {
+		if entry.Key == lookup.key {
+			continue
+		}
+		if len(index) == receiptPHashIndexSize {
+			break
+		}
+		index = append(index, entry)
+	}
+	encoded, err = json.Marshal(index)
+	if err != nil {
+		return
+	}
+	if err := s.store.SetCached(ctx, lookup.indexKey, string(encoded), ttl); err != nil {
+		log.Printf("receipt cache index save failed err=%v", err)
+	}
+}
+
+func (s *Server) loadCachedReceipt(ctx context.Context, key string) (*ReceiptParseResult, bool) {
+	cached, ok, err := s.store.GetCached(ctx, key)
+	if err != nil {
+		log.Printf("receipt cache load failed err=%v", err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	var result ReceiptParseResult
+	if err := json.Unmarshal([]byte(cached), &result); err != nil {
+		return nil, false
+	}
+	result.Cached = true
+	return &result, true
+}
+
+func (s *Server) loadReceiptPHashIndex(ctx context.Context, key string) []receiptPHashEntry {
+	cached, ok, err := s.store.GetCached(ctx, key)
+	if err != nil || !ok {
+		return nil
+	}
+	var index []receiptPHashEntry
+	if err := json.Unmarshal([]byte(cached), &index); err != nil {
+		return nil
+	}
+	return index
+}
+
+// perceptualReceiptHash hashes the image and returns its height/width ratio.
+// It reports false when the image can't be decoded.
+func perceptualReceiptHash(data []byte) (receiptImageHash, float64, bool) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return receiptImageHash{}, 0, false
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return receiptImageHash{}, 0, false
+	}
+	luma, width, height := sampleImageLuma(img, 256)
+	const gridWidth, gridHeight = 17, 16
+	var grid [gridHeight][gridWidth]float64
+	for gy := 0; gy < gridHeight; gy++ {
+		y0, y1 := gy*height/gridHeight, maxInt((gy+1)*height/gridHeight, gy*height/gridHeight+1)
+		for gx := 0; gx < gridWidth; gx++ {
+			x0, x1 := gx*width/gridWidth, maxInt((gx+1)*width/gridWidth, gx*width/gridWidth+1)
+			sum, count := 0, 0
+			for y := y0; y < y1 && y < height; y++ {
+				for x := x0; x < x1 && x < width; x++ {
+					sum += int(luma[y*width+x])
+					count++
+				}
+			}
+			if count > 0 {
+				grid[gy][gx] = float64(sum) / float64(count)
+			}
+		}
+	}
+	var hash receiptImageHash
+	bit := 0
+	for gy := 0; gy < gridHeight; gy++ {
+		for gx := 0; gx < gridWidth-1; gx++ {
+			if grid[gy][gx] < grid[gy][gx+1] {
+				hash[bit/64] |= 1 << (bit % 64)
+			}
+			bit++
+		}
+	}
+	return hash, float64(bounds.Dy()) / float64(bounds.Dx()), true
+}
+
+func (h receiptImageHash) distance(other receiptImageHash) int {
+	distance := 0
+	for i := range h {
+		distance += bits.OnesCount64(h[i] ^ other[i])
+	}
+	return distance
+}
+
+func (h receiptImageHash) String() string {
+	return fmt.Sprintf("%016x%016x%016x%016x", h[0], h[1], h[2], h[3])
+}
+
+func parseReceiptImageHash(value string) (receiptImageHash, bool) {
+	var h receiptImageHash
+	if len(value) != 64 {
+		return h, false
+	}
+	if _, err := fmt.Sscanf(value, "%016x%016x%016x%016x", &h[0], &h[1], &h[2], &h[3]); err != nil {
+		return h, false
+	}
+	return h, true
+}
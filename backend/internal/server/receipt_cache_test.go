@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+type countingReceiptParser struct {
+	stubReceiptParser
+	calls *int
+}
+
+func (p countingReceiptParser) ParseReceipt(ctx context.Context, image []byte, contentType string) (*ReceiptParseResult, error) {
+	*p.calls++
+	return p.stubReceiptParser.ParseReceipt(ctx, image, contentType)
+}
+
+// testReceiptImage draws a white page with dark "text lines" of random
+// lengths; seed picks the lines.
+func testReceiptImage(seed int64) *image.Gray {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewGray(image.Rect(0, 0, 320, 720))
+	for i := range img.Pix {
+		img.Pix[i] = 245
+	}
+	for y := 30; y < 690; y += 24 {
+		start := 20 + rng.Intn(40)
+		end := start + 60 + rng.Intn(220)
+		for row := y; row < y+10; row++ {
+			for x := start; x < end && x < 300; x++ {
+				img.SetGray(x, row, color.Gray{Y: 20})
+			}
+		}
+	}
+	return img
+}
+
+func encodeTestImage(t *testing.T, img image.Image, asJPEG bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	if asJPEG {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReceiptParseCacheReusesResultsForTheSamePhoto(t *testing.T) {
+	calls := 0
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour, ReceiptCacheTTL: time.Hour}, memstore.New(time.Hour), HubOptions{})
+	srv.receiptChains = receiptChains{standard: []ReceiptParser{countingReceiptParser{calls: &calls}}}
+	ctx := context.Background()
+	parse := func(data []byte, contentType, mode string) *ReceiptParseResult {
+		t.Helper()
+		result, err := srv.parseReceipt(ctx, data, contentType, mode, true, nil)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		return result
+	}
+
+	original := testReceiptImage(1)
+	pngData := encodeTestImage(t, original, false)
+	if first := parse(pngData, "image/png", "standard"); first.Cached || calls != 1 {
+		t.Fatalf("expected a fresh parse, got cached=%v calls=%d", first.Cached, calls)
+	}
+	if again := parse(pngData, "image/png", "standard"); !again.Cached || again.Merchant != "Stub Diner" || calls != 1 {
+		t.Fatalf("expected the same bytes served from cache, got cached=%v calls=%d", again.Cached, calls)
+	}
+	if reencoded := parse(encodeTestImage(t, original, true), "image/jpeg", "standard"); !reencoded.Cached || calls != 1 {
+		t.Fatalf("expected a re-encoded copy to match perceptually, got cached=%v calls=%d", reencoded.Cached, calls)
+	}
+	if other := parse(encodeTestImage(t, testReceiptImage(2), false), "image/png", "standard"); other.Cached || calls != 2 {
+		t.Fatalf("expected a different receipt to be parsed, got cached=%v calls=%d", other.Cached, calls)
+	}
+	if accurate := parse(pngData, "image/png", "accurate"); accurate.Cached || calls != 3 {
+		t.Fatalf("expected a try-again parse to skip the standard cache, got cached=%v calls=%d", accurate.Cached, calls)
+	}
+
+	// Retrying goes back to the model even for a cached photo.
+	if retry := parse(pngData, "image/png", "retry"); retry.Cached || calls != 4 {
+		t.Fatalf("expected a retry to skip the cache, got cached=%v calls=%d", retry.Cached, calls)
+	}
+	// A retry's result is still cached, perceptual hash included.
+	third := testReceiptImage(3)
+	if retry := parse(encodeTestImage(t, third, false), "image/png", "retry"); retry.Cached || calls != 5 {
+		t.Fatalf("expected a retry to parse, got cached=%v calls=%d", retry.Cached, calls)
+	}
+	if reencoded := parse(encodeTestImage(t, third, true), "image/jpeg", "accurate"); !reencoded.Cached || calls != 5 {
+		t.Fatalf("expected the retry's result cached, got cached=%v calls=%d", reencoded.Cached, calls)
+	}
+}
+
+func TestPerceptualReceiptHashToleratesReencoding(t *testing.T) {
+	original, _, ok := perceptualReceiptHash(encodeTestImage(t, testReceiptImage(1), false))
+	if !ok {
+		t.Fatalf("expected the png to hash")
+	}
+	reencoded, _, _ := perceptualReceiptHash(encodeTestImage(t, testReceiptImage(1), true))
+	other, _, _ := perceptualReceiptHash(encodeTestImage(t, testReceiptImage(2), false))
+	if d := original.distance(reencoded); d > receiptPHashMaxDistance {
+		t.Fatalf("expected a jpeg copy within %d bits, got %d", receiptPHashMaxDistance, d)
+	}
+	if d := original.distance(other); d <= receiptPHashMaxDistance {
+		t.Fatalf("expected a different receipt further than %d bits, got %d", receiptPHashMaxDistance, d)
+	}
+	if parsed, ok := parseReceiptImageHash(original.String()); !ok || parsed != original {
+		t.Fatalf("expected the hash to round-trip, got %v %v", parsed, ok)
+	}
+	if _, _, ok := perceptualReceiptHash([]byte("not an image")); ok {
+		t.Fatalf("expected undecodable data to have no hash")
+	}
+}
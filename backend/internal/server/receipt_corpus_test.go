@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/cassette"
+)
+
+// receiptCorpusDir holds one directory per receipt: case.json with the ground
+// truth, cassette.json with the model responses recorded for it, and the image
+// the cassette was recorded from (only needed to re-record).
+const receiptCorpusDir = "testdata/receipts"
+
+type receiptCorpusCase struct {
+	Image       string `json:"image,omitempty"`
+	ParseMode   string `json:"parse_mode,omitempty"`
+	UserCropped bool   `json:"user_cropped,omitempty"`
+	// Providers pins the chain the cassette was recorded with, so changing
+	// the default models doesn't invalidate the corpus.
+	Providers []string                 `json:"providers,omitempty"`
+	Expect    receiptCorpusExpectation `json:"expect"`
+}
+
+type receiptCorpusExpectation struct {
+	Items         []receiptCorpusItem `json:"items"`
+	SubtotalCents *int                `json:"subtotal_cents,omitempty"`
+	TaxCents      *int                `json:"tax_cents,omitempty"`
+	TotalCents    *int                `json:"total_cents,omitempty"`
+	// Thresholds default to 1: a case that isn't parsed perfectly says so.
+	MinRecall      *float64 `json:"min_recall,omitempty"`
+	MinPrecision   *float64 `json:"min_precision,omitempty"`
+	MinAddonRecall *float64 `json:"min_addon_recall,omitempty"`
+}
+
+type receiptCorpusItem struct {
+	// Tokens must all appear in the parsed name or raw text.
+	Tokens []string `json:"tokens"`
+	// LineCents is the item's own line, add-ons excluded.
+	LineCents int                  `json:"line_cents"`
+	Addons    []receiptCorpusAddon `json:"addons,omitempty"`
+}
+
+type receiptCorpusAddon struct {
+	Tokens     []string `json:"tokens"`
+	PriceCents int      `json:"price_cents"`
+}
+
+type receiptCorpusEval struct {
+	ItemCount                 int      `json:"item_count"`
+	BaseTP                    int      `json:"base_tp"`
+	BasePrecision             float64  `json:"base_precision"`
+	BaseRecall                float64  `json:"base_recall"`
+	BaseLinePriceExactMatches int      `json:"base_line_price_exact_matches"`
+	AddonExpectedTotal        int      `json:"addon_expected_total"`
+	AddonParsedTotal          int      `json:"addon_parsed_total"`
+	AddonMatched              int      `json:"addon_matched"`
+	AddonRecall               float64  `json:"addon_recall"`
+	Missing                   []string `json:"missing,omitempty"`
+}
+
+// TestReceiptCorpus runs every receipt in the corpus through the whole parse
+// pipeline (decode, normalization, modifier tagging and consolidation) with the
+// model calls replayed from its cassette, and scores the result against the
+// case's ground truth.
+//
+// To record a case, or re-record one after a prompt or model change, set
+// RECORD_RECEIPT_CASSETTES=1 and the keys its providers need; the image named
+// in case.json is parsed live and cassette.json rewritten:
+//
+//	RECORD_RECEIPT_CASSETTES=1 GEMINI_API_KEY=... go test ./internal/server -run 'TestReceiptCorpus/<name>'
+func TestReceiptCorpus(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join(receiptCorpusDir, "*", "case.json"))
+	if err != nil {
+		t.Fatalf("glob corpus: %v", err)
+	}
+	if len(dirs) == 0 {
+		t.Fatalf("no receipts under %s", receiptCorpusDir)
+	}
+	record := os.Getenv("RECORD_RECEIPT_CASSETTES") != ""
+	for _, casePath := range dirs {
+		dir := filepath.Dir(casePath)
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			var tc receiptCorpusCase
+			raw, err := os.ReadFile(casePath)
+			if err != nil {
+				t.Fatalf("read case: %v", err)
+			}
+			if err := json.Unmarshal(raw, &tc); err != nil {
+				t.Fatalf("decode case: %v", err)
+			}
+
+			config := Config{GeminiKey: "replay", OpenAIKey: "replay", ReceiptProviders: tc.Providers, ReceiptRetryProviders: tc.Providers}
+			var recorder *cassette.Recorder
+			var replayer *cassette.Replayer
+			if record {
+				config.GeminiKey = strings.TrimSpace(os.Getenv("GEMINI_API_KEY"))
+				config.OpenAIKey = strings.TrimSpace(os.Getenv("OPENAI_API_KEY"))
+				recorder = &cassette.Recorder{}
+				useModelTransport(t, recorder)
+			} else {
+				recorded, err := cassette.Load(filepath.Join(dir, "cassette.json"))
+				if err != nil {
+					t.Fatalf("load cassette: %v", err)
+				}
+				replayer = cassette.NewReplayer(recorded)
+				useModelTransport(t, replayer)
+			}
+
+			data, contentType, userCropped := []byte("replayed"), "image/jpeg", true
+			if tc.Image != "" {
+				image, err := os.ReadFile(filepath.Join(dir, tc.Image))
+				switch {
+				case err == nil:
+					data, contentType, userCropped = image, http.DetectContentType(image), tc.UserCropped
+				case record || !errors.Is(err, os.ErrNotExist):
+					t.Fatalf("read image: %v", err)
+				}
+			}
+
+			s := &Server{receiptChains: newReceiptChains(config)}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer cancel()
+			result, err := s.parseReceipt(ctx, data, contentType, tc.ParseMode, userCropped, nil)
+			if record {
+				if saveErr := recorder.Cassette().Save(filepath.Join(dir, "cassette.json")); saveErr != nil {
+					t.Fatalf("save cassette: %v", saveErr)
+				}
+			}
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if replayer != nil && replayer.Unused() > 0 {
+				t.Errorf("%d recorded responses were never requested; re-record the cassette", replayer.Unused())
+			}
+
+			eval := evaluateReceiptCorpusCase(result, tc.Expect)
+			if blob, err := json.Marshal(eval); err == nil {
+				t.Logf("receipt_corpus_eval %s", blob)
+			}
+			if os.Getenv("RECEIPT_DEBUG_ITEMS") != "" {
+				if itemBlob, err := json.Marshal(result.Items); err == nil {
+					t.Logf("receipt_corpus_items %s", itemBlob)
+				}
+			}
+			if min := orOne(tc.Expect.MinRecall); eval.BaseRecall < min {
+				t.Errorf("recall %.2f below %.2f, missing %v", eval.BaseRecall, min, eval.Missing)
+			}
+			if min := orOne(tc.Expect.MinPrecision); eval.BasePrecision < min {
+				t.Errorf("precision %.2f below %.2f over %d parsed items", eval.BasePrecision, min, eval.ItemCount)
+			}
+			if eval.BaseLinePriceExactMatches < eval.BaseTP {
+				t.Errorf("only %d of %d matched items have the expected line price", eval.BaseLinePriceExactMatches, eval.BaseTP)
+			}
+			if min := orOne(tc.Expect.MinAddonRecall); eval.AddonExpectedTotal > 0 && eval.AddonRecall < min {
+				t.Errorf("add-on recall %.2f below %.2f", eval.AddonRecall, min)
+			}
+			expectCents(t, "subtotal", result.SubtotalCents, tc.Expect.SubtotalCents)
+			expectCents(t, "tax", result.TaxCents, tc.Expect.TaxCents)
+			expectCents(t, "total", result.TotalCents, tc.Expect.TotalCents)
+		})
+	}
+}
+
+// useModelTransport sends model calls through transport for the rest of the
+// test.
+func useModelTransport(t *testing.T, transport http.RoundTripper) {
+	previous := modelHTTPClient
+	modelHTTPClient = &http.Client{Transport: transport}
+	t.Cleanup(func() { modelHTTPClient = previous })
+}
+
+// evaluateReceiptCorpusCase matches each expected item to the first unmatched
+// parsed item containing all its tokens, then scores the matches' line prices
+// and add-ons.
+func evaluateReceiptCorpusCase(result *ReceiptParseResult, expect receiptCorpusExpectation) receiptCorpusEval {
+	eval := receiptCorpusEval{ItemCount: len(result.Items)}
+	for _, item := range result.Items {
+		eval.AddonParsedTotal += len(item.Addons)
+	}
+	used := make([]bool, len(result.Items))
+	for _, want := range expect.Items {
+		eval.AddonExpectedTotal += len(want.Addons)
+		found := -1
+		for i, item := range result.Items {
+			if used[i] {
+				continue
+			}
+			if containsAllTokens(normalizeForGroundTruth(item.Name+" "+ptrString(item.RawText)), want.Tokens...) {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			eval.Missing = append(eval.Missing, strings.Join(want.Tokens, " "))
+			continue
+		}
+		used[found] = true
+		eval.BaseTP++
+		item := result.Items[found]
+		if receiptItemLineCents(item) == want.LineCents {
+			eval.BaseLinePriceExactMatches++
+		}
+		addons := make([]groundTruthAddon, len(want.Addons))
+		for i, addon := range want.Addons {
+			addons[i] = groundTruthAddon{NameToken: strings.Join(addon.Tokens, " "), PriceCents: addon.PriceCents}
+		}
+		eval.AddonMatched += countMatchedExpectedAddons(item.Addons, addons)
+	}
+	if len(expect.Items) > 0 {
+		eval.BaseRecall = float64(eval.BaseTP) / float64(len(expect.Items))
+	}
+	if eval.ItemCount > 0 {
+		eval.BasePrecision = float64(eval.BaseTP) / float64(eval.ItemCount)
+	}
+	if eval.AddonExpectedTotal > 0 {
+		eval.AddonRecall = float64(eval.AddonMatched) / float64(eval.AddonExpectedTotal)
+	}
+	return eval
+}
+
+func expectCents(t *testing.T, field string, got, want *int) {
+	t.Helper()
+	if want == nil {
+		return
+	}
+	if got == nil || *got != *want {
+		t.Errorf("%s: expected %d cents, got %v", field, *want, formatCents(got))
+	}
+}
+
+func formatCents(value *int) any {
+	if value == nil {
+		return "none"
+	}
+	return *value
+}
+
+func orOne(value *float64) float64 {
+	if value == nil {
+		return 1
+	}
+	return *value
+}
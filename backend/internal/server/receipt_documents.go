@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/pdf"
+)
+
+// Receipts also arrive as emailed PDFs and iPhone HEIC photos. Both are turned
+// into ordinary images before the pipeline sees them (see
+// expandReceiptDocuments), except a PDF with a text layer, which is read
+// without a model call at all (see receiptFromPDFText).
+
+// receiptConverterTimeout bounds one run of an external converter.
+const receiptConverterTimeout = 60 * time.Second
+
+// receiptConverterLookPath finds the external converters; tests swap it to
+// pretend one is missing.
+var receiptConverterLookPath = exec.LookPath
+
+// heifBrands are the ISO-BMFF "ftyp" brands of HEIC/HEIF files.
+var heifBrands = map[string]string{
+	"heic": "image/heic", "heix": "image/heic", "heim": "image/heic", "heis": "image/heic",
+	"hevc": "image/heic-sequence", "hevx": "image/heic-sequence", "hevm": "image/heic-sequence", "hevs": "image/heic-sequence",
+	"mif1": "image/heif", "msf1": "image/heif-sequence",
+}
+
+// receiptUploadType returns the content type of an upload, going by its bytes
+// for PDFs and HEIC/HEIF photos: browsers often send those as
+// application/octet-stream, or label a HEIC photo image/jpeg.
+func receiptUploadType(data []byte, declared string) string {
+	if pdf.IsPDF(data) {
+		return "application/pdf"
+	}
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		if contentType, ok := heifBrands[string(data[8:12])]; ok {
+			return strings.TrimSuffix(contentType, "-sequence")
+		}
+	}
+	if declared == "" || declared == "application/octet-stream" {
+		return http.DetectContentType(data)
+	}
+	return declared
+}
+
+// checkReceiptPDF opens an uploaded PDF so a broken or password-protected one
+// is refused with the upload rather than failing the parse later.
+func checkReceiptPDF(data []byte) error {
+	if _, err := pdf.Open(data); err != nil {
+		if errors.Is(err, pdf.ErrEncrypted) {
+			return errors.New("This PDF is password-protected. Please upload an unlocked copy or a photo of the receipt.")
+		}
+		return errors.New("The PDF could not be read. Please upload a photo of the receipt instead.")
+	}
+	return nil
+}
+
+// receiptFromPDFText reads a single uploaded PDF from its text layer, the way
+// e-receipts and invoices are usually sent. It returns nil, and the PDF goes
+// to the model like a photo, unless the text gives line items and totals that
+// reconcile; a retry in accurate mode always goes to the model.
+func receiptFromPDFText(pages []receiptImage, parseMode string) *ReceiptParseResult {
+	if len(pages) != 1 || pages[0].contentType != "application/pdf" || receiptParseModeIsAccurate(parseMode) {
+		return nil
+	}
+	doc, err := pdf.Open(pages[0].data)
+	if err != nil {
+		return nil
+	}
+	var lines []string
+	for _, page := range doc.Pages() {
+		lines = append(lines, page.TextLines()...)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return receiptFromTextLines(lines)
+}
+
+// receiptFromTextLines builds a receipt from its printed lines: item lines as
+// the model-free fallback reads them, and the subtotal, tax, tip and total
+// from their labelled lines. It returns nil unless those figures reconcile.
+func receiptFromTextLines(lines []string) *ReceiptParseResult {
+	result := &ReceiptParseResult{
+		Currency:   receiptTextCurrency(lines),
+		Warnings:   []string{"Read from the PDF's text; no photo parsing was needed."},
+		Confidence: 0.95,
+	}
+	itemLines := make([]string, 0, len(lines))
+	var tax int
+	taxSeen := false
+	for _, line := range lines {
+		_, cents, ok := rightmostMoneyToken(line)
+		if !ok {
+			if result.Merchant == "" && hasAnyLetter(line) {
+				result.Merchant = strings.TrimSpace(line)
+			}
+			continue
+		}
+		lower := strings.ToLower(line)
+		isTax := strings.Contains(lower, "tax") || receiptTextVATPattern.MatchString(lower)
+		isTip := strings.Contains(lower, "tip") || strings.Contains(lower, "gratuity")
+		// "Total incl. tax", "VAT No." and "Suggested tip" lines print amounts
+		// that aren't charged on top.
+		notCharged := receiptTextNotChargedPattern.MatchString(lower)
+		switch {
+		case strings.Contains(lower, "subtotal") || strings.Contains(lower, "sub total") || strings.Contains(lower, "sub-total"):
+			if result.SubtotalCents == nil {
+				result.SubtotalCents = intPtr(cents)
+			}
+		case isTax && !notCharged:
+			// Receipts split tax into state, city and so on; they add up.
+			tax += cents
+			taxSeen = true
+		case isTip && !notCharged:
+			if result.TipCents == nil {
+				result.TipCents = intPtr(cents)
+			}
+		case strings.Contains(lower, "total") || strings.Contains(lower, "amount due") || strings.Contains(lower, "balance due"):
+			// The first total is the bill's; later ones are what was paid.
+			if result.TotalCents == nil {
+				result.TotalCents = intPtr(cents)
+			}
+		case !isTax && !isTip:
+			itemLines = append(itemLines, line)
+		}
+	}
+	result.Items = parseFallbackItemsFromLines(itemLines)
+	if taxSeen {
+		result.TaxCents = intPtr(tax)
+	}
+	if len(result.Items) == 0 || result.TotalCents == nil {
+		return nil
+	}
+	normalizeReceiptParseResult(result)
+	if result.SubtotalCents == nil {
+		return nil
+	}
+	// With no model to fall back on, the lines have to add up to the
+	// subtotal and the subtotal, charges, tax and tip to the total.
+	itemsSubtotal := maxInt(0, receiptItemsNetSubtotal(result.Items)-receiptBillDiscountCents(result))
+	if absInt(itemsSubtotal-*result.SubtotalCents) > 1 {
+		return nil
+	}
+	total := *result.SubtotalCents - receiptBillDiscountCents(result) + receiptBillChargesCents(result)
+	for _, cents := range []*int{result.TaxCents, result.TipCents} {
+		if cents != nil {
+			total += *cents
+		}
+	}
+	if absInt(total-*result.TotalCents) > 1 {
+		return nil
+	}
+	return result
+}
+
+var receiptTextVATPattern = regexp.MustCompile(`\bvat\b`)
+
+var receiptTextNotChargedPattern = regexp.MustCompile(`\b(?:incl|including|inclusive|suggested|reg|no|number)\b`)
+
+// receiptTextCurrency picks the currency from an ISO code printed on the
+// receipt, or from a symbol that names only one currency.
+func receiptTextCurrency(lines []string) string {
+	for _, line := range lines {
+		for _, word := range strings.FieldsFunc(line, func(r rune) bool { return !(r >= 'A' && r <= 'Z') }) {
+			if len(word) == 3 {
+				if code := normalizeCurrencyCode(word); code != "" {
+					return code
+				}
+			}
+		}
+	}
+	text := strings.Join(lines, "\n")
+	for symbol, code := range map[string]string{"€": "EUR", "£": "GBP", "₩": "KRW", "₹": "INR"} {
+		if strings.Contains(text, symbol) {
+			return code
+		}
+	}
+	return ""
+}
+
+// expandReceiptDocuments turns the uploads into images the pipeline reads,
+// where orientation normalization and the models take over as for any photo.
+// A HEIC photo is converted to JPEG. A PDF becomes one image per page: the
+// scan a page is made of when it is one, or the page rendered by pdftoppm
+// otherwise. Without the converters the file is passed on as it is; Gemini
+// reads both HEIC and PDF itself.
+func expandReceiptDocuments(ctx context.Context, uploads []receiptImage) ([]receiptImage, error) {
+	pages := make([]receiptImage, 0, len(uploads))
+	for _, upload := range uploads {
+		switch upload.contentType {
+		case "image/heic", "image/heif":
+			jpegs, err := runReceiptConverter(ctx, "heif-convert", "receipt.heic", upload.data, func(input, dir string) []string {
+				return []string{"-q", "92", input, filepath.Join(dir, "page.jpg")}
+			}, "page*.jpg")
+			if err != nil || len(jpegs) == 0 {
+				log.Printf("receipt heic conversion unavailable, sending as is err=%v", err)
+				pages = append(pages, upload)
+				continue
+			}
+			// A burst or live photo holds several images; the first is the
+			// primary one.
+			pages = append(pages, receiptImage{data: jpegs[0], contentType: "image/jpeg"})
+		case "application/pdf":
+			pages = append(pages, expandReceiptPDF(ctx, upload)...)
+		default:
+			pages = append(pages, upload)
+		}
+	}
+	if len(pages) > maxReceiptPages {
+		return nil, fmt.Errorf("the receipt has %d pages; at most %d can be read at once", len(pages), maxReceiptPages)
+	}
+	return pages, nil
+}
+
+func expandReceiptPDF(ctx context.Context, upload receiptImage) []receiptImage {
+	doc, err := pdf.Open(upload.data)
+	if err != nil {
+		return []receiptImage{upload}
+	}
+	scans := make([]receiptImage, 0, len(doc.Pages()))
+	for _, page := range doc.Pages() {
+		scan, ok := page.ScanImage()
+		if !ok {
+			break
+		}
+		scans = append(scans, receiptImage{data: scan.Data, contentType: scan.ContentType})
+	}
+	if len(scans) > 0 && len(scans) == len(doc.Pages()) {
+		return scans
+	}
+	rendered, err := runReceiptConverter(ctx, "pdftoppm", "receipt.pdf", upload.data, func(input, dir string) []string {
+		return []string{"-r", "200", "-png", "-l", fmt.Sprint(maxReceiptPages + 1), input, filepath.Join(dir, "page")}
+	}, "page*.png")
+	if err != nil || len(rendered) == 0 {
+		log.Printf("receipt pdf rendering unavailable, sending as is pages=%d err=%v", len(doc.Pages()), err)
+		return []receiptImage{upload}
+	}
+	pages := make([]receiptImage, len(rendered))
+	for i, data := range rendered {
+		pages[i] = receiptImage{data: data, contentType: "image/png"}
+	}
+	return pages
+}
+
+// runReceiptConverter runs an external converter on data in a scratch
+// directory and returns the files it wrote that match outputGlob, in name
+// order.
+func runReceiptConverter(ctx context.Context, tool, inputName string, data []byte, args func(input, dir string) []string, outputGlob string) ([][]byte, error) {
+	path, err := receiptConverterLookPath(tool)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "receipt-convert-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, inputName)
+	if err := os.WriteFile(input, data, 0o600); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, receiptConverterTimeout)
+	defer cancel()
+	if output, err := exec.CommandContext(ctx, path, args(input, dir)...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", tool, err, bytes.TrimSpace(output))
+	}
+	names, err := filepath.Glob(filepath.Join(dir, outputGlob))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	outputs := make([][]byte, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, data)
+	}
+	return outputs, nil
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+// testReceiptPDF writes a one-page PDF whose text layer is lines, each split
+// into a left-aligned label and a right-aligned amount the way e-receipts
+// set them.
+func testReceiptPDF(lines [][2]string) []byte {
+	var content strings.Builder
+	for i, line := range lines {
+		y := 760 - 16*i
+		fmt.Fprintf(&content, "BT /F1 10 Tf 1 0 0 1 60 %d Tm (%s) Tj ET\n", y, line[0])
+		if line[1] != "" {
+			fmt.Fprintf(&content, "BT /F1 10 Tf 1 0 0 1 480 %d Tm (%s) Tj ET\n", y, line[1])
+		}
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 5 0 R >> >> /Contents 4 0 R >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	}
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	for i, object := range objects {
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	b.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return b.Bytes()
+}
+
+func postReceiptFile(t *testing.T, url string, data []byte, contentType, parseMode string) (int, ReceiptParseResult, string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("parse_mode", parseMode)
+	part, _ := form.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="receipt"`},
+		"Content-Type":        {contentType},
+	})
+	part.Write(data)
+	form.Close()
+	resp, err := http.Post(url, form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer resp.Body.Close()
+	raw := new(bytes.Buffer)
+	raw.ReadFrom(resp.Body)
+	var result ReceiptParseResult
+	json.Unmarshal(raw.Bytes(), &result)
+	return resp.StatusCode, result, raw.String()
+}
+
+func TestReceiptParseReadsPDFTextWithoutModelCall(t *testing.T) {
+	original := receiptConverterLookPath
+	receiptConverterLookPath = func(string) (string, error) { return "", errors.New("not installed") }
+	t.Cleanup(func() { receiptConverterLookPath = original })
+
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour, ReceiptProviders: []string{"stub"}}, memstore.New(time.Hour), HubOptions{})
+	calls := 0
+	srv.receiptChains = receiptChains{
+		standard: []ReceiptParser{countingReceiptParser{calls: &calls}},
+		accurate: []ReceiptParser{countingReceiptParser{calls: &calls}},
+	}
+	ts := httptest.NewServer(srv.Routes())
+	t.Cleanup(ts.Close)
+
+	receipt := testReceiptPDF([][2]string{
+		{"Harbor Street Diner", ""},
+		{"Order 1042, table 7", ""},
+		{"Fish Tacos", "32.00"},
+		{"Key Lime Pie", "7.00"},
+		{"Subtotal", "39.00"},
+		{"Sales Tax", "3.41"},
+		{"Total", "42.41"},
+		{"Visa Paid", "42.41"},
+	})
+	// Mail clients hand PDFs over as application/octet-stream.
+	status, result, raw := postReceiptFile(t, ts.URL+"/api/receipt/parse", receipt, "application/octet-stream", "")
+	if status != http.StatusOK || calls != 0 {
+		t.Fatalf("expected the text layer read without a model call, got %d calls=%d %s", status, calls, raw)
+	}
+	if result.Merchant != "Harbor Street Diner" || itemNames(result.Items) != "Fish Tacos,Key Lime Pie" {
+		t.Fatalf("unexpected items %s", raw)
+	}
+	if *result.SubtotalCents != 3900 || *result.TaxCents != 341 || *result.TotalCents != 4241 {
+		t.Fatalf("unexpected totals %s", raw)
+	}
+
+	// A retry asks the model; with no scan in the PDF and no renderer
+	// installed, the PDF goes to it as it is.
+	status, result, raw = postReceiptFile(t, ts.URL+"/api/receipt/parse", receipt, "application/pdf", "accurate")
+	if status != http.StatusOK || calls != 1 || result.Merchant != "Stub Diner" {
+		t.Fatalf("expected an accurate retry to call the model, got %d calls=%d %s", status, calls, raw)
+	}
+
+	// Lines that don't add up to the subtotal aren't trusted.
+	short := testReceiptPDF([][2]string{{"Key Lime Pie", "7.00"}, {"Subtotal", "39.00"}, {"Total", "42.41"}})
+	if status, _, raw = postReceiptFile(t, ts.URL+"/api/receipt/parse", short, "application/pdf", ""); status != http.StatusOK || calls != 2 {
+		t.Fatalf("expected a PDF that doesn't add up to go to the model, got %d calls=%d %s", status, calls, raw)
+	}
+
+	encrypted := append(testReceiptPDF(nil), []byte("trailer\n<< /Root 1 0 R /Encrypt << /Filter /Standard >> >>\n")...)
+	if status, _, raw = postReceiptFile(t, ts.URL+"/api/receipt/parse", encrypted, "application/pdf", ""); status != http.StatusBadRequest || !strings.Contains(raw, "password-protected") {
+		t.Fatalf("expected an encrypted PDF refused, got %d %s", status, raw)
+	}
+}
+
+func TestReceiptUploadsSniffHEIC(t *testing.T) {
+	heic := append([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), make([]byte, 64)...)
+	if got := receiptUploadType(heic, "application/octet-stream"); got != "image/heic" {
+		t.Fatalf("expected image/heic, got %q", got)
+	}
+	if got := receiptUploadType(heic, "image/jpeg"); got != "image/heic" {
+		t.Fatalf("expected a mislabelled HEIC photo sniffed, got %q", got)
+	}
+	if got := receiptUploadType([]byte("\x89PNG\r\n\x1a\n"), ""); got != "image/png" {
+		t.Fatalf("expected image/png, got %q", got)
+	}
+
+	original := receiptConverterLookPath
+	receiptConverterLookPath = func(string) (string, error) { return "", errors.New("not installed") }
+	t.Cleanup(func() { receiptConverterLookPath = original })
+	pages, err := expandReceiptDocuments(context.Background(), []receiptImage{{data: heic, contentType: "image/heic"}})
+	if err != nil || len(pages) != 1 || pages[0].contentType != "image/heic" {
+		t.Fatalf("expected the HEIC photo passed on as it is without heif-convert, got %v %+v", err, pages)
+	}
+}
+
+func TestReceiptUploadRejectsOversizedBody(t *testing.T) {
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour, ReceiptProviders: []string{"stub"}}, memstore.New(time.Hour), HubOptions{})
+	ts := httptest.NewServer(srv.Routes())
+	t.Cleanup(ts.Close)
+
+	huge := append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte("["), maxReceiptUploadBytes)...)
+	status, _, raw := postReceiptFile(t, ts.URL+"/api/receipt/parse", huge, "application/pdf", "")
+	if status != http.StatusBadRequest || !strings.Contains(raw, "too large") {
+		t.Fatalf("expected an oversized upload refused, got %d %s", status, raw)
+	}
+
+	// The other upload endpoints read form fields before the file; the cap
+	// has to hold for those reads too.
+	created := createTestRoom(t, ts, "Alice")
+	for _, url := range []string{ts.URL + "/api/rooms/" + created.RoomCode + "/receipt", ts.URL + "/api/receipt/jobs"} {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("room_code", created.RoomCode)
+		form.WriteField("user_id", created.UserID)
+		form.WriteField("join_token", created.JoinToken)
+		part, _ := form.CreateFormFile("file", "receipt.pdf")
+		part.Write(huge)
+		form.Close()
+		resp, err := http.Post(url, form.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatalf("post %s: %v", url, err)
+		}
+		reply := new(bytes.Buffer)
+		reply.ReadFrom(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(reply.String(), "too large") {
+			t.Fatalf("expected an oversized upload to %s refused, got %d %s", url, resp.StatusCode, reply)
+		}
+	}
+}
+
+func TestReceiptFromTextLinesOnlyTrustsReconciledTotals(t *testing.T) {
+	result := receiptFromTextLines([]string{
+		"Corner Cafe",
+		"VAT No. 123456789",
+		"Flat White 3.50",
+		"Croissant 4.00",
+		"Subtotal 7.50",
+		"VAT 20% 0.60",
+		"Total 8.10",
+		"Total incl. tax 8.10",
+		"Suggested tip 18% 1.46",
+	})
+	if result == nil {
+		t.Fatal("expected a receipt that reconciles to be read")
+	}
+	if *result.SubtotalCents != 750 || *result.TaxCents != 60 || result.TipCents != nil || *result.TotalCents != 810 {
+		t.Fatalf("expected only charged amounts counted, got subtotal=%v tax=%v tip=%v total=%v",
+			*result.SubtotalCents, *result.TaxCents, result.TipCents, *result.TotalCents)
+	}
+
+	// A tip the total doesn't include means a line was misread; the model
+	// gets it instead.
+	if result := receiptFromTextLines([]string{"Flat White 3.50", "Croissant 4.00", "Subtotal 7.50", "Tax 0.60", "Tip 1.46", "Total 8.10"}); result != nil {
+		t.Fatalf("expected totals that don't reconcile to be refused, got %+v", result)
+	}
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+// sortOrderStep spaces imported receipt lines apart, as the web client does,
+// so items added later can slot in between.
+const sortOrderStep = 1000
+
+// maxItemWarnings caps the review reasons attached to one imported item.
+const maxItemWarnings = 3
+
+var genericItemNamePattern = regexp.MustCompile(`(?i)^item\b`)
+var addonLabelPrefixPattern = regexp.MustCompile(`(?i)^\s*(?:\+|add(?:\s+on)?\b|extra\b|with\b|w/\b)\s*`)
+
+type ReceiptImportResponse struct {
+	RoomCode string              `json:"room_code"`
+	Seq      int64               `json:"seq"`
+	ItemIDs  []string            `json:"item_ids"`
+	Currency string              `json:"currency"`
+	Receipt  *ReceiptParseResult `json:"receipt"`
+}
+
+// handleRoomReceipt parses a receipt upload and adds it to the room in one
+// go: the items, whichever of the bill's tax, tip, discount and charges the
+// receipt shows, and the receipt's currency are applied as a single batch by
+// the uploading participant (who authenticates with user_id and join_token
+// form fields), so every socket gets one "ops" message and the import is one
+// undo.
+func (s *Server) handleRoomReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	roomCode := strings.ToUpper(strings.TrimSpace(r.PathValue("code")))
+	if roomCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := parseReceiptForm(w, r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]any{"error": err.Error()})
+		return
+	}
+	userID := strings.TrimSpace(r.FormValue("user_id"))
+	if userID == "" || !s.verifyJoinToken(roomCode, userID, r.FormValue("join_token")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if len(s.receiptChains.standard) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]any{"error": errNoReceiptParser.Error()})
+		return
+	}
+	ctx := r.Context()
+	if !s.hub.restoreRoom(ctx, roomCode) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	pages, err := readReceiptUploads(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]any{"error": err.Error()})
+		return
+	}
+	result, err := s.parseReceiptPages(ctx, pages, receiptParseMode(r), receiptUserCropped(r), nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]any{"error": err.Error()})
+		return
+	}
+	response, err := s.importReceipt(ctx, roomCode, userID, result)
+	var rejection *batchRejection
+	if errors.As(err, &rejection) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]any{"error": rejection.reason, "receipt": result})
+		return
+	}
+	if err != nil {
+		log.Printf("receipt import failed room=%s actor=%s err=%v", roomCode, userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, response)
+}
+
+// importReceipt materializes a parsed receipt into the room as one batch by
+// actorID.
+func (s *Server) importReceipt(ctx context.Context, roomCode, actorID string, result *ReceiptParseResult) (ReceiptImportResponse, error) {
+	doc, _ := s.hub.loadDoc(ctx, roomCode)
+	ops, itemIDs, err := receiptImportOps(doc, result, time.Now().UnixMilli())
+	if err != nil {
+		return ReceiptImportResponse{}, err
+	}
+	seq, err := s.hub.applyBatch(ctx, roomCode, actorID, ops)
+	if err != nil {
+		return ReceiptImportResponse{}, err
+	}
+	currency := doc.Currency
+	if code := normalizeCurrencyCode(result.Currency); code != "" {
+		currency = code
+	}
+	log.Printf("receipt imported room=%s seq=%d actor=%s items=%d currency=%s", roomCode, seq, actorID, len(itemIDs), currency)
+	return ReceiptImportResponse{RoomCode: roomCode, Seq: seq, ItemIDs: itemIDs, Currency: currency, Receipt: result}, nil
+}
+
+// receiptImportLine is one or more identical receipt lines, merged the way
+// the web client's review screen merges them.
+type receiptImportLine struct {
+	name        string
+	quantity    float64
+	unitCents   int
+	lineCents   int
+	discount    int
+	discountPct float64
+	addons      []map[string]any
+	warnings    []string
+}
+
+// receiptImportOps translates a parsed receipt into the ops the web client
+// would send after review: identical lines merged and then fanned out into
+// one single-quantity item each ("Pho #1", "Pho #2"), add-on prices folded
+// into the item price with the add-ons kept in meta, review warnings plus the
+// parser's warnings that name the item, sort orders continuing
+// after the room's items, a set_tax_tip for the bill-level amounts the
+// receipt shows, and a set_room_name switching to the receipt's currency if
+// it is supported and different. It returns the ops and the new item ids.
+func receiptImportOps(doc *crdt.RoomDoc, result *ReceiptParseResult, now int64) ([]crdt.Op, []string, error) {
+	if result == nil {
+		return nil, nil, errors.New("no receipt to import")
+	}
+	var lines []*receiptImportLine
+	byKey := map[string]*receiptImportLine{}
+	for _, parsed := range result.Items {
+		line := newReceiptImportLine(parsed)
+		line.warnings = mergeItemWarnings(line.warnings, receiptWarningsNaming(result.Warnings, parsed.Name))
+		key := fmt.Sprintf("%s|%s|%d|%d|%g", strings.ToLower(line.name), receiptAddonSignature(line.addons), line.unitCents, line.discount, line.discountPct)
+		if existing := byKey[key]; existing != nil {
+			existing.quantity += line.quantity
+			existing.lineCents += line.lineCents
+			existing.warnings = mergeItemWarnings(existing.warnings, line.warnings)
+			continue
+		}
+		byKey[key] = line
+		lines = append(lines, line)
+	}
+
+	var ops []crdt.Op
+	if code := normalizeCurrencyCode(result.Currency); code != "" && code != doc.Currency {
+		ops = append(ops, receiptImportOp("set_room_name", crdt.RoomPayload{Currency: code}, now))
+	}
+	nextSortOrder := nextStandaloneSortOrder(doc)
+	var itemIDs []string
+	for _, line := range lines {
+		count := 1
+		if whole := math.Round(line.quantity); whole >= 1 && math.Abs(line.quantity-whole) < 0.0001 {
+			count = int(whole)
+		}
+		if count > maxItemQuantity {
+			return nil, nil, fmt.Errorf("%q has a quantity over %d", line.name, maxItemQuantity)
+		}
+		// The line total is split evenly, the cents left over going one each
+		// to the first items, so the fanned-out items add back up to it.
+		baseLine, remainder := line.lineCents/count, line.lineCents%count
+		if line.lineCents == 0 {
+			baseLine = line.unitCents
+		}
+		for i := 0; i < count; i++ {
+			name := line.name
+			if count > 1 {
+				name = fmt.Sprintf("%s #%d", line.name, i+1)
+			}
+			unitLine := baseLine
+			if i < remainder {
+				unitLine++
+			}
+			unit := line.unitCents
+			if unit == 0 {
+				unit = unitLine
+			}
+			sortOrder := nextSortOrder + int64(i)
+			item := crdt.Item{
+				ID:              uuid.NewString(),
+				Name:            name,
+				Quantity:        1,
+				UnitPriceCents:  unit,
+				LinePriceCents:  unitLine,
+				DiscountCents:   max(0, min(unitLine, line.discount)),
+				DiscountPercent: line.discountPct,
+				Assigned:        map[string]bool{},
+				SortOrder:       &sortOrder,
+				Warnings:        line.warnings,
+			}
+			if len(line.addons) > 0 {
+				item.Meta = map[string]any{"addons": line.addons}
+			}
+			itemIDs = append(itemIDs, item.ID)
+			ops = append(ops, receiptImportOp("set_item", crdt.ItemPayload{Item: item}, now))
+		}
+		nextSortOrder += sortOrderStep
+	}
+
+	if taxTip, ok := receiptTaxTipPayload(result); ok {
+		ops = append(ops, receiptImportOp("set_tax_tip", taxTip, now))
+	}
+	return ops, itemIDs, nil
+}
+
+// receiptTaxTipPayload sets only the bill-level amounts the receipt shows, so
+// an import doesn't wipe a tip or discount already entered in the room. It
+// reports false when the receipt shows none of them.
+func receiptTaxTipPayload(result *ReceiptParseResult) (crdt.TaxTipPayload, bool) {
+	var payload crdt.TaxTipPayload
+	if result.TaxCents != nil {
+		tax := max(0, *result.TaxCents)
+		payload.TaxCents = &tax
+	}
+	if result.TipCents != nil {
+		tip := max(0, *result.TipCents)
+		payload.TipCents = &tip
+	}
+	if result.BillDiscountCents != nil {
+		discount := receiptBillDiscountCents(result)
+		payload.BillDiscountCents = &discount
+	}
+	if result.BillChargesCents != nil {
+		charges := receiptBillChargesCents(result)
+		payload.BillChargesCents = &charges
+	}
+	found := payload.TaxCents != nil || payload.TipCents != nil || payload.BillDiscountCents != nil || payload.BillChargesCents != nil
+	return payload, found
+}
+
+func newReceiptImportLine(parsed ReceiptItem) *receiptImportLine {
+	line := &receiptImportLine{
+		name:     truncateRunes(normalizeReceiptLabel(parsed.Name), maxOpNameLength),
+		quantity: receiptItemQuantity(parsed),
+		warnings: receiptItemWarnings(parsed),
+	}
+	if line.name == "" {
+		line.name = "Item"
+	}
+	addonCents := 0
+	for _, addon := range parsed.Addons {
+		label := addon.Name
+		if strings.TrimSpace(label) == "" {
+			label = ptrString(addon.RawText)
+		}
+		name := truncateRunes(normalizeReceiptLabel(addonLabelPrefixPattern.ReplaceAllString(label, "")), maxOpNameLength)
+		price := max(0, intOrZero(addon.PriceCents))
+		if name == "" && price == 0 {
+			continue
+		}
+		if name == "" {
+			name = "Addon"
+		}
+		addonCents += price
+		line.addons = append(line.addons, map[string]any{"name": name, "price_cents": price})
+	}
+	unit := max(0, intOrZero(parsed.UnitPriceCents))
+	lineCents := receiptItemLineCents(parsed)
+	if unit == 0 && lineCents > 0 {
+		unit = int(math.Round(float64(lineCents) / line.quantity))
+	}
+	if lineCents == 0 && unit > 0 {
+		lineCents = int(math.Round(float64(unit) * line.quantity))
+	}
+	line.unitCents = unit + addonCents
+	line.lineCents = lineCents + int(math.Round(float64(addonCents)*line.quantity))
+	line.discount = max(0, intOrZero(parsed.DiscountCents))
+	if parsed.DiscountPercent != nil && *parsed.DiscountPercent > 0 {
+		line.discountPct = min(*parsed.DiscountPercent, maxDiscountRatio)
+		if line.discount == 0 && unit > 0 {
+			line.discount = int(math.Round(float64(unit) * line.discountPct / 100))
+		}
+	}
+	return line
+}
+
+// receiptItemWarnings flags what a reviewer should double-check on a parsed
+// line; the web client highlights the same things on its review screen.
+func receiptItemWarnings(item ReceiptItem) []string {
+	var warnings []string
+	name := strings.TrimSpace(item.Name)
+	if name == "" || genericItemNamePattern.MatchString(name) {
+		warnings = append(warnings, "Name may be incomplete")
+	}
+	if strings.TrimSpace(ptrString(item.RawText)) == "" {
+		warnings = append(warnings, "Missing source line text")
+	}
+	hasQty := item.Quantity != nil && *item.Quantity > 0
+	if !hasQty || math.Abs(*item.Quantity-math.Round(*item.Quantity)) > 0.0001 {
+		warnings = append(warnings, "Quantity may need review")
+	}
+	hasUnit := item.UnitPriceCents != nil && *item.UnitPriceCents >= 0
+	hasLine := item.LinePriceCents != nil && *item.LinePriceCents >= 0
+	switch {
+	case !hasUnit && !hasLine:
+		warnings = append(warnings, "Missing price value")
+	case hasUnit && hasLine && hasQty:
+		expected := *item.UnitPriceCents * max(1, int(math.Round(*item.Quantity)))
+		tolerance := max(2, int(math.Round(float64(expected)*0.06)))
+		if absInt(expected-*item.LinePriceCents) > tolerance {
+			warnings = append(warnings, "Unit × quantity does not match total")
+		}
+	}
+	hasDiscount := item.DiscountCents != nil && *item.DiscountCents > 0
+	if item.DiscountPercent != nil && *item.DiscountPercent > 0 && !hasDiscount && !hasUnit {
+		warnings = append(warnings, "Discount percent may not map cleanly")
+	}
+	if hasDiscount && hasUnit && *item.DiscountCents > *item.UnitPriceCents {
+		warnings = append(warnings, "Discount is larger than unit price")
+	}
+	for _, addon := range item.Addons {
+		if strings.TrimSpace(addon.Name) == "" || addon.PriceCents == nil || *addon.PriceCents < 0 {
+			warnings = append(warnings, "Add-on details may be incomplete")
+			break
+		}
+	}
+	if len(warnings) > maxItemWarnings {
+		warnings = warnings[:maxItemWarnings]
+	}
+	return warnings
+}
+
+// receiptWarningsNaming picks the parser's warnings that mention an item by
+// name, e.g. "Price for Pad Thai is unclear". The rest are about the whole
+// receipt and stay on the parse result.
+func receiptWarningsNaming(warnings []string, name string) []string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	// Very short names would match unrelated words.
+	if utf8.RuneCountInString(name) < 3 {
+		return nil
+	}
+	var named []string
+	for _, warning := range warnings {
+		if strings.Contains(strings.ToLower(warning), name) {
+			named = append(named, strings.TrimSpace(warning))
+		}
+	}
+	return named
+}
+
+func mergeItemWarnings(left, right []string) []string {
+	out := append([]string(nil), left...)
+	for _, warning := range right {
+		seen := false
+		for _, existing := range out {
+			if existing == warning {
+				seen = true
+				break
+			}
+		}
+		if !seen && len(out) < maxItemWarnings {
+			out = append(out, warning)
+		}
+	}
+	return out
+}
+
+func receiptAddonSignature(addons []map[string]any) string {
+	parts := make([]string, len(addons))
+	for i, addon := range addons {
+		parts[i] = fmt.Sprintf("%s:%d", strings.ToLower(addon["name"].(string)), addon["price_cents"].(int))
+	}
+	return strings.Join(parts, "|")
+}
+
+// nextStandaloneSortOrder is the first multiple of sortOrderStep after every
+// item in the room.
+func nextStandaloneSortOrder(doc *crdt.RoomDoc) int64 {
+	maxOrder := int64(-sortOrderStep)
+	for _, item := range doc.Items {
+		if item != nil && item.SortOrder != nil && *item.SortOrder > maxOrder {
+			maxOrder = *item.SortOrder
+		}
+	}
+	if maxOrder < 0 {
+		return sortOrderStep
+	}
+	return (maxOrder/sortOrderStep + 1) * sortOrderStep
+}
+
+func receiptImportOp(kind string, payload any, now int64) crdt.Op {
+	data, _ := json.Marshal(payload)
+	return crdt.Op{ID: uuid.NewString(), Kind: kind, Timestamp: now, Payload: data}
+}
+
+func intOrZero(v *int) int {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+func truncateRunes(value string, limit int) string {
+	if utf8.RuneCountInString(value) <= limit {
+		return value
+	}
+	return string([]rune(value)[:limit])
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+func TestReceiptImportOpsFansOutLinesAndFoldsAddons(t *testing.T) {
+	existing := int64(2500)
+	doc := &crdt.RoomDoc{
+		Currency:     "USD",
+		Items:        map[string]*crdt.Item{"old": {ID: "old", Name: "Bread", SortOrder: &existing}},
+		Participants: map[string]*crdt.Participant{},
+		Tombstones:   map[string]int64{},
+	}
+	qty := 2.0
+	result := &ReceiptParseResult{
+		Items: []ReceiptItem{
+			{Name: "Pho -", Quantity: &qty, UnitPriceCents: intPtr(1500), LinePriceCents: intPtr(3000), RawText: strPtr("2 Pho 30.00"),
+				Addons: []ReceiptAddon{{Name: "+ brisket", PriceCents: intPtr(300)}}},
+			{Name: "Thai tea", LinePriceCents: intPtr(500), RawText: strPtr("Thai tea 5.00")},
+		},
+		TaxCents: intPtr(400),
+		TipCents: intPtr(900),
+		Currency: "eur",
+		Warnings: []string{"Primary parse failed; fallback stub used.", "Thai tea may be a refill."},
+	}
+
+	ops, itemIDs, err := receiptImportOps(doc, result, 1)
+	if err != nil {
+		t.Fatalf("import ops: %v", err)
+	}
+	if len(itemIDs) != 3 || len(ops) != 5 {
+		t.Fatalf("expected 3 items in 5 ops, got %d items %d ops", len(itemIDs), len(ops))
+	}
+	if ops[0].Kind != "set_room_name" || !bytes.Contains(ops[0].Payload, []byte(`"currency":"EUR"`)) {
+		t.Fatalf("expected the currency switch first, got %s %s", ops[0].Kind, ops[0].Payload)
+	}
+	for _, op := range ops {
+		if err := validateOp(doc, op); err != nil {
+			t.Fatalf("%s does not validate: %v", op.Kind, err)
+		}
+		crdt.ApplyOp(doc, op)
+	}
+	first, second, tea := doc.Items[itemIDs[0]], doc.Items[itemIDs[1]], doc.Items[itemIDs[2]]
+	if first.Name != "Pho #1" || second.Name != "Pho #2" || first.UnitPriceCents != 1800 || first.LinePriceCents != 1800 {
+		t.Fatalf("expected two single Pho with the add-on in the price, got %+v %+v", first, second)
+	}
+	if *first.SortOrder != 3000 || *second.SortOrder != 3001 || *tea.SortOrder != 4000 {
+		t.Fatalf("expected sort orders after the room's items, got %d %d %d", *first.SortOrder, *second.SortOrder, *tea.SortOrder)
+	}
+	addons, _ := json.Marshal(first.Meta["addons"])
+	if string(addons) != `[{"name":"brisket","price_cents":300}]` {
+		t.Fatalf("expected the add-on in meta, got %s", addons)
+	}
+	if len(first.Warnings) != 0 || len(tea.Warnings) != 2 || tea.Warnings[0] != "Quantity may need review" || tea.Warnings[1] != "Thai tea may be a refill." {
+		t.Fatalf("expected only the tea flagged, with the parser's warning naming it, got %v %v", first.Warnings, tea.Warnings)
+	}
+	if doc.Currency != "EUR" || doc.TaxCents != 400 || doc.TipCents != 900 {
+		t.Fatalf("expected EUR with tax and tip, got %s %d %d", doc.Currency, doc.TaxCents, doc.TipCents)
+	}
+}
+
+func TestReceiptImportOpsKeepsBillAmountsTheReceiptLacks(t *testing.T) {
+	doc := crdt.NewRoom("ROOM", "")
+	doc.TipCents = 500
+	doc.BillChargesCents = 200
+
+	ops, _, err := receiptImportOps(doc, &ReceiptParseResult{Items: []ReceiptItem{{Name: "Fries", LinePriceCents: intPtr(500)}}}, 1)
+	if err != nil {
+		t.Fatalf("import ops: %v", err)
+	}
+	for _, op := range ops {
+		if op.Kind == "set_tax_tip" {
+			t.Fatalf("expected no set_tax_tip for a receipt without bill amounts, got %s", op.Payload)
+		}
+	}
+
+	ops, _, err = receiptImportOps(doc, &ReceiptParseResult{TaxCents: intPtr(80)}, 1)
+	if err != nil {
+		t.Fatalf("import ops: %v", err)
+	}
+	for _, op := range ops {
+		crdt.ApplyOp(doc, op)
+	}
+	if doc.TaxCents != 80 || doc.TipCents != 500 || doc.BillChargesCents != 200 {
+		t.Fatalf("expected only the tax replaced, got tax=%d tip=%d charges=%d", doc.TaxCents, doc.TipCents, doc.BillChargesCents)
+	}
+}
+
+func TestReceiptImportOpsSplitsUnevenLineTotals(t *testing.T) {
+	doc := crdt.NewRoom("ROOM", "")
+	qty := 3.0
+	ops, itemIDs, err := receiptImportOps(doc, &ReceiptParseResult{Items: []ReceiptItem{{Name: "Dumplings", Quantity: &qty, LinePriceCents: intPtr(1000)}}}, 1)
+	if err != nil {
+		t.Fatalf("import ops: %v", err)
+	}
+	for _, op := range ops {
+		crdt.ApplyOp(doc, op)
+	}
+	var got []int
+	total := 0
+	for _, id := range itemIDs {
+		got = append(got, doc.Items[id].LinePriceCents)
+		total += doc.Items[id].LinePriceCents
+	}
+	if len(got) != 3 || got[0] != 334 || got[1] != 333 || got[2] != 333 || total != 1000 {
+		t.Fatalf("expected 10.00 split 3.34/3.33/3.33, got %v", got)
+	}
+}
+
+func TestImportReceiptIsOneBatch(t *testing.T) {
+	srv, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, conn, "snapshot")
+
+	result := &ReceiptParseResult{
+		Items:    []ReceiptItem{{Name: "Fries", LinePriceCents: intPtr(500)}, {Name: "Soda", LinePriceCents: intPtr(300)}},
+		TaxCents: intPtr(80),
+	}
+	response, err := srv.importReceipt(context.Background(), created.RoomCode, created.UserID, result)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	broadcast := readUntil(t, conn, "ops")
+	if broadcast.Seq != response.Seq || len(response.ItemIDs) != 2 {
+		t.Fatalf("expected one ops broadcast through seq %d, got %s", response.Seq, broadcast.Raw)
+	}
+	if items := resyncItems(t, conn); len(items) != 2 || items[response.ItemIDs[0]].Name != "Fries" {
+		t.Fatalf("expected the receipt items in the room, got %+v", items)
+	}
+
+	conn.WriteJSON(map[string]any{"type": "undo"})
+	readUntil(t, conn, "ack")
+	if items := resyncItems(t, conn); len(items) != 0 {
+		t.Fatalf("expected undo to remove the whole import, got %+v", items)
+	}
+}
+
+func TestRoomReceiptNeedsJoinToken(t *testing.T) {
+	_, ts := newSignedTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("user_id", created.UserID)
+	form.WriteField("join_token", "forged")
+	form.Close()
+	resp, err := http.Post(ts.URL+"/api/rooms/"+created.RoomCode+"/receipt", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+}
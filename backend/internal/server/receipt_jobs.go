@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Stages of a receipt parse, in the order they can start. fallback only runs
+// when the primary model fails, tagging only when the result has rows that
+// look like modifiers.
+const (
+	receiptStagePreprocess = "preprocess"
+	receiptStagePrimary    = "primary_model"
+	receiptStageFallback   = "fallback_model"
+	receiptStageNormalize  = "normalization"
+	receiptStageTagging    = "tagging"
+)
+
+const (
+	receiptJobQueued  = "queued"
+	receiptJobRunning = "running"
+	receiptJobDone    = "done"
+	receiptJobFailed  = "failed"
+)
+
+const (
+	defaultReceiptJobWorkers = 4
+	// receiptJobQueuePerWorker caps the jobs held per worker, the one it is
+	// parsing included; each holds its uploads until it runs.
+	receiptJobQueuePerWorker = 8
+	// receiptJobOverhead is a job's time outside model calls and conversion:
+	// preprocessing, normalization and saving its progress.
+	receiptJobOverhead = 30 * time.Second
+	// receiptJobTTL is how long a job and its result can be fetched.
+	receiptJobTTL = time.Hour
+)
+
+// ReceiptJob is a receipt parse running in the background. It is kept in the
+// store's cache, so any node can answer for it, and while it runs every
+// change is broadcast to RoomCode's sockets as a "receipt_job" message.
+type ReceiptJob struct {
+	ID        string              `json:"id"`
+	RoomCode  string              `json:"room_code,omitempty"`
+	Status    string              `json:"status"`
+	Stage     string              `json:"stage,omitempty"`
+	Error     string              `json:"error,omitempty"`
+	Result    *ReceiptParseResult `json:"result,omitempty"`
+	CreatedAt int64               `json:"created_at"`
+	UpdatedAt int64               `json:"updated_at"`
+}
+
+var errReceiptQueueFull = errors.New("Receipt parsing is busy right now. Please try again in a minute.")
+
+// receiptParseFunc runs one parse, reporting each stage as it starts.
+type receiptParseFunc func(ctx context.Context, progress func(stage string)) (*ReceiptParseResult, error)
+
+// handleSubmitReceiptJob takes the same form as /api/receipt/parse and answers
+// 202 with the queued job straight away, so the upload doesn't have to outlive
+// the model calls. With room_code (plus user_id and join_token) the room's
+// sockets get the job's progress.
+func (s *Server) handleSubmitReceiptJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.receiptChains.standard) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]any{"error": errNoReceiptParser.Error()})
+		return
+	}
+	if err := parseReceiptForm(w, r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]any{"error": err.Error()})
+		return
+	}
+	ctx := r.Context()
+	roomCode := strings.ToUpper(strings.TrimSpace(r.FormValue("room_code")))
+	if roomCode != "" {
+		userID := strings.TrimSpace(r.FormValue("user_id"))
+		if userID == "" || !s.verifyJoinToken(roomCode, userID, r.FormValue("join_token")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !s.hub.restoreRoom(ctx, roomCode) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	pages, err := readReceiptUploads(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]any{"error": err.Error()})
+		return
+	}
+	parseMode := receiptParseMode(r)
+	userCropped := receiptUserCropped(r)
+	job, err := s.startReceiptJob(ctx, roomCode, s.receiptJobTimeout(parseMode), func(ctx context.Context, progress func(string)) (*ReceiptParseResult, error) {
+		return s.parseReceiptPages(ctx, pages, parseMode, userCropped, progress)
+	})
+	if errors.Is(err, errReceiptQueueFull) {
+		log.Printf("receipt job queue full room=%s", roomCode)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeJSON(w, map[string]any{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("receipt job submit failed room=%s err=%v", roomCode, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, job)
+}
+
+func (s *Server) handleReceiptJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	job, ok, err := s.loadReceiptJob(r.Context(), strings.TrimSpace(r.PathValue("id")))
+	if err != nil {
+		log.Printf("receipt job load failed id=%s err=%v", r.PathValue("id"), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, job)
+}
+
+// receiptJobTimeout bounds one job in parseMode: a document conversion, then
+// every model call the mode's chain can make, each to its own deadline.
+func (s *Server) receiptJobTimeout(parseMode string) time.Duration {
+	return receiptConverterTimeout + s.receiptChains.budget(receiptParseModeIsAccurate(parseMode)) + receiptJobOverhead
+}
+
+// startReceiptJob records a queued job and runs parse in the background, for
+// at most timeout, once a worker slot is free. It returns the job as queued, or errReceiptQueueFull
+// when too many jobs are already waiting.
+func (s *Server) startReceiptJob(ctx context.Context, roomCode string, timeout time.Duration, parse receiptParseFunc) (ReceiptJob, error) {
+	select {
+	case s.receiptQueue <- struct{}{}:
+	default:
+		return ReceiptJob{}, errReceiptQueueFull
+	}
+	now := time.Now().UnixMilli()
+	job := ReceiptJob{
+		ID:        uuid.NewString(),
+		RoomCode:  roomCode,
+		Status:    receiptJobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.saveReceiptJob(ctx, job); err != nil {
+		<-s.receiptQueue
+		return ReceiptJob{}, err
+	}
+	go s.runReceiptJob(job, timeout, parse)
+	return job, nil
+}
+
+func (s *Server) runReceiptJob(job ReceiptJob, timeout time.Duration, parse receiptParseFunc) {
+	defer func() { <-s.receiptQueue }()
+	s.receiptSlots <- struct{}{}
+	defer func() { <-s.receiptSlots }()
+
+	start := time.Now()
+	job.Status = receiptJobRunning
+	s.updateReceiptJob(&job)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	result, err := parse(ctx, func(stage string) {
+		job.Stage = stage
+		s.updateReceiptJob(&job)
+	})
+	if err != nil {
+		job.Status = receiptJobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = receiptJobDone
+		job.Result = result
+	}
+	s.updateReceiptJob(&job)
+	log.Printf("receipt job finished id=%s room=%s status=%s stage=%s total_ms=%d", job.ID, job.RoomCode, job.Status, job.Stage, time.Since(start).Milliseconds())
+}
+
+// updateReceiptJob saves the job and tells its room. It runs outside any
+// request, so it uses its own context: a job that timed out still records
+// that it failed.
+func (s *Server) updateReceiptJob(job *ReceiptJob) {
+	job.UpdatedAt = time.Now().UnixMilli()
+	if err := s.saveReceiptJob(context.Background(), *job); err != nil {
+		log.Printf("receipt job save failed id=%s err=%v", job.ID, err)
+	}
+	if job.RoomCode != "" {
+		s.hub.broadcast(job.RoomCode, map[string]any{"type": "receipt_job", "job": *job})
+	}
+}
+
+func receiptJobKey(id string) string {
+	return "receipt_job:" + id
+}
+
+func (s *Server) saveReceiptJob(ctx context.Context, job ReceiptJob) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.store.SetCached(ctx, receiptJobKey(job.ID), string(encoded), receiptJobTTL)
+}
+
+func (s *Server) loadReceiptJob(ctx context.Context, id string) (ReceiptJob, bool, error) {
+	if id == "" {
+		return ReceiptJob{}, false, nil
+	}
+	cached, ok, err := s.store.GetCached(ctx, receiptJobKey(id))
+	if err != nil || !ok {
+		return ReceiptJob{}, false, err
+	}
+	var job ReceiptJob
+	if err := json.Unmarshal([]byte(cached), &job); err != nil {
+		return ReceiptJob{}, false, err
+	}
+	return job, true, nil
+}
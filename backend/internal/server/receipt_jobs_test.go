@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+func getReceiptJob(t *testing.T, ts *httptest.Server, id string) (int, ReceiptJob) {
+	t.Helper()
+	resp, err := http.Get(ts.URL + "/api/receipt/jobs/" + id)
+	if err != nil {
+		t.Fatalf("get job: %v", err)
+	}
+	defer resp.Body.Close()
+	var job ReceiptJob
+	json.NewDecoder(resp.Body).Decode(&job)
+	return resp.StatusCode, job
+}
+
+func TestReceiptJobReportsStagesToRoom(t *testing.T) {
+	srv, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, conn, "snapshot")
+
+	release := make(chan struct{})
+	job, err := srv.startReceiptJob(context.Background(), created.RoomCode, time.Minute, func(ctx context.Context, progress func(string)) (*ReceiptParseResult, error) {
+		progress(receiptStagePrimary)
+		<-release
+		progress(receiptStageNormalize)
+		return &ReceiptParseResult{Merchant: "Pho Place", Items: []ReceiptItem{{Name: "Pho"}}}, nil
+	})
+	if err != nil || job.Status != receiptJobQueued {
+		t.Fatalf("expected a queued job, got %+v %v", job, err)
+	}
+
+	var stages []string
+	for {
+		var message struct {
+			Job ReceiptJob `json:"job"`
+		}
+		json.Unmarshal(readUntil(t, conn, "receipt_job").Raw, &message)
+		if message.Job.ID != job.ID {
+			t.Fatalf("unexpected job %+v", message.Job)
+		}
+		if message.Job.Stage == receiptStagePrimary {
+			// The job is mid-parse: fetching it shows where it is.
+			if status, running := getReceiptJob(t, ts, job.ID); status != http.StatusOK || running.Status != receiptJobRunning {
+				t.Fatalf("expected the job running, got %d %+v", status, running)
+			}
+			close(release)
+		}
+		if message.Job.Status == receiptJobDone {
+			break
+		}
+		stages = append(stages, message.Job.Status+"/"+message.Job.Stage)
+	}
+	want := []string{"running/", "running/primary_model", "running/normalization"}
+	if len(stages) != len(want) || stages[0] != want[0] || stages[1] != want[1] || stages[2] != want[2] {
+		t.Fatalf("expected stages %v, got %v", want, stages)
+	}
+
+	status, done := getReceiptJob(t, ts, job.ID)
+	if status != http.StatusOK || done.Status != receiptJobDone || done.Result == nil || done.Result.Merchant != "Pho Place" {
+		t.Fatalf("expected the finished result, got %d %+v", status, done)
+	}
+}
+
+func TestReceiptJobRecordsFailure(t *testing.T) {
+	srv, ts := newTestServer(t)
+	job, err := srv.startReceiptJob(context.Background(), "", time.Minute, func(ctx context.Context, progress func(string)) (*ReceiptParseResult, error) {
+		return nil, errors.New("model unavailable")
+	})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, current := getReceiptJob(t, ts, job.ID)
+		if current.Status == receiptJobFailed {
+			if current.Error != "model unavailable" || current.Result != nil {
+				t.Fatalf("expected the parse error, got %+v", current)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job never failed: %+v", current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status, _ := getReceiptJob(t, ts, "missing"); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown job, got %d", status)
+	}
+}
+
+func TestReceiptJobQueueRefusesWhenFull(t *testing.T) {
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour, ReceiptJobWorkers: 1}, memstore.New(time.Hour), HubOptions{})
+	release := make(chan struct{})
+	blocked := func(ctx context.Context, progress func(string)) (*ReceiptParseResult, error) {
+		<-release
+		return &ReceiptParseResult{}, nil
+	}
+	for i := 0; i < receiptJobQueuePerWorker; i++ {
+		if _, err := srv.startReceiptJob(context.Background(), "", time.Minute, blocked); err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+	}
+	if _, err := srv.startReceiptJob(context.Background(), "", time.Minute, blocked); !errors.Is(err, errReceiptQueueFull) {
+		t.Fatalf("expected the queue full, got %v", err)
+	}
+
+	// Finished jobs free their place in the queue.
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := srv.startReceiptJob(context.Background(), "", time.Minute, blocked)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue never drained: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReceiptJobTimeoutCoversTheChain(t *testing.T) {
+	srv, _ := newTestServer(t)
+	srv.receiptChains = receiptChains{
+		standard: []ReceiptParser{
+			&geminiReceiptParser{model: "primary", timeout: 180 * time.Second},
+			&openAIReceiptParser{model: "fallback", timeout: 45 * time.Second},
+		},
+	}
+	// Both parse calls, then Gemini's tagging call, each to its deadline.
+	calls := 180*time.Second + 45*time.Second + geminiModifierTaggingTimeout
+	if got := srv.receiptJobTimeout(""); got < calls {
+		t.Fatalf("expected a job budget of at least %s, got %s", calls, got)
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// maxReceiptPages caps the photos in one parse; each is its own model call.
+const maxReceiptPages = 6
+
+// maxReceiptUploadBytes caps the whole request body of a receipt upload.
+const maxReceiptUploadBytes = 40 << 20
+
+// receiptImage is one uploaded photo.
+type receiptImage struct {
+	data        []byte
+	contentType string
+}
+
+// parseReceiptPages parses the photos of one receipt, once PDFs and HEIC
+// photos are turned into images (see expandReceiptDocuments). A long receipt
+// comes as several overlapping photos, top to bottom: each is parsed on its
+// own, at the same time and through the same pipeline (and cache) as a single
+// photo, then the results are stitched together (see mergeReceiptPages).
+func (s *Server) parseReceiptPages(ctx context.Context, pages []receiptImage, parseMode string, userCropped bool, progress func(stage string)) (*ReceiptParseResult, error) {
+	if progress == nil {
+		progress = func(string) {}
+	}
+	if result := receiptFromPDFText(pages, parseMode); result != nil {
+		progress(receiptStagePreprocess)
+		progress(receiptStageNormalize)
+		return result, nil
+	}
+	pages, err := expandReceiptDocuments(ctx, pages)
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 1 {
+		return s.parseReceipt(ctx, pages[0].data, pages[0].contentType, parseMode, userCropped, progress)
+	}
+	// Pages move through the stages at their own pace; report each stage
+	// once, when the first page reaches it.
+	var mu sync.Mutex
+	reported := map[string]bool{}
+	report := func(stage string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !reported[stage] {
+			reported[stage] = true
+			progress(stage)
+		}
+	}
+
+	results := make([]*ReceiptParseResult, len(pages))
+	errs := make([]error, len(pages))
+	var wg sync.WaitGroup
+	for i, page := range pages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = s.parseReceipt(ctx, page.data, page.contentType, parseMode, userCropped, report)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("photo %d of %d: %w", i+1, len(pages), err)
+		}
+	}
+	return mergeReceiptPages(results), nil
+}
+
+// mergeReceiptPages stitches the parses of consecutive photos of one receipt.
+// Lines that appear at the bottom of one photo and again at the top of the
+// next are kept once. The subtotal, tax, tip and total come from the last
+// photo that has any, since only the bottom of the receipt prints them, and
+// the stitched lines are checked against that subtotal.
+func mergeReceiptPages(pages []*ReceiptParseResult) *ReceiptParseResult {
+	merged := &ReceiptParseResult{Items: []ReceiptItem{}, Warnings: []string{}, Confidence: 1, Cached: true}
+	dropped := 0
+	for i, page := range pages {
+		if merged.Merchant == "" {
+			merged.Merchant = page.Merchant
+		}
+		if merged.Currency == "" {
+			merged.Currency = page.Currency
+		}
+		items := page.Items
+		if i > 0 {
+			overlap := receiptPageOverlap(merged.Items, items)
+			items = items[overlap:]
+			dropped += overlap
+		}
+		merged.Items = append(merged.Items, items...)
+		for _, warning := range page.Warnings {
+			appendReceiptWarningUnique(merged, warning)
+		}
+		merged.Fees = appendUniqueStrings(merged.Fees, page.Fees)
+		merged.UnparsedLines = appendUniqueStrings(merged.UnparsedLines, page.UnparsedLines)
+		if page.Confidence < merged.Confidence {
+			merged.Confidence = page.Confidence
+		}
+		merged.Cached = merged.Cached && page.Cached
+	}
+	for i := len(pages) - 1; i >= 0; i-- {
+		page := pages[i]
+		if page.SubtotalCents == nil && page.TaxCents == nil && page.TotalCents == nil {
+			continue
+		}
+		merged.SubtotalCents = page.SubtotalCents
+		merged.BillDiscountCents = page.BillDiscountCents
+		merged.BillChargesCents = page.BillChargesCents
+		merged.TaxCents = page.TaxCents
+		merged.TipCents = page.TipCents
+		merged.TotalCents = page.TotalCents
+		break
+	}
+
+	message := fmt.Sprintf("Stitched %d photos into one receipt.", len(pages))
+	if dropped > 0 {
+		message = fmt.Sprintf("Stitched %d photos into one receipt; dropped %d line%s repeated where they overlap.", len(pages), dropped, map[bool]string{true: "", false: "s"}[dropped == 1])
+	}
+	appendReceiptWarningUnique(merged, message)
+	repairItemLinePricesAgainstSubtotal(merged)
+	normalizeSubtotalFromTotalAndTax(merged)
+	if merged.SubtotalCents != nil && *merged.SubtotalCents > 0 {
+		itemsSubtotal := maxInt(0, receiptItemsNetSubtotal(merged.Items)-receiptBillDiscountCents(merged))
+		if absInt(itemsSubtotal-*merged.SubtotalCents) > 1 {
+			appendReceiptWarningUnique(merged, "Stitched lines don't add up to the receipt's subtotal; a line may be missing or repeated where the photos overlap.")
+		}
+	}
+	return merged
+}
+
+// receiptPageOverlap returns how many lines at the start of next repeat the
+// end of previous: the longest run that matches line for line.
+func receiptPageOverlap(previous, next []ReceiptItem) int {
+	longest := len(previous)
+	if len(next) < longest {
+		longest = len(next)
+	}
+	for size := longest; size > 0; size-- {
+		tail := previous[len(previous)-size:]
+		matches := true
+		for i := 0; i < size; i++ {
+			if !sameReceiptLine(tail[i], next[i]) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return size
+		}
+	}
+	return 0
+}
+
+// sameReceiptLine reports whether two parsed lines are the same printed line:
+// the same raw text, or, when either lacks it, the same name and price.
+func sameReceiptLine(a, b ReceiptItem) bool {
+	if receiptItemLineCents(a) != receiptItemLineCents(b) {
+		return false
+	}
+	rawA, rawB := receiptLineKey(ptrString(a.RawText)), receiptLineKey(ptrString(b.RawText))
+	if rawA != "" && rawB != "" {
+		return rawA == rawB
+	}
+	return receiptLineKey(a.Name) == receiptLineKey(b.Name)
+}
+
+// receiptLineKey folds case, spacing and punctuation, which differ between two
+// reads of the same line.
+func receiptLineKey(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func appendUniqueStrings(values, more []string) []string {
+	for _, value := range more {
+		seen := false
+		for _, existing := range values {
+			if existing == value {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+func pageItem(name string, cents int, raw string) ReceiptItem {
+	return ReceiptItem{Name: name, UnitPriceCents: intPtr(cents), LinePriceCents: intPtr(cents), RawText: textPtr(raw)}
+}
+
+func itemNames(items []ReceiptItem) string {
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestMergeReceiptPagesDropsOverlapAndUsesLastPageTotals(t *testing.T) {
+	top := &ReceiptParseResult{
+		Merchant: "Harbor Street Diner",
+		Items: []ReceiptItem{
+			pageItem("Oysters", 1800, "Oysters 18.00"),
+			pageItem("Chowder", 900, "Chowder 9.00"),
+			pageItem("Fish Tacos", 1600, "1 Fish Tacos 16.00"),
+		},
+		Currency:   "USD",
+		Warnings:   []string{},
+		Confidence: 0.9,
+		Cached:     true,
+	}
+	bottom := &ReceiptParseResult{
+		Items: []ReceiptItem{
+			// The same printed line, read a little differently.
+			pageItem("Fish tacos", 1600, "1  FISH TACOS  16.00"),
+			pageItem("Key Lime Pie", 700, "Key Lime Pie 7.00"),
+		},
+		SubtotalCents: intPtr(5000),
+		TaxCents:      intPtr(438),
+		TotalCents:    intPtr(5438),
+		Warnings:      []string{},
+		Confidence:    0.8,
+	}
+
+	merged := mergeReceiptPages([]*ReceiptParseResult{top, bottom})
+	if got := itemNames(merged.Items); got != "Oysters,Chowder,Fish Tacos,Key Lime Pie" {
+		t.Fatalf("expected the overlapping line kept once, got %s", got)
+	}
+	if merged.Merchant != "Harbor Street Diner" || merged.Currency != "USD" || merged.Confidence != 0.8 || merged.Cached {
+		t.Fatalf("unexpected header fields %+v", merged)
+	}
+	if *merged.SubtotalCents != 5000 || *merged.TaxCents != 438 || *merged.TotalCents != 5438 {
+		t.Fatalf("expected the last page's totals, got %+v", merged)
+	}
+	if strings.Join(merged.Warnings, "|") != "Stitched 2 photos into one receipt; dropped 1 line repeated where they overlap." {
+		t.Fatalf("unexpected warnings %q", merged.Warnings)
+	}
+
+	// Two reads that don't meet in the middle leave the lines short of the
+	// subtotal, which the stitched result should flag.
+	gap := &ReceiptParseResult{Items: []ReceiptItem{pageItem("Key Lime Pie", 700, "Key Lime Pie 7.00")}, SubtotalCents: intPtr(6600), Warnings: []string{}, Confidence: 0.8}
+	merged = mergeReceiptPages([]*ReceiptParseResult{top, gap})
+	if len(merged.Items) != 4 || !strings.Contains(strings.Join(merged.Warnings, "|"), "don't add up to the receipt's subtotal") {
+		t.Fatalf("expected a subtotal mismatch warning, got %d items %q", len(merged.Items), merged.Warnings)
+	}
+}
+
+func TestReceiptPageOverlapNeedsAWholeRun(t *testing.T) {
+	previous := []ReceiptItem{pageItem("Beer", 600, "Beer 6.00"), pageItem("Fries", 500, "Fries 5.00")}
+	// Beer matches the first line of the next page but Fries doesn't follow it,
+	// so the two Beers are different lines.
+	next := []ReceiptItem{pageItem("Fries", 500, "Fries 5.00"), pageItem("Beer", 600, "Beer 6.00")}
+	if overlap := receiptPageOverlap(previous, next); overlap != 1 {
+		t.Fatalf("expected only Fries to overlap, got %d", overlap)
+	}
+	if overlap := receiptPageOverlap(previous, []ReceiptItem{pageItem("Fries", 550, "Fries 5.50")}); overlap != 0 {
+		t.Fatalf("expected a different price not to overlap, got %d", overlap)
+	}
+}
+
+func postReceiptPhotos(t *testing.T, url string, count int) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("user_cropped", "1")
+	for i := 0; i < count; i++ {
+		part, _ := form.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {`form-data; name="file"; filename="receipt.png"`},
+			"Content-Type":        {"image/png"},
+		})
+		part.Write([]byte("not really a png"))
+	}
+	form.Close()
+	resp, err := http.Post(url, form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	return resp
+}
+
+func TestReceiptParseStitchesSeveralPhotos(t *testing.T) {
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour, ReceiptProviders: []string{"stub"}}, memstore.New(time.Hour), HubOptions{})
+	ts := httptest.NewServer(srv.Routes())
+	t.Cleanup(ts.Close)
+
+	resp := postReceiptPhotos(t, ts.URL+"/api/receipt/parse", 2)
+	defer resp.Body.Close()
+	var result ReceiptParseResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	// The stub reads every photo as the same receipt, so the second photo
+	// overlaps the first entirely.
+	if resp.StatusCode != http.StatusOK || itemNames(result.Items) != "Burger,Fries,Lemonade" || *result.TotalCents != 4623 {
+		t.Fatalf("expected one stitched stub receipt, got %d %+v", resp.StatusCode, result)
+	}
+	if !strings.Contains(strings.Join(result.Warnings, "|"), "dropped 3 lines repeated") {
+		t.Fatalf("expected the stitch reported, got %q", result.Warnings)
+	}
+
+	tooMany := postReceiptPhotos(t, ts.URL+"/api/receipt/parse", maxReceiptPages+1)
+	defer tooMany.Body.Close()
+	if tooMany.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected more than %d photos rejected, got %d", maxReceiptPages, tooMany.StatusCode)
+	}
+}
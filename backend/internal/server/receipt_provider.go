@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ReceiptParser reads a receipt image into a ReceiptParseResult. Parsers are
+// tried in chains (see receiptChains): the first to succeed wins.
+type ReceiptParser interface {
+	// Name identifies the parser in logs and errors, e.g. "gemini:gemini-2.5-flash-lite".
+	Name() string
+	ParseReceipt(ctx context.Context, image []byte, contentType string) (*ReceiptParseResult, error)
+}
+
+// receiptModifierTagger is a parser that can also classify which parsed rows
+// are modifiers of the row above them.
+type receiptModifierTagger interface {
+	TagModifiers(ctx context.Context, result *ReceiptParseResult) ([]ReceiptModifierTag, error)
+}
+
+// Default per-call timeouts, overridable with "@duration" in a provider spec.
+const (
+	defaultGeminiReceiptTimeout = 180 * time.Second
+	defaultOpenAIReceiptTimeout = 45 * time.Second
+	defaultOpenAIReceiptModel   = "gpt-4o"
+)
+
+var errNoReceiptParser = errors.New("receipt parsing is not configured")
+
+// receiptChains holds the parsers to try for each parse mode.
+type receiptChains struct {
+	standard []ReceiptParser
+	accurate []ReceiptParser
+}
+
+func (c receiptChains) forMode(preferHighAccuracy bool) []ReceiptParser {
+	if preferHighAccuracy && len(c.accurate) > 0 {
+		return c.accurate
+	}
+	return c.standard
+}
+
+// receiptTimedParser is a parser whose calls each run to their own deadline.
+type receiptTimedParser interface {
+	callTimeout() time.Duration
+}
+
+// budget is how long a parse in one mode can take when every call its chain
+// makes runs to its deadline: each parser tried in turn, then each one that
+// tags modifiers.
+func (c receiptChains) budget(preferHighAccuracy bool) time.Duration {
+	var total time.Duration
+	for _, parser := range c.forMode(preferHighAccuracy) {
+		timed, ok := parser.(receiptTimedParser)
+		if !ok {
+			continue
+		}
+		total += timed.callTimeout()
+		if _, ok := parser.(receiptModifierTagger); ok {
+			total += min(timed.callTimeout(), geminiModifierTaggingTimeout)
+		}
+	}
+	return total
+}
+
+// newReceiptChains builds the parser chains from config. Without
+// RECEIPT_PROVIDERS it keeps the Gemini primary/fallback models, or uses
+// OpenAI when only that key is set.
+func newReceiptChains(config Config) receiptChains {
+	standard, accurate := config.ReceiptProviders, config.ReceiptRetryProviders
+	if len(standard) == 0 {
+		switch {
+		case config.GeminiKey != "":
+			standard = []string{"gemini:" + geminiModelPrimary, "gemini:" + geminiModelFallback}
+			if len(accurate) == 0 {
+				accurate = []string{"gemini:" + geminiModelRetryPrimary, "gemini:" + geminiModelRetryFallback}
+			}
+		case config.OpenAIKey != "":
+			standard = []string{"openai:" + defaultOpenAIReceiptModel}
+		}
+	}
+	return receiptChains{
+		standard: buildReceiptChain(standard, config, false),
+		accurate: buildReceiptChain(accurate, config, true),
+	}
+}
+
+// buildReceiptChain parses provider specs, skipping (and logging) ones that
+// are invalid or lack a key, and repeats of a parser already in the chain.
+func buildReceiptChain(specs []string, config Config, accurate bool) []ReceiptParser {
+	var chain []ReceiptParser
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		parser, err := newReceiptParser(spec, config, accurate)
+		if err != nil {
+			log.Printf("receipt provider skipped spec=%q err=%v", spec, err)
+			continue
+		}
+		if seen[parser.Name()] {
+			continue
+		}
+		seen[parser.Name()] = true
+		chain = append(chain, parser)
+	}
+	return chain
+}
+
+// newReceiptParser builds a parser from a spec of the form
+// "vendor[:model][@timeout]", e.g. "gemini:gemini-2.5-flash-lite@90s",
+// "openai:gpt-4o" or "stub".
+func newReceiptParser(spec string, config Config, accurate bool) (ReceiptParser, error) {
+	spec = strings.TrimSpace(spec)
+	var timeout time.Duration
+	if at := strings.LastIndex(spec, "@"); at >= 0 {
+		parsed, err := time.ParseDuration(spec[at+1:])
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("bad timeout %q", spec[at+1:])
+		}
+		timeout = parsed
+		spec = spec[:at]
+	}
+	vendor, model, _ := strings.Cut(spec, ":")
+	switch strings.ToLower(vendor) {
+	case "gemini":
+		if config.GeminiKey == "" {
+			return nil, errors.New("GEMINI_API_KEY is not set")
+		}
+		if model == "" {
+			model = geminiModelPrimary
+		}
+		temperature := geminiReceiptTemperatureStandard
+		if accurate {
+			temperature = geminiReceiptTemperatureRetry
+		}
+		return &geminiReceiptParser{apiKey: config.GeminiKey, model: model, temperature: temperature, timeout: orDuration(timeout, defaultGeminiReceiptTimeout)}, nil
+	case "openai":
+		if config.OpenAIKey == "" {
+			return nil, errors.New("OPENAI_API_KEY is not set")
+		}
+		if model == "" {
+			model = defaultOpenAIReceiptModel
+		}
+		return &openAIReceiptParser{apiKey: config.OpenAIKey, model: model, timeout: orDuration(timeout, defaultOpenAIReceiptTimeout)}, nil
+	case "stub":
+		return stubReceiptParser{}, nil
+	default:
+		return nil, fmt.Errorf("unknown receipt provider %q", vendor)
+	}
+}
+
+func orDuration(value, fallback time.Duration) time.Duration {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// parseWithChain tries each parser in turn and returns the first result with
+// the index of the parser that produced it. progress gets the primary stage
+// for the first parser and the fallback stage for the rest.
+func parseWithChain(ctx context.Context, chain []ReceiptParser, image []byte, contentType string, progress func(string)) (*ReceiptParseResult, int, error) {
+	if len(chain) == 0 {
+		return nil, 0, errNoReceiptParser
+	}
+	var failures []string
+	for i, parser := range chain {
+		if i == 0 {
+			progress(receiptStagePrimary)
+		} else {
+			progress(receiptStageFallback)
+		}
+		result, err := parser.ParseReceipt(ctx, image, contentType)
+		if err == nil {
+			if i > 0 {
+				log.Printf("receipt parse fallback: %s succeeded after %s", parser.Name(), strings.Join(failures, "; "))
+			}
+			return result, i, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s failed (%v)", parser.Name(), err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, errors.New(strings.Join(failures, "; "))
+}
+
+// tagWithChain asks the chain's taggers, in order, to tag modifier rows.
+func tagWithChain(ctx context.Context, chain []ReceiptParser, result *ReceiptParseResult) ([]ReceiptModifierTag, error) {
+	var failures []string
+	for _, parser := range chain {
+		tagger, ok := parser.(receiptModifierTagger)
+		if !ok {
+			continue
+		}
+		tags, err := tagger.TagModifiers(ctx, result)
+		if err == nil {
+			return tags, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s modifier-tagging failed (%v)", parser.Name(), err))
+	}
+	if len(failures) == 0 {
+		return nil, errors.New("no parser in the chain tags modifiers")
+	}
+	return nil, errors.New(strings.Join(failures, "; "))
+}
+
+type geminiReceiptParser struct {
+	apiKey      string
+	model       string
+	temperature float64
+	timeout     time.Duration
+}
+
+func (p *geminiReceiptParser) Name() string { return "gemini:" + p.model }
+
+func (p *geminiReceiptParser) callTimeout() time.Duration { return p.timeout }
+
+func (p *geminiReceiptParser) ParseReceipt(ctx context.Context, image []byte, contentType string) (*ReceiptParseResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return callGeminiReceiptParseWithModel(ctx, p.apiKey, image, contentType, p.model, p.temperature)
+}
+
+func (p *geminiReceiptParser) TagModifiers(ctx context.Context, result *ReceiptParseResult) ([]ReceiptModifierTag, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return callGeminiModifierTaggingWithModel(ctx, p.apiKey, p.model, result)
+}
+
+type openAIReceiptParser struct {
+	apiKey  string
+	model   string
+	timeout time.Duration
+}
+
+func (p *openAIReceiptParser) Name() string { return "openai:" + p.model }
+
+func (p *openAIReceiptParser) callTimeout() time.Duration { return p.timeout }
+
+func (p *openAIReceiptParser) ParseReceipt(ctx context.Context, image []byte, contentType string) (*ReceiptParseResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return callOpenAIReceiptParse(ctx, p.apiKey, p.model, image, contentType)
+}
+
+// stubReceiptParser answers every image with the same small receipt, for
+// running the app and its tests without any model key.
+type stubReceiptParser struct{}
+
+func (stubReceiptParser) Name() string { return "stub" }
+
+func (stubReceiptParser) ParseReceipt(ctx context.Context, image []byte, contentType string) (*ReceiptParseResult, error) {
+	if len(image) == 0 {
+		return nil, errors.New("empty image")
+	}
+	quantity := 2.0
+	return &ReceiptParseResult{
+		Merchant: "Stub Diner",
+		Items: []ReceiptItem{
+			{Name: "Burger", Quantity: &quantity, UnitPriceCents: intPtr(1250), LinePriceCents: intPtr(2500), RawText: textPtr("2 Burger 25.00"),
+				Addons: []ReceiptAddon{{Name: "Bacon", PriceCents: intPtr(200), RawText: textPtr("+ Bacon 2.00")}}},
+			{Name: "Fries", UnitPriceCents: intPtr(450), LinePriceCents: intPtr(450), RawText: textPtr("Fries 4.50")},
+			{Name: "Lemonade", UnitPriceCents: intPtr(375), LinePriceCents: intPtr(375), RawText: textPtr("Lemonade 3.75")},
+		},
+		SubtotalCents: intPtr(3725),
+		TaxCents:      intPtr(298),
+		TipCents:      intPtr(600),
+		TotalCents:    intPtr(4623),
+		Currency:      "USD",
+		Warnings:      []string{"Parsed by the offline stub provider."},
+		Confidence:    1,
+	}, nil
+}
+
+func textPtr(value string) *string {
+	return &value
+}
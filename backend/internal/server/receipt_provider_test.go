@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
+)
+
+type failingReceiptParser struct{ name string }
+
+func (p failingReceiptParser) Name() string { return p.name }
+
+func (p failingReceiptParser) ParseReceipt(ctx context.Context, image []byte, contentType string) (*ReceiptParseResult, error) {
+	return nil, errors.New("unavailable")
+}
+
+func chainNames(chain []ReceiptParser) string {
+	names := make([]string, len(chain))
+	for i, parser := range chain {
+		names[i] = parser.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func TestReceiptChainsFromConfig(t *testing.T) {
+	chains := newReceiptChains(Config{GeminiKey: "key"})
+	if got := chainNames(chains.standard); got != "gemini:"+geminiModelPrimary {
+		t.Fatalf("expected the repeated default model once, got %s", got)
+	}
+	if got := chainNames(chains.accurate); got != "gemini:"+geminiModelRetryPrimary+",gemini:"+geminiModelRetryFallback {
+		t.Fatalf("expected the try-again models, got %s", got)
+	}
+
+	chains = newReceiptChains(Config{
+		OpenAIKey:        "key",
+		ReceiptProviders: []string{"openai:gpt-4o-mini@5s", "gemini:gemini-2.5-flash", "bogus", "stub"},
+	})
+	if got := chainNames(chains.standard); got != "openai:gpt-4o-mini,stub" {
+		t.Fatalf("expected keyless and unknown providers skipped, got %s", got)
+	}
+	if timeout := chains.standard[0].(*openAIReceiptParser).timeout; timeout != 5*time.Second {
+		t.Fatalf("expected the spec's timeout, got %s", timeout)
+	}
+	if got := chainNames(chains.forMode(true)); got != "openai:gpt-4o-mini,stub" {
+		t.Fatalf("expected try-again to fall back to the standard chain, got %s", got)
+	}
+}
+
+func TestParseWithChainFailsOverAcrossProviders(t *testing.T) {
+	var stages []string
+	progress := func(stage string) { stages = append(stages, stage) }
+	chain := []ReceiptParser{failingReceiptParser{name: "openai:gpt-4o"}, stubReceiptParser{}}
+	result, used, err := parseWithChain(context.Background(), chain, []byte("image"), "image/png", progress)
+	if err != nil || used != 1 || result.Merchant != "Stub Diner" {
+		t.Fatalf("expected the stub to answer, got %+v %d %v", result, used, err)
+	}
+	if strings.Join(stages, ",") != "primary_model,fallback_model" {
+		t.Fatalf("unexpected stages %v", stages)
+	}
+
+	_, _, err = parseWithChain(context.Background(), []ReceiptParser{failingReceiptParser{name: "a"}, failingReceiptParser{name: "b"}}, []byte("image"), "image/png", func(string) {})
+	if err == nil || err.Error() != "a failed (unavailable); b failed (unavailable)" {
+		t.Fatalf("expected every failure reported, got %v", err)
+	}
+}
+
+func TestRoomReceiptImportsWithStubProvider(t *testing.T) {
+	srv := NewServerWithStore(Config{RoomTTL: time.Hour, ReceiptProviders: []string{"stub"}}, memstore.New(time.Hour), HubOptions{})
+	ts := httptest.NewServer(srv.Routes())
+	t.Cleanup(ts.Close)
+	created := createTestRoom(t, ts, "Alice")
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("user_id", created.UserID)
+	form.WriteField("join_token", created.JoinToken)
+	form.WriteField("user_cropped", "1")
+	part, _ := form.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="receipt.png"`},
+		"Content-Type":        {"image/png"},
+	})
+	part.Write([]byte("not really a png"))
+	form.Close()
+	resp, err := http.Post(ts.URL+"/api/rooms/"+created.RoomCode+"/receipt", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer resp.Body.Close()
+	var imported ReceiptImportResponse
+	json.NewDecoder(resp.Body).Decode(&imported)
+	if resp.StatusCode != http.StatusOK || len(imported.ItemIDs) != 4 || imported.Receipt.Merchant != "Stub Diner" {
+		t.Fatalf("expected the stub receipt imported, got %d %+v", resp.StatusCode, imported)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	_ "image/jpeg"
@@ -25,28 +26,90 @@ import (
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/archive"
 	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/memstore"
 	"github.com/aschi2/MultiplayerBillSplit/backend/internal/redisstore"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/settlement"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/storage"
 )
 
 type Server struct {
 	config Config
 	hub    *Hub
-	store  *redisstore.Store
+	store  storage.Store
+	// receiptSlots bounds how many receipt jobs parse at once, receiptQueue
+	// how many are held, parsing or waiting for a slot.
+	receiptSlots  chan struct{}
+	receiptQueue  chan struct{}
+	receiptChains receiptChains
 }
 
 func NewServer(config Config) (*Server, error) {
-	opts, err := redis.ParseURL(config.RedisURL)
+	store, bus, err := newStore(config)
 	if err != nil {
 		return nil, err
 	}
-	client := redis.NewClient(opts)
-	store := redisstore.New(client, config.RoomTTL)
-	return &Server{
-		config: config,
-		hub:    NewHub(store),
-		store:  store,
-	}, nil
+	archiveStore, err := newArchive(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.JoinTokenKey == "" {
+		log.Printf("JOIN_TOKEN_SIGNING_KEY not set; websocket join tokens are not checked")
+	}
+	return NewServerWithStore(config, store, HubOptions{Archive: archiveStore, Bus: bus}), nil
+}
+
+// NewServerWithStore wires a server around an existing store (e.g. memstore in tests).
+// The compaction policy, join token check and origin allowlist always come from config.
+func NewServerWithStore(config Config, store storage.Store, opts HubOptions) *Server {
+	workers := config.ReceiptJobWorkers
+	if workers <= 0 {
+		workers = defaultReceiptJobWorkers
+	}
+	s := &Server{
+		config:        config,
+		store:         store,
+		receiptSlots:  make(chan struct{}, workers),
+		receiptQueue:  make(chan struct{}, workers*receiptJobQueuePerWorker),
+		receiptChains: newReceiptChains(config),
+	}
+	opts.Compaction = config.Compaction
+	opts.VerifyToken = s.verifyJoinToken
+	opts.AllowedOrigins = config.CorsAllowedOrigins
+	s.hub = NewHub(store, opts)
+	return s
+}
+
+func newArchive(config Config) (archive.Store, error) {
+	if config.ArchiveDir == "" {
+		log.Printf("ARCHIVE_DIR not set; rooms are dropped once their TTL expires")
+		return nil, nil
+	}
+	archiveStore, err := archive.NewFileStore(config.ArchiveDir)
+	if err != nil {
+		return nil, err
+	}
+	return archiveStore, nil
+}
+
+// newStore picks the room store and, for Redis, the pub/sub bus that lets
+// several backend nodes serve the same rooms. The memory backend is single-node.
+func newStore(config Config) (storage.Store, storage.Bus, error) {
+	switch strings.ToLower(config.StoreBackend) {
+	case "memory":
+		log.Printf("using in-memory room store; state is lost on restart")
+		return memstore.New(config.RoomTTL), nil, nil
+	case "", "redis":
+		opts, err := redis.ParseURL(config.RedisURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		client := redis.NewClient(opts)
+		return redisstore.New(client, config.RoomTTL), redisstore.NewBus(context.Background(), client), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown STORE_BACKEND %q (want redis or memory)", config.StoreBackend)
+	}
 }
 
 func (s *Server) Routes() http.Handler {
@@ -55,7 +118,21 @@ func (s *Server) Routes() http.Handler {
 	mux.HandleFunc("/api/create-room", s.handleCreateRoom)
 	mux.HandleFunc("/api/join-room", s.handleJoinRoom)
 	mux.HandleFunc("/api/room-status", s.handleRoomStatus)
+	mux.HandleFunc("/api/rooms/{code}/summary", s.handleRoomSummary)
+	mux.HandleFunc("/api/rooms/{code}/settlement", s.handleRoomSettlement)
+	mux.HandleFunc("/api/rooms/{code}/finalize", s.handleFinalizeRoom)
+	mux.HandleFunc("/api/rooms/{code}/history", s.handleRoomHistory)
+	mux.HandleFunc("/api/rooms/{code}/at", s.handleRoomAt)
+	mux.HandleFunc("/api/rooms/{code}/receipt", s.handleRoomReceipt)
+	mux.HandleFunc("/api/ledgers", s.handleCreateLedger)
+	mux.HandleFunc("/api/ledgers/{id}", s.handleLedger)
+	mux.HandleFunc("/api/ledgers/{id}/settlement", s.handleLedgerSettlement)
+	mux.HandleFunc("/api/ledgers/{id}/bills", s.handleAddLedgerBill)
+	mux.HandleFunc("/api/ledgers/{id}/bills/{code}", s.handleRemoveLedgerBill)
+	mux.HandleFunc("/api/ledgers/{id}/links", s.handleLinkLedgerMember)
 	mux.HandleFunc("/api/receipt/parse", s.handleReceiptParse)
+	mux.HandleFunc("/api/receipt/jobs", s.handleSubmitReceiptJob)
+	mux.HandleFunc("/api/receipt/jobs/{id}", s.handleReceiptJob)
 	mux.HandleFunc("/api/fx", s.handleFX)
 	mux.HandleFunc("/ws/", s.handleWS)
 	return s.withCORS(mux)
@@ -93,9 +170,14 @@ func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	ctx := context.Background()
 	roomCode := randomCode(6)
+	for attempt := 0; attempt < 5 && s.hub.roomCodeTaken(ctx, roomCode); attempt++ {
+		roomCode = randomCode(6)
+	}
 	userID := uuid.NewString()
 	room := crdt.NewRoom(roomCode, req.BillName)
+	room.CreatedAt = time.Now().UnixMilli()
 	if req.Currency != "" {
 		room.Currency = strings.ToUpper(req.Currency)
 		room.TargetCurrency = room.Currency
@@ -110,18 +192,31 @@ func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 		UpdatedAt:     time.Now().UnixMilli(),
 	}
 	room.Participants[userID] = &participant
-	ctx := context.Background()
-	s.store.SaveSnapshot(ctx, roomCode, room, 0)
-	op := crdt.Op{
-		ID:        uuid.NewString(),
-		ActorID:   userID,
-		Kind:      "set_participant",
-		Timestamp: time.Now().UnixMilli(),
+	if err := s.store.SaveSnapshot(ctx, roomCode, room, 0); err != nil {
+		log.Printf("create room snapshot failed room=%s err=%v", roomCode, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	payload, _ := json.Marshal(crdt.ParticipantPayload{Participant: participant})
-	op.Payload = payload
-	seq, _ := s.store.AppendOp(ctx, roomCode, op)
-	s.hub.broadcast(roomCode, map[string]any{"type": "op", "seq": seq, "op": op})
+	// The settings go in the log as well as the snapshot, so folding the log
+	// from seq 0 (room history) starts from the same room.
+	settings, _ := json.Marshal(crdt.RoomPayload{Name: room.Name, Currency: room.Currency, TargetCurrency: room.TargetCurrency})
+	participantPayload, _ := json.Marshal(crdt.ParticipantPayload{Participant: participant})
+	var seq int64
+	for _, op := range []crdt.Op{
+		{ID: uuid.NewString(), ActorID: userID, Kind: "set_room_name", Timestamp: time.Now().UnixMilli(), Payload: settings},
+		{ID: uuid.NewString(), ActorID: userID, Kind: "set_participant", Timestamp: time.Now().UnixMilli(), Payload: participantPayload},
+	} {
+		s.hub.stampOp(&op)
+		next, err := s.store.AppendOp(ctx, roomCode, op)
+		if err != nil {
+			log.Printf("create room append failed room=%s err=%v", roomCode, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		seq = next
+		s.hub.broadcast(roomCode, map[string]any{"type": "op", "seq": seq, "op": op})
+	}
+	s.hub.afterAppend(ctx, roomCode, nil, seq)
 
 	joinToken := s.signJoinToken(roomCode, userID)
 	writeJSON(w, CreateRoomResponse{
@@ -177,25 +272,20 @@ func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ctx := context.Background()
-	room, seq, err := s.store.LoadSnapshot(ctx, req.RoomCode)
-	if err != nil || room == nil {
+	// The snapshot trails the log, so read the room as the hub sees it.
+	room, _, ok := s.loadExistingRoom(ctx, req.RoomCode)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	// Rejoining as an existing participant takes that participant's join
+	// token; without one, the join is a new participant.
 	userID := req.UserID
 	if userID == "" {
-		// reuse participant if same name exists
-		for id, p := range room.Participants {
-			if strings.EqualFold(p.Name, req.Name) {
-				userID = id
-				break
-			}
-		}
-		if userID == "" {
-			userID = uuid.NewString()
-		}
+		userID = uuid.NewString()
 	}
-	if req.Token != "" && !s.verifyJoinToken(req.RoomCode, userID, req.Token) {
+	_, known := room.Participants[userID]
+	if (known || req.Token != "") && !s.verifyJoinToken(req.RoomCode, userID, req.Token) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -220,8 +310,6 @@ func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 			UpdatedAt:     time.Now().UnixMilli(),
 		}
 	}
-	room.Participants[userID] = &participant
-	s.store.SaveSnapshot(ctx, req.RoomCode, room, seq)
 	op := crdt.Op{
 		ID:        uuid.NewString(),
 		ActorID:   userID,
@@ -230,8 +318,15 @@ func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 	}
 	payload, _ := json.Marshal(crdt.ParticipantPayload{Participant: participant})
 	op.Payload = payload
-	newSeq, _ := s.store.AppendOp(ctx, req.RoomCode, op)
+	s.hub.stampOp(&op)
+	newSeq, err := s.store.AppendOp(ctx, req.RoomCode, op)
+	if err != nil {
+		log.Printf("join room append failed room=%s err=%v", req.RoomCode, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	s.hub.broadcast(req.RoomCode, map[string]any{"type": "op", "seq": newSeq, "op": op})
+	s.hub.afterAppend(ctx, req.RoomCode, nil, newSeq)
 
 	joinToken := s.signJoinToken(req.RoomCode, userID)
 	writeJSON(w, JoinRoomResponse{
@@ -255,8 +350,8 @@ func (s *Server) handleRoomStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ctx := context.Background()
-	room, _, err := s.store.LoadSnapshot(ctx, roomCode)
-	if err != nil || room == nil {
+	room, _, ok := s.loadExistingRoom(ctx, roomCode)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -276,171 +371,153 @@ func (s *Server) handleRoomStatus(w http.ResponseWriter, r *http.Request) {
 		TargetCurrency: room.TargetCurrency,
 		UpdatedAt:      room.UpdatedAt,
 		ExpiresInSec:   expiresInSec,
-		TotalCents:     computeRoomTotalCents(room),
+		TotalCents:     settlement.TotalCents(room),
 	})
 }
 
-func computeRoomTotalCents(room *crdt.RoomDoc) int64 {
-	if room == nil {
-		return 0
-	}
-	gross := int64(0)
-	itemDiscount := int64(0)
-	for _, it := range room.Items {
-		if it == nil {
-			continue
-		}
-		line := int64(it.LinePriceCents)
-		if line < 0 {
-			line = 0
-		}
-		qty := int64(it.Quantity)
-		if qty <= 0 {
-			qty = 1
-		}
-		disc := int64(it.DiscountCents) * qty
-		if disc < 0 {
-			disc = 0
-		}
-		gross += line
-		itemDiscount += disc
-	}
-	if itemDiscount > gross {
-		itemDiscount = gross
-	}
-	billDiscount := int64(room.BillDiscountCents)
-	if billDiscount < 0 {
-		billDiscount = 0
-	}
-	maxBillDiscount := gross - itemDiscount
-	if billDiscount > maxBillDiscount {
-		billDiscount = maxBillDiscount
-	}
-	net := gross - itemDiscount - billDiscount
-	if net < 0 {
-		net = 0
-	}
-	billCharges := int64(room.BillChargesCents)
-	if billCharges < 0 {
-		billCharges = 0
-	}
-	tax := int64(room.TaxCents)
-	if tax < 0 {
-		tax = 0
-	}
-	tip := int64(room.TipCents)
-	if tip < 0 {
-		tip = 0
-	}
-	return net + billCharges + tax + tip
-}
-
 func (s *Server) handleReceiptParse(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	if s.config.GeminiKey == "" {
+	if len(s.receiptChains.standard) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
-		writeJSON(w, map[string]any{"error": "Gemini API key is not configured"})
+		writeJSON(w, map[string]any{"error": errNoReceiptParser.Error()})
 		return
 	}
-	file, header, err := r.FormFile("file")
-	if err != nil {
+	if err := parseReceiptForm(w, r); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]any{"error": err.Error()})
 		return
 	}
-	defer file.Close()
-	data, err := io.ReadAll(file)
+	pages, err := readReceiptUploads(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]any{"error": err.Error()})
 		return
 	}
-	contentType := header.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = http.DetectContentType(data)
-	}
-	if !strings.HasPrefix(contentType, "image/") {
+	result, err := s.parseReceiptPages(r.Context(), pages, receiptParseMode(r), receiptUserCropped(r), nil)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		writeJSON(w, map[string]any{"error": "Unsupported file type. Please upload an image."})
+		writeJSON(w, map[string]any{"error": err.Error()})
 		return
 	}
-	switch contentType {
-	case "image/heic", "image/heif":
-		w.WriteHeader(http.StatusBadRequest)
-		writeJSON(w, map[string]any{"error": "HEIC images aren't supported yet. Please upload a JPEG or PNG."})
-		return
+	writeJSON(w, result)
+}
+
+// parseReceiptForm caps a receipt upload's body and parses its form. Handlers
+// call it before reading any form field, since the first FormValue reads the
+// whole body. The error text is meant for the user.
+func parseReceiptForm(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxReceiptUploadBytes)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return fmt.Errorf("The upload is too large. Please keep it under %d MB.", maxReceiptUploadBytes>>20)
+		}
+		return errors.New("Please upload a receipt image.")
+	}
+	return nil
+}
+
+// readReceiptUploads reads the photos in a receipt upload's "file" fields, one
+// per page of a long receipt, in the order sent, from a form parsed by
+// parseReceiptForm. A field can also hold a PDF (see expandReceiptDocuments).
+// The error text is meant for the user.
+func readReceiptUploads(r *http.Request) ([]receiptImage, error) {
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		return nil, errors.New("Please upload a receipt image.")
+	}
+	if len(headers) > maxReceiptPages {
+		return nil, fmt.Errorf("Please upload at most %d photos of one receipt.", maxReceiptPages)
+	}
+	pages := make([]receiptImage, 0, len(headers))
+	for _, header := range headers {
+		file, err := header.Open()
+		if err != nil {
+			return nil, errors.New("The upload could not be read.")
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, errors.New("The upload could not be read.")
+		}
+		contentType := receiptUploadType(data, header.Header.Get("Content-Type"))
+		if contentType == "application/pdf" {
+			if err := checkReceiptPDF(data); err != nil {
+				return nil, err
+			}
+		} else if !strings.HasPrefix(contentType, "image/") {
+			return nil, errors.New("Unsupported file type. Please upload a photo or PDF of the receipt.")
+		}
+		pages = append(pages, receiptImage{data: data, contentType: contentType})
+	}
+	return pages, nil
+}
+
+func receiptParseMode(r *http.Request) string {
+	return strings.ToLower(strings.TrimSpace(r.FormValue("parse_mode")))
+}
+
+// receiptParseModeIsAccurate reports whether parseMode asks for the accurate
+// chain, as a retry of a poor parse does.
+func receiptParseModeIsAccurate(parseMode string) bool {
+	return parseMode == "accurate" || parseMode == "retry" || parseMode == "high"
+}
+
+// receiptUserCropped reports whether the client says the user already
+// cropped/rotated the image.
+func receiptUserCropped(r *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(r.FormValue("user_cropped")), "1") ||
+		strings.EqualFold(strings.TrimSpace(r.FormValue("user_cropped")), "true")
+}
+
+// parseReceipt turns a receipt image into a normalized ReceiptParseResult:
+// orientation fix-up, the parse mode's provider chain (see receiptChains),
+// and modifier tagging when the result looks like it needs it.
+// progress, if set, is called as each stage starts (see receiptStage*).
+func (s *Server) parseReceipt(ctx context.Context, data []byte, contentType, parseMode string, userCropped bool, progress func(stage string)) (*ReceiptParseResult, error) {
+	if progress == nil {
+		progress = func(string) {}
 	}
+	progress(receiptStagePreprocess)
 	// Keep a single model call, but normalize orientation first so dense journal-style
 	// screenshots are sent in the most readable rotation. Skip when the client signals
 	// the user already cropped/rotated -- otherwise the heuristic crop can strip
 	// content the user deliberately included.
-	userCropped := strings.EqualFold(strings.TrimSpace(r.FormValue("user_cropped")), "1") ||
-		strings.EqualFold(strings.TrimSpace(r.FormValue("user_cropped")), "true")
 	if !userCropped {
 		if normalizedData, normalizedType, rotated := normalizeReceiptImageOrientation(data, contentType); rotated {
 			data = normalizedData
 			contentType = normalizedType
 		}
 	}
-	parseMode := strings.ToLower(strings.TrimSpace(r.FormValue("parse_mode")))
-	preferHighAccuracy := parseMode == "accurate" || parseMode == "retry" || parseMode == "high"
-	parseTemperature := geminiReceiptTemperatureStandard
-	primaryModel := geminiModelPrimary
-	fallbackModel := geminiModelFallback
-	if preferHighAccuracy {
-		parseTemperature = geminiReceiptTemperatureRetry
-		primaryModel = geminiModelRetryPrimary
-		fallbackModel = geminiModelRetryFallback
-	}
-
-	result, err := callGeminiReceiptParseWithModel(
-		r.Context(),
-		s.config.GeminiKey,
-		data,
-		contentType,
-		primaryModel,
-		parseTemperature,
-	)
-	if err != nil {
-		primaryErr := err
-		if fallbackModel == "" || strings.EqualFold(primaryModel, fallbackModel) {
-			err = fmt.Errorf("%s failed (%v)", primaryModel, primaryErr)
-		} else {
-			result, err = callGeminiReceiptParseWithModel(
-				r.Context(),
-				s.config.GeminiKey,
-				data,
-				contentType,
-				fallbackModel,
-				parseTemperature,
-			)
-			if err == nil {
-				if preferHighAccuracy {
-					result.Warnings = append(result.Warnings, "Try-again parse fallback used.")
-				} else {
-					result.Warnings = append(result.Warnings, "Primary Gemini parse failed; fallback model used.")
-				}
-				log.Printf("receipt parse fallback: %s failed (%v), %s succeeded", primaryModel, primaryErr, fallbackModel)
-			} else {
-				err = fmt.Errorf("%s failed (%v); %s fallback failed (%v)", primaryModel, primaryErr, fallbackModel, err)
-			}
+	preferHighAccuracy := receiptParseModeIsAccurate(parseMode)
+	chain := s.receiptChains.forMode(preferHighAccuracy)
+	cacheLookup := s.newReceiptCacheLookup(data, preferHighAccuracy, chain)
+	// A retry means the last result was wrong, so it goes to the model and its
+	// result replaces the cached one.
+	if parseMode != "retry" {
+		if cached, ok := s.cachedReceiptResult(ctx, cacheLookup); ok {
+			return cached, nil
 		}
 	}
+	result, used, err := parseWithChain(ctx, chain, data, contentType, progress)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		writeJSON(w, map[string]any{"error": err.Error()})
-		return
+		return nil, err
+	}
+	if used > 0 {
+		if preferHighAccuracy {
+			result.Warnings = append(result.Warnings, "Try-again parse fallback used.")
+		} else {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Primary parse failed; fallback %s used.", chain[used].Name()))
+		}
 	}
+	progress(receiptStageNormalize)
 	normalizeReceiptParseResult(result)
 	if shouldRunModifierTagging(result, preferHighAccuracy) {
-		tags, tagErr := callGeminiModifierTagging(
-			r.Context(),
-			s.config.GeminiKey,
-			primaryModel,
-			fallbackModel,
-			result,
-		)
+		progress(receiptStageTagging)
+		tags, tagErr := tagWithChain(ctx, chain, result)
 		if tagErr != nil {
 			log.Printf("receipt modifier-tagging skipped: %v", tagErr)
 		} else {
@@ -454,7 +531,8 @@ func (s *Server) handleReceiptParse(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	writeJSON(w, result)
+	s.cacheReceiptResult(ctx, cacheLookup, result)
+	return result, nil
 }
 
 var moneyTokenPattern = regexp.MustCompile(`\d{1,3}(?:,\d{3})*(?:\.\d{2})|\d+\.\d{2}|\d{3,}(?:,\d{3})*`)
@@ -2264,7 +2342,7 @@ func (s *Server) withCORS(next http.Handler) http.Handler {
 			}
 		}
 		if r.Method == http.MethodOptions {
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,DELETE,OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -2284,7 +2362,7 @@ func (s *Server) verifyJoinToken(roomCode, userID, token string) bool {
 	if s.config.JoinTokenKey == "" {
 		return true
 	}
-	return token == s.signJoinToken(roomCode, userID)
+	return hmac.Equal([]byte(token), []byte(s.signJoinToken(roomCode, userID)))
 }
 
 func writeJSON(w http.ResponseWriter, payload any) {
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/settlement"
+)
+
+type RoomSummaryResponse struct {
+	RoomCode string              `json:"room_code"`
+	Seq      int64               `json:"seq"`
+	Summary  *settlement.Summary `json:"summary"`
+}
+
+func (s *Server) handleRoomSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	roomCode := strings.ToUpper(strings.TrimSpace(r.PathValue("code")))
+	if roomCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	room, seq, ok := s.loadExistingRoom(r.Context(), roomCode)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, RoomSummaryResponse{
+		RoomCode: roomCode,
+		Seq:      seq,
+		Summary:  settlement.Compute(room),
+	})
+}
+
+// loadExistingRoom folds the snapshot and pending ops for a room, restoring it
+// from the archive if needed. It reports false when the room doesn't exist.
+func (s *Server) loadExistingRoom(ctx context.Context, roomCode string) (*crdt.RoomDoc, int64, bool) {
+	if !s.hub.restoreRoom(ctx, roomCode) {
+		return nil, 0, false
+	}
+	room, seq := s.hub.loadDoc(ctx, roomCode)
+	return room, seq, true
+}
+
+type RoomSettlementResponse struct {
+	RoomCode   string           `json:"room_code"`
+	Seq        int64            `json:"seq"`
+	Settlement *settlement.Plan `json:"settlement"`
+}
+
+func (s *Server) handleRoomSettlement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	roomCode := strings.ToUpper(strings.TrimSpace(r.PathValue("code")))
+	if roomCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	room, seq, ok := s.loadExistingRoom(r.Context(), roomCode)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, RoomSettlementResponse{
+		RoomCode:   roomCode,
+		Seq:        seq,
+		Settlement: settlement.PlanRoom(room),
+	})
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+// maxUndoDepth caps each participant's undo and redo stacks.
+const maxUndoDepth = 50
+
+// undoStacks are one participant's undo and redo history in a room. Each entry
+// holds the ops that revert one edit, in the order they are applied. Stacks
+// live on the node the participant is connected to and are dropped once the
+// room goes idle there.
+type undoStacks struct {
+	undo [][]crdt.Op
+	redo [][]crdt.Op
+}
+
+// recordEdit pushes the inverse of an edit the participant just made. A new
+// edit starts a new branch, so whatever was undone can no longer be redone.
+func (h *Hub) recordEdit(roomID, actorID string, inverse []crdt.Op) {
+	if len(inverse) == 0 {
+		return
+	}
+	h.undoMu.Lock()
+	defer h.undoMu.Unlock()
+	stacks := h.undoStacksFor(roomID, actorID)
+	stacks.undo = pushUndoEntry(stacks.undo, inverse)
+	stacks.redo = nil
+}
+
+// undoStacksFor returns the stacks for actorID in roomID. Callers hold undoMu.
+func (h *Hub) undoStacksFor(roomID, actorID string) *undoStacks {
+	if h.undo[roomID] == nil {
+		h.undo[roomID] = map[string]*undoStacks{}
+	}
+	stacks := h.undo[roomID][actorID]
+	if stacks == nil {
+		stacks = &undoStacks{}
+		h.undo[roomID][actorID] = stacks
+	}
+	return stacks
+}
+
+func pushUndoEntry(stack [][]crdt.Op, entry []crdt.Op) [][]crdt.Op {
+	stack = append(stack, entry)
+	if len(stack) > maxUndoDepth {
+		stack = stack[len(stack)-maxUndoDepth:]
+	}
+	return stack
+}
+
+func (h *Hub) popUndoEntry(roomID, actorID string, redo bool) ([]crdt.Op, bool) {
+	h.undoMu.Lock()
+	defer h.undoMu.Unlock()
+	stacks := h.undoStacksFor(roomID, actorID)
+	stack := &stacks.undo
+	if redo {
+		stack = &stacks.redo
+	}
+	if len(*stack) == 0 {
+		return nil, false
+	}
+	entry := (*stack)[len(*stack)-1]
+	*stack = (*stack)[:len(*stack)-1]
+	return entry, true
+}
+
+func (h *Hub) pushUndoEntry(roomID, actorID string, entry []crdt.Op, redo bool) {
+	if len(entry) == 0 {
+		return
+	}
+	h.undoMu.Lock()
+	defer h.undoMu.Unlock()
+	stacks := h.undoStacksFor(roomID, actorID)
+	if redo {
+		stacks.redo = pushUndoEntry(stacks.redo, entry)
+	} else {
+		stacks.undo = pushUndoEntry(stacks.undo, entry)
+	}
+}
+
+func (h *Hub) dropUndo(roomID string) {
+	h.undoMu.Lock()
+	defer h.undoMu.Unlock()
+	delete(h.undo, roomID)
+}
+
+// handleUndo applies the participant's latest undo (or redo) entry as ordinary
+// new ops in one seq range, so every client just sees more ops, and pushes
+// their inverse onto the opposite stack. An entry that no longer validates, say because the
+// participant it reassigns has left, is dropped and the client told why.
+func (h *Hub) handleUndo(ctx context.Context, c *client, roomID, actorID string, redo bool) {
+	request := "undo"
+	if redo {
+		request = "redo"
+	}
+	entry, ok := h.popUndoEntry(roomID, actorID, redo)
+	if !ok {
+		c.sendJSON(map[string]any{"type": "reject", "request": request, "reason": "nothing to " + request})
+		return
+	}
+	doc, docSeq := h.loadDoc(ctx, roomID)
+	ops := make([]crdt.Op, 0, len(entry))
+	var reverse []crdt.Op
+	for _, op := range entry {
+		op.ID = uuid.NewString()
+		op.ActorID = actorID
+		op.Timestamp = time.Now().UnixMilli()
+		op.Clock = nil
+		if err := validateOp(doc, op); err != nil {
+			log.Printf("ws %s rejected room=%s actor=%s kind=%s reason=%q", request, roomID, actorID, op.Kind, err.Error())
+			c.sendJSON(map[string]any{"type": "reject", "request": request, "reason": err.Error()})
+			return
+		}
+		h.stampOp(&op)
+		// Undoing a sequence means reverting its last op first.
+		reverse = append(crdt.Inverse(doc, op), reverse...)
+		crdt.ApplyOp(doc, op)
+		ops = append(ops, op)
+	}
+
+	seq, err := h.commitOps(ctx, roomID, doc, docSeq, ops)
+	if err != nil {
+		log.Printf("ws %s append failed room=%s actor=%s err=%v", request, roomID, actorID, err)
+		return
+	}
+	h.pushUndoEntry(roomID, actorID, reverse, !redo)
+	c.sendJSON(map[string]any{"type": "ack", "seq": seq, "request": request})
+	log.Printf("ws %s room=%s seq=%d actor=%s ops=%d", request, roomID, seq, actorID, len(ops))
+}
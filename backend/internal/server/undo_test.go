@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+func resyncItems(t *testing.T, conn *websocket.Conn) map[string]*crdt.Item {
+	t.Helper()
+	conn.WriteJSON(map[string]any{"type": "resync", "last_seq": 0})
+	return readUntil(t, conn, "snapshot").Doc.Items
+}
+
+func TestUndoRedoRemovedItem(t *testing.T) {
+	_, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, conn, "snapshot")
+
+	itemPayload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{ID: "fries", Name: "Fries", Quantity: 1, LinePriceCents: 500, Assigned: map[string]bool{created.UserID: true}}})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "set_item", Payload: itemPayload}})
+	readUntil(t, conn, "ack")
+	removePayload, _ := json.Marshal(crdt.RemovePayload{ID: "fries"})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "remove_item", Payload: removePayload}})
+	readUntil(t, conn, "ack")
+
+	conn.WriteJSON(map[string]any{"type": "undo"})
+	restored := readUntil(t, conn, "op")
+	if restored.Op.Kind != "restore_item" || restored.Op.ActorID != created.UserID || restored.Op.Clock == nil {
+		t.Fatalf("expected a stamped restore_item, got %s", restored.Raw)
+	}
+	readUntil(t, conn, "ack")
+	if item := resyncItems(t, conn)["fries"]; item == nil || item.LinePriceCents != 500 || !item.Assigned[created.UserID] {
+		t.Fatalf("expected fries back as they were, got %+v", item)
+	}
+
+	conn.WriteJSON(map[string]any{"type": "redo"})
+	readUntil(t, conn, "ack")
+	if item := resyncItems(t, conn)["fries"]; item != nil {
+		t.Fatalf("expected redo to remove fries again, got %+v", item)
+	}
+
+	// Undo twice more: back past the removal, then past the creation.
+	for range 2 {
+		conn.WriteJSON(map[string]any{"type": "undo"})
+		readUntil(t, conn, "ack")
+	}
+	if items := resyncItems(t, conn); len(items) != 0 {
+		t.Fatalf("expected no items after undoing the creation, got %+v", items)
+	}
+	conn.WriteJSON(map[string]any{"type": "undo"})
+	if reject := readUntil(t, conn, "reject"); !strings.Contains(string(reject.Raw), "nothing to undo") {
+		t.Fatalf("expected an empty-stack reject, got %s", reject.Raw)
+	}
+}
+
+func TestUndoIsPerParticipantAndNewEditClearsRedo(t *testing.T) {
+	_, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	bob := joinTestRoom(t, ts, created.RoomCode, "Bob")
+	alice := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, alice, "snapshot")
+	bobConn := dialTestRoom(t, ts, created.RoomCode, bob.UserID, bob.JoinToken)
+	readUntil(t, bobConn, "snapshot")
+
+	itemPayload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{ID: "fries", Name: "Fries", Quantity: 1}})
+	alice.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "set_item", Payload: itemPayload}})
+	readUntil(t, alice, "ack")
+
+	// Bob has nothing of his own to undo.
+	bobConn.WriteJSON(map[string]any{"type": "undo"})
+	readUntil(t, bobConn, "reject")
+
+	alice.WriteJSON(map[string]any{"type": "undo"})
+	readUntil(t, alice, "ack")
+	// The undone item is removed for good; the new edit adds another.
+	slawPayload, _ := json.Marshal(crdt.ItemPayload{Item: crdt.Item{ID: "slaw", Name: "Slaw", Quantity: 1}})
+	alice.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{Kind: "set_item", Payload: slawPayload}})
+	readUntil(t, alice, "ack")
+	alice.WriteJSON(map[string]any{"type": "redo"})
+	if reject := readUntil(t, alice, "reject"); !strings.Contains(string(reject.Raw), "nothing to redo") {
+		t.Fatalf("expected a new edit to clear redo, got %s", reject.Raw)
+	}
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+// Bounds for client-supplied op values. They are far past any real bill; the
+// point is to keep garbage and overflow-sized numbers out of the log.
+const (
+	maxOpCents       = 1_000_000_000_000
+	maxItemQuantity  = 1000
+	maxAllocShares   = 1000
+	maxOpNameLength  = 200
+	maxDiscountRatio = 100
+)
+
+// validateOp checks a client op against the room it targets before it is
+// appended. ApplyOp tolerates anything; the log should only hold ops that
+// mean something. The error text is sent back to the client as the reason.
+func validateOp(doc *crdt.RoomDoc, op crdt.Op) error {
+	if op.ID == "" {
+		return errors.New("op id is required")
+	}
+	switch op.Kind {
+	case "set_item", "restore_item":
+		var payload crdt.ItemPayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		// The hub restamps every op, so a set_item sent from before a removal
+		// would otherwise win over it. Only restore_item brings an item back.
+		if op.Kind == "set_item" {
+			if err := checkNotRemoved(doc.Items[payload.Item.ID] != nil, doc.Tombstones, doc.TombstoneClocks, "item", payload.Item.ID); err != nil {
+				return err
+			}
+		}
+		return validateItem(doc, payload.Item)
+	case "patch_item":
+		var payload crdt.PatchPayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		if err := checkItem(doc, payload.ID); err != nil {
+			return err
+		}
+		// Only the patched fields are checked: a legacy value or a since-removed
+		// assignee elsewhere on the item mustn't block fixing it.
+		var item crdt.Item
+		if err := decodePatch(&item, crdt.ItemFields, payload.Fields); err != nil {
+			return err
+		}
+		for _, check := range itemFieldChecks {
+			if _, ok := payload.Fields[check.field]; ok {
+				if err := check.check(item); err != nil {
+					return err
+				}
+			}
+		}
+	case "patch_participant":
+		var payload crdt.PatchPayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		if err := checkParticipant(doc, payload.ID); err != nil {
+			return err
+		}
+		var participant crdt.Participant
+		if err := decodePatch(&participant, crdt.ParticipantFields, payload.Fields); err != nil {
+			return err
+		}
+		if _, ok := payload.Fields["name"]; ok {
+			return checkName("participant name", participant.Name)
+		}
+	case "remove_item", "remove_participant":
+		var payload crdt.RemovePayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		if payload.ID == "" {
+			return errors.New("id is required")
+		}
+	case "set_participant", "restore_participant":
+		var payload crdt.ParticipantPayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		if payload.Participant.ID == "" {
+			return errors.New("participant id is required")
+		}
+		if op.Kind == "set_participant" {
+			if err := checkNotRemoved(doc.Participants[payload.Participant.ID] != nil, doc.ParticipantTombstones, doc.ParticipantTombstoneClocks, "participant", payload.Participant.ID); err != nil {
+				return err
+			}
+		}
+		return checkName("participant name", payload.Participant.Name)
+	case "assign_item":
+		var payload crdt.AssignPayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		if err := checkItem(doc, payload.ItemID); err != nil {
+			return err
+		}
+		if payload.On {
+			return checkParticipant(doc, payload.UserID)
+		}
+		if payload.UserID == "" {
+			return errors.New("user_id is required")
+		}
+	case "allocate_item":
+		var payload crdt.AllocatePayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		if err := checkItem(doc, payload.ItemID); err != nil {
+			return err
+		}
+		if err := checkParticipant(doc, payload.UserID); err != nil {
+			return err
+		}
+		if payload.Shares < 0 || payload.Shares > maxAllocShares {
+			return fmt.Errorf("shares must be between 0 and %d", maxAllocShares)
+		}
+		if payload.Cents != nil {
+			return checkCents("cents", *payload.Cents)
+		}
+	case "set_payer":
+		var payload crdt.PayerPayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		if err := checkParticipant(doc, payload.ParticipantID); err != nil {
+			return err
+		}
+		return checkCents("amount_cents", payload.AmountCents)
+	case "set_tax_tip":
+		var payload crdt.TaxTipPayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		fields := []struct {
+			name  string
+			value *int
+		}{
+			{"tax_cents", payload.TaxCents},
+			{"tip_cents", payload.TipCents},
+			{"bill_discount_cents", payload.BillDiscountCents},
+			{"bill_charges_cents", payload.BillChargesCents},
+		}
+		for _, field := range fields {
+			if field.value == nil {
+				continue
+			}
+			if err := checkCents(field.name, *field.value); err != nil {
+				return err
+			}
+		}
+	case "set_room_name":
+		var payload crdt.RoomPayload
+		if err := decodeOpPayload(op, &payload); err != nil {
+			return err
+		}
+		if err := checkName("room name", payload.Name); err != nil {
+			return err
+		}
+		if err := checkCurrency("currency", payload.Currency); err != nil {
+			return err
+		}
+		return checkCurrency("target_currency", payload.TargetCurrency)
+	default:
+		return fmt.Errorf("unknown op kind %q", op.Kind)
+	}
+	return nil
+}
+
+func decodeOpPayload(op crdt.Op, payload any) error {
+	if len(op.Payload) == 0 {
+		return fmt.Errorf("%s payload is required", op.Kind)
+	}
+	if err := json.Unmarshal(op.Payload, payload); err != nil {
+		return fmt.Errorf("malformed %s payload", op.Kind)
+	}
+	return nil
+}
+
+// decodePatch decodes patch fields onto a scratch entity so they can be
+// checked.
+func decodePatch[T any, D ~func(*T, json.RawMessage) error](target *T, decoders map[string]D, fields map[string]json.RawMessage) error {
+	if len(fields) == 0 {
+		return errors.New("fields are required")
+	}
+	for name, raw := range fields {
+		decode, ok := decoders[name]
+		if !ok {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		if err := decode(target, raw); err != nil {
+			return fmt.Errorf("malformed %s", name)
+		}
+	}
+	return nil
+}
+
+// itemFieldChecks bound the item fields patch_item may set, in the order
+// they are checked.
+var itemFieldChecks = []struct {
+	field string
+	check func(crdt.Item) error
+}{
+	{"name", func(item crdt.Item) error { return checkName("item name", item.Name) }},
+	{"quantity", func(item crdt.Item) error {
+		if item.Quantity < 0 || item.Quantity > maxItemQuantity {
+			return fmt.Errorf("quantity must be between 0 and %d", maxItemQuantity)
+		}
+		return nil
+	}},
+	{"unit_price_cents", func(item crdt.Item) error { return checkCents("unit_price_cents", item.UnitPriceCents) }},
+	{"line_price_cents", func(item crdt.Item) error { return checkCents("line_price_cents", item.LinePriceCents) }},
+	{"discount_cents", func(item crdt.Item) error { return checkCents("discount_cents", item.DiscountCents) }},
+	{"discount_percent", func(item crdt.Item) error {
+		if item.DiscountPercent < 0 || item.DiscountPercent > maxDiscountRatio {
+			return fmt.Errorf("discount_percent must be between 0 and %d", maxDiscountRatio)
+		}
+		return nil
+	}},
+}
+
+func validateItem(doc *crdt.RoomDoc, item crdt.Item) error {
+	if item.ID == "" {
+		return errors.New("item id is required")
+	}
+	for _, check := range itemFieldChecks {
+		if err := check.check(item); err != nil {
+			return err
+		}
+	}
+	for userID, on := range item.Assigned {
+		if !on {
+			continue
+		}
+		if err := checkParticipant(doc, userID); err != nil {
+			return err
+		}
+	}
+	for userID, allocation := range item.Allocations {
+		if err := checkParticipant(doc, userID); err != nil {
+			return err
+		}
+		if allocation.Shares < 0 || allocation.Shares > maxAllocShares {
+			return fmt.Errorf("shares must be between 0 and %d", maxAllocShares)
+		}
+		if allocation.Cents != nil {
+			if err := checkCents("allocation cents", *allocation.Cents); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkCents(field string, cents int) error {
+	if cents < 0 || cents > maxOpCents {
+		return fmt.Errorf("%s must be between 0 and %d", field, maxOpCents)
+	}
+	return nil
+}
+
+func checkName(field, name string) error {
+	if utf8.RuneCountInString(name) > maxOpNameLength {
+		return fmt.Errorf("%s is longer than %d characters", field, maxOpNameLength)
+	}
+	return nil
+}
+
+func checkCurrency(field, code string) error {
+	if code == "" {
+		return nil
+	}
+	if _, ok := currencyMeta[code]; !ok {
+		return fmt.Errorf("%s %q is not a supported currency", field, code)
+	}
+	return nil
+}
+
+func checkItem(doc *crdt.RoomDoc, itemID string) error {
+	if itemID == "" {
+		return errors.New("item_id is required")
+	}
+	if _, ok := doc.Items[itemID]; !ok {
+		return fmt.Errorf("unknown item %q", itemID)
+	}
+	return nil
+}
+
+// checkNotRemoved refuses a set op for an id that was removed and hasn't been
+// restored since.
+func checkNotRemoved(live bool, tombstones map[string]int64, clocks map[string]crdt.HLC, kind, id string) error {
+	if live {
+		return nil
+	}
+	_, removed := tombstones[id]
+	if _, ok := clocks[id]; ok {
+		removed = true
+	}
+	if removed {
+		return fmt.Errorf("%s %q was removed", kind, id)
+	}
+	return nil
+}
+
+func checkParticipant(doc *crdt.RoomDoc, participantID string) error {
+	if participantID == "" {
+		return errors.New("participant id is required")
+	}
+	if _, ok := doc.Participants[participantID]; !ok {
+		return fmt.Errorf("unknown participant %q", participantID)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+func testValidationDoc() *crdt.RoomDoc {
+	doc := crdt.NewRoom("ROOM", "Dinner")
+	doc.Participants["alice"] = &crdt.Participant{ID: "alice", Name: "Alice"}
+	doc.Items["fries"] = &crdt.Item{ID: "fries", Name: "Fries", Quantity: 1, LinePriceCents: 500, Assigned: map[string]bool{}}
+	return doc
+}
+
+func testOp(kind string, payload any) crdt.Op {
+	raw, _ := json.Marshal(payload)
+	return crdt.Op{ID: "op-1", ActorID: "alice", Kind: kind, Payload: raw}
+}
+
+func TestValidateOp(t *testing.T) {
+	negative := -1
+	fine := 250
+	cases := []struct {
+		name   string
+		op     crdt.Op
+		reason string
+	}{
+		{"item ok", testOp("set_item", crdt.ItemPayload{Item: crdt.Item{ID: "soup", Quantity: 2, UnitPriceCents: 300, LinePriceCents: 600, Assigned: map[string]bool{"alice": true}}}), ""},
+		{"item without id", testOp("set_item", crdt.ItemPayload{Item: crdt.Item{Name: "Soup"}}), "item id is required"},
+		{"negative price", testOp("set_item", crdt.ItemPayload{Item: crdt.Item{ID: "soup", LinePriceCents: -5}}), "line_price_cents must be between"},
+		{"absurd quantity", testOp("set_item", crdt.ItemPayload{Item: crdt.Item{ID: "soup", Quantity: 5000}}), "quantity must be between"},
+		{"item assigned to stranger", testOp("set_item", crdt.ItemPayload{Item: crdt.Item{ID: "soup", Assigned: map[string]bool{"mallory": true}}}), `unknown participant "mallory"`},
+		{"unassigned stranger ignored", testOp("set_item", crdt.ItemPayload{Item: crdt.Item{ID: "soup", Assigned: map[string]bool{"mallory": false}}}), ""},
+		{"assign ok", testOp("assign_item", crdt.AssignPayload{ItemID: "fries", UserID: "alice", On: true}), ""},
+		{"assign stranger", testOp("assign_item", crdt.AssignPayload{ItemID: "fries", UserID: "mallory", On: true}), `unknown participant "mallory"`},
+		{"assign missing item", testOp("assign_item", crdt.AssignPayload{ItemID: "soup", UserID: "alice", On: true}), `unknown item "soup"`},
+		{"allocate negative cents", testOp("allocate_item", crdt.AllocatePayload{ItemID: "fries", UserID: "alice", Cents: &negative}), "cents must be between"},
+		{"payer ok", testOp("set_payer", crdt.PayerPayload{ParticipantID: "alice", AmountCents: 1000}), ""},
+		{"payer stranger", testOp("set_payer", crdt.PayerPayload{ParticipantID: "mallory", AmountCents: 1000}), `unknown participant "mallory"`},
+		{"tax ok", testOp("set_tax_tip", crdt.TaxTipPayload{TaxCents: &fine}), ""},
+		{"negative tip", testOp("set_tax_tip", crdt.TaxTipPayload{TipCents: &negative}), "tip_cents must be between"},
+		{"currency ok", testOp("set_room_name", crdt.RoomPayload{Currency: "EUR"}), ""},
+		{"unknown currency", testOp("set_room_name", crdt.RoomPayload{Currency: "DOGE"}), `currency "DOGE" is not a supported currency`},
+		{"lowercase currency", testOp("set_room_name", crdt.RoomPayload{TargetCurrency: "eur"}), "target_currency"},
+		{"participant without id", testOp("set_participant", crdt.ParticipantPayload{Participant: crdt.Participant{Name: "Bob"}}), "participant id is required"},
+		{"patch item ok", testOp("patch_item", crdt.PatchPayload{ID: "fries", Fields: map[string]json.RawMessage{"name": json.RawMessage(`"Curly fries"`)}}), ""},
+		{"patch missing item", testOp("patch_item", crdt.PatchPayload{ID: "soup", Fields: map[string]json.RawMessage{"name": json.RawMessage(`"Soup"`)}}), `unknown item "soup"`},
+		{"patch unknown field", testOp("patch_item", crdt.PatchPayload{ID: "fries", Fields: map[string]json.RawMessage{"assigned": json.RawMessage(`{}`)}}), `unknown field "assigned"`},
+		{"patch negative price", testOp("patch_item", crdt.PatchPayload{ID: "fries", Fields: map[string]json.RawMessage{"line_price_cents": json.RawMessage(`-1`)}}), "line_price_cents must be between"},
+		{"patch wrong type", testOp("patch_item", crdt.PatchPayload{ID: "fries", Fields: map[string]json.RawMessage{"quantity": json.RawMessage(`"two"`)}}), "malformed quantity"},
+		{"patch without fields", testOp("patch_item", crdt.PatchPayload{ID: "fries"}), "fields are required"},
+		{"patch participant ok", testOp("patch_participant", crdt.PatchPayload{ID: "alice", Fields: map[string]json.RawMessage{"finished": json.RawMessage(`true`)}}), ""},
+		{"patch participant stranger", testOp("patch_participant", crdt.PatchPayload{ID: "mallory", Fields: map[string]json.RawMessage{"finished": json.RawMessage(`true`)}}), `unknown participant "mallory"`},
+		{"remove without id", testOp("remove_item", crdt.RemovePayload{}), "id is required"},
+		{"unknown kind", testOp("drop_table", map[string]any{}), `unknown op kind "drop_table"`},
+		{"malformed payload", crdt.Op{ID: "op-1", Kind: "set_item", Payload: json.RawMessage(`"nope"`)}, "malformed set_item payload"},
+		{"missing payload", crdt.Op{ID: "op-1", Kind: "set_payer"}, "set_payer payload is required"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateOp(testValidationDoc(), tc.op)
+			if tc.reason == "" {
+				if err != nil {
+					t.Fatalf("expected valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.reason) {
+				t.Fatalf("expected %q, got %v", tc.reason, err)
+			}
+		})
+	}
+}
+
+func TestPatchItemChecksOnlyPatchedFields(t *testing.T) {
+	doc := testValidationDoc()
+	// Bob has left the room, and the item predates the quantity bound.
+	fries := doc.Items["fries"]
+	fries.Assigned["bob"] = true
+	fries.Quantity = 5000
+	patch := func(fields string) error {
+		var raw map[string]json.RawMessage
+		json.Unmarshal([]byte(fields), &raw)
+		return validateOp(doc, testOp("patch_item", crdt.PatchPayload{ID: "fries", Fields: raw}))
+	}
+	if err := patch(`{"name": "Curly fries", "line_price_cents": 600}`); err != nil {
+		t.Fatalf("expected the item to stay editable, got %v", err)
+	}
+	if err := patch(`{"quantity": 2}`); err != nil {
+		t.Fatalf("expected the legacy quantity to be fixable, got %v", err)
+	}
+	if err := patch(`{"quantity": 5001}`); err == nil || !strings.Contains(err.Error(), "quantity must be between") {
+		t.Fatalf("expected a patched quantity still checked, got %v", err)
+	}
+}
+
+func TestInvalidOpIsRejectedAndNotPersisted(t *testing.T) {
+	srv, ts := newTestServer(t)
+	created := createTestRoom(t, ts, "Alice")
+	conn := dialTestRoom(t, ts, created.RoomCode, created.UserID, created.JoinToken)
+	readUntil(t, conn, "snapshot")
+	before, _ := srv.store.CurrentSeq(context.Background(), created.RoomCode)
+
+	negative := -500
+	payload, _ := json.Marshal(crdt.TaxTipPayload{TaxCents: &negative})
+	conn.WriteJSON(map[string]any{"type": "op", "op": crdt.Op{ID: "bad-tax", ActorID: created.UserID, Kind: "set_tax_tip", Payload: payload}})
+
+	var reject struct {
+		Type   string `json:"type"`
+		OpID   string `json:"op_id"`
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(readUntil(t, conn, "reject").Raw, &reject)
+	if reject.OpID != "bad-tax" || !strings.Contains(reject.Reason, "tax_cents") {
+		t.Fatalf("unexpected reject %+v", reject)
+	}
+	if after, _ := srv.store.CurrentSeq(context.Background(), created.RoomCode); after != before {
+		t.Fatalf("invalid op was appended: seq %d -> %d", before, after)
+	}
+}
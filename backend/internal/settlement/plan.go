@@ -0,0 +1,227 @@
+package settlement
+
+import (
+	"math/bits"
+	"sort"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+// exactPlanLimit caps how many non-zero balances get the exhaustive
+// minimum-transfer search; larger groups fall back to greedy matching.
+const exactPlanLimit = 16
+
+type Transfer struct {
+	FromID      string `json:"from_id"`
+	FromName    string `json:"from_name"`
+	ToID        string `json:"to_id"`
+	ToName      string `json:"to_name"`
+	AmountCents int64  `json:"amount_cents"`
+}
+
+type Balance struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	OwedCents int64  `json:"owed_cents"`
+	PaidCents int64  `json:"paid_cents"`
+	// NetCents is paid minus owed: positive means the person is owed money.
+	NetCents int64 `json:"net_cents"`
+}
+
+// Plan is the settlement for one room. UnsettledCents is what the transfers
+// cannot cover because payments and assigned shares don't add up (unassigned
+// items, an under- or overpayment).
+type Plan struct {
+	RoomID          string     `json:"room_id"`
+	Currency        string     `json:"currency"`
+	TotalCents      int64      `json:"total_cents"`
+	PaidCents       int64      `json:"paid_cents"`
+	UnassignedCents int64      `json:"unassigned_cents"`
+	UnsettledCents  int64      `json:"unsettled_cents"`
+	Balances        []Balance  `json:"balances"`
+	Transfers       []Transfer `json:"transfers"`
+}
+
+// PlanRoom turns a room's per-person totals and recorded payers into the
+// smallest set of transfers that settles everyone.
+func PlanRoom(room *crdt.RoomDoc) *Plan {
+	summary := Compute(room)
+	if summary == nil {
+		return nil
+	}
+	plan := &Plan{
+		RoomID:          summary.RoomID,
+		Currency:        summary.Currency,
+		TotalCents:      summary.TotalCents,
+		UnassignedCents: summary.UnassignedCents,
+		Balances:        []Balance{},
+		Transfers:       []Transfer{},
+	}
+
+	balances := map[string]*Balance{}
+	names := map[string]string{}
+	for _, person := range summary.People {
+		balances[person.ID] = &Balance{ID: person.ID, Name: person.Name, OwedCents: person.TotalCents}
+		names[person.ID] = person.Name
+	}
+	for id, payer := range room.Payers {
+		if payer == nil || payer.AmountCents <= 0 {
+			continue
+		}
+		balance := balances[id]
+		if balance == nil {
+			balance = &Balance{ID: id, Name: id}
+			if participant := room.Participants[id]; participant != nil && participant.Name != "" {
+				balance.Name = participant.Name
+			}
+			balances[id] = balance
+			names[id] = balance.Name
+		}
+		balance.PaidCents += int64(payer.AmountCents)
+		plan.PaidCents += int64(payer.AmountCents)
+	}
+
+	ids := make([]string, 0, len(balances))
+	for id := range balances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	nets := map[string]int64{}
+	for _, id := range ids {
+		balance := balances[id]
+		balance.NetCents = balance.PaidCents - balance.OwedCents
+		nets[id] = balance.NetCents
+		plan.Balances = append(plan.Balances, *balance)
+	}
+	if plan.PaidCents == 0 {
+		return plan
+	}
+
+	transfers, unsettled := MinimizeTransfers(nets)
+	for _, transfer := range transfers {
+		transfer.FromName = names[transfer.FromID]
+		transfer.ToName = names[transfer.ToID]
+		plan.Transfers = append(plan.Transfers, transfer)
+	}
+	plan.UnsettledCents = unsettled
+	return plan
+}
+
+// MinimizeTransfers settles net balances (positive = owed money) with as few
+// transfers as possible. A group of n balances summing to zero needs n-1
+// transfers, so the minimum comes from splitting people into the largest
+// number of zero-sum subgroups; that search is exact up to exactPlanLimit
+// balances. The second return value is the absolute imbalance left over when
+// the balances don't sum to zero.
+func MinimizeTransfers(nets map[string]int64) ([]Transfer, int64) {
+	ids := make([]string, 0, len(nets))
+	total := int64(0)
+	for id, net := range nets {
+		if net == 0 {
+			continue
+		}
+		ids = append(ids, id)
+		total += net
+	}
+	sort.Strings(ids)
+	if total != 0 || len(ids) > exactPlanLimit {
+		transfers := greedyTransfers(ids, nets)
+		if total < 0 {
+			total = -total
+		}
+		return transfers, total
+	}
+
+	transfers := []Transfer{}
+	for _, group := range zeroSumGroups(ids, nets) {
+		transfers = append(transfers, greedyTransfers(group, nets)...)
+	}
+	return transfers, 0
+}
+
+// zeroSumGroups partitions ids into the maximum number of zero-sum subsets via a
+// DP over bitmasks: best[mask] is the most zero-sum groups that can be formed by
+// some ordering of mask, each group closing when the running sum returns to zero.
+func zeroSumGroups(ids []string, nets map[string]int64) [][]string {
+	n := len(ids)
+	if n == 0 {
+		return nil
+	}
+	full := 1<<n - 1
+	sums := make([]int64, full+1)
+	best := make([]int, full+1)
+	for mask := 1; mask <= full; mask++ {
+		low := mask & -mask
+		sums[mask] = sums[mask^low] + nets[ids[bits.TrailingZeros(uint(low))]]
+		top := 0
+		for i := 0; i < n; i++ {
+			if mask&(1<<i) != 0 && best[mask^(1<<i)] > top {
+				top = best[mask^(1<<i)]
+			}
+		}
+		best[mask] = top
+		if sums[mask] == 0 {
+			best[mask]++
+		}
+	}
+
+	// Walk back from the full set peeling one element at a time; every time the
+	// remaining set sums to zero a group boundary has been crossed.
+	groups := [][]string{}
+	current := []string{}
+	mask := full
+	for mask != 0 {
+		target := best[mask]
+		if sums[mask] == 0 {
+			target--
+		}
+		for i := 0; i < n; i++ {
+			bit := 1 << i
+			if mask&bit == 0 || best[mask^bit] != target {
+				continue
+			}
+			current = append(current, ids[i])
+			mask ^= bit
+			break
+		}
+		if sums[mask] == 0 {
+			sort.Strings(current)
+			groups = append(groups, current)
+			current = []string{}
+		}
+	}
+	return groups
+}
+
+// greedyTransfers repeatedly pays the largest creditor from the largest debtor.
+// Each transfer zeroes at least one side, so a zero-sum group of n people
+// settles in at most n-1 transfers.
+func greedyTransfers(ids []string, nets map[string]int64) []Transfer {
+	remaining := make(map[string]int64, len(ids))
+	for _, id := range ids {
+		remaining[id] = nets[id]
+	}
+	transfers := []Transfer{}
+	for {
+		debtor, creditor := "", ""
+		for _, id := range ids {
+			net := remaining[id]
+			if net < 0 && (debtor == "" || net < remaining[debtor]) {
+				debtor = id
+			}
+			if net > 0 && (creditor == "" || net > remaining[creditor]) {
+				creditor = id
+			}
+		}
+		if debtor == "" || creditor == "" {
+			return transfers
+		}
+		amount := -remaining[debtor]
+		if remaining[creditor] < amount {
+			amount = remaining[creditor]
+		}
+		remaining[debtor] += amount
+		remaining[creditor] -= amount
+		transfers = append(transfers, Transfer{FromID: debtor, ToID: creditor, AmountCents: amount})
+	}
+}
@@ -0,0 +1,95 @@
+package settlement
+
+import (
+	"testing"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+func applyTransfers(nets map[string]int64, transfers []Transfer) map[string]int64 {
+	out := map[string]int64{}
+	for id, net := range nets {
+		out[id] = net
+	}
+	for _, transfer := range transfers {
+		out[transfer.FromID] += transfer.AmountCents
+		out[transfer.ToID] -= transfer.AmountCents
+	}
+	return out
+}
+
+func TestMinimizeTransfersBeatsGreedy(t *testing.T) {
+	// Largest-debtor-to-largest-creditor needs 5 transfers here; splitting into
+	// {a, e, d} and {b, c, f} settles in 4.
+	nets := map[string]int64{
+		"a": 800, "b": 500, "c": 400, "d": -200, "e": -600, "f": -900,
+	}
+	if got := len(greedyTransfers([]string{"a", "b", "c", "d", "e", "f"}, nets)); got != 5 {
+		t.Fatalf("expected greedy baseline of 5 transfers, got %d", got)
+	}
+	transfers, unsettled := MinimizeTransfers(nets)
+	if unsettled != 0 {
+		t.Fatalf("expected balanced plan, got unsettled=%d", unsettled)
+	}
+	if len(transfers) != 4 {
+		t.Fatalf("expected 4 transfers, got %d: %#v", len(transfers), transfers)
+	}
+	for id, net := range applyTransfers(nets, transfers) {
+		if net != 0 {
+			t.Fatalf("expected %s settled, still %d", id, net)
+		}
+	}
+}
+
+func TestMinimizeTransfersPairsMatchingBalances(t *testing.T) {
+	nets := map[string]int64{"a": 700, "b": 300, "c": -300, "d": -400, "e": -300, "z": 0}
+	transfers, _ := MinimizeTransfers(nets)
+	if len(transfers) != 3 {
+		t.Fatalf("expected 3 transfers, got %#v", transfers)
+	}
+	for id, net := range applyTransfers(nets, transfers) {
+		if net != 0 {
+			t.Fatalf("expected %s settled, still %d", id, net)
+		}
+	}
+}
+
+func TestMinimizeTransfersReportsImbalance(t *testing.T) {
+	transfers, unsettled := MinimizeTransfers(map[string]int64{"a": 1000, "b": -700})
+	if unsettled != 300 {
+		t.Fatalf("expected 300 unsettled, got %d", unsettled)
+	}
+	if len(transfers) != 1 || transfers[0].AmountCents != 700 {
+		t.Fatalf("expected single 700 transfer, got %#v", transfers)
+	}
+}
+
+func TestPlanRoomSettlesAgainstPayers(t *testing.T) {
+	room := testRoom()
+	room.Items["i1"] = &crdt.Item{ID: "i1", Name: "Pizza", Quantity: 1, LinePriceCents: 3000, Assigned: map[string]bool{"u1": true, "u2": true, "u3": true}}
+	room.TipCents = 600
+	room.Payers["u1"] = &crdt.Payer{ParticipantID: "u1", AmountCents: 3600}
+
+	plan := PlanRoom(room)
+	if plan.PaidCents != 3600 || plan.TotalCents != 3600 || plan.UnsettledCents != 0 {
+		t.Fatalf("unexpected plan totals: %#v", plan)
+	}
+	if len(plan.Transfers) != 2 {
+		t.Fatalf("expected two transfers to the payer, got %#v", plan.Transfers)
+	}
+	for _, transfer := range plan.Transfers {
+		if transfer.ToID != "u1" || transfer.ToName != "Alice" || transfer.AmountCents != 1200 {
+			t.Fatalf("unexpected transfer %#v", transfer)
+		}
+	}
+}
+
+func TestPlanRoomWithoutPayersHasNoTransfers(t *testing.T) {
+	room := testRoom()
+	room.Items["i1"] = &crdt.Item{ID: "i1", Name: "Pizza", Quantity: 1, LinePriceCents: 3000, Assigned: map[string]bool{"u1": true}}
+
+	plan := PlanRoom(room)
+	if len(plan.Transfers) != 0 || len(plan.Balances) != 1 || plan.Balances[0].NetCents != -3000 {
+		t.Fatalf("expected balances only, got %#v", plan)
+	}
+}
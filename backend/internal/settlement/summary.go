@@ -0,0 +1,373 @@
+package settlement
+
+import (
+	"sort"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+// Summary is the authoritative per-participant breakdown of a room. It mirrors
+// computeSummary in the frontend so bots/exports see the same cents a browser shows.
+type Summary struct {
+	RoomID              string          `json:"room_id"`
+	Currency            string          `json:"currency"`
+	GrossCents          int64           `json:"gross_cents"`
+	ItemDiscountCents   int64           `json:"item_discount_cents"`
+	BillDiscountCents   int64           `json:"bill_discount_cents"`
+	DiscountCents       int64           `json:"discount_cents"`
+	NetCents            int64           `json:"net_cents"`
+	BillChargesCents    int64           `json:"bill_charges_cents"`
+	TaxCents            int64           `json:"tax_cents"`
+	TipCents            int64           `json:"tip_cents"`
+	TotalBeforeTipCents int64           `json:"total_before_tip_cents"`
+	TotalCents          int64           `json:"total_cents"`
+	AssignedCents       int64           `json:"assigned_cents"`
+	UnassignedCents     int64           `json:"unassigned_cents"`
+	UnassignedItemIDs   []string        `json:"unassigned_item_ids"`
+	People              []PersonSummary `json:"people"`
+}
+
+type PersonSummary struct {
+	ID                     string      `json:"id"`
+	Name                   string      `json:"name"`
+	Items                  []ItemShare `json:"items"`
+	GrossItemsCents        int64       `json:"gross_items_cents"`
+	ItemsCents             int64       `json:"items_cents"`
+	BillDiscountShareCents int64       `json:"bill_discount_share_cents"`
+	BillChargesShareCents  int64       `json:"bill_charges_share_cents"`
+	TaxShareCents          int64       `json:"tax_share_cents"`
+	TipShareCents          int64       `json:"tip_share_cents"`
+	// RemainderCents counts the leftover pennies this person absorbed across
+	// every even/proportional split (already included in the shares above).
+	RemainderCents int64 `json:"remainder_cents"`
+	TotalCents     int64 `json:"total_cents"`
+}
+
+type ItemShare struct {
+	ItemID              string `json:"item_id"`
+	Name                string `json:"name"`
+	ShareCents          int64  `json:"share_cents"`
+	FractionNumerator   int64  `json:"fraction_numerator"`
+	FractionDenominator int64  `json:"fraction_denominator"`
+}
+
+// allocation is the result of splitting an amount: the per-id shares plus the
+// extra pennies each id received while distributing the rounding remainder.
+type allocation struct {
+	shares    map[string]int64
+	remainder map[string]int64
+}
+
+// SplitEven divides total across ids (deduplicated, sorted) with remainder
+// pennies going to the lowest ids first.
+func SplitEven(total int64, ids []string) map[string]int64 {
+	return splitEven(total, ids).shares
+}
+
+func splitEven(total int64, ids []string) allocation {
+	out := allocation{shares: map[string]int64{}, remainder: map[string]int64{}}
+	sorted := uniqueSorted(ids)
+	if total <= 0 || len(sorted) == 0 {
+		return out
+	}
+	base := total / int64(len(sorted))
+	rem := total - base*int64(len(sorted))
+	for _, id := range sorted {
+		out.shares[id] = base
+		if rem > 0 {
+			out.shares[id]++
+			out.remainder[id] = 1
+			rem--
+		}
+	}
+	return out
+}
+
+// SplitProportional divides total by weight using largest-remainder rounding;
+// ties break by id so the result is deterministic.
+func SplitProportional(total int64, weights map[string]int64) map[string]int64 {
+	return splitProportional(total, weights).shares
+}
+
+func splitProportional(total int64, weights map[string]int64) allocation {
+	out := allocation{shares: map[string]int64{}, remainder: map[string]int64{}}
+	ids := make([]string, 0, len(weights))
+	sumW := int64(0)
+	for id, w := range weights {
+		if w <= 0 {
+			continue
+		}
+		ids = append(ids, id)
+		sumW += w
+	}
+	if total <= 0 || sumW <= 0 || len(ids) == 0 {
+		return out
+	}
+	sort.Strings(ids)
+
+	// Integer math keeps the fractional parts exact: frac = (total*w) % sumW.
+	type fraction struct {
+		id  string
+		num int64
+	}
+	fracs := make([]fraction, 0, len(ids))
+	used := int64(0)
+	for _, id := range ids {
+		exact := total * weights[id]
+		base := exact / sumW
+		out.shares[id] = base
+		used += base
+		fracs = append(fracs, fraction{id: id, num: exact % sumW})
+	}
+	sort.SliceStable(fracs, func(i, j int) bool {
+		if fracs[i].num != fracs[j].num {
+			return fracs[i].num > fracs[j].num
+		}
+		return fracs[i].id < fracs[j].id
+	})
+	for i := int64(0); i < total-used; i++ {
+		id := fracs[i].id
+		out.shares[id]++
+		out.remainder[id]++
+	}
+	return out
+}
+
+// Compute builds the per-participant breakdown for a room. Items are split across
+// their assignees by allocation weight (evenly when unweighted); bill discount,
+// charges and tip are allocated proportionally to gross item shares and tax to
+// post-discount item shares.
+func Compute(room *crdt.RoomDoc) *Summary {
+	if room == nil {
+		return nil
+	}
+	summary := &Summary{
+		RoomID:            room.RoomID,
+		Currency:          room.Currency,
+		UnassignedItemIDs: []string{},
+		People:            []PersonSummary{},
+	}
+
+	itemIDs := make([]string, 0, len(room.Items))
+	for id, it := range room.Items {
+		if it != nil {
+			itemIDs = append(itemIDs, id)
+		}
+	}
+	sort.Strings(itemIDs)
+
+	people := map[string]*PersonSummary{}
+	for _, id := range itemIDs {
+		it := room.Items[id]
+		grossLine := nonNegative(int64(it.LinePriceCents))
+		netLine := grossLine - itemDiscountCents(it, grossLine)
+		summary.GrossCents += grossLine
+		summary.ItemDiscountCents += grossLine - netLine
+
+		assignees := assignedIDs(it)
+		if len(assignees) == 0 {
+			summary.UnassignedItemIDs = append(summary.UnassignedItemIDs, it.ID)
+			summary.UnassignedCents += netLine
+			continue
+		}
+		split := splitItem(it, grossLine, netLine, assignees)
+		for _, uid := range assignees {
+			person := people[uid]
+			if person == nil {
+				person = &PersonSummary{ID: uid, Name: uid, Items: []ItemShare{}}
+				if participant := room.Participants[uid]; participant != nil && participant.Name != "" {
+					person.Name = participant.Name
+				}
+				people[uid] = person
+			}
+			person.GrossItemsCents += split.gross.shares[uid]
+			person.ItemsCents += split.net.shares[uid]
+			person.RemainderCents += split.net.remainder[uid]
+			fraction := split.fractions[uid]
+			person.Items = append(person.Items, ItemShare{
+				ItemID:              it.ID,
+				Name:                it.Name,
+				ShareCents:          split.net.shares[uid],
+				FractionNumerator:   fraction[0],
+				FractionDenominator: fraction[1],
+			})
+		}
+	}
+
+	billDiscount := nonNegative(int64(room.BillDiscountCents))
+	if maxDiscount := summary.GrossCents - summary.ItemDiscountCents; billDiscount > maxDiscount {
+		billDiscount = maxDiscount
+	}
+	summary.BillDiscountCents = billDiscount
+	summary.DiscountCents = summary.ItemDiscountCents + billDiscount
+	summary.NetCents = nonNegative(summary.GrossCents - summary.DiscountCents)
+	summary.BillChargesCents = nonNegative(int64(room.BillChargesCents))
+	summary.TaxCents = nonNegative(int64(room.TaxCents))
+	summary.TipCents = nonNegative(int64(room.TipCents))
+	summary.TotalBeforeTipCents = summary.NetCents + summary.BillChargesCents + summary.TaxCents
+	summary.TotalCents = summary.TotalBeforeTipCents + summary.TipCents
+
+	grossWeights := map[string]int64{}
+	for uid, person := range people {
+		grossWeights[uid] = person.GrossItemsCents
+	}
+	discountSplit := splitProportional(billDiscount, grossWeights)
+	chargesSplit := splitProportional(summary.BillChargesCents, grossWeights)
+	taxableWeights := map[string]int64{}
+	for uid, person := range people {
+		taxableWeights[uid] = nonNegative(person.ItemsCents - discountSplit.shares[uid])
+	}
+	taxSplit := splitProportional(summary.TaxCents, taxableWeights)
+	tipSplit := splitProportional(summary.TipCents, grossWeights)
+
+	uids := make([]string, 0, len(people))
+	for uid := range people {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		person := people[uid]
+		person.BillDiscountShareCents = discountSplit.shares[uid]
+		person.BillChargesShareCents = chargesSplit.shares[uid]
+		person.TaxShareCents = taxSplit.shares[uid]
+		person.TipShareCents = tipSplit.shares[uid]
+		person.RemainderCents += discountSplit.remainder[uid] + chargesSplit.remainder[uid] + taxSplit.remainder[uid] + tipSplit.remainder[uid]
+		person.TotalCents = person.ItemsCents - person.BillDiscountShareCents + person.BillChargesShareCents + person.TaxShareCents + person.TipShareCents
+		sort.SliceStable(person.Items, func(i, j int) bool {
+			return person.Items[i].Name < person.Items[j].Name
+		})
+		summary.AssignedCents += person.TotalCents
+		summary.People = append(summary.People, *person)
+	}
+	return summary
+}
+
+// TotalCents returns the grand total of a room without building per-person shares.
+func TotalCents(room *crdt.RoomDoc) int64 {
+	summary := Compute(room)
+	if summary == nil {
+		return 0
+	}
+	return summary.TotalCents
+}
+
+// itemSplit is one item's gross and net line divided across its assignees, with
+// the numerator/denominator each assignee's portion is reported as.
+type itemSplit struct {
+	gross     allocation
+	net       allocation
+	fractions map[string][2]int64
+}
+
+// splitItem divides an item across assignees. Without weights it is an even split.
+// Fixed-cent allocations are taken off the gross line first and the rest is split by
+// shares; if nobody holds shares (or fixed amounts exceed the line) the fixed amounts
+// are scaled to fit. The net line then follows the gross split proportionally.
+func splitItem(it *crdt.Item, grossLine, netLine int64, assignees []string) itemSplit {
+	shareWeights := map[string]int64{}
+	fixed := map[string]int64{}
+	fixedTotal := int64(0)
+	weighted := false
+	for _, uid := range assignees {
+		allocation, ok := it.Allocations[uid]
+		switch {
+		case ok && allocation.Cents != nil:
+			fixed[uid] = nonNegative(int64(*allocation.Cents))
+			fixedTotal += fixed[uid]
+			weighted = true
+		case ok && allocation.Shares > 0:
+			shareWeights[uid] = int64(allocation.Shares)
+			if allocation.Shares != 1 {
+				weighted = true
+			}
+		default:
+			shareWeights[uid] = 1
+		}
+	}
+	if len(shareWeights) == 0 && fixedTotal == 0 {
+		weighted = false
+	}
+
+	out := itemSplit{fractions: map[string][2]int64{}}
+	if !weighted {
+		out.gross = splitEven(grossLine, assignees)
+		out.net = splitEven(netLine, assignees)
+		for _, uid := range assignees {
+			out.fractions[uid] = [2]int64{1, int64(len(assignees))}
+		}
+		return out
+	}
+
+	if len(fixed) == 0 {
+		out.gross = splitProportional(grossLine, shareWeights)
+		totalShares := int64(0)
+		for _, w := range shareWeights {
+			totalShares += w
+		}
+		for uid, w := range shareWeights {
+			out.fractions[uid] = [2]int64{w, totalShares}
+		}
+	} else {
+		if len(shareWeights) == 0 || fixedTotal >= grossLine {
+			out.gross = splitProportional(grossLine, fixed)
+		} else {
+			out.gross = splitProportional(grossLine-fixedTotal, shareWeights)
+			for uid, cents := range fixed {
+				out.gross.shares[uid] = cents
+			}
+		}
+		denominator := grossLine
+		if denominator <= 0 {
+			denominator = 1
+		}
+		for _, uid := range assignees {
+			out.fractions[uid] = [2]int64{out.gross.shares[uid], denominator}
+		}
+	}
+	out.net = splitProportional(netLine, out.gross.shares)
+	return out
+}
+
+func itemDiscountCents(it *crdt.Item, grossLine int64) int64 {
+	qty := int64(it.Quantity)
+	if qty <= 0 {
+		qty = 1
+	}
+	disc := nonNegative(int64(it.DiscountCents) * qty)
+	if disc > grossLine {
+		disc = grossLine
+	}
+	return disc
+}
+
+func assignedIDs(it *crdt.Item) []string {
+	ids := make([]string, 0, len(it.Assigned))
+	for uid, on := range it.Assigned {
+		if on && uid != "" {
+			ids = append(ids, uid)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func uniqueSorted(ids []string) []string {
+	seen := make(map[string]struct{}, len(ids))
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func nonNegative(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,192 @@
+package settlement
+
+import (
+	"testing"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+)
+
+func testRoom() *crdt.RoomDoc {
+	room := crdt.NewRoom("ROOM01", "Dinner")
+	room.Participants["u1"] = &crdt.Participant{ID: "u1", Name: "Alice"}
+	room.Participants["u2"] = &crdt.Participant{ID: "u2", Name: "Bob"}
+	room.Participants["u3"] = &crdt.Participant{ID: "u3", Name: "Cara"}
+	return room
+}
+
+func findPerson(t *testing.T, summary *Summary, id string) PersonSummary {
+	t.Helper()
+	for _, person := range summary.People {
+		if person.ID == id {
+			return person
+		}
+	}
+	t.Fatalf("expected person %s in summary, got %#v", id, summary.People)
+	return PersonSummary{}
+}
+
+func TestSplitEvenDistributesRemainderToLowestIDs(t *testing.T) {
+	got := SplitEven(100, []string{"c", "a", "b", "a"})
+	if got["a"] != 34 || got["b"] != 33 || got["c"] != 33 {
+		t.Fatalf("unexpected split: %#v", got)
+	}
+	if len(SplitEven(0, []string{"a"})) != 0 {
+		t.Fatal("expected empty split for zero total")
+	}
+}
+
+func TestSplitProportionalUsesLargestRemainder(t *testing.T) {
+	got := SplitProportional(10, map[string]int64{"a": 1, "b": 1, "c": 1})
+	if got["a"] != 4 || got["b"] != 3 || got["c"] != 3 {
+		t.Fatalf("unexpected split: %#v", got)
+	}
+	got = SplitProportional(100, map[string]int64{"a": 3, "b": 1, "z": 0})
+	if got["a"] != 75 || got["b"] != 25 || got["z"] != 0 {
+		t.Fatalf("unexpected weighted split: %#v", got)
+	}
+}
+
+func TestComputeAllocatesTaxTipAndDiscounts(t *testing.T) {
+	room := testRoom()
+	room.Items["i1"] = &crdt.Item{ID: "i1", Name: "Tacos", Quantity: 1, LinePriceCents: 3000, Assigned: map[string]bool{"u1": true, "u2": true}}
+	room.Items["i2"] = &crdt.Item{ID: "i2", Name: "Wine", Quantity: 2, LinePriceCents: 1000, DiscountCents: 100, Assigned: map[string]bool{"u2": true}}
+	room.Items["i3"] = &crdt.Item{ID: "i3", Name: "Dessert", Quantity: 1, LinePriceCents: 500, Assigned: map[string]bool{"u3": false}}
+	room.BillDiscountCents = 400
+	room.BillChargesCents = 200
+	room.TaxCents = 301
+	room.TipCents = 800
+
+	summary := Compute(room)
+	if summary.GrossCents != 4500 || summary.ItemDiscountCents != 200 || summary.BillDiscountCents != 400 {
+		t.Fatalf("unexpected gross/discounts: %#v", summary)
+	}
+	if summary.NetCents != 3900 || summary.TotalBeforeTipCents != 4401 || summary.TotalCents != 5201 {
+		t.Fatalf("unexpected totals: %#v", summary)
+	}
+	if len(summary.UnassignedItemIDs) != 1 || summary.UnassignedItemIDs[0] != "i3" || summary.UnassignedCents != 500 {
+		t.Fatalf("expected dessert to be reported unassigned, got %#v", summary.UnassignedItemIDs)
+	}
+
+	alice := findPerson(t, summary, "u1")
+	bob := findPerson(t, summary, "u2")
+	if alice.ItemsCents != 1500 || bob.ItemsCents != 2300 {
+		t.Fatalf("unexpected item shares: alice=%d bob=%d", alice.ItemsCents, bob.ItemsCents)
+	}
+	if alice.BillDiscountShareCents+bob.BillDiscountShareCents != 400 {
+		t.Fatalf("bill discount not fully allocated: %d + %d", alice.BillDiscountShareCents, bob.BillDiscountShareCents)
+	}
+	if alice.TaxShareCents+bob.TaxShareCents != 301 || alice.TipShareCents+bob.TipShareCents != 800 {
+		t.Fatalf("tax/tip not fully allocated: %#v %#v", alice, bob)
+	}
+	if alice.TotalCents+bob.TotalCents != summary.AssignedCents {
+		t.Fatalf("assigned total mismatch: %d + %d != %d", alice.TotalCents, bob.TotalCents, summary.AssignedCents)
+	}
+	if summary.AssignedCents != summary.TotalCents-summary.UnassignedCents {
+		t.Fatalf("expected assigned %d to cover total minus unassigned, got %d", summary.TotalCents-summary.UnassignedCents, summary.AssignedCents)
+	}
+	if len(bob.Items) != 2 || bob.Items[0].Name != "Tacos" || bob.Items[1].Name != "Wine" {
+		t.Fatalf("expected bob's items sorted by name, got %#v", bob.Items)
+	}
+}
+
+func TestComputeTracksRemainderPennies(t *testing.T) {
+	room := testRoom()
+	room.Items["i1"] = &crdt.Item{ID: "i1", Name: "Pizza", Quantity: 1, LinePriceCents: 1000, Assigned: map[string]bool{"u1": true, "u2": true, "u3": true}}
+
+	summary := Compute(room)
+	alice := findPerson(t, summary, "u1")
+	bob := findPerson(t, summary, "u2")
+	if alice.ItemsCents != 334 || alice.RemainderCents != 1 {
+		t.Fatalf("expected alice to absorb the extra penny, got %#v", alice)
+	}
+	if bob.ItemsCents != 333 || bob.RemainderCents != 0 {
+		t.Fatalf("expected bob to get an even share, got %#v", bob)
+	}
+	if alice.Items[0].FractionDenominator != 3 {
+		t.Fatalf("expected 1/3 fraction, got %#v", alice.Items[0])
+	}
+}
+
+func TestComputeNilRoom(t *testing.T) {
+	if Compute(nil) != nil {
+		t.Fatal("expected nil summary for nil room")
+	}
+	if TotalCents(nil) != 0 {
+		t.Fatal("expected zero total for nil room")
+	}
+}
+
+func TestComputeRespectsShareWeights(t *testing.T) {
+	room := testRoom()
+	room.Items["i1"] = &crdt.Item{
+		ID:             "i1",
+		Name:           "Tacos",
+		Quantity:       3,
+		LinePriceCents: 1200,
+		Assigned:       map[string]bool{"u1": true, "u2": true},
+		Allocations:    map[string]crdt.Allocation{"u1": {Shares: 2}},
+	}
+	room.TaxCents = 90
+
+	summary := Compute(room)
+	alice := findPerson(t, summary, "u1")
+	bob := findPerson(t, summary, "u2")
+	if alice.ItemsCents != 800 || bob.ItemsCents != 400 {
+		t.Fatalf("expected 2:1 split, got alice=%d bob=%d", alice.ItemsCents, bob.ItemsCents)
+	}
+	if alice.Items[0].FractionNumerator != 2 || alice.Items[0].FractionDenominator != 3 {
+		t.Fatalf("expected 2/3 fraction, got %#v", alice.Items[0])
+	}
+	if alice.TaxShareCents != 60 || bob.TaxShareCents != 30 {
+		t.Fatalf("expected tax to follow weighted shares, got alice=%d bob=%d", alice.TaxShareCents, bob.TaxShareCents)
+	}
+}
+
+func TestComputeRespectsFixedCentAllocations(t *testing.T) {
+	fixed := 300
+	room := testRoom()
+	room.Items["i1"] = &crdt.Item{
+		ID:             "i1",
+		Name:           "Platter",
+		Quantity:       1,
+		LinePriceCents: 1000,
+		DiscountCents:  100,
+		Assigned:       map[string]bool{"u1": true, "u2": true, "u3": true},
+		Allocations:    map[string]crdt.Allocation{"u1": {Cents: &fixed}},
+	}
+
+	summary := Compute(room)
+	alice := findPerson(t, summary, "u1")
+	bob := findPerson(t, summary, "u2")
+	cara := findPerson(t, summary, "u3")
+	if alice.GrossItemsCents != 300 || bob.GrossItemsCents != 350 || cara.GrossItemsCents != 350 {
+		t.Fatalf("unexpected gross split: %d/%d/%d", alice.GrossItemsCents, bob.GrossItemsCents, cara.GrossItemsCents)
+	}
+	if alice.ItemsCents+bob.ItemsCents+cara.ItemsCents != 900 {
+		t.Fatalf("expected net line fully allocated, got %d", alice.ItemsCents+bob.ItemsCents+cara.ItemsCents)
+	}
+	if alice.ItemsCents != 270 {
+		t.Fatalf("expected discount to apply proportionally to fixed share, got %d", alice.ItemsCents)
+	}
+}
+
+func TestComputeScalesFixedAllocationsThatExceedLine(t *testing.T) {
+	a, b := 900, 300
+	room := testRoom()
+	room.Items["i1"] = &crdt.Item{
+		ID:             "i1",
+		Name:           "Wine",
+		Quantity:       1,
+		LinePriceCents: 800,
+		Assigned:       map[string]bool{"u1": true, "u2": true},
+		Allocations:    map[string]crdt.Allocation{"u1": {Cents: &a}, "u2": {Cents: &b}},
+	}
+
+	summary := Compute(room)
+	if got := findPerson(t, summary, "u1").ItemsCents; got != 600 {
+		t.Fatalf("expected u1 scaled to 600, got %d", got)
+	}
+	if got := findPerson(t, summary, "u2").ItemsCents; got != 200 {
+		t.Fatalf("expected u2 scaled to 200, got %d", got)
+	}
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/crdt"
+	"github.com/aschi2/MultiplayerBillSplit/backend/internal/ledger"
+)
+
+// OpEntry is an op together with the seq the store assigned to it.
+type OpEntry struct {
+	Seq int64   `json:"seq"`
+	Op  crdt.Op `json:"op"`
+}
+
+// Store is everything the server needs from room persistence. redisstore is the
+// production implementation; memstore keeps it all in-process for demos and tests.
+type Store interface {
+	// LoadSnapshot returns the stored doc and the seq it was saved at, or a nil doc if missing.
+	LoadSnapshot(ctx context.Context, roomID string) (*crdt.RoomDoc, int64, error)
+	// SaveSnapshot stores doc as the room state through seq. A save older than the
+	// stored snapshot is ignored, and the room's seq counter is raised to seq but
+	// never lowered.
+	SaveSnapshot(ctx context.Context, roomID string, doc *crdt.RoomDoc, seq int64) error
+	// AppendOp atomically assigns the next seq to op and stores it in the room's op
+	// log, so the log is strictly ordered by seq with no gaps.
+	AppendOp(ctx context.Context, roomID string, op crdt.Op) (int64, error)
+	// AppendOps appends ops as one contiguous seq range in a single atomic step
+	// and returns the seq of the last; the first is that minus len(ops)-1.
+	AppendOps(ctx context.Context, roomID string, ops []crdt.Op) (int64, error)
+	CurrentSeq(ctx context.Context, roomID string) (int64, error)
+	// LoadOps returns retained ops with seq > fromSeq in seq order. Ops dropped by
+	// TrimOps are gone, so the first entry may start after fromSeq+1.
+	LoadOps(ctx context.Context, roomID string, fromSeq int64) ([]OpEntry, error)
+	// TrimOps drops ops with seq <= throughSeq from the log.
+	TrimOps(ctx context.Context, roomID string, throughSeq int64) error
+	TouchRoom(ctx context.Context, roomID string)
+	// SnapshotTTL returns remaining TTL for a room; <= 0 means missing or expired.
+	SnapshotTTL(ctx context.Context, roomID string) (time.Duration, error)
+
+	LoadLedger(ctx context.Context, ledgerID string) (*ledger.Ledger, error)
+	SaveLedger(ctx context.Context, l *ledger.Ledger, ttl time.Duration) error
+
+	// GetCached returns a cached value and whether it was present.
+	GetCached(ctx context.Context, key string) (string, bool, error)
+	SetCached(ctx context.Context, key, value string, ttl time.Duration) error
+}
+
+// BusMessage is a payload published to a room by some node.
+type BusMessage struct {
+	RoomID  string
+	Payload []byte
+}
+
+// Bus fans room messages out across backend nodes and shares which actors each
+// node has connected. redisstore implements it with pub/sub; memstore's is
+// in-process (several hubs in one process stand in for nodes in tests).
+type Bus interface {
+	// Publish delivers payload to every node subscribed to the room, the publisher included.
+	Publish(ctx context.Context, roomID string, payload []byte) error
+	Subscribe(ctx context.Context, roomID string) error
+	Unsubscribe(ctx context.Context, roomID string) error
+	// Messages yields payloads published to subscribed rooms.
+	Messages() <-chan BusMessage
+
+	// SetPresence records the actors connected to roomID through nodeID for ttl;
+	// an empty list clears the node's entry.
+	SetPresence(ctx context.Context, roomID, nodeID string, actorIDs []string, ttl time.Duration) error
+	// RoomPresence returns live actor lists keyed by node id.
+	RoomPresence(ctx context.Context, roomID string) (map[string][]string, error)
+}
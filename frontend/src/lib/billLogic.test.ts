@@ -4,7 +4,8 @@ import {
   hasUnassignedItems,
   hasUnreadyParticipants,
   mergeAssignment,
-  splitEvenCents
+  splitEvenCents,
+  splitItemCents
 } from './billLogic';
 import type { Item, Participant, RoomDoc } from './types';
 
@@ -283,6 +284,75 @@ describe('bulk footer mode state logic', () => {
   });
 });
 
+// ---------------------------------------------------------------------------
+// Allocations: same cents as backend/internal/settlement/summary.go
+// ---------------------------------------------------------------------------
+
+describe('computeSummary – allocations', () => {
+  const people = {
+    u1: makeParticipant({ id: 'u1', name: 'Alice' }),
+    u2: makeParticipant({ id: 'u2', name: 'Bob' }),
+    u3: makeParticipant({ id: 'u3', name: 'Cara' })
+  };
+  const person = (summary: ReturnType<typeof computeSummary>, id: string) =>
+    summary!.perPerson.find((p) => p.id === id)!;
+
+  it('splits by share weights and lets tax follow them', () => {
+    const summary = computeSummary(
+      makeRoom({
+        items: {
+          i1: makeItem({
+            id: 'i1',
+            quantity: 3,
+            line_price_cents: 1200,
+            assigned: { u1: true, u2: true },
+            allocations: { u1: { shares: 2 } }
+          })
+        },
+        participants: people,
+        tax_cents: 90
+      })
+    );
+    expect(person(summary, 'u1').itemsTotal).toBe(800);
+    expect(person(summary, 'u2').itemsTotal).toBe(400);
+    expect(person(summary, 'u1').items[0].fraction_numerator).toBe(2);
+    expect(person(summary, 'u1').items[0].fraction_denominator).toBe(3);
+    expect(person(summary, 'u1').taxShare).toBe(60);
+    expect(person(summary, 'u2').taxShare).toBe(30);
+  });
+
+  it('takes fixed cents off the line before splitting the rest', () => {
+    const summary = computeSummary(
+      makeRoom({
+        items: {
+          i1: makeItem({
+            id: 'i1',
+            line_price_cents: 1000,
+            discount_cents: 100,
+            assigned: { u1: true, u2: true, u3: true },
+            allocations: { u1: { cents: 300 } }
+          })
+        },
+        participants: people
+      })
+    );
+    expect(person(summary, 'u1').grossItemsTotal).toBe(300);
+    expect(person(summary, 'u2').grossItemsTotal).toBe(350);
+    expect(person(summary, 'u3').grossItemsTotal).toBe(350);
+    expect(person(summary, 'u1').itemsTotal).toBe(270);
+  });
+
+  it('scales fixed amounts that exceed the line', () => {
+    const split = splitItemCents(
+      makeItem({ line_price_cents: 800, allocations: { u1: { cents: 900 }, u2: { cents: 300 } } }),
+      800,
+      800,
+      ['u1', 'u2']
+    );
+    expect(split.net).toEqual({ u1: 600, u2: 200 });
+  });
+});
+
 // ---------------------------------------------------------------------------
 // Bonus: splitEvenCents correctness
 // ---------------------------------------------------------------------------
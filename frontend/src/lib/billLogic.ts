@@ -17,6 +17,96 @@ export const splitEvenCents = (total: number, participantIds: string[]) => {
   return result;
 };
 
+/**
+ * Splits total by weight with largest-remainder rounding, ties to the lowest
+ * id. Remainders are compared as whole numbers, as in settlement/summary.go.
+ */
+export const splitProportionalCents = (total: number, weights: Record<string, number>) => {
+  const entries = Object.entries(weights)
+    .filter(([, w]) => w > 0)
+    .sort(([a], [b]) => a.localeCompare(b));
+  const sumW = entries.reduce((s, [, w]) => s + w, 0);
+  if (total <= 0 || sumW <= 0 || !entries.length) return {} as Record<string, number>;
+  const bases: Record<string, number> = {};
+  const remainders: { id: string; frac: number }[] = [];
+  let used = 0;
+  entries.forEach(([id, w]) => {
+    const base = Math.floor((total * w) / sumW);
+    bases[id] = base;
+    used += base;
+    remainders.push({ id, frac: (total * w) % sumW });
+  });
+  const rem = total - used;
+  remainders.sort((a, b) => b.frac - a.frac || a.id.localeCompare(b.id));
+  for (let i = 0; i < rem; i++) {
+    bases[remainders[i].id] += 1;
+  }
+  return bases;
+};
+
+export type ItemSplit = {
+  gross: Record<string, number>;
+  net: Record<string, number>;
+  fractions: Record<string, [number, number]>;
+};
+
+/**
+ * Divides an item across its (sorted) assignees the way the server's
+ * settlement.splitItem does. Without allocations it is an even split.
+ * Fixed-cent allocations come off the gross line first and the rest is split
+ * by shares; if nobody holds shares (or the fixed amounts exceed the line) the
+ * fixed amounts are scaled to fit. The net line follows the gross split.
+ */
+export const splitItemCents = (item: Item, grossLine: number, netLine: number, assignees: string[]): ItemSplit => {
+  const allocations = item.allocations || {};
+  const shareWeights: Record<string, number> = {};
+  const fixed: Record<string, number> = {};
+  let fixedTotal = 0;
+  let weighted = false;
+  assignees.forEach((uid) => {
+    const allocation = allocations[uid];
+    if (allocation && typeof allocation.cents === 'number') {
+      fixed[uid] = Math.max(0, allocation.cents);
+      fixedTotal += fixed[uid];
+      weighted = true;
+    } else if (allocation && (allocation.shares || 0) > 0) {
+      shareWeights[uid] = allocation.shares || 0;
+      if (allocation.shares !== 1) weighted = true;
+    } else {
+      shareWeights[uid] = 1;
+    }
+  });
+  if (!Object.keys(shareWeights).length && fixedTotal === 0) weighted = false;
+
+  const fractions: Record<string, [number, number]> = {};
+  if (!weighted) {
+    assignees.forEach((uid) => {
+      fractions[uid] = [1, assignees.length];
+    });
+    return { gross: splitEvenCents(grossLine, assignees), net: splitEvenCents(netLine, assignees), fractions };
+  }
+
+  let gross: Record<string, number>;
+  if (!Object.keys(fixed).length) {
+    gross = splitProportionalCents(grossLine, shareWeights);
+    const totalShares = Object.values(shareWeights).reduce((sum, w) => sum + w, 0);
+    Object.entries(shareWeights).forEach(([uid, w]) => {
+      fractions[uid] = [w, totalShares];
+    });
+  } else {
+    if (!Object.keys(shareWeights).length || fixedTotal >= grossLine) {
+      gross = splitProportionalCents(grossLine, fixed);
+    } else {
+      gross = { ...splitProportionalCents(grossLine - fixedTotal, shareWeights), ...fixed };
+    }
+    const denominator = grossLine > 0 ? grossLine : 1;
+    assignees.forEach((uid) => {
+      fractions[uid] = [gross[uid] || 0, denominator];
+    });
+  }
+  return { gross, net: splitProportionalCents(netLine, gross), fractions };
+};
+
 export type SummaryResult = {
   gross: number;
   itemDiscount: number;
@@ -68,28 +158,6 @@ export const computeSummary = (room: RoomDoc): SummaryResult | null => {
 
   const perPerson = new Map<string, any>();
 
-  const splitProportional = (total: number, weights: Record<string, number>) => {
-    const entries = Object.entries(weights).filter(([, w]) => w > 0);
-    const sumW = entries.reduce((s, [, w]) => s + w, 0);
-    if (total <= 0 || sumW <= 0 || !entries.length) return {} as Record<string, number>;
-    const bases: Record<string, number> = {};
-    const remainders: { id: string; frac: number }[] = [];
-    let used = 0;
-    entries.forEach(([id, w]) => {
-      const exact = (total * w) / sumW;
-      const base = Math.floor(exact);
-      bases[id] = base;
-      used += base;
-      remainders.push({ id, frac: exact - base });
-    });
-    let rem = total - used;
-    remainders.sort((a, b) => b.frac - a.frac || a.id.localeCompare(b.id));
-    for (let i = 0; i < rem; i++) {
-      bases[remainders[i].id] += 1;
-    }
-    return bases;
-  };
-
   itemsArr.forEach((it) => {
     const assignees = Object.entries(it.assigned || {}).filter(([, on]) => on).map(([uid]) => uid);
     if (assignees.length === 0) return;
@@ -100,8 +168,7 @@ export const computeSummary = (room: RoomDoc): SummaryResult | null => {
     );
     const netLine = Math.max(0, grossLine - itemDiscountLine);
     const sortedAssignees = [...assignees].sort((a, b) => a.localeCompare(b));
-    const splitGross = splitEvenCents(grossLine, sortedAssignees);
-    const splitNet = splitEvenCents(netLine, sortedAssignees);
+    const split = splitItemCents(it, grossLine, netLine, sortedAssignees);
     sortedAssignees.forEach((uid) => {
       const participant = participants[uid];
       const entry =
@@ -116,16 +183,16 @@ export const computeSummary = (room: RoomDoc): SummaryResult | null => {
           taxShare: 0,
           tipShare: 0
         } as any);
-      const grossShare = Math.max(0, splitGross[uid] || 0);
-      const netShare = Math.max(0, splitNet[uid] || 0);
+      const grossShare = Math.max(0, split.gross[uid] || 0);
+      const netShare = Math.max(0, split.net[uid] || 0);
       entry.grossItemsTotal += grossShare;
       entry.itemsTotal += netShare;
       entry.items.push({
         item_id: it.id,
         name: it.name,
         share_cents: netShare,
-        fraction_numerator: 1,
-        fraction_denominator: sortedAssignees.length
+        fraction_numerator: split.fractions[uid][0],
+        fraction_denominator: split.fractions[uid][1]
       });
       perPerson.set(uid, entry);
     });
@@ -136,8 +203,8 @@ export const computeSummary = (room: RoomDoc): SummaryResult | null => {
     grossWeights[uid] = Math.max(0, person.grossItemsTotal || 0);
   });
 
-  const billDiscountSplits = splitProportional(billDiscount, grossWeights);
-  const billChargeSplits = splitProportional(billCharges, grossWeights);
+  const billDiscountSplits = splitProportionalCents(billDiscount, grossWeights);
+  const billChargeSplits = splitProportionalCents(billCharges, grossWeights);
 
   const taxableWeights: Record<string, number> = {};
   perPerson.forEach((person, uid) => {
@@ -145,8 +212,8 @@ export const computeSummary = (room: RoomDoc): SummaryResult | null => {
     taxableWeights[uid] = Math.max(0, person.itemsTotal - discountShare);
   });
 
-  const taxSplits = splitProportional(tax, taxableWeights);
-  const tipSplits = splitProportional(tip, grossWeights);
+  const taxSplits = splitProportionalCents(tax, taxableWeights);
+  const tipSplits = splitProportionalCents(tip, grossWeights);
 
   const detailed = Array.from(perPerson.entries()).map(([uid, person]) => {
     const billDiscountShare = billDiscountSplits[uid] || 0;
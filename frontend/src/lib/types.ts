@@ -20,6 +20,12 @@ export type ItemMeta = {
   [key: string]: any;
 };
 
+export type ItemAllocation = {
+  shares?: number;
+  cents?: number;
+  updated_at?: number;
+};
+
 export type Item = {
   id: string;
   name: string;
@@ -29,6 +35,7 @@ export type Item = {
   discount_cents: number;
   discount_percent: number;
   assigned: Record<string, boolean>;
+  allocations?: Record<string, ItemAllocation>;
   sort_order?: number | null;
   raw_text?: string;
   meta?: ItemMeta;
@@ -45,9 +52,16 @@ export type RoomDoc = {
   bill_charges_cents?: number;
   currency?: string;
   target_currency?: string;
+  payers?: Record<string, Payer>;
   seq: number;
 };
 
+export type Payer = {
+  participant_id: string;
+  amount_cents: number;
+  updated_at?: number;
+};
+
 export type ReceiptItem = {
   name: string;
   quantity: number | null;
@@ -79,4 +93,5 @@ export type ReceiptParseResult = {
   warnings: string[];
   confidence: number;
   unparsed_lines?: string[];
+  cached?: boolean;
 };